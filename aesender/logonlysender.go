@@ -8,8 +8,12 @@ import (
 // LogOnlyAESender is an implementation of AppendEntriesSender that can
 // only construct RpcAppendEntries from the raft log.
 // It is unable to handle raft snapshots.
+//
+// The entries returned by the log can be trimmed to a BatchPolicy before they
+// are sent, so RPCs respect the policy even if the log does not.
 type LogOnlyAESender struct {
 	logRO                         internal.LogTailRO
+	batchPolicy                   BatchPolicy
 	sendOnlyRpcAppendEntriesAsync internal.SendOnlyRpcAppendEntriesAsync
 }
 
@@ -17,7 +21,17 @@ func NewLogOnlyAESender(
 	logRO internal.LogTailRO,
 	sendOnlyRpcAppendEntriesAsync internal.SendOnlyRpcAppendEntriesAsync,
 ) internal.IAppendEntriesSender {
-	return &LogOnlyAESender{logRO, sendOnlyRpcAppendEntriesAsync}
+	return NewLogOnlyAESenderWithBatchPolicy(logRO, DefaultBatchPolicy, sendOnlyRpcAppendEntriesAsync)
+}
+
+// NewLogOnlyAESenderWithBatchPolicy creates a LogOnlyAESender that trims the
+// entries returned by the log to the given BatchPolicy.
+func NewLogOnlyAESenderWithBatchPolicy(
+	logRO internal.LogTailRO,
+	batchPolicy BatchPolicy,
+	sendOnlyRpcAppendEntriesAsync internal.SendOnlyRpcAppendEntriesAsync,
+) internal.IAppendEntriesSender {
+	return &LogOnlyAESender{logRO, batchPolicy, sendOnlyRpcAppendEntriesAsync}
 }
 
 func (s *LogOnlyAESender) SendAppendEntriesToPeerAsync(
@@ -45,6 +59,7 @@ func (s *LogOnlyAESender) SendAppendEntriesToPeerAsync(
 		if err != nil {
 			return err
 		}
+		entriesToSend = s.batchPolicy.TrimBatch(entriesToSend)
 	}
 	//
 	rpcAppendEntries := &RpcAppendEntries{
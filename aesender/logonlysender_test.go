@@ -27,7 +27,9 @@ func TestLogOnlyAESender(t *testing.T) {
 	}
 
 	mrs := testhelpers.NewMockRpcSender()
-	aes := aesender.NewLogOnlyAESender(iml, mrs.SendOnlyRpcAppendEntriesAsync)
+	aes := aesender.NewLogOnlyAESender(
+		iml, mrs.SendOnlyRpcAppendEntriesAsync,
+	)
 
 	var serverTerm TermNo = testdata.CurrentTerm
 
@@ -128,6 +130,31 @@ func TestLogOnlyAESender(t *testing.T) {
 	mrs.CheckSentRpcs(t, expectedRpcs)
 	mrs.ClearSentRpcs()
 
+	// Peer's last entry is the last compacted entry
+	params = internal.SendAppendEntriesParams{
+		102, 5, false, serverTerm, 4,
+	}
+	err = aes.SendAppendEntriesToPeerAsync(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedRpc = &RpcAppendEntries{
+		serverTerm,
+		4,
+		4,
+		[]LogEntry{
+			{4, Command("c5")},
+			{5, Command("c6")},
+			{5, Command("c7")},
+		},
+		4,
+	}
+	expectedRpcs = map[ServerId]interface{}{
+		102: expectedRpc,
+	}
+	mrs.CheckSentRpcs(t, expectedRpcs)
+	mrs.ClearSentRpcs()
+
 	// Peer is behind log compaction
 	params = internal.SendAppendEntriesParams{
 		102, 4, false, serverTerm, 4,
@@ -138,3 +165,54 @@ func TestLogOnlyAESender(t *testing.T) {
 	}
 	mrs.ClearSentRpcs()
 }
+
+func TestLogOnlyAESender_TrimsToBatchPolicy(t *testing.T) {
+	// The log itself has no byte limit
+	iml, err := inmemlog.TestUtil_NewInMemoryLog_WithFigure7LeaderLine(
+		testdata.MaxEntriesPerAppendEntry,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mrs := testhelpers.NewMockRpcSender()
+	aes := aesender.NewLogOnlyAESenderWithBatchPolicy(iml, BatchPolicy{3, 5}, mrs.SendOnlyRpcAppendEntriesAsync)
+
+	var serverTerm TermNo = testdata.CurrentTerm
+
+	// Commands are 2 bytes each so only two fit in 5 bytes
+	params := internal.SendAppendEntriesParams{
+		102, 5, false, serverTerm, 4,
+	}
+	err = aes.SendAppendEntriesToPeerAsync(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedRpc := &RpcAppendEntries{
+		serverTerm,
+		4,
+		4,
+		[]LogEntry{
+			{4, Command("c5")},
+			{5, Command("c6")},
+		},
+		4,
+	}
+	expectedRpcs := map[ServerId]interface{}{
+		102: expectedRpc,
+	}
+	mrs.CheckSentRpcs(t, expectedRpcs)
+	mrs.ClearSentRpcs()
+
+	// An entry larger than MaxBytes is still sent by itself
+	aes = aesender.NewLogOnlyAESenderWithBatchPolicy(iml, BatchPolicy{3, 1}, mrs.SendOnlyRpcAppendEntriesAsync)
+	err = aes.SendAppendEntriesToPeerAsync(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedRpc.Entries = []LogEntry{
+		{4, Command("c5")},
+	}
+	mrs.CheckSentRpcs(t, expectedRpcs)
+	mrs.ClearSentRpcs()
+}
@@ -1,16 +1,41 @@
 package applier
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	. "github.com/divtxt/raft"
 	"github.com/divtxt/raft/internal"
+	"github.com/divtxt/raft/logindex"
 	"github.com/divtxt/raft/util"
 )
 
 type FatalErrorHandler func(err error)
 
+// Stats counts the failures of a FallibleStateMachine.
+type Stats struct {
+	Failures uint64 // calls to TryApplyCommand that failed
+	Retries  uint64 // retries after a failure, for ApplyFailureRetry
+	Skipped  uint64 // entries marked as failed, for ApplyFailureSkip
+	Halted   bool   // the Applier stopped applying entries after a failure
+}
+
+// resultListener is the channel for the result of the entry with the given term
+// at a log index.
+type resultListener struct {
+	termNo TermNo
+	crc    chan CommandResult
+}
+
+// applyWaiter is a call to WaitApplied that is waiting for lastApplied to reach
+// logIndex. The channel is closed when it does.
+type applyWaiter struct {
+	logIndex LogIndex
+	done     chan struct{}
+}
+
 // An Applier is a goroutine that applies committed log entries to the state
 // machine and notifies the result listener for each entry.
 //
@@ -26,16 +51,28 @@ type Applier struct {
 	// commitIndex is the index of highest log entry known to be committed
 	// (initialized to 0, increases monotonically)
 	cachedCommitIndex      LogIndex
-	listeners              map[LogIndex]chan CommandResult // Result listeners
+	listeners              map[LogIndex]resultListener // Result listeners
 	highestRegisteredIndex LogIndex
+	stats                  Stats
+	waiters                []applyWaiter // WaitApplied calls
+	// lastApplied is the lastApplied of the state machine as of the last entry
+	// applied by the Applier. It is only set by the Applier's goroutine.
+	lastApplied *logindex.WatchedIndex
 
 	// -- External components
 	log          internal.LogTailRO
 	stateMachine StateMachine
-	feHandler    FatalErrorHandler
+	// batchStateMachine is the stateMachine if it is a BatchStateMachine and not
+	// a FallibleStateMachine, or nil.
+	batchStateMachine BatchStateMachine
+	// fallibleStateMachine is the stateMachine if it is a FallibleStateMachine, or nil.
+	fallibleStateMachine FallibleStateMachine
+	failurePolicy        ApplyFailurePolicy
+	feHandler            FatalErrorHandler
 
 	// -- Internal components
 	runner *util.TriggeredRunner
+	stop   chan struct{} // closed by StopSync to interrupt retry backoffs
 }
 
 // NewApplier creates a new Applier with the given parameters.
@@ -43,6 +80,9 @@ type Applier struct {
 // A goroutine is started that applies committed log entries to the state
 // machine. Note that this happens asynchronously to changes in commitIndex.
 //
+// If the state machine is a BatchStateMachine, each batch of committed entries
+// from the log is applied with a single call to ApplyEntries.
+//
 // If the goroutine encounters an error (from the log or the state machine),
 // this is fatal for it. In this case, it will call feHandler with the
 // encountered error. The feHandler callback is expected to call the
@@ -53,21 +93,60 @@ type Applier struct {
 // It will increase when GetResultAsync() is called. When the Log discards
 // entries, highestRegisteredIndex will be reset to indexOfLastEntry.
 //
+// The state machine failures of a FallibleStateMachine halt the Applier. See
+// NewApplierWithFailurePolicy.
+//
 func NewApplier(
 	log internal.LogTailRO,
 	commitIndex WatchableIndex,
 	stateMachine StateMachine,
 	feHandler FatalErrorHandler,
+) *Applier {
+	return NewApplierWithFailurePolicy(
+		log, commitIndex, stateMachine, DefaultApplyFailurePolicy, feHandler,
+	)
+}
+
+// NewApplierWithFailurePolicy creates a new Applier that handles the failures
+// of a FallibleStateMachine as decided by the given ApplyFailurePolicy.
+//
+// When the Applier halts, either for ApplyFailureHalt or after the retries of
+// ApplyFailureRetry, it closes the channels of all pending results - the entries
+// may still be applied after a restart - and calls feHandler with the
+// *ApplyError. Unlike other errors, the feHandler callback is expected to stop
+// the Applier asynchronously since the Applier's goroutine is the caller.
+//
+// The failurePolicy is expected to have been checked with Validate().
+//
+func NewApplierWithFailurePolicy(
+	log internal.LogTailRO,
+	commitIndex WatchableIndex,
+	stateMachine StateMachine,
+	failurePolicy ApplyFailurePolicy,
+	feHandler FatalErrorHandler,
 ) *Applier {
 	// TODO: check that parameters are not nil?!
 	// TODO: error if lastApplied > commitIndex!
 
+	fallibleStateMachine, _ := stateMachine.(FallibleStateMachine)
+	var batchStateMachine BatchStateMachine
+	if fallibleStateMachine == nil {
+		batchStateMachine, _ = stateMachine.(BatchStateMachine)
+	}
+
 	a := &Applier{
-		listeners:    make(map[LogIndex]chan CommandResult),
-		log:          log,
-		stateMachine: stateMachine,
-		feHandler:    feHandler,
+		listeners:            make(map[LogIndex]resultListener),
+		log:                  log,
+		stateMachine:         stateMachine,
+		batchStateMachine:    batchStateMachine,
+		fallibleStateMachine: fallibleStateMachine,
+		failurePolicy:        failurePolicy,
+		feHandler:            feHandler,
+		stop:                 make(chan struct{}),
+		lastApplied:          logindex.NewWatchedIndex(),
 	}
+	_ = a.lastApplied.Set(stateMachine.GetLastApplied())
+	a.lastApplied.AddListener(a.lastAppliedChanged)
 
 	// Get lock so that we can ensure that initial cached values are correct.
 	a.mutex.Lock()
@@ -93,17 +172,99 @@ func NewApplier(
 // Will panic if called more than once.
 func (a *Applier) StopSync() {
 	// FIXME: should other methods be checking stopped state?
+	close(a.stop)
 	a.runner.StopSync()
 	// FIXME: close pending listeners under lock!?
 }
 
+// GetLastAppliedWatchable returns lastApplied as a WatchableIndex.
+//
+// The value is the lastApplied of the state machine when the Applier started, and
+// then increases as the Applier applies committed entries. Listeners are called
+// from the Applier's goroutine, so they delay the next entries until they return.
+//
+func (a *Applier) GetLastAppliedWatchable() WatchableIndex {
+	return a.lastApplied
+}
+
+// WaitApplied waits until the entry at the given log index has been applied to the
+// state machine, i.e. lastApplied is greater than or equal to logIndex.
+//
+// Unlike GetResultAsync, this can be called for any index, including committed
+// entries, and on any server. However, it does not know which entry was applied
+// at the given index: the caller should use an index that is known to be
+// committed, such as the index of an entry whose result it received from the
+// leader.
+//
+// Returns ctx.Err() if the context is done first, or ErrStopped if the Applier
+// is stopped.
+//
+func (a *Applier) WaitApplied(ctx context.Context, logIndex LogIndex) error {
+	a.mutex.Lock()
+	// lastApplied is changed before lastAppliedChanged takes the lock, so we
+	// cannot miss a change between this check and adding the waiter.
+	if a.lastApplied.Get() >= logIndex {
+		a.mutex.Unlock()
+		return nil
+	}
+	w := applyWaiter{logIndex, make(chan struct{})}
+	a.waiters = append(a.waiters, w)
+	a.mutex.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		a.removeWaiter(w)
+		return ctx.Err()
+	case <-a.stop:
+		a.removeWaiter(w)
+		return ErrStopped
+	}
+}
+
+func (a *Applier) removeWaiter(w applyWaiter) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for i, w2 := range a.waiters {
+		if w2.done == w.done {
+			a.waiters = append(a.waiters[:i], a.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (a *Applier) lastAppliedChanged(newLastApplied LogIndex) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	waiters := a.waiters[:0]
+	for _, w := range a.waiters {
+		if w.logIndex <= newLastApplied {
+			close(w.done)
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+	a.waiters = waiters
+}
+
+// GetStats returns the counts of the failures of a FallibleStateMachine so far.
+func (a *Applier) GetStats() Stats {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.stats
+}
+
 // GetResultAsync asynchronously returns the state machine result for the given
 // log index.
 //
 // When the command at the given log index is applied to the state machine, the
 // value returned by the state machine will be sent on the channel returned by this
 // method. If the Log discards the entry at the given log index, the channel is
-// closed without a sent value.
+// closed without a sent value. This includes the case where the entry is
+// replaced by an entry with a different term without indexOfLastEntry
+// decreasing.
 //
 // The logIndex must be less than or equal to the Log's indexOfLastEntry. This
 // means that this method must be called after the log entry has been appended
@@ -121,9 +282,13 @@ func (a *Applier) StopSync() {
 // - there can be no more than one call to GetResultAsync for a given log
 // 	index, except when the Log discards entries.
 //
+// The termNo must be the term of the entry at the given log index. It is given
+// by the caller since the Log calls indexOfLastEntryChanged while holding its own
+// lock, so this method cannot read the Log while holding the Applier's lock.
+//
 // Note that this method does not have to be called for every log index.
 //
-func (a *Applier) GetResultAsync(logIndex LogIndex) (<-chan CommandResult, error) {
+func (a *Applier) GetResultAsync(logIndex LogIndex, termNo TermNo) (<-chan CommandResult, error) {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
@@ -149,7 +314,7 @@ func (a *Applier) GetResultAsync(logIndex LogIndex) (<-chan CommandResult, error
 
 	crc := make(chan CommandResult, 1)
 
-	a.listeners[logIndex] = crc
+	a.listeners[logIndex] = resultListener{termNo, crc}
 	a.highestRegisteredIndex = logIndex
 
 	return crc, nil
@@ -165,10 +330,10 @@ func (a *Applier) indexOfLastEntryChanged(newIole LogIndex) {
 	// and rewind highestRegisteredIndex
 	if newIole < a.highestRegisteredIndex {
 		for li := newIole + 1; li <= a.highestRegisteredIndex; li++ {
-			crc, ok := a.listeners[li]
+			rl, ok := a.listeners[li]
 			if ok {
 				delete(a.listeners, li)
-				close(crc)
+				close(rl.crc)
 			}
 		}
 		a.highestRegisteredIndex = newIole
@@ -206,8 +371,14 @@ func (a *Applier) applyCommittedEntries() {
 		// safely get commitIndex
 		a.mutex.Lock()
 		commitIndexSnapshot := a.cachedCommitIndex
+		halted := a.stats.Halted
 		a.mutex.Unlock()
 
+		// Nothing more is applied after a halt, even if commitIndex advances.
+		if halted {
+			return
+		}
+
 		lastApplied := a.stateMachine.GetLastApplied()
 
 		// Return if no more entries to apply at this time.
@@ -224,6 +395,22 @@ func (a *Applier) applyCommittedEntries() {
 			return
 		}
 
+		// Apply the entries to the state machine in one call if it supports batches.
+		if a.batchStateMachine != nil {
+			// Only apply entries up to the commitIndex snapshot.
+			// (TriggeredRunner should call again if CommitAsync advanced commitIndex)
+			if n := commitIndexSnapshot - lastApplied; LogIndex(len(entries)) > n {
+				entries = entries[:n]
+			}
+			err = a.applyBatch(lastApplied+1, entries)
+			if err != nil {
+				a.feHandler(err)
+				return
+			}
+			a.setLastApplied(lastApplied + LogIndex(len(entries)))
+			continue
+		}
+
 		// Apply the entries to the state machine.
 		for _, entry := range entries {
 			// Calculate the index that of the entry we are going to apply
@@ -237,7 +424,7 @@ func (a *Applier) applyCommittedEntries() {
 
 			// Get the commit listener for this index
 			a.mutex.Lock()
-			crc, haveCrc := a.listeners[indexToApply]
+			rl, haveCrc := a.listeners[indexToApply]
 			if haveCrc {
 				delete(a.listeners, indexToApply)
 			}
@@ -245,15 +432,141 @@ func (a *Applier) applyCommittedEntries() {
 			a.mutex.Unlock()
 
 			// Apply the command to the state machine.
-			commandResult := a.stateMachine.ApplyCommand(indexToApply, entry.Command)
+			commandResult, ok := a.applyCommand(indexToApply, entry.Command)
+			if !ok {
+				// The Applier halted or is stopping
+				if haveCrc {
+					close(rl.crc)
+				}
+				return
+			}
 
-			// Send the result to the commit listener.
+			// Send the result to the commit listener, unless the entry it was
+			// registered for was replaced by an entry from another term.
 			if haveCrc {
-				crc <- commandResult
+				if entry.TermNo == rl.termNo {
+					rl.crc <- commandResult
+				} else {
+					close(rl.crc)
+				}
 			}
 
 			// The index of the entry we have just applied MUST be the new value of lastApplied.
 			lastApplied = indexToApply
+			a.setLastApplied(lastApplied)
+		}
+	}
+}
+
+// applyBatch applies the given committed entries, starting at the given log index,
+// with a single call to the BatchStateMachine and then notifies their result listeners.
+func (a *Applier) applyBatch(firstLogIndex LogIndex, entries []LogEntry) error {
+	// Get the commit listeners for these indexes
+	a.mutex.Lock()
+	rls := make(map[LogIndex]resultListener)
+	for i := range entries {
+		li := firstLogIndex + LogIndex(i)
+		if rl, ok := a.listeners[li]; ok {
+			delete(a.listeners, li)
+			rls[li] = rl
+		}
+	}
+	a.mutex.Unlock()
+
+	// Apply the commands to the state machine.
+	commandResults := a.batchStateMachine.ApplyEntries(firstLogIndex, entries)
+	if len(commandResults) != len(entries) {
+		return fmt.Errorf(
+			"FATAL: BatchStateMachine returned %v results for %v entries",
+			len(commandResults), len(entries),
+		)
+	}
+
+	// Send the results to the commit listeners, unless the entry a listener was
+	// registered for was replaced by an entry from another term.
+	for i, entry := range entries {
+		rl, haveCrc := rls[firstLogIndex+LogIndex(i)]
+		if haveCrc {
+			if entry.TermNo == rl.termNo {
+				rl.crc <- commandResults[i]
+			} else {
+				close(rl.crc)
+			}
 		}
 	}
+	return nil
+}
+
+// applyCommand applies the command at the given log index to the state machine,
+// and handles the failures of a FallibleStateMachine as decided by the
+// ApplyFailurePolicy.
+//
+// Returns false if the command was not applied because the Applier halted or
+// is stopping.
+//
+func (a *Applier) applyCommand(logIndex LogIndex, command Command) (CommandResult, bool) {
+	if a.fallibleStateMachine == nil {
+		return a.stateMachine.ApplyCommand(logIndex, command), true
+	}
+
+	backoff := a.failurePolicy.InitialBackoff
+	for retries := uint64(0); ; retries++ {
+		commandResult, err := a.fallibleStateMachine.TryApplyCommand(logIndex, command)
+		if err == nil {
+			return commandResult, true
+		}
+		applyErr := &ApplyError{logIndex, err}
+
+		a.mutex.Lock()
+		a.stats.Failures++
+		a.mutex.Unlock()
+
+		switch a.failurePolicy.Action {
+		case ApplyFailureSkip:
+			a.fallibleStateMachine.SkipCommand(logIndex, err)
+			a.mutex.Lock()
+			a.stats.Skipped++
+			a.mutex.Unlock()
+			return applyErr, true
+		case ApplyFailureRetry:
+			if a.failurePolicy.MaxRetries == 0 || retries < a.failurePolicy.MaxRetries {
+				select {
+				case <-time.After(backoff):
+				case <-a.stop:
+					return nil, false
+				}
+				backoff *= 2
+				if backoff > a.failurePolicy.MaxBackoff {
+					backoff = a.failurePolicy.MaxBackoff
+				}
+				a.mutex.Lock()
+				a.stats.Retries++
+				a.mutex.Unlock()
+				continue
+			}
+		}
+		a.halt(applyErr)
+		return nil, false
+	}
+}
+
+// halt closes the channels of all pending results and reports the error.
+func (a *Applier) halt(applyErr *ApplyError) {
+	a.mutex.Lock()
+	a.stats.Halted = true
+	for li, rl := range a.listeners {
+		delete(a.listeners, li)
+		close(rl.crc)
+	}
+	a.mutex.Unlock()
+
+	if a.feHandler != nil {
+		a.feHandler(applyErr)
+	}
+}
+
+// setLastApplied sets the lastApplied WatchableIndex after entries were applied.
+func (a *Applier) setLastApplied(lastApplied LogIndex) {
+	// The index only increases and has no verifier, so there is no error.
+	_ = a.lastApplied.Set(lastApplied)
 }
@@ -1,7 +1,10 @@
 package applier
 
 import (
+	"context"
+	"reflect"
 	"testing"
+	"time"
 
 	. "github.com/divtxt/raft"
 	"github.com/divtxt/raft/inmemlog"
@@ -46,7 +49,7 @@ func TestApplier(t *testing.T) {
 	applier.runner.TestHelperFakeRestart()
 
 	// GetResultAsync for committed index should be an error
-	_, err = applier.GetResultAsync(4)
+	_, err = getResultAsync(applier, 4)
 	if err.Error() != "FATAL: logIndex=4 is <= cachedCommitIndex=4" {
 		t.Fatal(err)
 	}
@@ -54,28 +57,28 @@ func TestApplier(t *testing.T) {
 	// GetResultAsync for new notifications.
 	// Intentionally not registering for some indexes to test that gaps are allowed.
 	// We're cheating a bit here in this test since these entries are already in the log.
-	crc6, err := applier.GetResultAsync(6)
+	crc6, err := getResultAsync(applier, 6)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if crc6 == nil {
 		t.Fatal()
 	}
-	crc8, err := applier.GetResultAsync(8)
+	crc8, err := getResultAsync(applier, 8)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if crc8 == nil {
 		t.Fatal()
 	}
-	crc9, err := applier.GetResultAsync(9)
+	crc9, err := getResultAsync(applier, 9)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if crc9 == nil {
 		t.Fatal()
 	}
-	crc10, err := applier.GetResultAsync(10)
+	crc10, err := getResultAsync(applier, 10)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -88,7 +91,7 @@ func TestApplier(t *testing.T) {
 	testhelpers.AssertWillBlock(crc10)
 
 	// GetResultAsync for an older index should be an error
-	_, err = applier.GetResultAsync(7)
+	_, err = getResultAsync(applier, 7)
 	if err.Error() != "FATAL: logIndex=7 is <= highestRegisteredIndex=10" {
 		t.Fatal(err)
 	}
@@ -147,7 +150,7 @@ func TestApplier(t *testing.T) {
 	}
 
 	// GetResultAsync a few more entries.
-	crc12, err := applier.GetResultAsync(12)
+	crc12, err := getResultAsync(applier, 12)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -157,7 +160,7 @@ func TestApplier(t *testing.T) {
 	testhelpers.AssertWillBlock(crc12)
 
 	// Discard with later index should not affect highestRegisteredIndex.
-	crc13, err := applier.GetResultAsync(13)
+	crc13, err := getResultAsync(applier, 13)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -167,7 +170,7 @@ func TestApplier(t *testing.T) {
 	testhelpers.AssertWillBlock(crc13)
 
 	// Allowed index for register should have moved up
-	_, err = applier.GetResultAsync(12)
+	_, err = getResultAsync(applier, 12)
 	if err.Error() != "FATAL: logIndex=12 is <= highestRegisteredIndex=13" {
 		t.Fatal(err)
 	}
@@ -183,12 +186,12 @@ func TestApplier(t *testing.T) {
 	testhelpers.AssertIsClosed(crc13)
 
 	// GetResultAsync of indexOfLastEntry after discard is not allowed
-	_, err = applier.GetResultAsync(9)
+	_, err = getResultAsync(applier, 9)
 	if err.Error() != "FATAL: logIndex=9 is <= highestRegisteredIndex=9" {
 		t.Fatal(err)
 	}
 	// GetResultAsync beyond indexOfLastEntry after discard is not allowed
-	_, err = applier.GetResultAsync(10)
+	_, err = getResultAsync(applier, 10)
 	if err.Error() != "FATAL: logIndex=10 is > indexOfLastEntry=9" {
 		t.Fatal(err)
 	}
@@ -199,7 +202,7 @@ func TestApplier(t *testing.T) {
 	if ioleC10b != 10 || err != nil {
 		t.Fatal(10, err)
 	}
-	crc10b, err := applier.GetResultAsync(10)
+	crc10b, err := getResultAsync(applier, 10)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -227,6 +230,33 @@ func TestApplier(t *testing.T) {
 		t.Fatal(v)
 	}
 
+	// Replacing an entry without decreasing indexOfLastEntry should close the
+	// channel instead of sending the result of the new entry.
+	_, err = iml.AppendEntry(LogEntry{9, Command("c11")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crc11, err := getResultAsync(applier, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = iml.SetEntriesAfterIndex(10, []LogEntry{{10, Command("c11b")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhelpers.AssertWillBlock(crc11)
+	err = commitIndex.Set(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applier.runner.TestHelperRunOnceIfTriggerPending() {
+		t.Fatal()
+	}
+	if dsm.GetLastApplied() != 11 {
+		t.Fatal()
+	}
+	testhelpers.AssertIsClosed(crc11)
+
 	// Committing past the end of the log is an error but not applier's responsibility!
 	err = commitIndex.Set(14)
 	if err != nil {
@@ -234,4 +264,412 @@ func TestApplier(t *testing.T) {
 	}
 }
 
+// A BatchStateMachine gets each batch of committed entries from the log in one
+// call, trimmed to commitIndex.
+func TestApplier_Batch(t *testing.T) {
+	iml, err := inmemlog.TestUtil_NewInMemoryLog_WithFigure7LeaderLine(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbsm := testhelpers.NewDummyBatchStateMachine(1)
+	commitIndex := logindex.NewWatchedIndex()
+	applier := NewApplier(iml, commitIndex, dbsm, nil)
+	applier.StopSync()
+	applier.runner.TestHelperFakeRestart()
+
+	crc3, err := getResultAsync(applier, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crc8, err := getResultAsync(applier, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crc9, err := getResultAsync(applier, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commitIndex.Set(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applier.runner.TestHelperRunOnceIfTriggerPending() {
+		t.Fatal()
+	}
+	if dbsm.GetLastApplied() != 8 {
+		t.Fatal(dbsm.GetLastApplied())
+	}
+	if !dbsm.AppliedCommandsEqual(2, 3, 4, 5, 6, 7, 8) {
+		t.Fatal()
+	}
+	if !reflect.DeepEqual(dbsm.BatchSizes, []int{3, 3, 1}) {
+		t.Fatal(dbsm.BatchSizes)
+	}
+	if v := testhelpers.GetCommandResult(crc3); v != "rc3" {
+		t.Fatal(v)
+	}
+	if v := testhelpers.GetCommandResult(crc8); v != "rc8" {
+		t.Fatal(v)
+	}
+	testhelpers.AssertWillBlock(crc9)
+
+	// A replaced entry closes its channel
+	err = iml.SetEntriesAfterIndex(8, []LogEntry{{7, Command("c9b")}, {7, Command("c10b")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = commitIndex.Set(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applier.runner.TestHelperRunOnceIfTriggerPending() {
+		t.Fatal()
+	}
+	if dbsm.GetLastApplied() != 10 || !reflect.DeepEqual(dbsm.BatchSizes, []int{3, 3, 1, 2}) {
+		t.Fatal(dbsm.GetLastApplied(), dbsm.BatchSizes)
+	}
+	testhelpers.AssertIsClosed(crc9)
+}
+
+// badBatchStateMachine returns no results.
+type badBatchStateMachine struct {
+	*testhelpers.DummyBatchStateMachine
+}
+
+func (bbsm badBatchStateMachine) ApplyEntries(firstLogIndex LogIndex, entries []LogEntry) []CommandResult {
+	return nil
+}
+
+func TestApplier_BatchWrongResults(t *testing.T) {
+	iml, err := inmemlog.TestUtil_NewInMemoryLog_WithFigure7LeaderLine(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitIndex := logindex.NewWatchedIndex()
+	var feErr error
+	applier := NewApplier(
+		iml,
+		commitIndex,
+		badBatchStateMachine{testhelpers.NewDummyBatchStateMachine(0)},
+		func(err error) { feErr = err },
+	)
+	applier.StopSync()
+	applier.runner.TestHelperFakeRestart()
+
+	err = commitIndex.Set(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applier.runner.TestHelperRunOnceIfTriggerPending() {
+		t.Fatal()
+	}
+	if feErr == nil || feErr.Error() != "FATAL: BatchStateMachine returned 0 results for 2 entries" {
+		t.Fatal(feErr)
+	}
+}
+
+// newFallibleTestApplier returns an Applier for a FallibleStateMachine with lastApplied
+// of 1, and result channels for indexes 2 and 3.
+func newFallibleTestApplier(
+	t *testing.T,
+	failures map[LogIndex]int,
+	failurePolicy ApplyFailurePolicy,
+	feHandler FatalErrorHandler,
+) (*Applier, *testhelpers.DummyFallibleStateMachine, *logindex.WatchedIndex, <-chan CommandResult, <-chan CommandResult) {
+	iml, err := inmemlog.TestUtil_NewInMemoryLog_WithFigure7LeaderLine(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfsm := testhelpers.NewDummyFallibleStateMachine(1, failures)
+	commitIndex := logindex.NewWatchedIndex()
+	err = commitIndex.Set(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applier := NewApplierWithFailurePolicy(iml, commitIndex, dfsm, failurePolicy, feHandler)
+	crc2, err := getResultAsync(applier, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crc3, err := getResultAsync(applier, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return applier, dfsm, commitIndex, crc2, crc3
+}
+
+func waitForResult(t *testing.T, crc <-chan CommandResult) CommandResult {
+	select {
+	case result, ok := <-crc:
+		if !ok {
+			t.Fatal("closed")
+		}
+		return result
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+func TestApplier_FailureHalt(t *testing.T) {
+	var feErr error
+	applier, dfsm, commitIndex, crc2, crc3 := newFallibleTestApplier(
+		t, map[LogIndex]int{3: 1}, DefaultApplyFailurePolicy, func(err error) { feErr = err },
+	)
+	applier.StopSync()
+	applier.runner.TestHelperFakeRestart()
+
+	err := commitIndex.Set(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applier.runner.TestHelperRunOnceIfTriggerPending() {
+		t.Fatal()
+	}
+	if e, ok := feErr.(*ApplyError); !ok || e.LogIndex != 3 || e.Err != testhelpers.ErrDummyApply {
+		t.Fatal(feErr)
+	}
+	if feErr.Error() != "failed to apply command at index 3: dummy apply failure" {
+		t.Fatal(feErr)
+	}
+	if dfsm.GetLastApplied() != 2 {
+		t.Fatal(dfsm.GetLastApplied())
+	}
+	if v := testhelpers.GetCommandResult(crc2); v != "rc2" {
+		t.Fatal(v)
+	}
+	// The result is unknown since the entry can still be applied after a restart
+	testhelpers.AssertIsClosed(crc3)
+	if s := applier.GetStats(); s != (Stats{1, 0, 0, true}) {
+		t.Fatal(s)
+	}
+
+	// Nothing more is applied, even though the failure would not happen again
+	err = commitIndex.Set(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applier.runner.TestHelperRunOnceIfTriggerPending() {
+		t.Fatal()
+	}
+	if dfsm.GetLastApplied() != 2 {
+		t.Fatal(dfsm.GetLastApplied())
+	}
+}
+
+func TestApplier_FailureSkip(t *testing.T) {
+	applier, dfsm, commitIndex, crc2, crc3 := newFallibleTestApplier(
+		t, map[LogIndex]int{2: -1}, ApplyFailurePolicy{ApplyFailureSkip, 0, 0, 0}, nil,
+	)
+	applier.StopSync()
+	applier.runner.TestHelperFakeRestart()
+
+	err := commitIndex.Set(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applier.runner.TestHelperRunOnceIfTriggerPending() {
+		t.Fatal()
+	}
+	if dfsm.GetLastApplied() != 3 || !reflect.DeepEqual(dfsm.Skipped(), []LogIndex{2}) {
+		t.Fatal(dfsm.GetLastApplied(), dfsm.Skipped())
+	}
+	if !dfsm.AppliedCommandsEqual(3) {
+		t.Fatal()
+	}
+	v := testhelpers.GetCommandResult(crc2)
+	if e, ok := v.(*ApplyError); !ok || e.LogIndex != 2 || e.Err != testhelpers.ErrDummyApply {
+		t.Fatal(v)
+	}
+	if v := testhelpers.GetCommandResult(crc3); v != "rc3" {
+		t.Fatal(v)
+	}
+	if s := applier.GetStats(); s != (Stats{1, 0, 1, false}) {
+		t.Fatal(s)
+	}
+}
+
+func TestApplier_FailureRetry(t *testing.T) {
+	policy := ApplyFailurePolicy{ApplyFailureRetry, time.Millisecond, 2 * time.Millisecond, 3}
+
+	// Succeeds on the third retry
+	applier, dfsm, commitIndex, crc2, crc3 := newFallibleTestApplier(t, map[LogIndex]int{2: 3}, policy, nil)
+	err := commitIndex.Set(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := waitForResult(t, crc2); v != "rc2" {
+		t.Fatal(v)
+	}
+	if v := waitForResult(t, crc3); v != "rc3" {
+		t.Fatal(v)
+	}
+	applier.StopSync()
+	if !dfsm.AppliedCommandsEqual(2, 3) {
+		t.Fatal()
+	}
+	if s := applier.GetStats(); s != (Stats{3, 3, 0, false}) {
+		t.Fatal(s)
+	}
+
+	// Halts after the last retry
+	feErrs := make(chan error, 1)
+	applier, dfsm, commitIndex, crc2, crc3 = newFallibleTestApplier(
+		t, map[LogIndex]int{2: 4}, policy, func(err error) { feErrs <- err },
+	)
+	err = commitIndex.Set(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-feErrs:
+		if e, ok := err.(*ApplyError); !ok || e.LogIndex != 2 {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	applier.StopSync()
+	testhelpers.AssertIsClosed(crc2)
+	testhelpers.AssertIsClosed(crc3)
+	if dfsm.GetLastApplied() != 1 {
+		t.Fatal(dfsm.GetLastApplied())
+	}
+	if s := applier.GetStats(); s != (Stats{4, 3, 0, true}) {
+		t.Fatal(s)
+	}
+
+	// Stopping interrupts the retries
+	policy = ApplyFailurePolicy{ApplyFailureRetry, time.Hour, time.Hour, 0}
+	applier, _, commitIndex, crc2, _ = newFallibleTestApplier(t, map[LogIndex]int{2: -1}, policy, nil)
+	err = commitIndex.Set(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for applier.GetStats().Failures == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	applier.StopSync()
+	testhelpers.AssertIsClosed(crc2)
+}
+
 // TODO: tests for fceListener
+
+// Call GetResultAsync with the term of the entry in the log - or 0 if there is no
+// entry at the given index.
+func getResultAsync(applier *Applier, logIndex LogIndex) (<-chan CommandResult, error) {
+	termNo, _ := applier.log.GetTermAtIndex(logIndex)
+	return applier.GetResultAsync(logIndex, termNo)
+}
+
+// The result is only sent if the applied entry has the term given to GetResultAsync.
+func TestApplier_GetResultAsyncUsesGivenTerm(t *testing.T) {
+	iml, err := inmemlog.TestUtil_NewInMemoryLog_WithFigure7LeaderLine(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsm := testhelpers.NewDummyStateMachine(3)
+	commitIndex := logindex.NewWatchedIndex()
+	applier := NewApplier(iml, commitIndex, dsm, nil)
+	applier.StopSync()
+	applier.runner.TestHelperFakeRestart()
+
+	// The entries at 4 and 5 both have term 4
+	crc4, err := applier.GetResultAsync(4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crc5, err := applier.GetResultAsync(5, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = commitIndex.Set(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applier.runner.TestHelperRunOnceIfTriggerPending() {
+		t.Fatal()
+	}
+	if dsm.GetLastApplied() != 5 {
+		t.Fatal(dsm.GetLastApplied())
+	}
+	if v := testhelpers.GetCommandResult(crc4); v != "rc4" {
+		t.Fatal(v)
+	}
+	testhelpers.AssertIsClosed(crc5)
+}
+
+func TestApplier_WaitApplied(t *testing.T) {
+	iml, err := inmemlog.TestUtil_NewInMemoryLog_WithFigure7LeaderLine(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsm := testhelpers.NewDummyStateMachine(3)
+	commitIndex := logindex.NewWatchedIndex()
+	applier := NewApplier(iml, commitIndex, dsm, nil)
+
+	// lastApplied starts at the lastApplied of the state machine
+	lastApplied := applier.GetLastAppliedWatchable()
+	if lastApplied.Get() != 3 {
+		t.Fatal(lastApplied.Get())
+	}
+	var changes []LogIndex
+	lastApplied.AddListener(func(li LogIndex) { changes = append(changes, li) })
+
+	// Entries that are already applied do not wait, even if they are below commitIndex
+	if err := applier.WaitApplied(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := applier.WaitApplied(context.Background(), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// The context can end the wait
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := applier.WaitApplied(ctx, 4); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	waitErrs := make(chan error, 2)
+	go func() { waitErrs <- applier.WaitApplied(context.Background(), 5) }()
+	go func() { waitErrs <- applier.WaitApplied(context.Background(), 7) }()
+	time.Sleep(10 * time.Millisecond)
+
+	// Only the waits for entries up to lastApplied return
+	err = commitIndex.Set(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-waitErrs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case err := <-waitErrs:
+		t.Fatal(err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if lastApplied.Get() != 5 || !reflect.DeepEqual(changes, []LogIndex{4, 5}) {
+		t.Fatal(lastApplied.Get(), changes)
+	}
+
+	// Waits that are pending return ErrStopped when the Applier stops
+	applier.StopSync()
+	select {
+	case err := <-waitErrs:
+		if err != ErrStopped {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	if err := applier.WaitApplied(context.Background(), 8); err != ErrStopped {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,82 @@
+package raft
+
+import (
+	"fmt"
+	"time"
+)
+
+// ApplyError is the error of a FallibleStateMachine that failed to apply the
+// command at LogIndex.
+//
+// With ApplyFailureSkip, it is also the CommandResult of the skipped entry.
+//
+type ApplyError struct {
+	LogIndex LogIndex
+	Err      error
+}
+
+func (e *ApplyError) Error() string {
+	return fmt.Sprintf("failed to apply command at index %v: %v", e.LogIndex, e.Err)
+}
+
+// ApplyFailureAction is what happens when a FallibleStateMachine fails to apply
+// a command.
+type ApplyFailureAction uint32
+
+const (
+	// Stop the ConsensusModule. The log is unchanged, so the command will be
+	// applied again when the server restarts.
+	ApplyFailureHalt ApplyFailureAction = iota
+	// Apply the command again after a backoff, and halt if it still fails
+	// after MaxRetries retries.
+	ApplyFailureRetry
+	// Mark the entry as failed with FallibleStateMachine.SkipCommand and
+	// continue with the next entry.
+	//
+	// Other servers may apply the same command successfully, so this gives up
+	// the guarantee that all state machines have the same state. Use it only
+	// for failures that are deterministic, such as a command that cannot be
+	// decoded, or for state that can diverge.
+	ApplyFailureSkip
+)
+
+// ApplyFailurePolicy decides what happens when a FallibleStateMachine fails to
+// apply a command.
+//
+// For ApplyFailureRetry, the first retry is after InitialBackoff, and the delay
+// doubles after each retry up to MaxBackoff. A MaxRetries of 0 means that the
+// command is retried until it succeeds or the ConsensusModule is stopped.
+//
+// The policy is ignored for a StateMachine that is not a FallibleStateMachine.
+//
+type ApplyFailurePolicy struct {
+	Action         ApplyFailureAction
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxRetries     uint64
+}
+
+// DefaultApplyFailurePolicy halts at the first failure.
+var DefaultApplyFailurePolicy = ApplyFailurePolicy{ApplyFailureHalt, 0, 0, 0}
+
+// Validate checks that the ApplyFailurePolicy is usable.
+func (afp ApplyFailurePolicy) Validate() error {
+	switch afp.Action {
+	case ApplyFailureHalt, ApplyFailureSkip:
+	case ApplyFailureRetry:
+		if afp.InitialBackoff <= 0 {
+			return fmt.Errorf(
+				"initialBackoff=%v must be greater than zero", afp.InitialBackoff,
+			)
+		}
+		if afp.MaxBackoff < afp.InitialBackoff {
+			return fmt.Errorf(
+				"maxBackoff=%v must not be less than initialBackoff=%v",
+				afp.MaxBackoff, afp.InitialBackoff,
+			)
+		}
+	default:
+		return fmt.Errorf("unknown action=%v", afp.Action)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package raft
+
+import (
+	"fmt"
+	"math"
+)
+
+// BatchPolicy limits how many log entries are sent together i.e. returned by one
+// call to Log.GetEntriesAfterIndex and sent in one RpcAppendEntries.
+//
+// A batch holds at most MaxEntries entries, and the total size of the commands in
+// a batch is at most MaxBytes. A MaxBytes of 0 means that there is no size limit.
+//
+// Since MaxBytes only counts the commands, it should leave room for the rest of
+// the RPC message if it is meant to keep messages under a transport limit.
+//
+// A single entry whose command is larger than MaxBytes is still returned as a
+// batch by itself, since the entry could not be replicated otherwise.
+//
+type BatchPolicy struct {
+	MaxEntries uint64
+	MaxBytes   uint64
+}
+
+// DefaultBatchPolicy is the BatchPolicy used by the constructors that do not take one.
+// It does not trim the entries returned by the Log, so only the Log's own policy applies.
+var DefaultBatchPolicy = BatchPolicy{math.MaxUint64, 0}
+
+// Validate checks that the BatchPolicy is usable.
+func (bp BatchPolicy) Validate() error {
+	if bp.MaxEntries == 0 {
+		return fmt.Errorf(
+			"maxEntries=%v must be greater than zero", bp.MaxEntries,
+		)
+	}
+	return nil
+}
+
+// BatchLength returns how many of the given number of consecutive entries fit in
+// a batch, starting from the first entry.
+//
+// commandSize should return the size in bytes of the command of the i-th entry.
+//
+// Returns at least 1 if numEntries is greater than 0.
+func (bp BatchPolicy) BatchLength(numEntries uint64, commandSize func(i uint64) uint64) uint64 {
+	if numEntries > bp.MaxEntries {
+		numEntries = bp.MaxEntries
+	}
+	if bp.MaxBytes == 0 {
+		return numEntries
+	}
+	var n, batchSize uint64
+	for n < numEntries {
+		batchSize += commandSize(n)
+		if n > 0 && batchSize > bp.MaxBytes {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// TrimBatch returns the longest prefix of the given entries that fits in a batch.
+func (bp BatchPolicy) TrimBatch(entries []LogEntry) []LogEntry {
+	n := bp.BatchLength(
+		uint64(len(entries)),
+		func(i uint64) uint64 { return uint64(len(entries[i].Command)) },
+	)
+	return entries[:n]
+}
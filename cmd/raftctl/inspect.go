@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/fileutil"
+	"github.com/divtxt/raft/rps"
+	"github.com/divtxt/raft/seglog"
+)
+
+// The layout of a data directory of cmd/raftkv.
+const (
+	rpsFilename = "rps.json"
+	logDirname  = "log"
+)
+
+// StateInfo is the persisted RaftPersistentState of a server.
+type StateInfo struct {
+	Filename    string
+	CurrentTerm TermNo
+	VotedFor    ServerId
+}
+
+// LogInfo is a summary of a SegmentedLog.
+type LogInfo struct {
+	Dir        string
+	FirstIndex LogIndex
+	LastIndex  LogIndex
+	LastTerm   TermNo // 0 if the log has no entries
+	Segments   []seglog.SegmentInfo
+	TailRepair *seglog.TailRepair `json:",omitempty"`
+	Entries    []seglog.EntryInfo `json:",omitempty"`
+}
+
+// NodeInfo is the persisted state and log of a server.
+type NodeInfo struct {
+	State StateInfo
+	Log   LogInfo
+}
+
+// DiffResult is the result of comparing two logs.
+type DiffResult struct {
+	A, B LogInfo
+	// The range of indexes that are in both logs. Entries before this range
+	// have been compacted in at least one log. Empty if Last < First.
+	First LogIndex
+	Last  LogIndex
+	// The first index in the range where the logs have different entries,
+	// or 0 if the logs agree on the whole range.
+	Divergent LogIndex
+	// The entries at Divergent.
+	EntryA *seglog.EntryInfo `json:",omitempty"`
+	EntryB *seglog.EntryInfo `json:",omitempty"`
+}
+
+// readState reads the JsonFileRaftPersistentState file without changing it.
+func readState(filename string) (StateInfo, error) {
+	// A missing file would be read as the initial state.
+	if _, err := os.Stat(filename); err != nil {
+		return StateInfo{}, err
+	}
+	jfrps, err := rps.NewJsonFileRaftPersistentState(fileutil.NewAtomicJsonFile(filename))
+	if err != nil {
+		return StateInfo{}, fmt.Errorf("%v: %v", filename, err)
+	}
+	return StateInfo{filename, jfrps.GetCurrentTerm(), jfrps.GetVotedFor()}, nil
+}
+
+// readLog verifies the SegmentedLog in the given directory without changing it,
+// and returns its summary. The entries are included if withEntries is true.
+func readLog(dir string, withEntries bool) (LogInfo, error) {
+	li := LogInfo{Dir: dir}
+	vr, err := seglog.ScanDir(dir, func(ei seglog.EntryInfo) error {
+		li.LastTerm = ei.Term
+		if withEntries {
+			li.Entries = append(li.Entries, ei)
+		}
+		return nil
+	})
+	if err != nil {
+		return LogInfo{}, err
+	}
+	li.FirstIndex = vr.FirstIndex
+	li.LastIndex = vr.LastIndex
+	li.Segments = vr.Segments
+	li.TailRepair = vr.TailRepair
+	return li, nil
+}
+
+// readNode reads the state and log of a cmd/raftkv data directory.
+func readNode(dataDir string) (NodeInfo, error) {
+	state, err := readState(filepath.Join(dataDir, rpsFilename))
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	log, err := readLog(filepath.Join(dataDir, logDirname), false)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	return NodeInfo{state, log}, nil
+}
+
+// diffLogs compares the entries of two logs by term and checksum, and finds the
+// first index where they diverge.
+func diffLogs(dirA, dirB string) (DiffResult, error) {
+	a, err := readLog(dirA, true)
+	if err != nil {
+		return DiffResult{}, err
+	}
+	b, err := readLog(dirB, true)
+	if err != nil {
+		return DiffResult{}, err
+	}
+	d := DiffResult{A: a, B: b, First: a.FirstIndex, Last: a.LastIndex}
+	if b.FirstIndex > d.First {
+		d.First = b.FirstIndex
+	}
+	if b.LastIndex < d.Last {
+		d.Last = b.LastIndex
+	}
+	for li := d.First; li <= d.Last; li++ {
+		ea := a.Entries[li-a.FirstIndex]
+		eb := b.Entries[li-b.FirstIndex]
+		if ea.Term != eb.Term || ea.Checksum != eb.Checksum {
+			d.Divergent = li
+			d.EntryA = &ea
+			d.EntryB = &eb
+			break
+		}
+	}
+	// Only the summaries are needed
+	d.A.Entries = nil
+	d.B.Entries = nil
+	return d, nil
+}
+
+var (
+	errUsage    = errors.New("unknown command")
+	errDiverged = errors.New("logs diverge")
+)
@@ -0,0 +1,190 @@
+// Command raftctl inspects the persisted state of a server offline.
+//
+// Usage:
+//
+//  raftctl [-json] state <file>               a JsonFileRaftPersistentState file
+//  raftctl [-json] [-entries] log <dir>       a seglog.SegmentedLog directory
+//  raftctl [-json] node <dir>                 a cmd/raftkv data directory
+//  raftctl [-json] snapshot <file>            a kvsm snapshot file
+//  raftctl [-json] diff <dir> <dir>           the first index where two logs diverge
+//
+// Files are only read, so raftctl can be used on a server that will not start,
+// but it should not be used while the server is running.
+//
+// The exit status is 0 on success, 1 if a log is damaged or the logs diverge,
+// and 2 for usage or I/O errors.
+//
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/divtxt/raft/kvsm"
+	"github.com/divtxt/raft/seglog"
+)
+
+func main() {
+	asJson := flag.Bool("json", false, "print JSON instead of text")
+	withEntries := flag.Bool("entries", false, "list every entry of a log")
+	flag.Usage = func() {
+		fmt.Fprintf(
+			flag.CommandLine.Output(),
+			"Usage: %s [-json] [-entries] state|log|node|snapshot <path>\n"+
+				"       %s [-json] diff <dir> <dir>\n",
+			os.Args[0], os.Args[0],
+		)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	nargs := 2
+	if len(args) > 0 && args[0] == "diff" {
+		nargs = 3
+	}
+	if len(args) != nargs {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(os.Stdout, args[0], args[1:], *asJson, *withEntries)
+	if err == errUsage {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if _, ok := err.(*seglog.CorruptionError); ok || err == errDiverged {
+			os.Exit(1)
+		}
+		os.Exit(2)
+	}
+}
+
+// run runs the given command and prints its result to w.
+//
+// Returns errDiverged after printing the result of a diff of logs that diverge.
+//
+func run(w io.Writer, command string, paths []string, asJson bool, withEntries bool) error {
+	var v interface{}
+	var printText func(io.Writer)
+	var err error
+	switch command {
+	case "state":
+		var si StateInfo
+		si, err = readState(paths[0])
+		v, printText = si, si.print
+	case "log":
+		var li LogInfo
+		li, err = readLog(paths[0], withEntries)
+		v, printText = li, li.print
+	case "node":
+		var ni NodeInfo
+		ni, err = readNode(paths[0])
+		v, printText = ni, ni.print
+	case "snapshot":
+		var si kvsm.SnapshotInfo
+		si, err = readSnapshot(paths[0])
+		v, printText = si, func(w io.Writer) { printSnapshot(w, paths[0], si) }
+	case "diff":
+		var d DiffResult
+		d, err = diffLogs(paths[0], paths[1])
+		v, printText = d, d.print
+	default:
+		return errUsage
+	}
+	if err != nil {
+		return err
+	}
+
+	if asJson {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(b))
+	} else {
+		printText(w)
+	}
+	if d, ok := v.(DiffResult); ok && d.Divergent != 0 {
+		return errDiverged
+	}
+	return nil
+}
+
+func readSnapshot(filename string) (kvsm.SnapshotInfo, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return kvsm.SnapshotInfo{}, err
+	}
+	defer f.Close()
+	si, err := kvsm.ReadSnapshotInfo(f)
+	if err != nil {
+		return kvsm.SnapshotInfo{}, fmt.Errorf("%v: %v", filename, err)
+	}
+	return si, nil
+}
+
+func (si StateInfo) print(w io.Writer) {
+	fmt.Fprintf(w, "%v: currentTerm=%v votedFor=%v\n", si.Filename, si.CurrentTerm, si.VotedFor)
+}
+
+func (li LogInfo) print(w io.Writer) {
+	fmt.Fprintf(
+		w, "%v: firstIndex=%v lastIndex=%v lastTerm=%v segments=%v\n",
+		li.Dir, li.FirstIndex, li.LastIndex, li.LastTerm, len(li.Segments),
+	)
+	for _, si := range li.Segments {
+		fmt.Fprintf(
+			w, "  %v: firstIndex=%v entries=%v size=%v\n",
+			si.Filename, si.FirstIndex, si.Entries, si.Size,
+		)
+	}
+	if tr := li.TailRepair; tr != nil {
+		fmt.Fprintf(
+			w, "  damaged tail: %v entries after offset %v in %v will be dropped on open\n",
+			tr.DroppedEntries, tr.Offset, tr.Filename,
+		)
+	}
+	for _, ei := range li.Entries {
+		printEntry(w, "  ", ei)
+	}
+}
+
+func printEntry(w io.Writer, prefix string, ei seglog.EntryInfo) {
+	fmt.Fprintf(
+		w, "%sindex=%v term=%v size=%v checksum=%08x\n",
+		prefix, ei.Index, ei.Term, ei.CommandSize, ei.Checksum,
+	)
+}
+
+func (ni NodeInfo) print(w io.Writer) {
+	ni.State.print(w)
+	ni.Log.print(w)
+}
+
+func printSnapshot(w io.Writer, filename string, si kvsm.SnapshotInfo) {
+	fmt.Fprintf(
+		w, "%v: version=%v lastApplied=%v keys=%v size=%v checksum=%08x\n",
+		filename, si.Version, si.LastApplied, si.Keys, si.Size, si.Checksum,
+	)
+}
+
+func (d DiffResult) print(w io.Writer) {
+	fmt.Fprintf(w, "a: %v: firstIndex=%v lastIndex=%v\n", d.A.Dir, d.A.FirstIndex, d.A.LastIndex)
+	fmt.Fprintf(w, "b: %v: firstIndex=%v lastIndex=%v\n", d.B.Dir, d.B.FirstIndex, d.B.LastIndex)
+	switch {
+	case d.Last < d.First:
+		fmt.Fprintln(w, "no common indexes to compare")
+	case d.Divergent == 0:
+		fmt.Fprintf(w, "logs agree from index %v to %v\n", d.First, d.Last)
+	default:
+		fmt.Fprintf(w, "logs diverge at index %v\n", d.Divergent)
+		printEntry(w, "  a: ", *d.EntryA)
+		printEntry(w, "  b: ", *d.EntryB)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/fileutil"
+	"github.com/divtxt/raft/kvsm"
+	"github.com/divtxt/raft/rps"
+	"github.com/divtxt/raft/seglog"
+)
+
+// makeNodeDir makes a cmd/raftkv data directory with the given state and log.
+func makeNodeDir(t *testing.T, parent string, name string, currentTerm TermNo, entries []LogEntry) string {
+	dir := filepath.Join(parent, name)
+	if err := os.MkdirAll(filepath.Join(dir, logDirname), 0755); err != nil {
+		t.Fatal(err)
+	}
+	jfrps, err := rps.NewJsonFileRaftPersistentState(
+		fileutil.NewAtomicJsonFile(filepath.Join(dir, rpsFilename)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jfrps.SetCurrentTerm(currentTerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := jfrps.SetVotedFor(2); err != nil {
+		t.Fatal(err)
+	}
+	sl, err := seglog.OpenSegmentedLog(filepath.Join(dir, logDirname), 3, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if _, err := sl.AppendEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func runToString(t *testing.T, command string, paths []string, asJson, withEntries bool) (string, error) {
+	var buf bytes.Buffer
+	err := run(&buf, command, paths, asJson, withEntries)
+	return buf.String(), err
+}
+
+func TestRaftctl(t *testing.T) {
+	parent, err := ioutil.TempDir("", "raftctl_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	entries := []LogEntry{{1, Command("a")}, {1, Command("bb")}, {2, Command("c")}}
+	a := makeNodeDir(t, parent, "a", 3, entries)
+	b := makeNodeDir(t, parent, "b", 3, append(entries[:2:2], LogEntry{3, Command("c")}, LogEntry{3, Command("d")}))
+	c := makeNodeDir(t, parent, "c", 2, entries[:2])
+
+	out, err := runToString(t, "state", []string{filepath.Join(a, rpsFilename)}, false, false)
+	if err != nil || out != filepath.Join(a, rpsFilename)+": currentTerm=3 votedFor=2\n" {
+		t.Fatal(out, err)
+	}
+	// A missing file is an error rather than the initial state
+	if _, err := runToString(t, "state", []string{filepath.Join(parent, "none")}, false, false); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	out, err = runToString(t, "log", []string{filepath.Join(a, logDirname)}, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if lines[0] != filepath.Join(a, logDirname)+": firstIndex=1 lastIndex=3 lastTerm=2 segments=1" ||
+		len(lines) != 5 ||
+		!strings.HasPrefix(lines[3], "  index=2 term=1 size=2 checksum=") {
+		t.Fatal(out)
+	}
+
+	out, err = runToString(t, "node", []string{a}, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ni NodeInfo
+	if err := json.Unmarshal([]byte(out), &ni); err != nil {
+		t.Fatal(err)
+	}
+	if ni.State.CurrentTerm != 3 || ni.Log.LastIndex != 3 || ni.Log.Entries != nil {
+		t.Fatal(ni)
+	}
+
+	// Diverging logs
+	out, err = runToString(t, "diff", []string{filepath.Join(a, logDirname), filepath.Join(b, logDirname)}, false, false)
+	if err != errDiverged || !strings.Contains(out, "logs diverge at index 3\n  a: index=3 term=2 size=1") {
+		t.Fatal(out, err)
+	}
+	// A log that is a prefix of the other
+	out, err = runToString(t, "diff", []string{filepath.Join(a, logDirname), filepath.Join(c, logDirname)}, false, false)
+	if err != nil || !strings.HasSuffix(out, "logs agree from index 1 to 2\n") {
+		t.Fatal(out, err)
+	}
+
+	// Snapshot
+	kv := kvsm.NewKVStateMachine()
+	kv.ApplyCommand(1, kvsm.Put("k", "v"))
+	snapshotFile := filepath.Join(parent, "snapshot")
+	f, err := os.Create(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Snapshot(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runToString(t, "snapshot", []string{snapshotFile}, false, false)
+	if err != nil || !strings.HasPrefix(out, snapshotFile+": version=1 lastApplied=1 keys=1 size=") {
+		t.Fatal(out, err)
+	}
+
+	if _, err := runToString(t, "bogus", []string{a}, false, false); err != errUsage {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/kvsm"
+)
+
+// Status is the response of GET /status.
+type Status struct {
+	ServerId         ServerId `json:"serverId"`
+	State            string   `json:"state"`
+	CurrentTerm      TermNo   `json:"currentTerm"`
+	IndexOfLastEntry LogIndex `json:"indexOfLastEntry"`
+	LastApplied      LogIndex `json:"lastApplied"`
+	Keys             int      `json:"keys"`
+}
+
+// apiHandler serves the HTTP client API of a node:
+//
+//  GET /kv/<key>     the value of the key, or 404 if it does not exist
+//  PUT /kv/<key>     set the value of the key to the request body
+//  DELETE /kv/<key>  delete the key
+//  GET /status       the Status of the node as JSON
+//
+// Requests to /kv/ go through the raft log, so they are linearizable and must be
+// sent to the leader. Other servers reply with 503 Service Unavailable.
+//
+// The reply to a request that went through the log has the index of its entry in
+// the tokenHeader. This is a consistency token: a GET with the token parameter
+// is a local read, which can be sent to any server, and waits until the server
+// has applied the entry of the token. A client that keeps the latest token it
+// has received reads its own writes, and never reads older state than it has
+// seen, from any server. The reply to a local read has the lastApplied of the
+// state it was served from as the token.
+//
+// A GET with the maxStaleness parameter (in milliseconds) is also a local read,
+// but is only served if the server has heard from the leader within that time.
+// Otherwise the reply is 503, and the client should try another server. The
+// leader serves these through the log instead, since it does not hear from a
+// leader. maxStaleness bounds how long a follower can serve reads after being
+// partitioned from the leader, but not how far its state is behind the leader:
+// use it with a token for session consistency.
+//
+//  GET /kv/<key>?token=<index>[&maxStaleness=<ms>]
+//
+type apiHandler struct {
+	serverId            ServerId
+	cm                  IConsensusModule
+	raftPersistentState RaftPersistentState
+	log                 Log
+	sm                  *kvsm.KVStateMachine
+	timeout             time.Duration
+}
+
+const (
+	kvPath = "/kv/"
+
+	// tokenHeader is the header with the consistency token of a reply.
+	tokenHeader = "X-Raftkv-Token"
+)
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/status" {
+		h.status(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, kvPath) || len(r.URL.Path) == len(kvPath) {
+		http.NotFound(w, r)
+		return
+	}
+	key := r.URL.Path[len(kvPath):]
+
+	var command Command
+	switch r.Method {
+	case http.MethodGet:
+		local, token, maxStaleness, err := parseLocalRead(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if local && !(token == 0 && h.cm.GetServerState() == LEADER) {
+			h.localRead(w, r, key, token, maxStaleness)
+			return
+		}
+		command = kvsm.Get(key)
+	case http.MethodPut:
+		value, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		command = kvsm.Put(key, string(value))
+	case http.MethodDelete:
+		command = kvsm.Delete(key)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logIndex, result, status, msg := h.apply(command)
+	if status != http.StatusOK {
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set(tokenHeader, fmt.Sprint(logIndex))
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !result.Found {
+		http.NotFound(w, r)
+		return
+	}
+	_, _ = w.Write([]byte(result.Value))
+}
+
+// apply appends the command and waits for its result.
+//
+// Returns the log index of the command, or the HTTP status and error message if
+// there is no result.
+//
+func (h *apiHandler) apply(command Command) (LogIndex, kvsm.Result, int, string) {
+	logIndex, crc, err := h.cm.AppendCommandWithIndex(command)
+	if err == ErrNotLeader {
+		return 0, kvsm.Result{}, http.StatusServiceUnavailable, "not leader: try another server"
+	}
+	if err != nil {
+		return 0, kvsm.Result{}, http.StatusServiceUnavailable, err.Error()
+	}
+	select {
+	case result, ok := <-crc:
+		if !ok {
+			return 0, kvsm.Result{}, http.StatusServiceUnavailable,
+				"leadership changed: the command may or may not have been applied"
+		}
+		if e, ok := result.(error); ok {
+			return 0, kvsm.Result{}, http.StatusInternalServerError, e.Error()
+		}
+		return logIndex, result.(kvsm.Result), http.StatusOK, ""
+	case <-time.After(h.timeout):
+		return 0, kvsm.Result{}, http.StatusGatewayTimeout,
+			"timed out: the command may or may not have been applied"
+	}
+}
+
+// parseLocalRead parses the token and maxStaleness parameters of a GET. local is
+// false if there are neither.
+func parseLocalRead(r *http.Request) (local bool, token LogIndex, maxStaleness time.Duration, err error) {
+	q := r.URL.Query()
+	if s := q.Get("token"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return false, 0, 0, fmt.Errorf("bad token: %v", s)
+		}
+		local, token = true, LogIndex(n)
+	}
+	if s := q.Get("maxStaleness"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return false, 0, 0, fmt.Errorf("bad maxStaleness: %v", s)
+		}
+		if n == 0 {
+			return false, 0, 0, fmt.Errorf("maxStaleness=%v must be greater than zero", n)
+		}
+		local, maxStaleness = true, time.Duration(n)*time.Millisecond
+	}
+	return local, token, maxStaleness, nil
+}
+
+// localRead serves a GET from the local state once it has applied the entry of
+// the token, and if maxStaleness is set, only if the server heard from the leader
+// within maxStaleness.
+func (h *apiHandler) localRead(
+	w http.ResponseWriter, r *http.Request, key string, token LogIndex, maxStaleness time.Duration,
+) {
+	if maxStaleness > 0 {
+		contact := h.cm.GetLastLeaderContact()
+		if contact.IsZero() || time.Since(contact) > maxStaleness {
+			http.Error(w, "no recent contact with the leader: try another server", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+	switch err := h.cm.WaitApplied(ctx, token); err {
+	case nil:
+	case context.DeadlineExceeded:
+		http.Error(w, "timed out waiting for the token: try another server", http.StatusGatewayTimeout)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// The value and the token are read together so that the token is never
+	// behind the value.
+	value, found, lastApplied := h.sm.GetWithLastApplied(key)
+	w.Header().Set(tokenHeader, fmt.Sprint(lastApplied))
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	_, _ = w.Write([]byte(value))
+}
+
+func (h *apiHandler) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s := Status{
+		h.serverId,
+		ServerStateToString(h.cm.GetServerState()),
+		h.raftPersistentState.GetCurrentTerm(),
+		h.log.GetIndexOfLastEntry(),
+		h.sm.GetLastApplied(),
+		h.sm.Len(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&s)
+}
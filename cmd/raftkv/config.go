@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	. "github.com/divtxt/raft"
+)
+
+// ClusterConfig is the JSON cluster file.
+//
+// Example:
+//
+//  {
+//    "servers": [
+//      {"id": 1, "raftAddress": "127.0.0.1:7001", "httpAddress": "127.0.0.1:7101"},
+//      {"id": 2, "raftAddress": "127.0.0.1:7002", "httpAddress": "127.0.0.1:7102"},
+//      {"id": 3, "raftAddress": "127.0.0.1:7003", "httpAddress": "127.0.0.1:7103"}
+//    ]
+//  }
+//
+type ClusterConfig struct {
+	Servers []ServerConfig `json:"servers"`
+}
+
+// ServerConfig is a server in the cluster file.
+type ServerConfig struct {
+	Id ServerId `json:"id"`
+	// The address of the raft RPC server, for the other servers.
+	RaftAddress string `json:"raftAddress"`
+	// The address of the HTTP client API.
+	HttpAddress string `json:"httpAddress"`
+}
+
+// readConfig reads and validates the given cluster file.
+func readConfig(filename string) (*ClusterConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cc := &ClusterConfig{}
+	if err := json.Unmarshal(b, cc); err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	if err := cc.validate(); err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	return cc, nil
+}
+
+func (cc *ClusterConfig) validate() error {
+	if len(cc.Servers) == 0 {
+		return errors.New("no servers")
+	}
+	ids := make(map[ServerId]bool)
+	addresses := make(map[string]bool)
+	for _, s := range cc.Servers {
+		if s.Id == 0 {
+			return errors.New("server id must be greater than zero")
+		}
+		if ids[s.Id] {
+			return fmt.Errorf("duplicate server id: %v", s.Id)
+		}
+		ids[s.Id] = true
+		if s.RaftAddress == "" || s.HttpAddress == "" {
+			return fmt.Errorf("server %v: raftAddress and httpAddress are required", s.Id)
+		}
+		for _, a := range []string{s.RaftAddress, s.HttpAddress} {
+			if addresses[a] {
+				return fmt.Errorf("duplicate address: %v", a)
+			}
+			addresses[a] = true
+		}
+	}
+	return nil
+}
+
+// server returns the config of the given server.
+func (cc *ClusterConfig) server(serverId ServerId) (ServerConfig, error) {
+	for _, s := range cc.Servers {
+		if s.Id == serverId {
+			return s, nil
+		}
+	}
+	return ServerConfig{}, fmt.Errorf("server %v is not in the cluster", serverId)
+}
+
+func (cc *ClusterConfig) serverIds() []ServerId {
+	var serverIds []ServerId
+	for _, s := range cc.Servers {
+		serverIds = append(serverIds, s.Id)
+	}
+	return serverIds
+}
+
+func (cc *ClusterConfig) raftAddresses() map[ServerId]string {
+	addresses := make(map[ServerId]string)
+	for _, s := range cc.Servers {
+		addresses[s.Id] = s.RaftAddress
+	}
+	return addresses
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	. "github.com/divtxt/raft"
+)
+
+// localConfig returns the config of a cluster of the given size on localhost.
+//
+// Server i has the raft port basePort+i and the HTTP port basePort+100+i.
+//
+func localConfig(size int, basePort int) *ClusterConfig {
+	cc := &ClusterConfig{}
+	for i := 1; i <= size; i++ {
+		cc.Servers = append(cc.Servers, ServerConfig{
+			ServerId(i),
+			fmt.Sprintf("127.0.0.1:%d", basePort+i),
+			fmt.Sprintf("127.0.0.1:%d", basePort+100+i),
+		})
+	}
+	return cc
+}
+
+// launch writes the config of a local cluster of the given size to dir and
+// starts a child process for each server, until a signal is received.
+//
+// The output of each server is prefixed with its id. A server that is killed
+// by hand is not restarted, and its command line is printed so that it can be
+// restarted by hand.
+//
+func launch(size int, basePort int, dir string, signals <-chan os.Signal) error {
+	if size < 1 {
+		return fmt.Errorf("size=%v must be greater than zero", size)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	cc := localConfig(size, basePort)
+	b, err := json.MarshalIndent(cc, "", "  ")
+	if err != nil {
+		return err
+	}
+	configFile := filepath.Join(dir, "cluster.json")
+	if err := ioutil.WriteFile(configFile, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+
+	var procs []*exec.Cmd
+	wg := &sync.WaitGroup{}
+	defer func() {
+		for _, p := range procs {
+			_ = p.Process.Signal(os.Interrupt)
+		}
+		wg.Wait()
+	}()
+	for _, sc := range cc.Servers {
+		args := []string{
+			"-config", configFile,
+			"-id", fmt.Sprint(sc.Id),
+			"-data", filepath.Join(dir, fmt.Sprintf("server%d", sc.Id)),
+		}
+		p := exec.Command(executable, args...)
+		stdout, err := p.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		p.Stderr = p.Stdout
+		if err := p.Start(); err != nil {
+			return err
+		}
+		procs = append(procs, p)
+		fmt.Printf(
+			"server %v: pid=%v http=%v\n  restart with: %v %v\n",
+			sc.Id, p.Process.Pid, sc.HttpAddress, executable, strings.Join(args, " "),
+		)
+
+		wg.Add(1)
+		go func(serverId ServerId, p *exec.Cmd, output io.Reader) {
+			defer wg.Done()
+			prefixLines(fmt.Sprintf("%v| ", serverId), output)
+			fmt.Printf("%v| exited: %v\n", serverId, p.Wait())
+		}(sc.Id, p, stdout)
+	}
+
+	first := cc.Servers[0].HttpAddress
+	fmt.Printf(
+		"\nTry:\n  curl http://%v/status\n  curl -X PUT -d world http://%v/kv/hello\n  curl http://%v/kv/hello\n\n",
+		first, first, first,
+	)
+
+	<-signals
+	fmt.Println("Stopping servers")
+	return nil
+}
+
+// prefixLines copies lines from the given reader to stdout with the given prefix.
+func prefixLines(prefix string, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fmt.Println(prefix + scanner.Text())
+	}
+}
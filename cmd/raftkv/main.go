@@ -0,0 +1,164 @@
+// Command raftkv runs a node of a replicated key-value service, for trying out
+// failover by hand and for smoke tests.
+//
+// Usage:
+//
+//  raftkv -config <cluster.json> -id <serverId> -data <dir>
+//  raftkv -launch <size> [-dir <dir>] [-port <basePort>]
+//  raftkv -config <cluster.json> -id <serverId> -data <dir> -unsafe-recover <ids>
+//         -reason <text> -new-config <file> -accept-data-loss
+//
+// The first form runs one server of the cluster described by the cluster file
+// (see ClusterConfig). The raft persistent state and log are kept in the data
+// directory, and the key-value state is rebuilt from the log on restart. The
+// servers talk to each other with tcprpc.
+//
+// The second form writes the cluster file of a cluster of the given size on
+// localhost to the given directory, and starts each server in a child process.
+// Kill a server process to see another server take over as leader.
+//
+// Each server has an HTTP client API:
+//
+//  GET /kv/<key>     the value of the key, or 404 if it does not exist
+//  PUT /kv/<key>     set the value of the key to the request body
+//  DELETE /kv/<key>  delete the key
+//  GET /status       the state of the server as JSON
+//
+// Requests to /kv/ must be sent to the leader. Other servers reply with 503.
+// The reply has a consistency token in the X-Raftkv-Token header. Reads can be
+// sent to any server with the latest token the client has received, and wait
+// until that server has caught up with the token. Add maxStaleness to only read
+// from a server that heard from the leader in the last <ms> milliseconds:
+//
+//  GET /kv/<key>?token=<index>[&maxStaleness=<ms>]
+//
+// The third form brings back a cluster that has permanently lost a majority of
+// its servers from a surviving server, which must be stopped. The new members
+// are a comma separated list of server ids from the cluster file, including the
+// surviving server. The server's term is bumped and an audit entry is appended
+// to its log, which puts the record of the recovery in the key
+// "raftkv/recovery/<term>". The record is also appended to recovery.json in the
+// data directory, and the cluster file of the new members is written to the
+// new config file.
+//
+// This can lose committed entries. Follow the procedure of package recovery:
+// stop every server, recover the survivor with the most up-to-date log (see
+// cmd/raftctl), then start it with the new cluster file before any other new
+// member, and start the others one at a time once it is leader.
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	. "github.com/divtxt/raft"
+)
+
+func main() {
+	configFile := flag.String("config", "", "the cluster file")
+	id := flag.Uint64("id", 0, "the id of this server in the cluster file")
+	dataDir := flag.String("data", "", "the directory for the state of this server")
+	size := flag.Int("launch", 0, "start a local cluster of this size")
+	dir := flag.String("dir", "raftkv-cluster", "the directory for the local cluster")
+	basePort := flag.Int("port", 7000, "the base port for the local cluster")
+	recoverMembers := flag.String("unsafe-recover", "", "recover this stopped server with these new members (comma separated ids)")
+	reason := flag.String("reason", "", "the reason for the recovery, for the audit record")
+	newConfigFile := flag.String("new-config", "", "the cluster file to write for the new members")
+	acceptDataLoss := flag.Bool("accept-data-loss", false, "accept that the recovery can lose committed entries")
+	flag.Usage = func() {
+		fmt.Fprintf(
+			flag.CommandLine.Output(),
+			"Usage:\n  %s -config <cluster.json> -id <serverId> -data <dir>\n"+
+				"  %s -launch <size> [-dir <dir>] [-port <basePort>]\n"+
+				"  %s -config <cluster.json> -id <serverId> -data <dir> -unsafe-recover <ids>\n"+
+				"      -reason <text> -new-config <file> -accept-data-loss\n",
+			os.Args[0], os.Args[0], os.Args[0],
+		)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	if *size != 0 {
+		if err := launch(*size, *basePort, *dir, signals); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *configFile == "" || *id == 0 || *dataDir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cc, err := readConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *recoverMembers != "" {
+		if *reason == "" || *newConfigFile == "" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if !*acceptDataLoss {
+			fmt.Fprintln(os.Stderr, errNotAccepted)
+			os.Exit(2)
+		}
+		members, err := parseServerIds(*recoverMembers)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		record, err := unsafeRecover(cc, ServerId(*id), members, *dataDir, *reason, *newConfigFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf(
+			"Recovered server %v with members %v: term %v -> %v, audit entry at index %v\n"+
+				"Start it with %v before any other member.\n",
+			record.ServerId, record.Members, record.OldTerm, record.NewTerm, record.AuditIndex,
+			*newConfigFile,
+		)
+		return
+	}
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	n, err := startNode(cc, ServerId(*id), *dataDir, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	<-signals
+	logger.Println("[raftkv] Stopping")
+	n.stop()
+}
+
+// parseServerIds parses a comma separated list of server ids.
+func parseServerIds(s string) ([]ServerId, error) {
+	var serverIds []ServerId
+	for _, f := range strings.Split(s, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(f), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad server id: %q", f)
+		}
+		serverIds = append(serverIds, ServerId(id))
+	}
+	return serverIds, nil
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/fileutil"
+	"github.com/divtxt/raft/recovery"
+)
+
+// freeAddress returns a localhost address with a port that is free right now.
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// testConfig returns the config of a cluster of the given size with free
+// localhost addresses.
+func testConfig(t *testing.T, size int) *ClusterConfig {
+	for {
+		cc := &ClusterConfig{}
+		for i := 1; i <= size; i++ {
+			cc.Servers = append(cc.Servers, ServerConfig{ServerId(i), freeAddress(t), freeAddress(t)})
+		}
+		// A port can be returned twice since it is free again after each call
+		if cc.validate() == nil {
+			return cc
+		}
+	}
+}
+
+func getStatus(address string) (Status, error) {
+	var s Status
+	resp, err := http.Get("http://" + address + "/status")
+	if err != nil {
+		return s, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	return s, err
+}
+
+func waitForLeader(t *testing.T, cc *ClusterConfig, nodes map[ServerId]*node) ServerConfig {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, sc := range cc.Servers {
+			if nodes[sc.Id] == nil {
+				continue
+			}
+			if s, err := getStatus(sc.HttpAddress); err == nil && s.State == "LEADER" {
+				return sc
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("no leader")
+	return ServerConfig{}
+}
+
+func do(t *testing.T, method, url, body string) (int, string) {
+	status, body, _ := doWithToken(t, method, url, body)
+	return status, body
+}
+
+// doWithToken is do that also returns the consistency token of the reply.
+func doWithToken(t *testing.T, method, url, body string) (int, string, LogIndex) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token LogIndex
+	if h := resp.Header.Get(tokenHeader); h != "" {
+		if _, err := fmt.Sscan(h, &token); err != nil {
+			t.Fatal(h, err)
+		}
+	}
+	return resp.StatusCode, string(b), token
+}
+
+func TestRaftKV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raftkv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := testConfig(t, 3)
+	logger := log.New(ioutil.Discard, "", 0)
+	nodes := make(map[ServerId]*node)
+	start := func(serverId ServerId) {
+		n, err := startNode(cc, serverId, filepath.Join(dir, fmt.Sprint(serverId)), logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[serverId] = n
+	}
+	for _, sc := range cc.Servers {
+		start(sc.Id)
+	}
+	defer func() {
+		for _, n := range nodes {
+			if n != nil {
+				n.stop()
+			}
+		}
+	}()
+
+	leader := waitForLeader(t, cc, nodes)
+	url := "http://" + leader.HttpAddress + "/kv/hello"
+	if status, body := do(t, "GET", url, ""); status != http.StatusNotFound {
+		t.Fatal(status, body)
+	}
+	if status, body := do(t, "PUT", url, "world"); status != http.StatusNoContent {
+		t.Fatal(status, body)
+	}
+	if status, body := do(t, "GET", url, ""); status != http.StatusOK || body != "world" {
+		t.Fatal(status, body)
+	}
+	for _, sc := range cc.Servers {
+		if sc.Id != leader.Id {
+			status, body := do(t, "GET", "http://"+sc.HttpAddress+"/kv/hello", "")
+			if status != http.StatusServiceUnavailable {
+				t.Fatal(status, body)
+			}
+		}
+	}
+
+	// Stop the leader: another server takes over with the same data.
+	nodes[leader.Id].stop()
+	nodes[leader.Id] = nil
+	newLeader := waitForLeader(t, cc, nodes)
+	url = "http://" + newLeader.HttpAddress + "/kv/hello"
+	if status, body := do(t, "GET", url, ""); status != http.StatusOK || body != "world" {
+		t.Fatal(status, body)
+	}
+	if status, body := do(t, "DELETE", url, ""); status != http.StatusNoContent {
+		t.Fatal(status, body)
+	}
+
+	// The old leader restarts and rebuilds its state from its log.
+	start(leader.Id)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, err := getStatus(leader.HttpAddress)
+		if err == nil && s.LastApplied >= 2 && s.Keys == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(s, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRaftKV_LocalReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raftkv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := testConfig(t, 3)
+	logger := log.New(ioutil.Discard, "", 0)
+	nodes := make(map[ServerId]*node)
+	for _, sc := range cc.Servers {
+		n, err := startNode(cc, sc.Id, filepath.Join(dir, fmt.Sprint(sc.Id)), logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[sc.Id] = n
+	}
+	defer func() {
+		for _, n := range nodes {
+			if n != nil {
+				n.stop()
+			}
+		}
+	}()
+
+	leader := waitForLeader(t, cc, nodes)
+	var followers []ServerConfig
+	for _, sc := range cc.Servers {
+		if sc.Id != leader.Id {
+			followers = append(followers, sc)
+		}
+	}
+	leaderUrl := "http://" + leader.HttpAddress + "/kv/hello"
+	followerUrl := "http://" + followers[0].HttpAddress + "/kv/hello"
+
+	status, body, token := doWithToken(t, "PUT", leaderUrl, "world")
+	if status != http.StatusNoContent || token == 0 {
+		t.Fatal(status, body, token)
+	}
+
+	// Read your write from a follower
+	status, body, token2 := doWithToken(t, "GET", fmt.Sprint(followerUrl, "?token=", token), "")
+	if status != http.StatusOK || body != "world" || token2 < token {
+		t.Fatal(status, body, token2)
+	}
+
+	// A read waits for the follower to apply the token
+	type reply struct {
+		status int
+		body   string
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		status, body := do(t, "GET", fmt.Sprint(followerUrl, "?token=", token+1), "")
+		replies <- reply{status, body}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case r := <-replies:
+		t.Fatal(r)
+	default:
+	}
+	status, body, token3 := doWithToken(t, "PUT", leaderUrl, "again")
+	if status != http.StatusNoContent || token3 != token+1 {
+		t.Fatal(status, body, token3)
+	}
+	select {
+	case r := <-replies:
+		if r.status != http.StatusOK || r.body != "again" {
+			t.Fatal(r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// Bounded staleness: the follower hears from the leader with each heartbeat
+	status, body = do(t, "GET", fmt.Sprint(followerUrl, "?token=", token3, "&maxStaleness=1000"), "")
+	if status != http.StatusOK || body != "again" {
+		t.Fatal(status, body)
+	}
+	// The leader serves these through the log
+	status, body, token4 := doWithToken(t, "GET", leaderUrl+"?maxStaleness=1", "")
+	if status != http.StatusOK || body != "again" || token4 <= token3 {
+		t.Fatal(status, body, token4)
+	}
+	for _, query := range []string{"?token=x", "?maxStaleness=-1", "?maxStaleness=0"} {
+		if status, body := do(t, "GET", followerUrl+query, ""); status != http.StatusBadRequest {
+			t.Fatal(query, status, body)
+		}
+	}
+
+	// A follower that cannot hear from a leader only serves reads without maxStaleness
+	nodes[leader.Id].stop()
+	nodes[leader.Id] = nil
+	nodes[followers[1].Id].stop()
+	nodes[followers[1].Id] = nil
+	time.Sleep(200 * time.Millisecond)
+	status, body = do(t, "GET", fmt.Sprint(followerUrl, "?token=", token3, "&maxStaleness=100"), "")
+	if status != http.StatusServiceUnavailable {
+		t.Fatal(status, body)
+	}
+	status, body = do(t, "GET", fmt.Sprint(followerUrl, "?token=", token3), "")
+	if status != http.StatusOK || body != "again" {
+		t.Fatal(status, body)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raftkv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cluster.json")
+
+	tests := []struct {
+		json     string
+		expected string
+	}{
+		{`{"servers": []}`, "no servers"},
+		{`{"servers": [{"id": 0, "raftAddress": "a", "httpAddress": "b"}]}`, "server id must be greater than zero"},
+		{`{"servers": [{"id": 1, "raftAddress": "a"}]}`, "server 1: raftAddress and httpAddress are required"},
+		{`{"servers": [{"id": 1, "raftAddress": "a", "httpAddress": "a"}]}`, "duplicate address: a"},
+		{
+			`{"servers": [{"id": 1, "raftAddress": "a", "httpAddress": "b"}, {"id": 1, "raftAddress": "c", "httpAddress": "d"}]}`,
+			"duplicate server id: 1",
+		},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(filename, []byte(test.json), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readConfig(filename)
+		if err == nil || err.Error() != filename+": "+test.expected {
+			t.Fatal(test.json, err)
+		}
+	}
+
+	cc := localConfig(3, 7000)
+	b, err := json.Marshal(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cc2, err := readConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc, err := cc2.server(2); err != nil || sc.RaftAddress != "127.0.0.1:7002" || sc.HttpAddress != "127.0.0.1:7102" {
+		t.Fatal(sc, err)
+	}
+}
+
+func TestUnsafeRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raftkv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := testConfig(t, 3)
+	logger := log.New(ioutil.Discard, "", 0)
+	dataDir := func(serverId ServerId) string {
+		return filepath.Join(dir, fmt.Sprint(serverId))
+	}
+	nodes := make(map[ServerId]*node)
+	start := func(cc *ClusterConfig, serverId ServerId) {
+		n, err := startNode(cc, serverId, dataDir(serverId), logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[serverId] = n
+	}
+	stopAll := func() {
+		for serverId, n := range nodes {
+			if n != nil {
+				n.stop()
+				nodes[serverId] = nil
+			}
+		}
+	}
+	defer stopAll()
+	for _, sc := range cc.Servers {
+		start(cc, sc.Id)
+	}
+
+	leader := waitForLeader(t, cc, nodes)
+	if status, body := do(t, "PUT", "http://"+leader.HttpAddress+"/kv/hello", "world"); status != http.StatusNoContent {
+		t.Fatal(status, body)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, sc := range cc.Servers {
+		for {
+			s, err := getStatus(sc.HttpAddress)
+			if err == nil && s.LastApplied >= 1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal(s, err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	newConfigFile := filepath.Join(dir, "recovered.json")
+	// A running server cannot be recovered
+	if _, err := unsafeRecover(cc, 1, []ServerId{1, 2}, dataDir(1), "test", newConfigFile); err == nil ||
+		!strings.HasPrefix(err.Error(), "server 1 may still be running") {
+		t.Fatal(err)
+	}
+	stopAll()
+
+	// Servers 2 and 3 are lost: server 2 is replaced by a new server with no state.
+	if err := os.RemoveAll(dataDir(2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unsafeRecover(cc, 2, []ServerId{1, 2}, dataDir(2), "test", newConfigFile); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if _, err := unsafeRecover(cc, 1, []ServerId{1, 4}, dataDir(1), "test", newConfigFile); err == nil ||
+		err.Error() != "server 4 is not in the cluster" {
+		t.Fatal(err)
+	}
+	record, err := unsafeRecover(cc, 1, []ServerId{1, 2}, dataDir(1), "lost 2 and 3", newConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unsafeRecover(cc, 1, []ServerId{1, 2}, dataDir(1), "test", newConfigFile); err == nil ||
+		err.Error() != newConfigFile+" already exists" {
+		t.Fatal(err)
+	}
+
+	newConfig, err := readConfig(newConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newConfig.Servers) != 2 || newConfig.Servers[0] != cc.Servers[0] || newConfig.Servers[1] != cc.Servers[1] {
+		t.Fatal(newConfig)
+	}
+
+	// The recovered server is started first and is elected by the new server.
+	start(newConfig, 1)
+	start(newConfig, 2)
+	if newLeader := waitForLeader(t, newConfig, nodes); newLeader.Id != 1 {
+		t.Fatal(newLeader)
+	}
+	url := "http://" + cc.Servers[0].HttpAddress + "/kv/"
+	if status, body := do(t, "GET", url+"hello", ""); status != http.StatusOK || body != "world" {
+		t.Fatal(status, body)
+	}
+	status, body := do(t, "GET", url+fmt.Sprint(recoveryKeyPrefix, record.NewTerm), "")
+	if status != http.StatusOK || !strings.Contains(body, `"Reason":"lost 2 and 3"`) {
+		t.Fatal(status, body)
+	}
+	var records []recovery.Record
+	if err := fileutil.NewAtomicJsonFile(filepath.Join(dataDir(1), recoveryFilename)).Read(&records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].NewTerm != record.NewTerm || records[0].AuditIndex != 2 {
+		t.Fatal(records)
+	}
+}
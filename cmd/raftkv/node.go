@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/config"
+	"github.com/divtxt/raft/fileutil"
+	"github.com/divtxt/raft/impl"
+	"github.com/divtxt/raft/kvsm"
+	"github.com/divtxt/raft/rps"
+	"github.com/divtxt/raft/seglog"
+	"github.com/divtxt/raft/tcprpc"
+)
+
+// Settings for a cluster on a local network.
+var timeSettings = config.TimeSettings{
+	TickerDuration:     50 * time.Millisecond,
+	ElectionTimeoutLow: 300 * time.Millisecond,
+}
+
+const (
+	dialTimeout    = 50 * time.Millisecond
+	callTimeout    = 100 * time.Millisecond
+	commandTimeout = 5 * time.Second
+
+	maxEntriesPerAppendEntry = 64
+	maxSegmentSize           = 16 * 1024 * 1024
+)
+
+// node is a running server of the cluster.
+type node struct {
+	logger     *log.Logger
+	log        *seglog.SegmentedLog
+	client     *tcprpc.Client
+	cm         *impl.ConsensusModule
+	raftServer *tcprpc.Server
+	httpServer *http.Server
+	httpDone   chan error
+}
+
+// startNode starts the given server of the cluster, with its persistent state
+// and log in the given directory.
+//
+// The key-value state is not persisted: it is rebuilt from the log when the
+// server restarts.
+//
+func startNode(cc *ClusterConfig, serverId ServerId, dataDir string, logger *log.Logger) (*node, error) {
+	sc, err := cc.server(serverId)
+	if err != nil {
+		return nil, err
+	}
+	logDir := filepath.Join(dataDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return nil, err
+	}
+
+	n := &node{logger: logger}
+	ok := false
+	defer func() {
+		if !ok {
+			n.stop()
+		}
+	}()
+
+	raftPersistentState, err := rps.NewJsonFileRaftPersistentState(
+		fileutil.NewAtomicJsonFile(filepath.Join(dataDir, "rps.json")),
+	)
+	if err != nil {
+		return nil, err
+	}
+	n.log, err = seglog.OpenSegmentedLog(logDir, maxEntriesPerAppendEntry, maxSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	if tr := n.log.GetTailRepair(); tr != nil {
+		logger.Printf("[raftkv] Repaired damaged log tail: %+v", *tr)
+	}
+	sm := kvsm.NewKVStateMachine()
+
+	n.client, err = tcprpc.NewClient(serverId, cc.raftAddresses(), dialTimeout, callTimeout, logger)
+	if err != nil {
+		return nil, err
+	}
+	ci, err := config.NewClusterInfo(cc.serverIds(), serverId)
+	if err != nil {
+		return nil, err
+	}
+	n.cm, err = impl.NewConsensusModuleWithBatchPolicy(
+		raftPersistentState,
+		n.log,
+		sm,
+		n.client,
+		ci,
+		BatchPolicy{maxEntriesPerAppendEntry, 0},
+		timeSettings,
+		logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+	n.raftServer, err = tcprpc.Listen(sc.RaftAddress, n.cm, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", sc.HttpAddress)
+	if err != nil {
+		return nil, err
+	}
+	n.httpServer = &http.Server{
+		Handler: &apiHandler{serverId, n.cm, raftPersistentState, n.log, sm, commandTimeout},
+	}
+	n.httpDone = make(chan error, 1)
+	go func() {
+		n.httpDone <- n.httpServer.Serve(listener)
+	}()
+
+	logger.Printf(
+		"[raftkv] Server %v started: raft=%v http=%v data=%v",
+		serverId, sc.RaftAddress, sc.HttpAddress, dataDir,
+	)
+	ok = true
+	return n, nil
+}
+
+// stop stops the server. This can be called on a partially started node.
+func (n *node) stop() {
+	if n.httpServer != nil {
+		_ = n.httpServer.Close()
+		<-n.httpDone
+	}
+	if n.raftServer != nil {
+		_ = n.raftServer.Close()
+	}
+	if n.cm != nil {
+		n.cm.Stop()
+	}
+	if n.client != nil {
+		n.client.Close()
+	}
+	if n.log != nil {
+		if err := n.log.Close(); err != nil {
+			n.logger.Printf("[raftkv] Error closing log: %v", err)
+		}
+	}
+}
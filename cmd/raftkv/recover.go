@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/config"
+	"github.com/divtxt/raft/fileutil"
+	"github.com/divtxt/raft/kvsm"
+	"github.com/divtxt/raft/recovery"
+	"github.com/divtxt/raft/rps"
+	"github.com/divtxt/raft/seglog"
+)
+
+const (
+	// recoveryFilename is the file in the data directory with the records of
+	// the unsafe recoveries of the server.
+	recoveryFilename = "recovery.json"
+
+	// The audit entry of a recovery puts the record as JSON in this key,
+	// followed by the new term.
+	recoveryKeyPrefix = "raftkv/recovery/"
+)
+
+// unsafeRecover runs recovery.UnsafeRecover on the data of the given server with
+// the given new members, and writes the cluster file of the new members to
+// newConfigFile, which must not already exist.
+//
+// The new members must be in the cluster file, which is used for their addresses.
+// The record of the recovery is appended to the recovery file, and is also put
+// in the key-value state by the audit entry.
+//
+// The server must not be running: this fails if its addresses are in use.
+//
+func unsafeRecover(
+	cc *ClusterConfig,
+	serverId ServerId,
+	members []ServerId,
+	dataDir string,
+	reason string,
+	newConfigFile string,
+) (*recovery.Record, error) {
+	sc, err := cc.server(serverId)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(newConfigFile); err == nil {
+		return nil, fmt.Errorf("%v already exists", newConfigFile)
+	}
+	newConfig := &ClusterConfig{}
+	for _, memberId := range members {
+		msc, err := cc.server(memberId)
+		if err != nil {
+			return nil, err
+		}
+		newConfig.Servers = append(newConfig.Servers, msc)
+	}
+	ci, err := config.NewClusterInfo(members, serverId)
+	if err != nil {
+		return nil, err
+	}
+
+	// A server that is still running would overwrite the recovered state.
+	for _, address := range []string{sc.RaftAddress, sc.HttpAddress} {
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("server %v may still be running: %v", serverId, err)
+		}
+		_ = l.Close()
+	}
+	// Recovering a server without state would lose everything.
+	rpsFilename := filepath.Join(dataDir, "rps.json")
+	if _, err := os.Stat(rpsFilename); err != nil {
+		return nil, err
+	}
+
+	raftPersistentState, err := rps.NewJsonFileRaftPersistentState(fileutil.NewAtomicJsonFile(rpsFilename))
+	if err != nil {
+		return nil, err
+	}
+	sl, err := seglog.OpenSegmentedLog(filepath.Join(dataDir, "log"), maxEntriesPerAppendEntry, maxSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	record, err := recovery.UnsafeRecover(
+		raftPersistentState,
+		sl,
+		ci,
+		func(r recovery.Record) (Command, error) {
+			b, err := json.Marshal(r)
+			if err != nil {
+				return nil, err
+			}
+			return kvsm.Put(fmt.Sprint(recoveryKeyPrefix, r.NewTerm), string(b)), nil
+		},
+		reason,
+		recovery.AcknowledgeDataLoss,
+	)
+	if closeErr := sl.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryFile := fileutil.NewAtomicJsonFile(filepath.Join(dataDir, recoveryFilename))
+	var records []recovery.Record
+	if err := recoveryFile.Read(&records); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := recoveryFile.Write(append(records, *record)); err != nil {
+		return nil, err
+	}
+
+	b, err := json.MarshalIndent(newConfig, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(newConfigFile, append(b, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+var errNotAccepted = errors.New("unsafe recovery can lose committed entries: add -accept-data-loss to proceed")
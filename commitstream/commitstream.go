@@ -0,0 +1,160 @@
+// Package commitstream streams the committed entries of a raft Log to external
+// consumers, such as message queues or audit logs.
+//
+// A Subscription reads committed entries from the Log in its own goroutine,
+// driven by the commitIndex WatchableIndex, so consumers are separate from the
+// StateMachine and never block the applier. A slow consumer only delays its own
+// Subscription: the buffered channel fills up, and the goroutine waits for the
+// consumer before it reads more entries from the Log (backpressure).
+//
+// To resume after a restart, the consumer records the index of the last entry
+// it has processed and subscribes from the next index. If the Log has compacted
+// that index in the meantime, the Subscription fails with ErrIndexCompacted
+// and the consumer must catch up from a snapshot instead.
+//
+package commitstream
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/util"
+)
+
+// CommittedEntry is a committed log entry and its index.
+type CommittedEntry struct {
+	Index   LogIndex
+	TermNo  TermNo
+	Command Command
+}
+
+// A Subscription delivers the committed entries of a Log, in order, from a
+// given index onward.
+type Subscription struct {
+	log         Log
+	commitIndex WatchableIndex
+	unwatch     func()
+	c           chan CommittedEntry
+	trigger     chan struct{}
+	sg          *util.StoppableGoroutine
+	closeOnce   sync.Once
+
+	mutex *sync.Mutex
+	err   error
+}
+
+// Subscribe starts a Subscription to the committed entries of the given Log,
+// starting with the entry at fromIndex.
+//
+// commitIndex must be the commitIndex of the ConsensusModule that uses the Log
+// (see impl.ConsensusModule.GetCommitIndexWatchable). Entries are only read up to
+// commitIndex, so the Subscription never sees entries that can be discarded.
+//
+// bufferSize is the capacity of the channel returned by C, and bounds how far
+// the Subscription reads ahead of the consumer.
+//
+func Subscribe(log Log, commitIndex WatchableIndex, fromIndex LogIndex, bufferSize int) (*Subscription, error) {
+	if log == nil {
+		return nil, errors.New("'log' cannot be nil")
+	}
+	if commitIndex == nil {
+		return nil, errors.New("'commitIndex' cannot be nil")
+	}
+	if fromIndex == 0 {
+		return nil, fmt.Errorf("fromIndex=%v must be greater than zero", fromIndex)
+	}
+	if bufferSize < 0 {
+		return nil, fmt.Errorf("bufferSize=%v must not be negative", bufferSize)
+	}
+
+	s := &Subscription{
+		log:         log,
+		commitIndex: commitIndex,
+		c:           make(chan CommittedEntry, bufferSize),
+		trigger:     make(chan struct{}, 1),
+		mutex:       &sync.Mutex{},
+	}
+	// The listener is called while the commitIndex is locked, so it must not block.
+	s.unwatch = commitIndex.AddListener(func(LogIndex) {
+		select {
+		case s.trigger <- struct{}{}:
+		default: // a run is already pending
+		}
+	})
+	s.sg = util.StartGoroutine(func(stop <-chan struct{}) {
+		s.run(stop, fromIndex)
+	})
+	return s, nil
+}
+
+// C returns the channel of committed entries.
+//
+// The channel is closed when the Subscription is closed or fails. Err then
+// returns the reason for the failure.
+//
+func (s *Subscription) C() <-chan CommittedEntry {
+	return s.c
+}
+
+// Err returns the error that ended the Subscription, or nil if it has not
+// failed. In particular, this is ErrIndexCompacted if the next entry has been
+// compacted from the Log before it could be read.
+//
+// Err returns nil after Close.
+//
+func (s *Subscription) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+// Close stops the Subscription, removes its listener from commitIndex and
+// closes its channel. Entries that are still buffered in the channel can be
+// drained after Close.
+//
+// This is safe to call more than once, and after the Subscription has failed.
+//
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		s.unwatch()
+		s.sg.StopSync()
+	})
+}
+
+func (s *Subscription) run(stop <-chan struct{}, next LogIndex) {
+	defer close(s.c)
+	for {
+		commitIndex := s.commitIndex.Get()
+		for next <= commitIndex {
+			entries, err := s.log.GetEntriesAfterIndex(next - 1)
+			if err == nil && len(entries) == 0 {
+				err = fmt.Errorf("no entries after index %v", next-1)
+			}
+			if err != nil {
+				s.mutex.Lock()
+				s.err = err
+				s.mutex.Unlock()
+				return
+			}
+			for _, entry := range entries {
+				if next > commitIndex {
+					break
+				}
+				select {
+				case s.c <- CommittedEntry{next, entry.TermNo, entry.Command}:
+					next++
+				case <-stop:
+					return
+				}
+			}
+		}
+
+		select {
+		case <-s.trigger:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package commitstream
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/config"
+	"github.com/divtxt/raft/impl"
+	"github.com/divtxt/raft/inmemlog"
+	"github.com/divtxt/raft/logindex"
+	"github.com/divtxt/raft/rps"
+	"github.com/divtxt/raft/simnet"
+	"github.com/divtxt/raft/testdata"
+	"github.com/divtxt/raft/testhelpers"
+)
+
+func newTestLog(t *testing.T, n int) *inmemlog.InMemoryLog {
+	iml, err := inmemlog.NewInMemoryLog(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		if _, err := iml.AppendEntry(LogEntry{TermNo(i/4 + 1), testhelpers.DummyCommand(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return iml
+}
+
+// receive receives the next entry and checks its index.
+func receive(t *testing.T, s *Subscription, expectedIndex LogIndex) CommittedEntry {
+	select {
+	case ce, ok := <-s.C():
+		if !ok {
+			t.Fatal("closed", s.Err())
+		}
+		if ce.Index != expectedIndex {
+			t.Fatal(ce, expectedIndex)
+		}
+		return ce
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for", expectedIndex)
+	}
+	return CommittedEntry{}
+}
+
+func assertNothing(t *testing.T, s *Subscription) {
+	select {
+	case ce, ok := <-s.C():
+		t.Fatal(ce, ok)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func assertClosed(t *testing.T, s *Subscription) {
+	select {
+	case ce, ok := <-s.C():
+		if ok {
+			t.Fatal(ce)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestSubscribe_Validation(t *testing.T) {
+	iml := newTestLog(t, 0)
+	commitIndex := logindex.NewWatchedIndex()
+	tests := []struct {
+		log         Log
+		commitIndex WatchableIndex
+		fromIndex   LogIndex
+		bufferSize  int
+		expected    string
+	}{
+		{nil, commitIndex, 1, 0, "'log' cannot be nil"},
+		{iml, nil, 1, 0, "'commitIndex' cannot be nil"},
+		{iml, commitIndex, 0, 0, "fromIndex=0 must be greater than zero"},
+		{iml, commitIndex, 1, -1, "bufferSize=-1 must not be negative"},
+	}
+	for _, test := range tests {
+		_, err := Subscribe(test.log, test.commitIndex, test.fromIndex, test.bufferSize)
+		if err == nil || err.Error() != test.expected {
+			t.Fatal(test.expected, err)
+		}
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	iml := newTestLog(t, 10)
+	commitIndex := logindex.NewWatchedIndex()
+	if err := commitIndex.Set(2); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Subscribe(iml, commitIndex, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ce := receive(t, s, 1)
+	if ce.TermNo != 1 || !testhelpers.DummyCommandEquals(ce.Command, 1) {
+		t.Fatal(ce)
+	}
+	receive(t, s, 2)
+	// Entries after commitIndex are not sent
+	assertNothing(t, s)
+
+	// Entries are read in batches of 3 from the log, but only up to commitIndex
+	if err := commitIndex.Set(4); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, s, 3)
+	ce = receive(t, s, 4)
+	if ce.TermNo != 2 || !testhelpers.DummyCommandEquals(ce.Command, 4) {
+		t.Fatal(ce)
+	}
+	assertNothing(t, s)
+
+	// Backpressure: the subscription reads ahead at most the buffer size, plus
+	// the entry it is waiting to send.
+	if err := commitIndex.Set(10); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(s.C()) != 2 {
+		t.Fatal(len(s.C()))
+	}
+	for li := LogIndex(5); li <= 10; li++ {
+		receive(t, s, li)
+	}
+	assertNothing(t, s)
+
+	// Entries that are appended and committed later are sent
+	if _, err := iml.AppendEntry(LogEntry{4, testhelpers.DummyCommand(11)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitIndex.Set(11); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, s, 11)
+
+	s.Close()
+	assertClosed(t, s)
+	if s.Err() != nil {
+		t.Fatal(s.Err())
+	}
+	// Close is idempotent
+	s.Close()
+}
+
+// countingIndex is a WatchableIndex that counts its listeners.
+type countingIndex struct {
+	*logindex.WatchedIndex
+	listeners int
+}
+
+func (ci *countingIndex) AddListener(didChangeListener IndexChangeListener) func() {
+	ci.listeners++
+	remove := ci.WatchedIndex.AddListener(didChangeListener)
+	return func() {
+		ci.listeners--
+		remove()
+	}
+}
+
+func TestSubscription_CloseRemovesListener(t *testing.T) {
+	iml := newTestLog(t, 10)
+	commitIndex := &countingIndex{logindex.NewWatchedIndex(), 0}
+
+	for i := 0; i < 3; i++ {
+		s, err := Subscribe(iml, commitIndex, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if commitIndex.listeners != 1 {
+			t.Fatal(commitIndex.listeners)
+		}
+		s.Close()
+		s.Close()
+		if commitIndex.listeners != 0 {
+			t.Fatal(commitIndex.listeners)
+		}
+	}
+}
+
+func TestSubscription_Resume(t *testing.T) {
+	iml := newTestLog(t, 10)
+	commitIndex := logindex.NewWatchedIndex()
+	if err := commitIndex.Set(8); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resume after the last processed entry
+	s, err := Subscribe(iml, commitIndex, 6, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for li := LogIndex(6); li <= 8; li++ {
+		receive(t, s, li)
+	}
+	s.Close()
+
+	// Resume from an index that is not yet committed
+	s, err = Subscribe(iml, commitIndex, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assertNothing(t, s)
+	if err := commitIndex.Set(10); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, s, 10)
+
+	// Entries that have been compacted cannot be resumed from
+	if err := iml.DiscardEntriesBeforeIndex(5); err != nil {
+		t.Fatal(err)
+	}
+	s2, err := Subscribe(iml, commitIndex, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	assertClosed(t, s2)
+	if s2.Err() != ErrIndexCompacted {
+		t.Fatal(s2.Err())
+	}
+}
+
+// A follower streams the commands that are appended on the leader.
+func TestSubscription_Cluster(t *testing.T) {
+	serverIds := []ServerId{1, 2, 3}
+	logs := make(map[ServerId]*inmemlog.InMemoryLog)
+	for _, serverId := range serverIds {
+		iml, err := inmemlog.NewInMemoryLog(testdata.MaxEntriesPerAppendEntry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs[serverId] = iml
+	}
+	newNode := func(serverId ServerId, rpcService RpcService) (IConsensusModule, error) {
+		ci, err := config.NewClusterInfo(serverIds, serverId)
+		if err != nil {
+			return nil, err
+		}
+		return impl.NewConsensusModule(
+			rps.NewIMPSWithCurrentTerm(0),
+			logs[serverId],
+			testhelpers.NewDummyStateMachine(0),
+			rpcService,
+			ci,
+			config.TimeSettings{testdata.TickerDuration, testdata.ElectionTimeoutLow},
+			log.New(ioutil.Discard, "", 0),
+		)
+	}
+	c, err := simnet.NewCluster(serverIds, 1, newNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.StopAll()
+	leader, err := c.WaitForLeader(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower := leader%3 + 1
+	cm := c.Node(follower).(*impl.ConsensusModule)
+	s, err := Subscribe(logs[follower], cm.GetCommitIndexWatchable(), 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	const n = 20
+	for i := 1; i <= n; i++ {
+		if _, err := c.Node(leader).AppendCommand(testhelpers.DummyCommand(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= n; i++ {
+		ce := receive(t, s, LogIndex(i))
+		if !testhelpers.DummyCommandEquals(ce.Command, i) {
+			t.Fatal(ce)
+		}
+	}
+}
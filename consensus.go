@@ -2,6 +2,11 @@
 
 package raft
 
+import (
+	"context"
+	"time"
+)
+
 // The Raft ConsensusModule.
 type IConsensusModule interface {
 
@@ -53,6 +58,37 @@ type IConsensusModule interface {
 	//
 	// See the notes on NewConsensusModule() for more details about this method's behavior.
 	AppendCommand(command Command) (<-chan CommandResult, error)
+
+	// AppendCommandWithIndex is AppendCommand that also returns the log index of the new entry.
+	//
+	// Once the result has been received, the entry is committed and the index can be given
+	// to the client as a consistency token: WaitApplied with this index on any server waits
+	// until that server's state includes the command.
+	AppendCommandWithIndex(command Command) (LogIndex, <-chan CommandResult, error)
+
+	// Get lastApplied as a WatchableIndex.
+	//
+	// This is the index of the last entry applied to the state machine on this server,
+	// whatever its state. Listeners are called from the goroutine that applies entries,
+	// so they must not block.
+	GetLastAppliedWatchable() WatchableIndex
+
+	// WaitApplied waits until the entry at the given log index has been applied to the
+	// state machine on this server.
+	//
+	// This can be called on any server, and for any index. A client that wrote through
+	// the leader can use the index of its entry to read its own write from a follower.
+	//
+	// Returns ctx.Err() if the context is done before the entry is applied.
+	// Returns ErrStopped if ConsensusModule is stopped.
+	WaitApplied(ctx context.Context, logIndex LogIndex) error
+
+	// Get the time of the last AppendEntries accepted from the current leader.
+	//
+	// This is the zero time if this server is not a follower, or has not heard from the
+	// leader since it became a follower. Together with WaitApplied, this bounds how stale
+	// the state of a follower can be.
+	GetLastLeaderContact() time.Time
 }
 
 // A subset of the IConsensusModule interface with just the AppendCommand method.
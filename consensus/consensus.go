@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -30,6 +31,11 @@ type PassiveConsensusModule struct {
 	aeSender                    internal.IAppendEntriesSender
 	logger                      *log.Logger
 
+	// indexOfLastDurableEntry is nil if the log is not an AsyncLog
+	indexOfLastDurableEntry WatchableIndex
+	// bufferedState is nil if the RaftPersistentState is not a BufferedRaftPersistentState
+	bufferedState BufferedRaftPersistentState
+
 	// -- Config
 	ClusterInfo *config.ClusterInfo
 
@@ -43,6 +49,7 @@ type PassiveConsensusModule struct {
 	commitIndex            *logindex.WatchedIndex
 	electionTimeoutChooser *util.ElectionTimeoutChooser
 	ElectionTimeoutTimer   *util.Timer
+	nowFunc                func() time.Time
 
 	// -- State-specific state - only one of these should be set at any given time
 	FollowerVolatileState  *follower.FollowerVolatileState // TODO: use for checks!
@@ -59,6 +66,35 @@ func NewPassiveConsensusModule(
 	electionTimeoutLow time.Duration,
 	nowFunc func() time.Time,
 	logger *log.Logger,
+) (*PassiveConsensusModule, error) {
+	return NewPassiveConsensusModuleWithRand(
+		raftPersistentState,
+		log,
+		sendOnlyRpcRequestVoteAsync,
+		aeSender,
+		clusterInfo,
+		electionTimeoutLow,
+		nowFunc,
+		rand.New(rand.NewSource(time.Now().UnixNano())),
+		logger,
+	)
+}
+
+// NewPassiveConsensusModuleWithRand creates a PassiveConsensusModule that chooses its
+// election timeouts using the given random number generator, which must not be shared.
+//
+// With a generator that has a fixed seed, and a nowFunc that does not use the real
+// time, the PassiveConsensusModule behaves the same way every time (see package sim).
+func NewPassiveConsensusModuleWithRand(
+	raftPersistentState RaftPersistentState,
+	log internal.LogTail,
+	sendOnlyRpcRequestVoteAsync internal.SendOnlyRpcRequestVoteAsync,
+	aeSender internal.IAppendEntriesSender,
+	clusterInfo *config.ClusterInfo,
+	electionTimeoutLow time.Duration,
+	nowFunc func() time.Time,
+	electionTimeoutRand *rand.Rand,
+	logger *log.Logger,
 ) (*PassiveConsensusModule, error) {
 	// Param checks
 	if raftPersistentState == nil {
@@ -79,6 +115,9 @@ func NewPassiveConsensusModule(
 	if nowFunc == nil {
 		return nil, errors.New("'nowFunc' cannot be nil")
 	}
+	if electionTimeoutRand == nil {
+		return nil, errors.New("'electionTimeoutRand' cannot be nil")
+	}
 	if logger == nil {
 		return nil, errors.New("'logger' cannot be nil")
 	}
@@ -96,6 +135,8 @@ func NewPassiveConsensusModule(
 		sendOnlyRpcRequestVoteAsync,
 		aeSender,
 		logger,
+		nil, // indexOfLastDurableEntry - set below
+		nil, // bufferedState - set below
 
 		// -- Config
 		clusterInfo,
@@ -108,8 +149,9 @@ func NewPassiveConsensusModule(
 		// commitIndex is the index of highest log entry known to be committed
 		// (initialized to 0, increases monotonically)
 		logindex.NewWatchedIndexWithVerifier(nil), // FIXME: verifier
-		util.NewElectionTimeoutChooser(electionTimeoutLow),
+		util.NewElectionTimeoutChooserWithRand(electionTimeoutLow, electionTimeoutRand),
 		electionTimeoutTimer,
+		nowFunc,
 
 		// -- State-specific state
 		follower.NewFollowerVolatileState(0),
@@ -117,6 +159,13 @@ func NewPassiveConsensusModule(
 		nil,
 	}
 
+	if asyncLog, ok := log.(internal.AsyncLogTail); ok {
+		pcm.indexOfLastDurableEntry = asyncLog.GetIndexOfLastDurableEntryWatchable()
+	}
+	if bufferedState, ok := raftPersistentState.(BufferedRaftPersistentState); ok {
+		pcm.bufferedState = bufferedState
+	}
+
 	return pcm, nil
 }
 
@@ -129,6 +178,20 @@ func (cm *PassiveConsensusModule) GetServerState() ServerState {
 	return cm.serverState
 }
 
+// Get the time of the last AppendEntries accepted from the current leader.
+//
+// This is the zero time if this server is not a follower, or has not accepted an
+// AppendEntries since it became a follower.
+func (cm *PassiveConsensusModule) GetLastLeaderContact() time.Time {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if cm.serverState != FOLLOWER {
+		return time.Time{}
+	}
+	return cm.FollowerVolatileState.GetLastLeaderContact()
+}
+
 // Set the current server state.
 // Validates the server state before setting.
 func (cm *PassiveConsensusModule) setServerStateFollower(leader ServerId) {
@@ -148,6 +211,7 @@ func (cm *PassiveConsensusModule) setServerStateLeader(indexOfLastEntry LogIndex
 	cm.FollowerVolatileState = nil
 	cm.CandidateVolatileState = nil
 	cm.LeaderVolatileState = leader.NewLeaderVolatileState(cm.ClusterInfo, indexOfLastEntry, cm.aeSender)
+	cm.LeaderVolatileState.SetSelfMatchIndex(cm.getIndexOfLastDurableEntry())
 }
 func (cm *PassiveConsensusModule) _setServerState(serverState ServerState) {
 	if serverState != FOLLOWER && serverState != CANDIDATE && serverState != LEADER {
@@ -198,6 +262,40 @@ func (cm *PassiveConsensusModule) setCommitIndex(commitIndex LogIndex) error {
 	return err
 }
 
+// Get the index of the last entry that is durable in the log.
+// All entries are durable unless the log is an AsyncLog.
+func (cm *PassiveConsensusModule) getIndexOfLastDurableEntry() LogIndex {
+	if cm.indexOfLastDurableEntry == nil {
+		return cm.logRO.GetIndexOfLastEntry()
+	}
+	return cm.indexOfLastDurableEntry.Get()
+}
+
+// Make any change to currentTerm and votedFor durable.
+// This does nothing unless the RaftPersistentState is a BufferedRaftPersistentState.
+func (cm *PassiveConsensusModule) syncState() error {
+	if cm.bufferedState == nil {
+		return nil
+	}
+	return cm.bufferedState.SyncState()
+}
+
+// IndexOfLastDurableEntryChanged tells a leader that more of its log may now be durable,
+// so that it can advance commitIndex without waiting for the next tick.
+//
+// This should be called after the indexOfLastDurableEntry of an AsyncLog changes, but
+// must not be called from the listener itself since the log may be calling the listener
+// while the ConsensusModule is waiting on the log.
+func (cm *PassiveConsensusModule) IndexOfLastDurableEntryChanged() error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if cm.serverState != LEADER {
+		return nil
+	}
+	return cm.advanceCommitIndexIfPossible()
+}
+
 // AppendCommand appends the given serialized command to the Raft log and returns
 // the index of the appended entry.
 func (cm *PassiveConsensusModule) AppendCommand(command Command) (LogIndex, error) {
@@ -291,6 +389,11 @@ func (cm *PassiveConsensusModule) becomeCandidateAndBeginElection() error {
 	if err != nil {
 		return err
 	}
+	// The new term and vote must be durable before other servers see them
+	err = cm.syncState()
+	if err != nil {
+		return err
+	}
 	lastLogIndex, lastLogTerm, err := GetIndexAndTermOfLastEntry(cm.logRO)
 	if err != nil {
 		return err
@@ -364,6 +467,8 @@ func (cm *PassiveConsensusModule) sendAppendEntriesToAllPeers(empty bool) error
 // set commitIndex = N (#5.3, #5.4)
 func (cm *PassiveConsensusModule) advanceCommitIndexIfPossible() error {
 	commitIndex := cm.commitIndex.Get()
+	// #10.2.1: the leader only counts itself once its own entries are durable
+	cm.LeaderVolatileState.SetSelfMatchIndex(cm.getIndexOfLastDurableEntry())
 	newerCommitIndex, err := cm.LeaderVolatileState.FindNewerCommitIndex(
 		cm.ClusterInfo,
 		cm.logRO,
@@ -14,6 +14,7 @@ import (
 	"github.com/divtxt/raft/consensus/follower"
 	"github.com/divtxt/raft/inmemlog"
 	"github.com/divtxt/raft/internal"
+	"github.com/divtxt/raft/logindex"
 	"github.com/divtxt/raft/rps"
 	"github.com/divtxt/raft/testdata"
 	"github.com/divtxt/raft/testhelpers"
@@ -40,7 +41,9 @@ func setupManagedConsensusModuleR2(
 	}
 
 	mrs := testhelpers.NewMockRpcSender()
-	aes := aesender.NewLogOnlyAESender(iml, mrs.SendOnlyRpcAppendEntriesAsync)
+	aes := aesender.NewLogOnlyAESender(
+		iml, mrs.SendOnlyRpcAppendEntriesAsync,
+	)
 	var allServerIds []ServerId
 	if solo {
 		allServerIds = []ServerId{testdata.ThisServerId}
@@ -662,6 +665,150 @@ func TestCM_SOLO_Leader_TickAdvancesCommitIndexIfPossible(t *testing.T) {
 	mrs.ClearSentRpcs()
 }
 
+// #10.2.1: The leader can write to its disk in parallel with replication,
+// but only counts itself in the majority once its own entries are durable.
+func TestCM_SOLO_Leader_AsyncLog_CountsSelfOnlyWhenDurable(t *testing.T) {
+	var err error
+	mcm, mrs := testSetupMCM_SOLO_Leader_WithTerms(
+		t, testdata.TestUtil_MakeFigure7LeaderLineTerms(), 0,
+	)
+
+	// Simulate an AsyncLog whose appended entries are not yet durable
+	durable := logindex.NewWatchedIndex()
+	err = durable.Set(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mcm.pcm.indexOfLastDurableEntry = durable
+
+	li11, err := mcm.pcm.AppendCommand(testhelpers.DummyCommand(11))
+	if err != nil || li11 != 11 {
+		t.Fatal()
+	}
+	li12, err := mcm.pcm.AppendCommand(testhelpers.DummyCommand(12))
+	if err != nil || li12 != 12 {
+		t.Fatal()
+	}
+
+	// tick cannot advance commitIndex since the leader is the only match
+	err = mcm.Tick()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mcm.pcm.GetCommitIndex() != 0 {
+		t.Fatal(mcm.pcm.GetCommitIndex())
+	}
+	if smi := mcm.pcm.LeaderVolatileState.GetSelfMatchIndex(); smi != 10 {
+		t.Fatal(smi)
+	}
+	mcm.iw.CheckCalls()
+
+	// durability notification advances commitIndex without a tick
+	err = durable.Set(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mcm.pcm.IndexOfLastDurableEntryChanged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mcm.pcm.GetCommitIndex() != 11 {
+		t.Fatal(mcm.pcm.GetCommitIndex())
+	}
+	mcm.iw.CheckCalls("->11")
+
+	err = durable.Set(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mcm.Tick()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mcm.pcm.GetCommitIndex() != 12 {
+		t.Fatal(mcm.pcm.GetCommitIndex())
+	}
+	mcm.iw.CheckCalls("->12")
+	mrs.CheckSentRpcs(t, map[ServerId]interface{}{})
+}
+
+// bufferedTestState simulates a BufferedRaftPersistentState by tracking changes
+// that have not been synced.
+type bufferedTestState struct {
+	RaftPersistentState
+	pending bool
+	syncs   int
+}
+
+func (bts *bufferedTestState) SetCurrentTerm(currentTerm TermNo) error {
+	bts.pending = true
+	return bts.RaftPersistentState.SetCurrentTerm(currentTerm)
+}
+
+func (bts *bufferedTestState) SetVotedFor(votedFor ServerId) error {
+	bts.pending = true
+	return bts.RaftPersistentState.SetVotedFor(votedFor)
+}
+
+func (bts *bufferedTestState) SyncState() error {
+	if bts.pending {
+		bts.pending = false
+		bts.syncs++
+	}
+	return nil
+}
+
+func TestCM_BufferedState_SyncedBeforeOtherServersSeeIt(t *testing.T) {
+	mcm, mrs := testSetupMCM_Follower_Figure7LeaderLine(t)
+	bts := &bufferedTestState{mcm.pcm.RaftPersistentState, false, 0}
+	mcm.pcm.RaftPersistentState = bts
+	mcm.pcm.bufferedState = bts
+	sendOnlyRpcRequestVoteAsync := mcm.pcm.sendOnlyRpcRequestVoteAsync
+	mcm.pcm.sendOnlyRpcRequestVoteAsync = func(toServer ServerId, rpc *RpcRequestVote) {
+		if bts.pending {
+			t.Fatal("RequestVote sent before the new term was synced")
+		}
+		sendOnlyRpcRequestVoteAsync(toServer, rpc)
+	}
+
+	// A candidate syncs its new term and its vote for itself together
+	mcm.tickTilElectionTimeout(t)
+	if mcm.pcm.GetServerState() != CANDIDATE {
+		t.Fatal()
+	}
+	if bts.pending || bts.syncs != 1 {
+		t.Fatal(bts.pending, bts.syncs)
+	}
+	mrs.ClearSentRpcs()
+
+	// A vote is synced before the reply
+	serverTerm := mcm.pcm.RaftPersistentState.GetCurrentTerm()
+	requestVote := &RpcRequestVote{serverTerm + 1, 10, 6}
+	reply, err := mcm.Rpc_RpcRequestVote(102, requestVote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply, &RpcRequestVoteReply{serverTerm + 1, true}) {
+		t.Fatal(reply)
+	}
+	if bts.pending || bts.syncs != 2 {
+		t.Fatal(bts.pending, bts.syncs)
+	}
+
+	// A new term from a leader is synced before the reply
+	appendEntries := &RpcAppendEntries{serverTerm + 2, 10, 6, []LogEntry{}, 0}
+	aeReply, err := mcm.Rpc_RpcAppendEntries(103, appendEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(aeReply, &RpcAppendEntriesReply{serverTerm + 2, true}) {
+		t.Fatal(aeReply)
+	}
+	if bts.pending || bts.syncs != 3 {
+		t.Fatal(bts.pending, bts.syncs)
+	}
+}
+
 func TestCM_SetCommitIndexNotifiesListener(t *testing.T) {
 	f := func(
 		setup func(t *testing.T) (mcm *managedConsensusModule, mrs *testhelpers.MockRpcSender),
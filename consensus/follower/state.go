@@ -1,18 +1,32 @@
 package follower
 
 import (
+	"time"
+
 	. "github.com/divtxt/raft"
 )
 
 // Volatile state on followers
 type FollowerVolatileState struct {
 	leader ServerId
+	// the time of the last AppendEntries accepted from the leader
+	lastLeaderContact time.Time
 }
 
 func NewFollowerVolatileState(leader ServerId) *FollowerVolatileState {
-	return &FollowerVolatileState{leader}
+	return &FollowerVolatileState{leader, time.Time{}}
 }
 
 func (fvs *FollowerVolatileState) GetLeader() ServerId {
 	return fvs.leader
 }
+
+// Get the time of the last AppendEntries accepted from the leader.
+// This is the zero time if there has been none since becoming a follower.
+func (fvs *FollowerVolatileState) GetLastLeaderContact() time.Time {
+	return fvs.lastLeaderContact
+}
+
+func (fvs *FollowerVolatileState) SetLastLeaderContact(t time.Time) {
+	fvs.lastLeaderContact = t
+}
@@ -2,6 +2,7 @@ package follower_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/divtxt/raft/consensus/follower"
 )
@@ -13,6 +14,15 @@ func TestFollowerVolatileState(t *testing.T) {
 		t.Fatal(fvs)
 	}
 
+	if !fvs.GetLastLeaderContact().IsZero() {
+		t.Fatal(fvs)
+	}
+	now := time.Now()
+	fvs.SetLastLeaderContact(now)
+	if fvs.GetLastLeaderContact() != now {
+		t.Fatal(fvs)
+	}
+
 	// Unknown leader
 	fvs = follower.NewFollowerVolatileState(0)
 	if fvs.GetLeader() != 0 {
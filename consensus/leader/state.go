@@ -12,16 +12,23 @@ import (
 // (Reinitialized after election)
 type LeaderVolatileState struct {
 	followerManagers map[ServerId]*FollowerManager
+
+	// index of highest log entry known to be durable in the leader's own log
+	selfMatchIndex LogIndex
 }
 
 func (lvs *LeaderVolatileState) GoString() string {
 	return fmt.Sprintf(
-		"&LeaderVolatileState{followerManagers: %#v}",
+		"&LeaderVolatileState{followerManagers: %#v, selfMatchIndex: %v}",
 		lvs.followerManagers,
+		lvs.selfMatchIndex,
 	)
 }
 
 // New instance set up for a fresh leader
+//
+// The leader's own matchIndex starts at indexOfLastEntry i.e. the entries
+// are assumed to be durable. Use SetSelfMatchIndex if this is not the case.
 func NewLeaderVolatileState(
 	clusterInfo *config.ClusterInfo,
 	indexOfLastEntry LogIndex,
@@ -29,6 +36,7 @@ func NewLeaderVolatileState(
 ) *LeaderVolatileState {
 	lvs := &LeaderVolatileState{
 		make(map[ServerId]*FollowerManager),
+		indexOfLastEntry,
 	}
 
 	clusterInfo.ForEachPeer(
@@ -60,6 +68,19 @@ func (lvs *LeaderVolatileState) GetFollowerManager(peerId ServerId) (*FollowerMa
 	return fm, nil
 }
 
+// Set the leader's own matchIndex.
+//
+// This is the index of the last entry that is durable in the leader's log.
+// Unlike the matchIndex of a follower, this may decrease.
+func (lvs *LeaderVolatileState) SetSelfMatchIndex(li LogIndex) {
+	lvs.selfMatchIndex = li
+}
+
+// Get the leader's own matchIndex.
+func (lvs *LeaderVolatileState) GetSelfMatchIndex() LogIndex {
+	return lvs.selfMatchIndex
+}
+
 // Helper for tests
 func (lvs *LeaderVolatileState) NextIndexes() map[ServerId]LogIndex {
 	m := make(map[ServerId]LogIndex)
@@ -84,6 +105,8 @@ func (lvs *LeaderVolatileState) MatchIndexes() map[ServerId]LogIndex {
 // #RFS-L4: If there exists an N such that N > commitIndex, a majority
 // of matchIndex[i] >= N, and log[N].term == currentTerm:
 // set commitIndex = N (#5.3, #5.4)
+// The leader counts itself only if its own log entry at N is durable
+// i.e. if selfMatchIndex >= N (#10.2.1).
 func (lvs *LeaderVolatileState) FindNewerCommitIndex(
 	ci *config.ClusterInfo,
 	log internal.LogTailRO,
@@ -110,7 +133,10 @@ func (lvs *LeaderVolatileState) FindNewerCommitIndex(
 			continue
 		}
 		// finally, check for majority of matchIndex
-		var foundMatches uint = 1 // 1 because we already match!
+		var foundMatches uint = 0
+		if lvs.selfMatchIndex >= N {
+			foundMatches++
+		}
 		for _, fm := range lvs.followerManagers {
 			if fm.getMatchIndex() >= N {
 				foundMatches++
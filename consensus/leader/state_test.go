@@ -43,6 +43,9 @@ func TestLeaderVolatileState(t *testing.T) {
 	if !reflect.DeepEqual(lvs.MatchIndexes(), expectedMatchIndex) {
 		t.Fatal(lvs.MatchIndexes())
 	}
+	if lvs.GetSelfMatchIndex() != 42 {
+		t.Fatal(lvs.GetSelfMatchIndex())
+	}
 
 	// GetFollowerManager
 	fm101, err := lvs.GetFollowerManager(101)
@@ -441,3 +444,53 @@ func (maes *mockAESender) SendAppendEntriesToPeerAsync(
 	maes.params = &params
 	return nil
 }
+
+func TestFindNewerCommitIndex_SelfMatchIndex(t *testing.T) {
+	ci, err := config.NewClusterInfo([]ServerId{101, 102, 103}, 101)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	terms := []TermNo{1, 1, 1, 1}
+	imle, err := inmemlog.TestUtil_NewInMemoryLog_WithTerms(terms, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lvs := NewLeaderVolatileState(ci, LogIndex(len(terms)), nil)
+
+	_findNewerCommitIndex := func() LogIndex {
+		nci, err := lvs.FindNewerCommitIndex(ci, imle, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nci
+	}
+
+	// entries not yet durable on the leader
+	lvs.SetSelfMatchIndex(1)
+	err = setMatchIndexAndNextIndex(lvs, 102, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// leader only counts itself up to selfMatchIndex
+	if nci := _findNewerCommitIndex(); nci != 1 {
+		t.Fatal(nci)
+	}
+
+	// leader's entries become durable
+	lvs.SetSelfMatchIndex(4)
+	if nci := _findNewerCommitIndex(); nci != 3 {
+		t.Fatal(nci)
+	}
+
+	// a majority of followers does not need the leader
+	lvs.SetSelfMatchIndex(0)
+	err = setMatchIndexAndNextIndex(lvs, 103, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nci := _findNewerCommitIndex(); nci != 2 {
+		t.Fatal(nci)
+	}
+}
@@ -28,11 +28,16 @@ func (cm *PassiveConsensusModule) Rpc_RpcAppendEntries(
 		return nil, fmt.Errorf("FATAL: 'from' serverId %v is not in the cluster", from)
 	}
 
-	makeReply := func(success bool) *RpcAppendEntriesReply {
+	// Any change to currentTerm and votedFor must be durable before replying
+	makeReply := func(success bool) (*RpcAppendEntriesReply, error) {
+		err := cm.syncState()
+		if err != nil {
+			return nil, err
+		}
 		return &RpcAppendEntriesReply{
 			cm.RaftPersistentState.GetCurrentTerm(), // refetch in case it has changed!
 			success,
-		}
+		}, nil
 	}
 
 	serverTerm := cm.RaftPersistentState.GetCurrentTerm()
@@ -41,7 +46,7 @@ func (cm *PassiveConsensusModule) Rpc_RpcAppendEntries(
 
 	// 1. Reply false if term < currentTerm (#5.1)
 	if leaderCurrentTerm < serverTerm {
-		return makeReply(false), nil
+		return makeReply(false)
 	}
 
 	// Extra: raft violation - two leaders with same term
@@ -79,30 +84,70 @@ func (cm *PassiveConsensusModule) Rpc_RpcAppendEntries(
 	// term matches prevLogTerm (#5.3)
 	iole := cm.logRO.GetIndexOfLastEntry()
 	if iole < prevLogIndex {
-		return makeReply(false), nil
+		return makeReply(false)
+	}
+	commitIndex := cm.commitIndex.Get()
+	if prevLogIndex > 0 {
+		match, err := cm.hasEntryWithTerm(prevLogIndex, appendEntries.PrevLogTerm, commitIndex)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			return makeReply(false)
+		}
 	}
 
+	// Extra: record the contact for follower reads only once the log matches the
+	// leader's up to prevLogIndex, since the entries the leader sends next are
+	// what bring this server up to date.
+	cm.FollowerVolatileState.SetLastLeaderContact(cm.nowFunc())
+
 	// 3. If an existing entry conflicts with a new one (same index
 	// but different terms), delete the existing entry and all that
 	// follow it (#5.3)
 	// 4. Append any new entries not already in the log
-	err = cm.setEntriesAfterIndex(prevLogIndex, appendEntries.Entries)
-	if err != nil {
-		return nil, err
+	// Existing entries that match are kept since this could be an old RPC that
+	// was delayed, and the log may already have more entries from this leader.
+	for i, entry := range appendEntries.Entries {
+		li := prevLogIndex + LogIndex(i) + 1
+		if li <= iole {
+			match, err := cm.hasEntryWithTerm(li, entry.TermNo, commitIndex)
+			if err != nil {
+				return nil, err
+			}
+			if match {
+				continue
+			}
+		}
+		err = cm.setEntriesAfterIndex(li-1, appendEntries.Entries[i:])
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	// Extra: a success reply tells the leader that the entries up to the index
+	// of last new entry are durable, but entries that were appended to an
+	// AsyncLog while this server was the leader may still be in flight even if
+	// they match. SetEntriesAfterIndex makes them durable without deleting any.
+	indexOfLastNewEntry := prevLogIndex + LogIndex(len(appendEntries.Entries))
+	if cm.getIndexOfLastDurableEntry() < indexOfLastNewEntry {
+		err = cm.setEntriesAfterIndex(cm.logRO.GetIndexOfLastEntry(), nil)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// 5. If leaderCommit > commitIndex, set commitIndex = min(leaderCommit,
 	// index of last new entry)
 	leaderCommit := appendEntries.LeaderCommit
-	if leaderCommit > cm.commitIndex.Get() {
-		var indexOfLastNewEntry LogIndex
-		indexOfLastNewEntry = cm.logRO.GetIndexOfLastEntry()
+	if leaderCommit > commitIndex {
 		if leaderCommit < indexOfLastNewEntry {
 			err = cm.setCommitIndex(leaderCommit)
 			if err != nil {
 				return nil, err
 			}
-		} else {
+		} else if indexOfLastNewEntry > commitIndex {
 			err = cm.setCommitIndex(indexOfLastNewEntry)
 			if err != nil {
 				return nil, err
@@ -110,5 +155,23 @@ func (cm *PassiveConsensusModule) Rpc_RpcAppendEntries(
 		}
 	}
 
-	return makeReply(true), nil
+	return makeReply(true)
+}
+
+// Check if the log has an entry at the given index with the given term.
+//
+// Entries up to commitIndex may have been compacted, and are assumed to match
+// since committed entries are in the log of every later leader (#5.4.3).
+//
+func (cm *PassiveConsensusModule) hasEntryWithTerm(
+	li LogIndex, term TermNo, commitIndex LogIndex,
+) (bool, error) {
+	t, err := cm.logRO.GetTermAtIndex(li)
+	if err == ErrIndexCompacted && li <= commitIndex {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return t == term, nil
 }
@@ -1,9 +1,13 @@
 package consensus
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
 	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/internal"
+	"github.com/divtxt/raft/logindex"
 	"github.com/divtxt/raft/testhelpers"
 )
 
@@ -79,9 +83,6 @@ func TestCM_RpcAE_LeaderTermLessThanCurrentTerm(t *testing.T) {
 
 // 2. Reply false if log doesn't contain an entry at prevLogIndex whose term
 //      matches prevLogTerm (#5.3)
-// Note: the above language is slightly ambiguous but I'm assuming that this
-// step refers strictly to the follower's log not having any entry at
-// prevLogIndex since step 3 covers the alternate conflicting entry case.
 // Note: this test based on Figure 7, server (b)
 func TestCM_RpcAE_NoMatchingLogEntry(t *testing.T) {
 	f := func(
@@ -165,6 +166,40 @@ func TestCM_RpcAE_NoMatchingLogEntry(t *testing.T) {
 	)
 }
 
+// 2. (continued) The log has an entry at prevLogIndex but its term does not
+// match prevLogTerm.
+// Note: this test based on Figure 7, server (f)
+func TestCM_RpcAE_PrevLogTermMismatch(t *testing.T) {
+	mcm, _ := testSetupMCM_Follower_WithTerms(t, []TermNo{1, 1, 1, 2, 2, 2, 3, 3, 3, 3, 3})
+	serverTerm := mcm.pcm.RaftPersistentState.GetCurrentTerm()
+
+	appendEntries := &RpcAppendEntries{
+		serverTerm,
+		5,
+		4,
+		[]LogEntry{{4, Command("c6")}},
+		0,
+	}
+
+	reply, err := mcm.Rpc_RpcAppendEntries(103, appendEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mcm.iw.CheckCalls()
+
+	expectedRpc := RpcAppendEntriesReply{serverTerm, false}
+	if *reply != expectedRpc {
+		t.Fatal(reply)
+	}
+	// The log is not modified
+	if iole := mcm.pcm.logRO.GetIndexOfLastEntry(); iole != 11 {
+		t.Fatal(iole)
+	}
+	if term, err := mcm.pcm.logRO.GetTermAtIndex(6); err != nil || term != 2 {
+		t.Fatal(term, err)
+	}
+}
+
 // 3. If an existing entry conflicts with a new one (same index
 // but different terms), delete the existing entry and all that
 // follow it (#5.3)
@@ -445,17 +480,197 @@ func TestCM_RpcAE_LessThanCommitIndex(t *testing.T) {
 			senderTerm,
 			5,
 			4,
-			[]LogEntry{{5, Command("c601")}, {5, Command("c701")}, {6, Command("c801")}},
+			[]LogEntry{{6, Command("c601")}, {6, Command("c701")}, {6, Command("c801")}},
 			7,
 		}
 
 		_, err = mcm.Rpc_RpcAppendEntries(104, appendEntries)
-		if err.Error() != "FATAL: setEntriesAfterIndex(5, ...) but commitIndex=6" {
+		if err == nil || err.Error() != "FATAL: setEntriesAfterIndex(5, ...) but commitIndex=6" {
 			t.Fatal(err)
 		}
 		mcm.iw.CheckCalls()
+
+		// Entries that match the log are not modified e.g. for a delayed RPC
+		appendEntries.Entries = []LogEntry{{5, Command("c601")}, {5, Command("c701")}}
+		reply, err := mcm.Rpc_RpcAppendEntries(104, appendEntries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reply.Success {
+			t.Fatal(reply)
+		}
+		if iole := mcm.pcm.logRO.GetIndexOfLastEntry(); iole != 10 {
+			t.Fatal(iole)
+		}
+		mcm.iw.CheckCalls("->7")
 	}
 
 	f(testSetupMCM_Follower_Figure7LeaderLine)
 	f(testSetupMCM_Candidate_Figure7LeaderLine)
 }
+
+// asyncTestLog simulates the SetEntriesAfterIndex of an AsyncLog by making every
+// entry durable.
+type asyncTestLog struct {
+	internal.LogTailWO
+	logRO   internal.LogTailRO
+	durable *logindex.WatchedIndex
+	calls   []LogIndex
+}
+
+func (atl *asyncTestLog) SetEntriesAfterIndex(li LogIndex, entries []LogEntry) error {
+	atl.calls = append(atl.calls, li)
+	err := atl.LogTailWO.SetEntriesAfterIndex(li, entries)
+	if err != nil {
+		return err
+	}
+	return atl.durable.Set(atl.logRO.GetIndexOfLastEntry())
+}
+
+// Extra: entries that match but are not yet durable in an AsyncLog are made
+// durable before a success reply.
+func TestCM_RpcAE_AsyncLog_MatchingEntriesMadeDurable(t *testing.T) {
+	mcm, _ := testSetupMCM_Follower_Figure7LeaderLine(t)
+	serverTerm := mcm.pcm.RaftPersistentState.GetCurrentTerm()
+
+	// Simulate entries 9 and 10 still being written from when this server
+	// was the leader
+	durable := logindex.NewWatchedIndex()
+	err := durable.Set(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mcm.pcm.indexOfLastDurableEntry = durable
+	atl := &asyncTestLog{mcm.pcm.logWO, mcm.pcm.logRO, durable, nil}
+	mcm.pcm.logWO = atl
+
+	// Matching entries up to a durable index need no sync
+	appendEntries := &RpcAppendEntries{
+		serverTerm, 4, 4, []LogEntry{{4, Command("c5")}, {5, Command("c6")}}, 0,
+	}
+	reply, err := mcm.Rpc_RpcAppendEntries(102, appendEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Success || len(atl.calls) != 0 {
+		t.Fatal(reply, atl.calls)
+	}
+
+	// A heartbeat after entries that are not durable
+	reply, err = mcm.Rpc_RpcAppendEntries(102, makeAEWithTermAndPrevLogDetails(serverTerm, 10, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Success || !reflect.DeepEqual(atl.calls, []LogIndex{10}) {
+		t.Fatal(reply, atl.calls)
+	}
+	if iole := mcm.pcm.logRO.GetIndexOfLastEntry(); iole != 10 || durable.Get() != 10 {
+		t.Fatal(iole, durable.Get())
+	}
+
+	// Matching entries that are not durable
+	err = durable.Set(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atl.calls = nil
+	appendEntries = &RpcAppendEntries{
+		serverTerm, 7, 5, []LogEntry{{6, Command("c8")}, {6, Command("c9")}}, 0,
+	}
+	reply, err = mcm.Rpc_RpcAppendEntries(102, appendEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Success || !reflect.DeepEqual(atl.calls, []LogIndex{10}) {
+		t.Fatal(reply, atl.calls)
+	}
+
+	// No second sync when new entries were written
+	err = durable.Set(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atl.calls = nil
+	appendEntries = &RpcAppendEntries{
+		serverTerm, 10, 6, []LogEntry{{serverTerm, Command("c11")}}, 0,
+	}
+	reply, err = mcm.Rpc_RpcAppendEntries(102, appendEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Success || !reflect.DeepEqual(atl.calls, []LogIndex{10}) {
+		t.Fatal(reply, atl.calls)
+	}
+	if durable.Get() != 11 {
+		t.Fatal(durable.Get())
+	}
+}
+
+// Extra: the time of the last AppendEntries from the current leader is recorded
+// for follower reads.
+func TestCM_RpcAE_LastLeaderContact(t *testing.T) {
+	// Follower
+	mcm, _ := testSetupMCM_Follower_Figure7LeaderLine(t)
+	serverTerm := mcm.pcm.RaftPersistentState.GetCurrentTerm()
+	if !mcm.pcm.GetLastLeaderContact().IsZero() {
+		t.Fatal(mcm.pcm.GetLastLeaderContact())
+	}
+	// Not from the current leader
+	_, err := mcm.Rpc_RpcAppendEntries(102, makeAEWithTerm(serverTerm-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mcm.pcm.GetLastLeaderContact().IsZero() {
+		t.Fatal(mcm.pcm.GetLastLeaderContact())
+	}
+	// Not recorded if the log does not match
+	_, err = mcm.Rpc_RpcAppendEntries(102, makeAEWithTermAndPrevLogDetails(serverTerm, 20, serverTerm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mcm.pcm.GetLastLeaderContact().IsZero() {
+		t.Fatal(mcm.pcm.GetLastLeaderContact())
+	}
+	_, err = mcm.Rpc_RpcAppendEntries(102, makeAEWithTermAndPrevLogDetails(serverTerm, 10, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mcm.pcm.GetLastLeaderContact().IsZero() {
+		t.Fatal(mcm.pcm.GetLastLeaderContact())
+	}
+	_, err = mcm.Rpc_RpcAppendEntries(102, makeAEWithTermAndPrevLogDetails(serverTerm, 10, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mcm.pcm.GetLastLeaderContact() != mcm.cc.now() {
+		t.Fatal(mcm.pcm.GetLastLeaderContact(), mcm.cc.now())
+	}
+	mcm.cc.advance(time.Millisecond)
+	_, err = mcm.Rpc_RpcAppendEntries(102, makeAEWithTerm(serverTerm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mcm.pcm.GetLastLeaderContact() != mcm.cc.now() {
+		t.Fatal(mcm.pcm.GetLastLeaderContact(), mcm.cc.now())
+	}
+
+	// Candidate
+	mcm, _ = testSetupMCM_Candidate_Figure7LeaderLine(t)
+	serverTerm = mcm.pcm.RaftPersistentState.GetCurrentTerm()
+	if !mcm.pcm.GetLastLeaderContact().IsZero() {
+		t.Fatal(mcm.pcm.GetLastLeaderContact())
+	}
+	_, err = mcm.Rpc_RpcAppendEntries(102, makeAEWithTerm(serverTerm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mcm.pcm.GetServerState() != FOLLOWER || mcm.pcm.GetLastLeaderContact() != mcm.cc.now() {
+		t.Fatal(mcm.pcm.GetServerState(), mcm.pcm.GetLastLeaderContact())
+	}
+
+	// Leader
+	mcm, _ = testSetupMCM_Leader_Figure7LeaderLine(t)
+	if !mcm.pcm.GetLastLeaderContact().IsZero() {
+		t.Fatal(mcm.pcm.GetLastLeaderContact())
+	}
+}
@@ -26,11 +26,16 @@ func (cm *PassiveConsensusModule) Rpc_RpcRequestVote(
 		return nil, fmt.Errorf("FATAL: 'from' serverId %v is not in the cluster", from)
 	}
 
-	makeReply := func(voteGranted bool) *RpcRequestVoteReply {
+	// Any change to currentTerm and votedFor must be durable before replying
+	makeReply := func(voteGranted bool) (*RpcRequestVoteReply, error) {
+		err := cm.syncState()
+		if err != nil {
+			return nil, err
+		}
 		return &RpcRequestVoteReply{
 			cm.RaftPersistentState.GetCurrentTerm(), // refetch in case it has changed!
 			voteGranted,
-		}
+		}, nil
 	}
 
 	serverTerm := cm.RaftPersistentState.GetCurrentTerm()
@@ -38,7 +43,7 @@ func (cm *PassiveConsensusModule) Rpc_RpcRequestVote(
 
 	// 1. Reply false if term < currentTerm (#5.1)
 	if senderCurrentTerm < serverTerm {
-		return makeReply(false), nil
+		return makeReply(false)
 	}
 
 	// #RFS-A2: If RPC request or response contains term T > currentTerm:
@@ -90,8 +95,8 @@ func (cm *PassiveConsensusModule) Rpc_RpcRequestVote(
 		}
 		// #RFS-F2: (paraphrasing) granting vote should prevent election timeout
 		cm.ElectionTimeoutTimer.Restart()
-		return makeReply(true), nil
+		return makeReply(true)
 	}
 
-	return makeReply(false), nil
+	return makeReply(false)
 }
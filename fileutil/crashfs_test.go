@@ -0,0 +1,162 @@
+package fileutil
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errCrashed = errors.New("crashfs: crashed")
+
+// crashFileSystem is an in-memory fileSystem for crash-consistency tests.
+//
+// It tracks what has reached stable storage: the contents of a file are only
+// durable after the file is synced, and the directory entries are only durable
+// after the directory is synced.
+//
+// After crashAfter operations every operation fails with errCrashed, as if the
+// machine had stopped. powerLoss then returns the state seen after a restart.
+type crashFileSystem struct {
+	crashAfter int // -1 to never crash
+	ops        int
+	numTemp    int
+
+	entries        map[string]*crashInode
+	durableEntries map[string]*crashInode
+}
+
+type crashInode struct {
+	data        []byte
+	durableData []byte
+}
+
+type crashFile struct {
+	cfs   *crashFileSystem
+	name  string
+	inode *crashInode
+}
+
+func newCrashFileSystem() *crashFileSystem {
+	return &crashFileSystem{-1, 0, 0, map[string]*crashInode{}, map[string]*crashInode{}}
+}
+
+func (cfs *crashFileSystem) op() error {
+	if cfs.crashAfter >= 0 && cfs.ops >= cfs.crashAfter {
+		return errCrashed
+	}
+	cfs.ops++
+	return nil
+}
+
+// powerLoss returns the file system as it would be after a restart.
+//
+// Writes that were not synced may or may not have reached stable storage, so
+// keepEntries and keepData select whether the unsynced directory entries and
+// unsynced file contents survive.
+func (cfs *crashFileSystem) powerLoss(keepEntries, keepData bool) *crashFileSystem {
+	entries := cfs.durableEntries
+	if keepEntries {
+		entries = cfs.entries
+	}
+	inodes := map[*crashInode]*crashInode{}
+	after := newCrashFileSystem()
+	after.numTemp = cfs.numTemp
+	for name, inode := range entries {
+		newInode, ok := inodes[inode]
+		if !ok {
+			data := inode.durableData
+			if keepData {
+				data = inode.data
+			}
+			newInode = &crashInode{data, data}
+			inodes[inode] = newInode
+		}
+		after.entries[name] = newInode
+		after.durableEntries[name] = newInode
+	}
+	return after
+}
+
+func (cfs *crashFileSystem) TempFile(dir, pattern string) (file, error) {
+	if err := cfs.op(); err != nil {
+		return nil, err
+	}
+	cfs.numTemp++
+	name := filepath.Join(dir, strings.Replace(pattern, "*", strconv.Itoa(cfs.numTemp), 1))
+	inode := &crashInode{}
+	cfs.entries[name] = inode
+	return &crashFile{cfs, name, inode}, nil
+}
+
+func (cfs *crashFileSystem) ReadFile(filename string) ([]byte, error) {
+	if err := cfs.op(); err != nil {
+		return nil, err
+	}
+	inode, ok := cfs.entries[filename]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), inode.data...), nil
+}
+
+func (cfs *crashFileSystem) Rename(oldpath, newpath string) error {
+	if err := cfs.op(); err != nil {
+		return err
+	}
+	inode, ok := cfs.entries[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	delete(cfs.entries, oldpath)
+	cfs.entries[newpath] = inode
+	return nil
+}
+
+func (cfs *crashFileSystem) Remove(name string) error {
+	if err := cfs.op(); err != nil {
+		return err
+	}
+	if _, ok := cfs.entries[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(cfs.entries, name)
+	return nil
+}
+
+func (cfs *crashFileSystem) SyncDir(dirname string) error {
+	if err := cfs.op(); err != nil {
+		return err
+	}
+	// All the test files are in a single directory
+	cfs.durableEntries = map[string]*crashInode{}
+	for name, inode := range cfs.entries {
+		cfs.durableEntries[name] = inode
+	}
+	return nil
+}
+
+func (cf *crashFile) Name() string {
+	return cf.name
+}
+
+func (cf *crashFile) Write(b []byte) (int, error) {
+	if err := cf.cfs.op(); err != nil {
+		return 0, err
+	}
+	cf.inode.data = append(cf.inode.data, b...)
+	return len(b), nil
+}
+
+func (cf *crashFile) Sync() error {
+	if err := cf.cfs.op(); err != nil {
+		return err
+	}
+	cf.inode.durableData = append([]byte(nil), cf.inode.data...)
+	return nil
+}
+
+func (cf *crashFile) Close() error {
+	return cf.cfs.op()
+}
@@ -0,0 +1,74 @@
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// fileSystem is the set of file operations used by atomicJsonFile.
+//
+// This allows tests to substitute a file system that can simulate a crash.
+type fileSystem interface {
+	TempFile(dir, pattern string) (file, error)
+	ReadFile(filename string) ([]byte, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	SyncDir(dirname string) error
+}
+
+type file interface {
+	Name() string
+	Write(b []byte) (int, error)
+	Sync() error
+	Close() error
+}
+
+// osFileSystem is the real file system.
+type osFileSystem struct{}
+
+// tempFileCounter makes the names of temp files unique within the process.
+var tempFileCounter uint64
+
+// TempFile creates a new file like ioutil.TempFile, but with mode 0666 (before
+// umask) like ioutil.WriteFile instead of 0600, so that the file it replaces
+// keeps the usual permissions.
+func (osFileSystem) TempFile(dir, pattern string) (file, error) {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	for {
+		random := strconv.FormatInt(time.Now().UnixNano(), 36) + "-" +
+			strconv.FormatUint(atomic.AddUint64(&tempFileCounter, 1), 36)
+		name := filepath.Join(dir, prefix+random+suffix)
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+}
+
+func (osFileSystem) ReadFile(filename string) ([]byte, error) {
+	return ioutil.ReadFile(filename)
+}
+
+func (osFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFileSystem) SyncDir(dirname string) error {
+	return SyncDir(dirname)
+}
@@ -2,22 +2,31 @@ package fileutil
 
 import (
 	"encoding/json"
-	"io/ioutil"
-	"os"
+	"errors"
+	"hash/crc32"
+	"path/filepath"
 )
 
-// AtomicJsonFile is a simple API to atomically read and write a json file.
+// AtomicJsonFile is a simple API to atomically and durably read and write a json file.
 //
-// The atomic write is done by writing to a file named "<filename>.new"
-// and then renaming it to "<filename>" after the write is complete.
+// The atomic write is done by writing to a uniquely named temp file "<filename>.new-*"
+// in the same directory, syncing it to stable storage, renaming it to "<filename>"
+// and then syncing the directory.
 //
 // Assuming all writers use the same method to write the file, this method ensures
 // that readers will always see a "<filename>" that contains valid complete json
 // since empty or partially written files, due to in progress or crashed writes, will
-// never affect the original file.
+// never affect the original file. Once Write returns successfully the new contents
+// will survive a crash or power loss.
 //
-// However, because this uses the same temp file name for all writers, this is
-// NOT safe for concurrent writes. (One writer may rename another's partially written file)
+// The json is stored with a CRC32C checksum, and Read returns ErrChecksumMismatch
+// if the file does not match its checksum. A file without a checksum - i.e. one
+// written by an older version, whose top-level object has neither the "data" nor
+// the "crc32c" key - is read as plain json. A file with only one of these keys is
+// treated as a checksum mismatch.
+//
+// Each writer uses its own temp file, but concurrent writes are still unsafe in the
+// sense that the last rename wins. A crashed write may leave its temp file behind.
 //
 type AtomicJsonFile interface {
 	// Read the JSON-encoded data in the wrapped file and
@@ -28,22 +37,57 @@ type AtomicJsonFile interface {
 	Write(v interface{}) error
 }
 
+// ErrChecksumMismatch is returned by AtomicJsonFile.Read if the contents of
+// the file do not match the stored checksum.
+var ErrChecksumMismatch = errors.New("AtomicJsonFile: checksum mismatch")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksummedJson is the json that is actually stored in the file.
+type checksummedJson struct {
+	Data   json.RawMessage `json:"data"`
+	Crc32c uint32          `json:"crc32c"`
+}
+
 type atomicJsonFile struct {
-	filename    string
-	filenameTmp string
+	filename string
+	fs       fileSystem
 }
 
 // Create an AtomicJsonFile for the given file.
 func NewAtomicJsonFile(filename string) AtomicJsonFile {
-	return &atomicJsonFile{filename, filename + ".new"}
+	return &atomicJsonFile{filename, osFileSystem{}}
 }
 
 func (ajf *atomicJsonFile) Read(v interface{}) error {
-	data, err := ioutil.ReadFile(ajf.filename)
+	data, err := ajf.fs.ReadFile(ajf.filename)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(data, v)
+	checksummedData, hasData := fields["data"]
+	crcField, hasCrc := fields["crc32c"]
+	if !hasData && !hasCrc {
+		// No checksum - read as plain json
+		return json.Unmarshal(data, v)
+	}
+	if !hasData || !hasCrc {
+		// Part of the checksummed json is missing
+		return ErrChecksumMismatch
+	}
+	var crc uint32
+	err = json.Unmarshal(crcField, &crc)
+	if err != nil {
+		return ErrChecksumMismatch
+	}
+	if crc32.Checksum(checksummedData, crc32cTable) != crc {
+		return ErrChecksumMismatch
+	}
+	err = json.Unmarshal(checksummedData, v)
 	if err != nil {
 		return err
 	}
@@ -55,9 +99,38 @@ func (ajf *atomicJsonFile) Write(v interface{}) error {
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(ajf.filenameTmp, data, 0666)
+	data, err = json.Marshal(checksummedJson{data, crc32.Checksum(data, crc32cTable)})
+	if err != nil {
+		return err
+	}
+
+	dir, base := filepath.Split(ajf.filename)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ajf.fs.TempFile(dir, base+".new-*")
+	if err != nil {
+		return err
+	}
+	tmpFilename := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = ajf.fs.Remove(tmpFilename)
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		_ = ajf.fs.Remove(tmpFilename)
+		return err
+	}
+	err = ajf.fs.Rename(tmpFilename, ajf.filename)
 	if err != nil {
+		_ = ajf.fs.Remove(tmpFilename)
 		return err
 	}
-	return os.Rename(ajf.filenameTmp, ajf.filename)
+	return ajf.fs.SyncDir(dir)
 }
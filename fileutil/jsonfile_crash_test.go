@@ -0,0 +1,98 @@
+package fileutil
+
+import (
+	"testing"
+)
+
+type crashTestStruct struct {
+	Value int `json:"value"`
+}
+
+const crashTestFile = "dir/state.json"
+
+// Return a crashFileSystem with crashTestFile durably written with the given value.
+func makeCrashTestFileSystem(t *testing.T, value int) *crashFileSystem {
+	cfs := newCrashFileSystem()
+	ajf := &atomicJsonFile{crashTestFile, cfs}
+	err := ajf.Write(&crashTestStruct{value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A completed write survives a power loss
+	cfs = cfs.powerLoss(false, false)
+	checkCrashTestValue(t, cfs, value)
+	return cfs
+}
+
+func checkCrashTestValue(t *testing.T, cfs *crashFileSystem, expectedValues ...int) {
+	var v crashTestStruct
+	err := (&atomicJsonFile{crashTestFile, cfs}).Read(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expectedValue := range expectedValues {
+		if v.Value == expectedValue {
+			return
+		}
+	}
+	t.Fatal(v.Value, expectedValues)
+}
+
+// Simulate a power loss at every step of AtomicJsonFile.Write and check that
+// the file always has either the old or the new value, and that it has the new
+// value if Write returned successfully.
+func TestAtomicJsonFile_CrashConsistency(t *testing.T) {
+	// Count the steps in a write
+	cfs := makeCrashTestFileSystem(t, 1)
+	cfs.ops = 0
+	err := (&atomicJsonFile{crashTestFile, cfs}).Write(&crashTestStruct{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	numSteps := cfs.ops
+	if numSteps != 6 {
+		t.Fatal(numSteps)
+	}
+
+	for crashAfter := 0; crashAfter <= numSteps; crashAfter++ {
+		cfs := makeCrashTestFileSystem(t, 1)
+		cfs.ops = 0
+		cfs.crashAfter = crashAfter
+		err := (&atomicJsonFile{crashTestFile, cfs}).Write(&crashTestStruct{2})
+		if (err == nil) != (crashAfter == numSteps) {
+			t.Fatal(crashAfter, err)
+		}
+
+		for _, keepEntries := range []bool{false, true} {
+			for _, keepData := range []bool{false, true} {
+				after := cfs.powerLoss(keepEntries, keepData)
+				if err == nil {
+					checkCrashTestValue(t, after, 2)
+				} else {
+					checkCrashTestValue(t, after, 1, 2)
+				}
+			}
+		}
+	}
+}
+
+func TestAtomicJsonFile_ChecksumMismatch(t *testing.T) {
+	cfs := makeCrashTestFileSystem(t, 1)
+
+	// Change the value without updating the checksum
+	inode := cfs.entries[crashTestFile]
+	data := string(inode.data)
+	if data != `{"data":{"value":1},"crc32c":3699783880}` {
+		t.Fatal(data)
+	}
+	inode.data = []byte(`{"data":{"value":2},"crc32c":3699783880}`)
+
+	var v crashTestStruct
+	err := (&atomicJsonFile{crashTestFile, cfs}).Read(&v)
+	if err != ErrChecksumMismatch {
+		t.Fatal(err)
+	}
+	if v.Value != 0 {
+		t.Fatal(v)
+	}
+}
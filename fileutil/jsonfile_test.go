@@ -31,9 +31,27 @@ func TestAtomicJsonFile_Write(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if bytes.Compare(data, []byte("{\"barBaz\":101}")) != 0 {
+	if bytes.Compare(data, []byte("{\"data\":{\"barBaz\":101},\"crc32c\":475157556}")) != 0 {
 		t.Fatal()
 	}
+
+	// The file has the same mode as one written by ioutil.WriteFile
+	err = ioutil.WriteFile(test_jsonfile+".mode", data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(test_jsonfile + ".mode")
+	fi1, err := os.Stat(test_jsonfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi2, err := os.Stat(test_jsonfile + ".mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi1.Mode() != fi2.Mode() {
+		t.Fatal(fi1.Mode(), fi2.Mode())
+	}
 }
 
 func TestAtomicJsonFile_Read(t *testing.T) {
@@ -67,8 +85,43 @@ func TestAtomicJsonFile_Read(t *testing.T) {
 		t.Fatal(foo)
 	}
 
+	// Read file with bad checksum
+	data = []byte("{\"data\":{\"barBaz\":201},\"crc32c\":475157556}")
+	err = ioutil.WriteFile(test_jsonfile, data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ajf.Read(&foo)
+	if err != fileutil.ErrChecksumMismatch {
+		t.Fatal(err)
+	}
+	if foo.BarBaz != 60 {
+		t.Fatal(foo)
+	}
+
+	// Read file with a damaged or missing part of the checksummed json
+	for _, bad := range []string{
+		"{\"data\":{\"barBaz\":201}}",
+		"{\"crc32c\":2121325837}",
+		"{\"data\":{\"barBaz\":201},\"crc32c\":\"2121325837\"}",
+		"{\"data\":{\"barBaz\":201},\"crc32c\":null}",
+		"{\"data\":null,\"crc32c\":0}",
+	} {
+		err = ioutil.WriteFile(test_jsonfile, []byte(bad), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ajf.Read(&foo)
+		if err != fileutil.ErrChecksumMismatch {
+			t.Fatal(bad, err)
+		}
+		if foo.BarBaz != 60 {
+			t.Fatal(bad, foo)
+		}
+	}
+
 	// Read good file
-	data = []byte("{\"barBaz\": 201}")
+	data = []byte("{\"data\":{\"barBaz\":201},\"crc32c\":2121325837}")
 	err = ioutil.WriteFile(test_jsonfile, data, 0666)
 	if err != nil {
 		t.Fatal(err)
@@ -80,4 +133,18 @@ func TestAtomicJsonFile_Read(t *testing.T) {
 	if foo.BarBaz != 201 {
 		t.Fatal(foo)
 	}
+
+	// Read file without checksum
+	data = []byte("{\"barBaz\": 301}")
+	err = ioutil.WriteFile(test_jsonfile, data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ajf.Read(&foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if foo.BarBaz != 301 {
+		t.Fatal(foo)
+	}
 }
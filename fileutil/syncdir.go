@@ -0,0 +1,22 @@
+package fileutil
+
+import (
+	"os"
+)
+
+// SyncDir commits the directory entries of the given directory to stable storage.
+//
+// Creating, renaming or deleting a file only changes the directory and is not
+// durable until the directory itself has been synced.
+func SyncDir(dirname string) error {
+	d, err := os.Open(dirname)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
@@ -0,0 +1,20 @@
+package fileutil_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/divtxt/raft/fileutil"
+)
+
+func TestSyncDir(t *testing.T) {
+	err := fileutil.SyncDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fileutil.SyncDir("does-not-exist")
+	if !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
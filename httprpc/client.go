@@ -0,0 +1,188 @@
+package httprpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/divtxt/raft"
+)
+
+// Client is an RpcService that sends RPCs as JSON over HTTP to the Handlers of
+// the other servers in the cluster.
+//
+// It follows the notes on the RpcService interface:
+//
+// - There is at most one call in flight to a given peer. A call to a peer
+// that already has a call in flight returns nil immediately.
+//
+// - Every call is limited by callTimeout, and nil is returned for any failure
+// i.e. a connection error, a timeout, a reply with a status other than 200 or a
+// reply without the expected VersionHeader.
+//
+// Connections are reused and reopened by the underlying http.Client.
+//
+type Client struct {
+	thisServerId ServerId
+	httpClient   *http.Client
+	logger       *log.Logger
+
+	peers map[ServerId]*peer // immutable after construction
+}
+
+// Check that Client implements the RpcService interface
+var _ RpcService = (*Client)(nil)
+
+type peer struct {
+	baseUrl string
+
+	mutex    *sync.Mutex
+	inFlight bool
+	closed   bool
+}
+
+// NewClient creates a Client for the given server.
+//
+// baseUrls maps the ServerId of each peer to the URL that its Handler is served
+// at, e.g. "http://10.0.0.2:8080". AppendEntriesPath and RequestVotePath are
+// appended to this URL. It may include thisServerId, which is ignored.
+//
+// callTimeout limits the time for a complete call and should be well under the
+// election timeout.
+//
+func NewClient(
+	thisServerId ServerId,
+	baseUrls map[ServerId]string,
+	callTimeout time.Duration,
+	logger *log.Logger,
+) (*Client, error) {
+	if thisServerId == 0 {
+		return nil, errors.New("thisServerId is 0")
+	}
+	if callTimeout <= 0 {
+		return nil, fmt.Errorf("callTimeout=%v must be greater than zero", callTimeout)
+	}
+	if logger == nil {
+		return nil, errors.New("'logger' cannot be nil")
+	}
+
+	peers := make(map[ServerId]*peer)
+	for serverId, baseUrl := range baseUrls {
+		if serverId == 0 {
+			return nil, errors.New("baseUrls contains ServerId 0")
+		}
+		if serverId == thisServerId {
+			continue
+		}
+		peers[serverId] = &peer{strings.TrimSuffix(baseUrl, "/"), &sync.Mutex{}, false, false}
+	}
+
+	return &Client{
+		thisServerId,
+		&http.Client{Timeout: callTimeout},
+		logger,
+		peers,
+	}, nil
+}
+
+// Close closes idle connections.
+//
+// Calls made after Close return nil.
+func (c *Client) Close() {
+	for _, p := range c.peers {
+		p.mutex.Lock()
+		p.closed = true
+		p.mutex.Unlock()
+	}
+	c.httpClient.CloseIdleConnections()
+}
+
+func (c *Client) RpcAppendEntries(toServer ServerId, rpc *RpcAppendEntries) *RpcAppendEntriesReply {
+	req := toAppendEntriesRequest(c.thisServerId, rpc)
+	var reply appendEntriesReply
+	if !c.call(toServer, AppendEntriesPath, req, &reply) {
+		return nil
+	}
+	return &RpcAppendEntriesReply{reply.Term, reply.Success}
+}
+
+func (c *Client) RpcRequestVote(toServer ServerId, rpc *RpcRequestVote) *RpcRequestVoteReply {
+	req := &requestVoteRequest{c.thisServerId, rpc.Term, rpc.LastLogIndex, rpc.LastLogTerm}
+	var reply requestVoteReply
+	if !c.call(toServer, RequestVotePath, req, &reply) {
+		return nil
+	}
+	return &RpcRequestVoteReply{reply.Term, reply.VoteGranted}
+}
+
+// call posts the given request to the given peer and returns true if it succeeded.
+func (c *Client) call(toServer ServerId, path string, req interface{}, reply interface{}) bool {
+	p, ok := c.peers[toServer]
+	if !ok {
+		panic(fmt.Sprintf("httprpc: unknown peer: %v", toServer))
+	}
+
+	if !p.startCall() {
+		return false
+	}
+	defer p.endCall()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		c.logger.Println("[httprpc] Failed to encode request:", err)
+		return false
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, p.baseUrl+path, bytes.NewReader(body))
+	if err != nil {
+		c.logger.Println("[httprpc] Bad request for", toServer, ":", err)
+		return false
+	}
+	httpReq.Header.Set("Content-Type", contentTypeJson)
+	httpReq.Header.Set(VersionHeader, ProtocolVersion)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		// ErrStopped on the peer is expected during shutdown and is not logged
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			c.logger.Println("[httprpc] Call to", toServer, path, "failed:", resp.Status)
+		}
+		return false
+	}
+	if v := resp.Header.Get(VersionHeader); v != ProtocolVersion {
+		c.logger.Println("[httprpc] Call to", toServer, path, "failed: unsupported protocol version:", v)
+		return false
+	}
+	err = json.NewDecoder(resp.Body).Decode(reply)
+	return err == nil
+}
+
+// startCall marks a call in flight.
+//
+// Returns false if the Client is closed or a call is already in flight.
+func (p *peer) startCall() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed || p.inFlight {
+		return false
+	}
+	p.inFlight = true
+	return true
+}
+
+func (p *peer) endCall() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.inFlight = false
+}
@@ -0,0 +1,119 @@
+package httprpc
+
+import (
+	"encoding/json"
+	"net/http"
+
+	. "github.com/divtxt/raft"
+)
+
+// RpcProcessor is the subset of IConsensusModule that receives incoming RPCs.
+type RpcProcessor interface {
+	ProcessRpcAppendEntries(from ServerId, rpc *RpcAppendEntries) (*RpcAppendEntriesReply, error)
+	ProcessRpcRequestVote(from ServerId, rpc *RpcRequestVote) (*RpcRequestVoteReply, error)
+}
+
+// badRequestError is a request that could not be decoded.
+type badRequestError struct {
+	error
+}
+
+type handler struct {
+	processor      RpcProcessor
+	maxRequestSize int64
+}
+
+// NewHandler returns an http.Handler that serves the RPCs sent by Clients on other
+// servers by dispatching them to the given RpcProcessor - usually a ConsensusModule.
+//
+// The handler serves AppendEntriesPath and RequestVotePath. Use http.StripPrefix
+// to serve them under a different prefix.
+//
+// Request bodies are limited to DefaultMaxRequestSize bytes.
+//
+func NewHandler(processor RpcProcessor) http.Handler {
+	return NewHandlerWithMaxRequestSize(processor, DefaultMaxRequestSize)
+}
+
+// NewHandlerWithMaxRequestSize is NewHandler with the given maximum size in bytes of
+// a request body.
+//
+// The limit should allow for the largest batch of entries the Log returns for an
+// AppendEntries RPC, plus the JSON and base64 overhead.
+//
+func NewHandlerWithMaxRequestSize(processor RpcProcessor, maxRequestSize int64) http.Handler {
+	return &handler{processor, maxRequestSize}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var process func(*json.Decoder) (interface{}, error)
+	switch r.URL.Path {
+	case AppendEntriesPath:
+		process = h.appendEntries
+	case RequestVotePath:
+		process = h.requestVote
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if v := r.Header.Get(VersionHeader); v != ProtocolVersion {
+		http.Error(w, "unsupported protocol version: "+v, http.StatusBadRequest)
+		return
+	}
+
+	if r.ContentLength > h.maxRequestSize {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Without a Content-Length, reading past the limit fails the decode instead
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxRequestSize)
+
+	reply, err := process(json.NewDecoder(r.Body))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(badRequestError); ok {
+			status = http.StatusBadRequest
+		} else if err == ErrStopped {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set(VersionHeader, ProtocolVersion)
+	w.Header().Set("Content-Type", contentTypeJson)
+	// A failed write means that the client has gone away
+	_ = json.NewEncoder(w).Encode(reply)
+}
+
+func (h *handler) appendEntries(d *json.Decoder) (interface{}, error) {
+	var req appendEntriesRequest
+	err := d.Decode(&req)
+	if err != nil {
+		return nil, badRequestError{err}
+	}
+	rpcReply, err := h.processor.ProcessRpcAppendEntries(req.From, req.toRpc())
+	if err != nil {
+		return nil, err
+	}
+	return &appendEntriesReply{rpcReply.Term, rpcReply.Success}, nil
+}
+
+func (h *handler) requestVote(d *json.Decoder) (interface{}, error) {
+	var req requestVoteRequest
+	err := d.Decode(&req)
+	if err != nil {
+		return nil, badRequestError{err}
+	}
+	rpc := &RpcRequestVote{req.Term, req.LastLogIndex, req.LastLogTerm}
+	rpcReply, err := h.processor.ProcessRpcRequestVote(req.From, rpc)
+	if err != nil {
+		return nil, err
+	}
+	return &requestVoteReply{rpcReply.Term, rpcReply.VoteGranted}, nil
+}
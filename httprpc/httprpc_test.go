@@ -0,0 +1,309 @@
+package httprpc
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/divtxt/raft"
+)
+
+const testCallTimeout = 200 * time.Millisecond
+
+// mockProcessor records the RPCs it receives and replies with the current term.
+type mockProcessor struct {
+	mutex    sync.Mutex
+	received []interface{}
+	term     TermNo
+	block    chan struct{} // if not nil, calls wait for this to be closed
+	err      error
+}
+
+func (mp *mockProcessor) process(from ServerId, rpc interface{}) (TermNo, chan struct{}, error) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.received = append(mp.received, from, rpc)
+	return mp.term, mp.block, mp.err
+}
+
+func (mp *mockProcessor) setErr(err error) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.err = err
+}
+
+func (mp *mockProcessor) ProcessRpcAppendEntries(
+	from ServerId, rpc *RpcAppendEntries,
+) (*RpcAppendEntriesReply, error) {
+	term, block, err := mp.process(from, rpc)
+	if block != nil {
+		<-block
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &RpcAppendEntriesReply{term, true}, nil
+}
+
+func (mp *mockProcessor) ProcessRpcRequestVote(
+	from ServerId, rpc *RpcRequestVote,
+) (*RpcRequestVoteReply, error) {
+	term, block, err := mp.process(from, rpc)
+	if block != nil {
+		<-block
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &RpcRequestVoteReply{term, true}, nil
+}
+
+func (mp *mockProcessor) checkReceived(t *testing.T, expected ...interface{}) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	if !reflect.DeepEqual(mp.received, expected) {
+		t.Fatal(mp.received)
+	}
+	mp.received = nil
+}
+
+func setupServerAndClient(t *testing.T, mp *mockProcessor) (*httptest.Server, *Client) {
+	s := httptest.NewServer(NewHandler(mp))
+	baseUrls := map[ServerId]string{
+		101: "http://127.0.0.1:1", // this server - ignored
+		102: s.URL + "/",
+	}
+	logger := log.New(os.Stderr, "httprpc_test", log.Flags())
+	c, err := NewClient(101, baseUrls, testCallTimeout, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+func TestClientAndHandler(t *testing.T) {
+	mp := &mockProcessor{term: 8}
+	s, c := setupServerAndClient(t, mp)
+	defer s.Close()
+	defer c.Close()
+
+	rpcAE := &RpcAppendEntries{8, 4, 4, []LogEntry{{4, Command("c5")}, {5, Command{0, 255}}}, 3}
+	aeReply := c.RpcAppendEntries(102, rpcAE)
+	if !reflect.DeepEqual(aeReply, &RpcAppendEntriesReply{8, true}) {
+		t.Fatal(aeReply)
+	}
+	mp.checkReceived(t, ServerId(101), rpcAE)
+
+	// Heartbeat - no entries
+	rpcAE = &RpcAppendEntries{8, 10, 6, []LogEntry{}, 3}
+	aeReply = c.RpcAppendEntries(102, rpcAE)
+	if !reflect.DeepEqual(aeReply, &RpcAppendEntriesReply{8, true}) {
+		t.Fatal(aeReply)
+	}
+	mp.checkReceived(t, ServerId(101), rpcAE)
+
+	rpcRV := &RpcRequestVote{9, 10, 6}
+	rvReply := c.RpcRequestVote(102, rpcRV)
+	if !reflect.DeepEqual(rvReply, &RpcRequestVoteReply{8, true}) {
+		t.Fatal(rvReply)
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+
+	// An error from the processor is a failed call
+	mp.setErr(ErrStopped)
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+
+	// Calls after Close return nil
+	c.Close()
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t)
+}
+
+func TestClient_UnknownPeerPanics(t *testing.T) {
+	logger := log.New(os.Stderr, "httprpc_test", log.Flags())
+	c, err := NewClient(101, map[ServerId]string{102: "http://127.0.0.1:1"}, testCallTimeout, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if r := recover(); r != "httprpc: unknown peer: 101" {
+			t.Fatal(r)
+		}
+	}()
+	c.RpcRequestVote(101, &RpcRequestVote{1, 0, 0})
+}
+
+func TestClient_OneCallInFlightPerPeerAndTimeout(t *testing.T) {
+	block := make(chan struct{})
+	mp := &mockProcessor{term: 8, block: block}
+	s, c := setupServerAndClient(t, mp)
+	defer s.Close()
+	defer c.Close()
+	defer close(block)
+
+	rpcRV := &RpcRequestVote{9, 10, 6}
+	replies := make(chan *RpcRequestVoteReply)
+	go func() {
+		replies <- c.RpcRequestVote(102, rpcRV)
+	}()
+	time.Sleep(testCallTimeout / 4)
+
+	// A concurrent call returns nil without calling the peer
+	start := time.Now()
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	if d := time.Since(start); d > testCallTimeout/4 {
+		t.Fatal(d)
+	}
+
+	// The blocked call times out
+	if r := <-replies; r != nil {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+}
+
+// A reply without the expected VersionHeader is a failed call.
+func TestClient_ChecksReplyVersion(t *testing.T) {
+	var version string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if version != "" {
+			w.Header().Set(VersionHeader, version)
+		}
+		_, _ = w.Write([]byte(`{"term":8,"voteGranted":true}`))
+	}))
+	defer s.Close()
+	logger := log.New(os.Stderr, "httprpc_test", log.Flags())
+	c, err := NewClient(101, map[ServerId]string{102: s.URL}, testCallTimeout, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	rpcRV := &RpcRequestVote{9, 10, 6}
+	for _, version = range []string{"", "2"} {
+		if r := c.RpcRequestVote(102, rpcRV); r != nil {
+			t.Fatal(version, r)
+		}
+	}
+	version = ProtocolVersion
+	r := c.RpcRequestVote(102, rpcRV)
+	if !reflect.DeepEqual(r, &RpcRequestVoteReply{8, true}) {
+		t.Fatal(r)
+	}
+}
+
+func TestHandler_MaxRequestSize(t *testing.T) {
+	mp := &mockProcessor{term: 8}
+	body := `{"from":102,"term":9,"lastLogIndex":10,"lastLogTerm":6}`
+	h := NewHandlerWithMaxRequestSize(mp, int64(len(body)))
+
+	serve := func(body string, contentLength int64) int {
+		req := httptest.NewRequest(http.MethodPost, RequestVotePath, strings.NewReader(body))
+		req.Header.Set(VersionHeader, ProtocolVersion)
+		req.ContentLength = contentLength
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := serve(body, int64(len(body))); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	mp.checkReceived(t, ServerId(102), &RpcRequestVote{9, 10, 6})
+
+	// Rejected from the Content-Length without reading the body
+	if code := serve(body+" ", int64(len(body))+1); code != http.StatusRequestEntityTooLarge {
+		t.Fatal(code)
+	}
+	// Without a Content-Length, reading stops at the limit
+	if code := serve(`{"from":102, "term":9,"lastLogIndex":10,"lastLogTerm":6}`, -1); code != http.StatusBadRequest {
+		t.Fatal(code)
+	}
+	mp.checkReceived(t)
+}
+
+// Check the wire format and status codes with raw requests.
+func TestHandler(t *testing.T) {
+	mp := &mockProcessor{term: 8}
+	h := NewHandler(mp)
+
+	serve := func(method, path, version, body string) (int, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if version != "" {
+			req.Header.Set(VersionHeader, version)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	code, body := serve(
+		http.MethodPost,
+		AppendEntriesPath,
+		"1",
+		`{"from":101,"term":8,"prevLogIndex":4,"prevLogTerm":4,`+
+			`"entries":[{"term":8,"command":"YzU="}],"leaderCommit":3}`,
+	)
+	if code != http.StatusOK || body != `{"term":8,"success":true}`+"\n" {
+		t.Fatal(code, body)
+	}
+	mp.checkReceived(
+		t, ServerId(101), &RpcAppendEntries{8, 4, 4, []LogEntry{{8, Command("c5")}}, 3},
+	)
+
+	code, body = serve(
+		http.MethodPost,
+		RequestVotePath,
+		"1",
+		`{"from":102,"term":9,"lastLogIndex":10,"lastLogTerm":6}`,
+	)
+	if code != http.StatusOK || body != `{"term":8,"voteGranted":true}`+"\n" {
+		t.Fatal(code, body)
+	}
+	mp.checkReceived(t, ServerId(102), &RpcRequestVote{9, 10, 6})
+
+	// Errors
+	tests := []struct {
+		method, path, version, body string
+		expectedCode                int
+	}{
+		{http.MethodPost, "/raft/other", "1", `{}`, http.StatusNotFound},
+		{http.MethodGet, RequestVotePath, "1", ``, http.StatusMethodNotAllowed},
+		{http.MethodPost, RequestVotePath, "", `{}`, http.StatusBadRequest},
+		{http.MethodPost, RequestVotePath, "2", `{}`, http.StatusBadRequest},
+		{http.MethodPost, RequestVotePath, "1", `{"term":`, http.StatusBadRequest},
+		{http.MethodPost, AppendEntriesPath, "1", `{"entries":[{"command":"!"}]}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		code, body := serve(test.method, test.path, test.version, test.body)
+		if code != test.expectedCode {
+			t.Fatal(test, code, body)
+		}
+	}
+	mp.checkReceived(t)
+
+	mp.setErr(ErrStopped)
+	code, _ = serve(http.MethodPost, RequestVotePath, "1", `{}`)
+	if code != http.StatusServiceUnavailable {
+		t.Fatal(code)
+	}
+	mp.setErr(errors.New("some error"))
+	code, body = serve(http.MethodPost, RequestVotePath, "1", `{}`)
+	if code != http.StatusInternalServerError || body != "some error\n" {
+		t.Fatal(code, body)
+	}
+}
@@ -0,0 +1,115 @@
+// Package httprpc provides an HTTP implementation of the raft RpcService using JSON.
+//
+// Client implements RpcService for sending RPCs to the other servers of the cluster,
+// and Handler receives those RPCs and dispatches them to a ConsensusModule.
+//
+// Each RPC is a POST of a JSON request to AppendEntriesPath or RequestVotePath,
+// and the JSON reply is returned with status 200. The field names below are part
+// of the protocol and will not change within a protocol version. Commands are
+// base64 encoded (standard encoding, with padding).
+//
+// Example RpcAppendEntries request and reply:
+//
+//  {"from":101,"term":8,"prevLogIndex":4,"prevLogTerm":4,
+//   "entries":[{"term":8,"command":"YzU="}],"leaderCommit":3}
+//
+//  {"term":8,"success":true}
+//
+// Example RpcRequestVote request and reply:
+//
+//  {"from":101,"term":9,"lastLogIndex":10,"lastLogTerm":6}
+//
+//  {"term":9,"voteGranted":true}
+//
+// Every request and every reply with status 200 must have a VersionHeader with
+// the value ProtocolVersion, and a Client ignores a reply without it.
+//
+// Errors are returned as text with the following status codes:
+//
+//  400 Bad Request - bad json or unsupported protocol version
+//  404 Not Found - unknown path
+//  405 Method Not Allowed - not a POST
+//  413 Request Entity Too Large - Content-Length is over the maximum request size
+//  503 Service Unavailable - the ConsensusModule is stopped (ErrStopped)
+//  500 Internal Server Error - any other error
+//
+package httprpc
+
+import (
+	. "github.com/divtxt/raft"
+)
+
+const (
+	AppendEntriesPath = "/raft/appendEntries"
+	RequestVotePath   = "/raft/requestVote"
+
+	VersionHeader   = "X-Raft-Rpc-Version"
+	ProtocolVersion = "1"
+
+	// DefaultMaxRequestSize is the maximum size in bytes of a request body
+	// used by NewHandler.
+	DefaultMaxRequestSize = 16 << 20
+
+	contentTypeJson = "application/json"
+)
+
+type appendEntriesRequest struct {
+	From         ServerId    `json:"from"`
+	Term         TermNo      `json:"term"`
+	PrevLogIndex LogIndex    `json:"prevLogIndex"`
+	PrevLogTerm  TermNo      `json:"prevLogTerm"`
+	Entries      []jsonEntry `json:"entries"`
+	LeaderCommit LogIndex    `json:"leaderCommit"`
+}
+
+// jsonEntry is a LogEntry. The []byte of the command is base64 encoded by encoding/json.
+type jsonEntry struct {
+	Term    TermNo `json:"term"`
+	Command []byte `json:"command"`
+}
+
+type appendEntriesReply struct {
+	Term    TermNo `json:"term"`
+	Success bool   `json:"success"`
+}
+
+type requestVoteRequest struct {
+	From         ServerId `json:"from"`
+	Term         TermNo   `json:"term"`
+	LastLogIndex LogIndex `json:"lastLogIndex"`
+	LastLogTerm  TermNo   `json:"lastLogTerm"`
+}
+
+type requestVoteReply struct {
+	Term        TermNo `json:"term"`
+	VoteGranted bool   `json:"voteGranted"`
+}
+
+func toAppendEntriesRequest(from ServerId, rpc *RpcAppendEntries) *appendEntriesRequest {
+	entries := make([]jsonEntry, len(rpc.Entries))
+	for i, e := range rpc.Entries {
+		entries[i] = jsonEntry{e.TermNo, e.Command}
+	}
+	return &appendEntriesRequest{
+		from,
+		rpc.Term,
+		rpc.PrevLogIndex,
+		rpc.PrevLogTerm,
+		entries,
+		rpc.LeaderCommit,
+	}
+}
+
+func (r *appendEntriesRequest) toRpc() *RpcAppendEntries {
+	entries := make([]LogEntry, len(r.Entries))
+	for i, e := range r.Entries {
+		entries[i] = LogEntry{e.Term, Command(e.Command)}
+	}
+	return &RpcAppendEntries{
+		r.Term,
+		r.PrevLogIndex,
+		r.PrevLogTerm,
+		entries,
+		r.LeaderCommit,
+	}
+}
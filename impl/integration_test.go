@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -11,21 +12,108 @@ import (
 	"github.com/divtxt/raft/config"
 	"github.com/divtxt/raft/inmemlog"
 	"github.com/divtxt/raft/rps"
+	"github.com/divtxt/raft/safety"
+	"github.com/divtxt/raft/simnet"
 	"github.com/divtxt/raft/testdata"
 	"github.com/divtxt/raft/testhelpers"
 )
 
 var testClusterServerIds = []ServerId{101, 102, 103}
 
+// clusterChecker checks the servers of a test cluster with a safety.Checker.
+//
+// It keeps the persistent state of each server, so that a server that is
+// restarted does not go back to an earlier term.
+//
+type clusterChecker struct {
+	t       *testing.T
+	mutex   *sync.Mutex
+	checker *safety.Checker
+	states  map[ServerId]*rps.InMemoryRaftPersistentState
+	servers map[ServerId]safety.Server
+	monitor *safety.Monitor
+}
+
+func newClusterChecker(t *testing.T) *clusterChecker {
+	checker, err := safety.NewChecker(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := &clusterChecker{
+		t,
+		&sync.Mutex{},
+		checker,
+		make(map[ServerId]*rps.InMemoryRaftPersistentState),
+		make(map[ServerId]safety.Server),
+		nil,
+	}
+	cc.monitor, err = safety.NewMonitor(checker, time.Millisecond, cc.runningServers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cc
+}
+
+// persistentState returns the persistent state of the given server, and
+// records a restart if the server has run before.
+func (cc *clusterChecker) persistentState(serverId ServerId) RaftPersistentState {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	ps := cc.states[serverId]
+	if ps == nil {
+		ps = rps.NewIMPSWithCurrentTerm(0)
+		cc.states[serverId] = ps
+	} else {
+		cc.checker.Restarted(serverId)
+	}
+	return ps
+}
+
+// attach starts observing the given server.
+// The StateMachine should be created by safety.NewStateMachine.
+func (cc *clusterChecker) attach(s safety.Server) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.servers[s.ServerId] = s
+}
+
+// detach stops observing the given server e.g. when it is stopped.
+func (cc *clusterChecker) detach(serverId ServerId) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	delete(cc.servers, serverId)
+}
+
+func (cc *clusterChecker) runningServers() []safety.Server {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	var servers []safety.Server
+	for _, serverId := range testClusterServerIds {
+		if s, ok := cc.servers[serverId]; ok {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// stop stops the observations and fails the test if a safety property was
+// violated. This should be deferred before the ConsensusModules are stopped.
+func (cc *clusterChecker) stop() {
+	if err := cc.monitor.Stop(); err != nil {
+		cc.t.Error(err)
+	}
+}
+
 func setupConsensusModuleR3(
 	t *testing.T,
 	thisServerId ServerId,
 	electionTimeoutLow time.Duration,
 	logTerms []TermNo,
 	discardEntriesBeforeIndex LogIndex,
-	imrsc *inMemoryRpcServiceConnector,
+	rpcService RpcService,
+	cc *clusterChecker,
 ) (IConsensusModule, *inmemlog.InMemoryLog, *testhelpers.DummyStateMachine) {
-	ps := rps.NewIMPSWithCurrentTerm(0)
+	ps := cc.persistentState(thisServerId)
 
 	iml, err := inmemlog.TestUtil_NewInMemoryLog_WithTerms(
 		logTerms, testdata.MaxEntriesPerAppendEntry,
@@ -41,19 +129,21 @@ func setupConsensusModuleR3(
 	}
 
 	dsm := testhelpers.NewDummyStateMachine(0) // FIXME: test with non-zero value
+	csm := safety.NewStateMachine(cc.checker, thisServerId, dsm)
 	ts := config.TimeSettings{testdata.TickerDuration, electionTimeoutLow}
 	ci, err := config.NewClusterInfo(testClusterServerIds, thisServerId)
 	if err != nil {
 		t.Fatal(err)
 	}
 	logger := log.New(os.Stderr, "integration_test", log.Flags())
-	cm, err := NewConsensusModule(ps, iml, dsm, imrsc, ci, ts, logger)
+	cm, err := NewConsensusModule(ps, iml, csm, rpcService, ci, ts, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if cm == nil {
 		t.Fatal()
 	}
+	cc.attach(safety.Server{thisServerId, cm, ps, iml, csm})
 	return cm, iml, dsm
 }
 
@@ -62,9 +152,10 @@ func setupConsensusModuleR3_SOLO(
 	electionTimeoutLow time.Duration,
 	logTerms []TermNo,
 	discardEntriesBeforeIndex LogIndex,
-	imrsc *inMemoryRpcServiceConnector,
+	rpcService RpcService,
+	cc *clusterChecker,
 ) (IConsensusModule, *inmemlog.InMemoryLog, *testhelpers.DummyStateMachine) {
-	ps := rps.NewIMPSWithCurrentTerm(0)
+	ps := cc.persistentState(101)
 
 	iml, err := inmemlog.TestUtil_NewInMemoryLog_WithTerms(
 		logTerms, testdata.MaxEntriesPerAppendEntry,
@@ -80,24 +171,28 @@ func setupConsensusModuleR3_SOLO(
 	}
 
 	dsm := testhelpers.NewDummyStateMachine(0) // FIXME: test with non-zero value
+	csm := safety.NewStateMachine(cc.checker, 101, dsm)
 	ts := config.TimeSettings{testdata.TickerDuration, testdata.ElectionTimeoutLow}
 	ci, err := config.NewClusterInfo([]ServerId{101}, 101)
 	if err != nil {
 		t.Fatal(err)
 	}
 	logger := log.New(os.Stderr, "integration_test", log.Flags())
-	cm, err := NewConsensusModule(ps, iml, dsm, imrsc, ci, ts, logger)
+	cm, err := NewConsensusModule(ps, iml, csm, rpcService, ci, ts, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if cm == nil {
 		t.Fatal()
 	}
+	cc.attach(safety.Server{101, cm, ps, iml, csm})
 	return cm, iml, dsm
 }
 
 func TestCluster_ElectsLeader(t *testing.T) {
-	imrsh := &inMemoryRpcServiceHub{nil}
+	cc := newClusterChecker(t)
+	defer cc.stop()
+	network := simnet.NewNetwork(1)
 	setupCMR3 := func(thisServerId ServerId) IConsensusModule {
 		cm, _, _ := setupConsensusModuleR3(
 			t,
@@ -105,7 +200,8 @@ func TestCluster_ElectsLeader(t *testing.T) {
 			testdata.ElectionTimeoutLow,
 			nil,
 			0,
-			imrsh.getRpcService(thisServerId),
+			network.RpcService(thisServerId),
+			cc,
 		)
 		return cm
 	}
@@ -115,11 +211,9 @@ func TestCluster_ElectsLeader(t *testing.T) {
 	defer cm2.Stop()
 	cm3 := setupCMR3(103)
 	defer cm3.Stop()
-	imrsh.cms = map[ServerId]IConsensusModule{
-		101: cm1,
-		102: cm2,
-		103: cm3,
-	}
+	network.Attach(101, cm1)
+	network.Attach(102, cm2)
+	network.Attach(103, cm3)
 
 	// -- All nodes start as followers
 	totalState := cm1.GetServerState() + cm2.GetServerState() + cm3.GetServerState()
@@ -163,13 +257,14 @@ func TestCluster_ElectsLeader(t *testing.T) {
 
 func testSetupClusterWithLeader(
 	t *testing.T,
+	cc *clusterChecker,
 ) (
-	*inMemoryRpcServiceHub,
+	*simnet.Network,
 	IConsensusModule, *inmemlog.InMemoryLog, *testhelpers.DummyStateMachine,
 	IConsensusModule, *inmemlog.InMemoryLog, *testhelpers.DummyStateMachine,
 	IConsensusModule, *inmemlog.InMemoryLog, *testhelpers.DummyStateMachine,
 ) {
-	imrsh := &inMemoryRpcServiceHub{nil}
+	network := simnet.NewNetwork(1)
 	setupCMR3 := func(
 		thisServerId ServerId, electionTimeoutLow time.Duration,
 	) (IConsensusModule, *inmemlog.InMemoryLog, *testhelpers.DummyStateMachine) {
@@ -179,17 +274,16 @@ func testSetupClusterWithLeader(
 			electionTimeoutLow,
 			nil,
 			0,
-			imrsh.getRpcService(thisServerId),
+			network.RpcService(thisServerId),
+			cc,
 		)
 	}
 	cm1, diml1, dsm1 := setupCMR3(101, testdata.ElectionTimeoutLow)
 	cm2, diml2, dsm2 := setupCMR3(102, testdata.ElectionTimeoutLow*3)
 	cm3, diml3, dsm3 := setupCMR3(103, testdata.ElectionTimeoutLow*3)
-	imrsh.cms = map[ServerId]IConsensusModule{
-		101: cm1,
-		102: cm2,
-		103: cm3,
-	}
+	network.Attach(101, cm1)
+	network.Attach(102, cm2)
+	network.Attach(103, cm3)
 
 	// -- Election timeout results in cm1 leader being elected
 	time.Sleep(testdata.ElectionTimeoutLow*2 + testdata.SleepJustMoreThanATick)
@@ -201,23 +295,23 @@ func testSetupClusterWithLeader(
 		t.Fatal(cm1.GetServerState()*100 + cm2.GetServerState()*10 + cm3.GetServerState())
 	}
 
-	return imrsh, cm1, diml1, dsm1, cm2, diml2, dsm2, cm3, diml3, dsm3
+	return network, cm1, diml1, dsm1, cm2, diml2, dsm2, cm3, diml3, dsm3
 }
 
 func testSetup_SOLO_Leader(
 	t *testing.T,
+	cc *clusterChecker,
 ) (IConsensusModule, *inmemlog.InMemoryLog, *testhelpers.DummyStateMachine) {
-	imrsh := &inMemoryRpcServiceHub{nil}
+	network := simnet.NewNetwork(1)
 	cm, diml, dsm := setupConsensusModuleR3_SOLO(
 		t,
 		testdata.ElectionTimeoutLow,
 		nil,
 		0,
-		imrsh.getRpcService(101),
+		network.RpcService(101),
+		cc,
 	)
-	imrsh.cms = map[ServerId]IConsensusModule{
-		101: cm,
-	}
+	network.Attach(101, cm)
 
 	// -- Election timeout results in cm electing itself leader
 	time.Sleep(testdata.ElectionTimeoutLow*2 + testdata.SleepJustMoreThanATick)
@@ -231,12 +325,15 @@ func testSetup_SOLO_Leader(
 }
 
 func TestCluster_CommandIsReplicatedVsMissingNode(t *testing.T) {
-	imrsh, cm1, diml1, dsm1, cm2, diml2, dsm2, cm3, _, _ := testSetupClusterWithLeader(t)
+	cc := newClusterChecker(t)
+	defer cc.stop()
+	network, cm1, diml1, dsm1, cm2, diml2, dsm2, cm3, _, _ := testSetupClusterWithLeader(t, cc)
 	defer cm1.Stop()
 	defer cm2.Stop()
 
 	// Simulate a follower crash
-	imrsh.cms[103] = nil
+	network.Detach(103)
+	cc.detach(103)
 	cm3.Stop()
 	cm3 = nil
 
@@ -311,10 +408,11 @@ func TestCluster_CommandIsReplicatedVsMissingNode(t *testing.T) {
 		testdata.ElectionTimeoutLow,
 		nil,
 		0,
-		imrsh.getRpcService(103),
+		network.RpcService(103),
+		cc,
 	)
 	defer cm3b.Stop()
-	imrsh.cms[103] = cm3b
+	network.Attach(103, cm3b)
 	if dsm3b.GetLastApplied() != 0 {
 		t.Fatal()
 	}
@@ -335,7 +433,9 @@ func TestCluster_CommandIsReplicatedVsMissingNode(t *testing.T) {
 }
 
 func TestCluster_SOLO_Command_And_CommitIndexAdvance(t *testing.T) {
-	cm, diml, dsm := testSetup_SOLO_Leader(t)
+	cc := newClusterChecker(t)
+	defer cc.stop()
+	cm, diml, dsm := testSetup_SOLO_Leader(t, cc)
 	defer cm.Stop()
 
 	// Apply a command on the leader
@@ -379,50 +479,3 @@ func TestCluster_SOLO_Command_And_CommitIndexAdvance(t *testing.T) {
 		t.Fatal(v)
 	}
 }
-
-// Real in-memory implementation of RpcService
-// - meant only for tests
-type inMemoryRpcServiceHub struct {
-	cms map[ServerId]IConsensusModule
-}
-
-type inMemoryRpcServiceConnector struct {
-	hub  *inMemoryRpcServiceHub
-	from ServerId
-}
-
-func (imrsh *inMemoryRpcServiceHub) getRpcService(
-	from ServerId,
-) *inMemoryRpcServiceConnector {
-	return &inMemoryRpcServiceConnector{imrsh, from}
-}
-
-func (imrs *inMemoryRpcServiceConnector) RpcAppendEntries(
-	toServer ServerId,
-	rpc *RpcAppendEntries,
-) *RpcAppendEntriesReply {
-	cm := imrs.hub.cms[toServer]
-	if cm != nil {
-		rpcReply, err := cm.ProcessRpcAppendEntries(imrs.from, rpc)
-		if err != nil {
-			return nil
-		}
-		return rpcReply
-	}
-	return nil
-}
-
-func (imrs *inMemoryRpcServiceConnector) RpcRequestVote(
-	toServer ServerId,
-	rpc *RpcRequestVote,
-) *RpcRequestVoteReply {
-	cm := imrs.hub.cms[toServer]
-	if cm != nil {
-		rpcReply, err := cm.ProcessRpcRequestVote(imrs.from, rpc)
-		if err != nil {
-			return nil
-		}
-		return rpcReply
-	}
-	return nil
-}
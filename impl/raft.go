@@ -23,6 +23,7 @@
 package impl
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sync"
@@ -56,6 +57,11 @@ type ConsensusModule struct {
 	// -- Ticker
 	tickerDuration time.Duration
 	ticker         *util.Ticker
+
+	// -- Durability notifications - only used if the Log is an AsyncLog
+	durableMutex   *sync.Mutex
+	durableRunner  *util.TriggeredRunner
+	durableUnwatch func()
 }
 
 // NewConsensusModule creates and starts a ConsensusModule with the given components and
@@ -66,6 +72,11 @@ type ConsensusModule struct {
 //
 // The goroutine that drives ticks (and therefore RPCs) is started.
 //
+// The entries returned by the Log are sent as is. See NewConsensusModuleWithBatchPolicy.
+//
+// If the stateMachine is a FallibleStateMachine, the ConsensusModule halts at the first
+// failure to apply a command. See NewConsensusModuleWithApplyFailurePolicy.
+//
 func NewConsensusModule(
 	raftPersistentState RaftPersistentState,
 	raftLog Log,
@@ -74,9 +85,79 @@ func NewConsensusModule(
 	clusterInfo *config.ClusterInfo,
 	timeSettings config.TimeSettings,
 	logger *log.Logger,
+) (*ConsensusModule, error) {
+	return NewConsensusModuleWithBatchPolicy(
+		raftPersistentState,
+		raftLog,
+		stateMachine,
+		rpcService,
+		clusterInfo,
+		DefaultBatchPolicy,
+		timeSettings,
+		logger,
+	)
+}
+
+// NewConsensusModuleWithBatchPolicy creates and starts a ConsensusModule that trims
+// the entries sent in each RpcAppendEntries to the given BatchPolicy.
+//
+// batchPolicy is checked using BatchPolicy.Validate().
+//
+func NewConsensusModuleWithBatchPolicy(
+	raftPersistentState RaftPersistentState,
+	raftLog Log,
+	stateMachine StateMachine,
+	rpcService RpcService,
+	clusterInfo *config.ClusterInfo,
+	batchPolicy BatchPolicy,
+	timeSettings config.TimeSettings,
+	logger *log.Logger,
+) (*ConsensusModule, error) {
+	return NewConsensusModuleWithApplyFailurePolicy(
+		raftPersistentState,
+		raftLog,
+		stateMachine,
+		rpcService,
+		clusterInfo,
+		batchPolicy,
+		timeSettings,
+		DefaultApplyFailurePolicy,
+		logger,
+	)
+}
+
+// NewConsensusModuleWithApplyFailurePolicy creates and starts a ConsensusModule that
+// handles the failures of a FallibleStateMachine as decided by the given
+// ApplyFailurePolicy.
+//
+// applyFailurePolicy is checked using ApplyFailurePolicy.Validate().
+//
+// When the ConsensusModule halts for a failure, it stops without a panic and logs the
+// *ApplyError. The results of the pending commands are closed. GetApplyStats() counts
+// the failures.
+//
+func NewConsensusModuleWithApplyFailurePolicy(
+	raftPersistentState RaftPersistentState,
+	raftLog Log,
+	stateMachine StateMachine,
+	rpcService RpcService,
+	clusterInfo *config.ClusterInfo,
+	batchPolicy BatchPolicy,
+	timeSettings config.TimeSettings,
+	applyFailurePolicy ApplyFailurePolicy,
+	logger *log.Logger,
 ) (*ConsensusModule, error) {
 	logger.Println("[raft] Initializing ConsensusModule")
 
+	err := batchPolicy.Validate()
+	if err != nil {
+		return nil, err
+	}
+	err = applyFailurePolicy.Validate()
+	if err != nil {
+		return nil, err
+	}
+
 	cm := &ConsensusModule{
 		&sync.Mutex{},
 
@@ -94,9 +175,14 @@ func NewConsensusModule(
 		// -- Ticker
 		timeSettings.TickerDuration,
 		nil,
+
+		// -- Durability notifications
+		&sync.Mutex{},
+		nil,
+		nil,
 	}
 
-	aes := aesender.NewLogOnlyAESender(raftLog, cm.SendOnlyRpcAppendEntriesAsync)
+	aes := aesender.NewLogOnlyAESenderWithBatchPolicy(raftLog, batchPolicy, cm.SendOnlyRpcAppendEntriesAsync)
 
 	pcm, err := consensus.NewPassiveConsensusModule(
 		raftPersistentState,
@@ -112,17 +198,28 @@ func NewConsensusModule(
 		return nil, err
 	}
 
-	applier := applier.NewApplier(
+	applier := applier.NewApplierWithFailurePolicy(
 		raftLog,
 		pcm.GetCommitIndexWatchable(),
 		stateMachine,
-		cm.safeShutdownAndPanic,
+		applyFailurePolicy,
+		cm.applierFailed,
 	)
 
 	// We can only set these value here because of the cyclic dependencies
 	cm.passiveConsensusModule = pcm
 	cm.applier = applier
 
+	// Advance commitIndex as soon as the leader's own entries become durable.
+	// The listener can be called while we are waiting on the Log, so it only triggers
+	// a separate goroutine.
+	if asyncLog, ok := raftLog.(AsyncLog); ok {
+		cm.durableRunner = util.NewTriggeredRunner(cm.safeIndexOfLastDurableEntryChanged)
+		cm.durableUnwatch = asyncLog.GetIndexOfLastDurableEntryWatchable().AddListener(
+			cm.indexOfLastDurableEntryChanged,
+		)
+	}
+
 	// Start the ticker goroutine
 	cm.ticker = util.NewTicker(cm.safeTick, cm.tickerDuration)
 
@@ -161,6 +258,20 @@ func (cm *ConsensusModule) GetServerState() ServerState {
 	return cm.passiveConsensusModule.GetServerState()
 }
 
+// Get the counts of the failures of a FallibleStateMachine so far.
+func (cm *ConsensusModule) GetApplyStats() applier.Stats {
+	return cm.applier.GetStats()
+}
+
+// Get the commitIndex as a WatchableIndex.
+//
+// Listeners are called while the ConsensusModule is locked, so they must not block
+// or call the ConsensusModule. See package commitstream for a consumer of committed
+// entries that is driven by this.
+func (cm *ConsensusModule) GetCommitIndexWatchable() WatchableIndex {
+	return cm.passiveConsensusModule.GetCommitIndexWatchable()
+}
+
 // Process the given RpcAppendEntries message from the given peer.
 //
 // Returns ErrStopped if ConsensusModule is stopped.
@@ -214,11 +325,19 @@ func (cm *ConsensusModule) ProcessRpcRequestVote(
 // AppendCommand appends the given serialized command to the Raft log and applies it
 // to the state machine once it is considered committed by the ConsensusModule.
 func (cm *ConsensusModule) AppendCommand(command Command) (<-chan CommandResult, error) {
+	_, crc, err := cm.AppendCommandWithIndex(command)
+	return crc, err
+}
+
+// AppendCommandWithIndex is AppendCommand that also returns the log index of the new entry.
+//
+// Once the result has been received, the index can be used with WaitApplied on any server.
+func (cm *ConsensusModule) AppendCommandWithIndex(command Command) (LogIndex, <-chan CommandResult, error) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
 
 	if cm.stopped {
-		return nil, ErrStopped
+		return 0, nil, ErrStopped
 	}
 
 	logIndex, err := cm.passiveConsensusModule.AppendCommand(command)
@@ -226,15 +345,44 @@ func (cm *ConsensusModule) AppendCommand(command Command) (<-chan CommandResult,
 		if err != ErrNotLeader {
 			cm.shutdownAndPanic(err)
 		}
-		return nil, err
+		return 0, nil, err
 	}
 
-	crc, err := cm.applier.GetResultAsync(logIndex)
+	// The term cannot have changed since we hold the lock
+	termNo := cm.passiveConsensusModule.RaftPersistentState.GetCurrentTerm()
+	crc, err := cm.applier.GetResultAsync(logIndex, termNo)
 	if err != nil {
 		cm.shutdownAndPanic(err)
 	}
 
-	return crc, err
+	return logIndex, crc, err
+}
+
+// Get lastApplied as a WatchableIndex.
+//
+// Listeners are called from the goroutine that applies entries, so they must not block.
+func (cm *ConsensusModule) GetLastAppliedWatchable() WatchableIndex {
+	return cm.applier.GetLastAppliedWatchable()
+}
+
+// WaitApplied waits until the entry at the given log index has been applied to the
+// state machine on this server.
+//
+// Returns ctx.Err() if the context is done before the entry is applied.
+// Returns ErrStopped if ConsensusModule is stopped.
+func (cm *ConsensusModule) WaitApplied(ctx context.Context, logIndex LogIndex) error {
+	if cm.IsStopped() {
+		return ErrStopped
+	}
+	return cm.applier.WaitApplied(ctx, logIndex)
+}
+
+// Get the time of the last AppendEntries accepted from the current leader.
+//
+// This is the zero time if this server is not a follower, or has not heard from the
+// leader since it became a follower.
+func (cm *ConsensusModule) GetLastLeaderContact() time.Time {
+	return cm.passiveConsensusModule.GetLastLeaderContact()
 }
 
 // -- protected methods
@@ -320,6 +468,41 @@ func (cm *ConsensusModule) safeTick() {
 	}
 }
 
+func (cm *ConsensusModule) indexOfLastDurableEntryChanged(_ LogIndex) {
+	cm.durableMutex.Lock()
+	defer cm.durableMutex.Unlock()
+
+	if cm.durableRunner != nil {
+		cm.durableRunner.TriggerRun()
+	}
+}
+
+func (cm *ConsensusModule) safeIndexOfLastDurableEntryChanged() {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if !cm.stopped {
+		err := cm.passiveConsensusModule.IndexOfLastDurableEntryChanged()
+		if err != nil {
+			cm.shutdownAndPanic(err)
+		}
+	}
+}
+
+// applierFailed handles a fatal error of the Applier, which calls this from its own
+// goroutine.
+//
+// An *ApplyError halts the ConsensusModule without a panic. Since stopping waits for
+// the Applier's goroutine, this is done in a new goroutine.
+func (cm *ConsensusModule) applierFailed(err error) {
+	if _, ok := err.(*ApplyError); ok {
+		cm.logger.Printf("[raft] Halting: %v", err)
+		go cm.Stop()
+		return
+	}
+	cm.safeShutdownAndPanic(err)
+}
+
 func (cm *ConsensusModule) safeShutdownAndPanic(err error) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
@@ -338,6 +521,21 @@ func (cm *ConsensusModule) shutdownAndPanic(err error) {
 		// Tell the ticker to stop.
 		// This needs be async since this method could be running as part of a tick.
 		cm.ticker.StopAsync()
+		// Tell the durability runner to stop, and stop triggering it.
+		// This also needs to be async since this method could be running in that goroutine.
+		cm.durableMutex.Lock()
+		if cm.durableRunner != nil {
+			cm.durableRunner.StopAsync()
+			cm.durableRunner = nil
+		}
+		cm.durableMutex.Unlock()
+		// Stop listening to the Log so that it does not keep a stopped ConsensusModule.
+		// This is done without holding durableMutex since the listener takes it while
+		// the index is locked.
+		if cm.durableUnwatch != nil {
+			cm.durableUnwatch()
+			cm.durableUnwatch = nil
+		}
 		// Tell the applier to stop.
 		// No other calls will be serviced, so there's no need to worry about a race condition
 		// between this stop and a commitIndex change.
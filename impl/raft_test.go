@@ -1,6 +1,7 @@
 package impl
 
 import (
+	"context"
 	"log"
 	"os"
 	"reflect"
@@ -340,3 +341,182 @@ func TestConsensusModule_AppendCommand_Follower_StoppedCM(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestConsensusModule_ApplyFailurePolicy(t *testing.T) {
+	ci, err := config.NewClusterInfo([]ServerId{1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iml, err := inmemlog.NewInMemoryLog(testdata.MaxEntriesPerAppendEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCM := func(applyFailurePolicy ApplyFailurePolicy) (*ConsensusModule, error) {
+		return NewConsensusModuleWithApplyFailurePolicy(
+			rps.NewIMPSWithCurrentTerm(0),
+			iml,
+			testhelpers.NewDummyFallibleStateMachine(0, map[LogIndex]int{1: -1}),
+			testhelpers.NewMockRpcSender(),
+			ci,
+			BatchPolicy{testdata.MaxEntriesPerAppendEntry, 0},
+			config.TimeSettings{testdata.TickerDuration, testdata.ElectionTimeoutLow},
+			applyFailurePolicy,
+			log.New(os.Stderr, "integration_test", log.Flags()),
+		)
+	}
+
+	_, err = newCM(ApplyFailurePolicy{Action: 9})
+	if err == nil || err.Error() != "unknown action=9" {
+		t.Fatal(err)
+	}
+	_, err = newCM(ApplyFailurePolicy{Action: ApplyFailureRetry})
+	if err == nil || err.Error() != "initialBackoff=0s must be greater than zero" {
+		t.Fatal(err)
+	}
+
+	// The single server becomes leader, commits the command and halts cleanly
+	// when it cannot be applied.
+	cm, err := newCM(DefaultApplyFailurePolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+	var crc <-chan CommandResult
+	for i := 0; crc == nil; i++ {
+		if i == 100 {
+			t.Fatal("not leader")
+		}
+		crc, err = cm.AppendCommand(testhelpers.DummyCommand(1))
+		if err != nil && err != ErrNotLeader {
+			t.Fatal(err)
+		}
+		time.Sleep(testdata.TickerDuration)
+	}
+	select {
+	case v, ok := <-crc:
+		if ok {
+			t.Fatal(v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	for i := 0; !cm.IsStopped(); i++ {
+		if i == 100 {
+			t.Fatal("not stopped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s := cm.GetApplyStats(); s.Failures != 1 || !s.Halted {
+		t.Fatal(s)
+	}
+}
+
+func TestConsensusModule_BatchPolicy(t *testing.T) {
+	ci, err := config.NewClusterInfo([]ServerId{1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iml, err := inmemlog.NewInMemoryLog(testdata.MaxEntriesPerAppendEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCM := func(batchPolicy BatchPolicy) (*ConsensusModule, error) {
+		return NewConsensusModuleWithBatchPolicy(
+			rps.NewIMPSWithCurrentTerm(0),
+			iml,
+			testhelpers.NewDummyStateMachine(0),
+			testhelpers.NewMockRpcSender(),
+			ci,
+			batchPolicy,
+			config.TimeSettings{testdata.TickerDuration, testdata.ElectionTimeoutLow},
+			log.New(os.Stderr, "integration_test", log.Flags()),
+		)
+	}
+
+	_, err = newCM(BatchPolicy{0, 10})
+	if err == nil || err.Error() != "maxEntries=0 must be greater than zero" {
+		t.Fatal(err)
+	}
+
+	cm, err := newCM(BatchPolicy{1, 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Stop()
+}
+
+func TestConsensusModule_WaitApplied(t *testing.T) {
+	ci, err := config.NewClusterInfo([]ServerId{1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iml, err := inmemlog.NewInMemoryLog(testdata.MaxEntriesPerAppendEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm, err := NewConsensusModule(
+		rps.NewIMPSWithCurrentTerm(0),
+		iml,
+		testhelpers.NewDummyStateMachine(0),
+		testhelpers.NewMockRpcSender(),
+		ci,
+		config.TimeSettings{testdata.TickerDuration, testdata.ElectionTimeoutLow},
+		log.New(os.Stderr, "integration_test", log.Flags()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Stop()
+	lastApplied := cm.GetLastAppliedWatchable()
+	if lastApplied.Get() != 0 {
+		t.Fatal(lastApplied.Get())
+	}
+
+	// Wait for an entry that has not been appended yet
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- cm.WaitApplied(context.Background(), 1) }()
+
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatal("not leader")
+		}
+		var li LogIndex
+		li, _, err = cm.AppendCommandWithIndex(testhelpers.DummyCommand(1))
+		if err == nil {
+			if li != 1 {
+				t.Fatal(li)
+			}
+			break
+		}
+		if err != ErrNotLeader {
+			t.Fatal(err)
+		}
+		time.Sleep(testdata.TickerDuration)
+	}
+	// The leader does not hear from a leader
+	if !cm.GetLastLeaderContact().IsZero() {
+		t.Fatal(cm.GetLastLeaderContact())
+	}
+	select {
+	case err := <-waitErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	if lastApplied.Get() != 1 {
+		t.Fatal(lastApplied.Get())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := cm.WaitApplied(ctx, 2); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	cm.Stop()
+	if err := cm.WaitApplied(context.Background(), 1); err != ErrStopped {
+		t.Fatal(err)
+	}
+}
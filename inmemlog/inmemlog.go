@@ -10,13 +10,19 @@ import (
 )
 
 // InMemoryLog is an in-memory implementation of the raft Log.
+//
+// Log compaction actually discards entries: the entries slice only holds the
+// entries after lastCompacted, i.e. entries[0] is the entry at lastCompacted+1.
+// The term of the entry at lastCompacted is kept so that GetTermAtIndex()
+// can still return it.
 type InMemoryLog struct {
-	maxEntries uint64
+	batchPolicy BatchPolicy
 
-	lock             *sync.RWMutex
-	indexOfLastEntry *logindex.WatchedIndex
-	lastCompacted    *logindex.WatchedIndex
-	entries          []LogEntry
+	lock              *sync.RWMutex
+	indexOfLastEntry  *logindex.WatchedIndex
+	lastCompacted     *logindex.WatchedIndex
+	lastCompactedTerm TermNo
+	entries           []LogEntry
 }
 
 // Check that InMemoryLog implements the Log interface
@@ -25,20 +31,27 @@ var _ Log = (*InMemoryLog)(nil)
 // NewInMemoryLog creates a new InMemoryLog with the given parameters.
 //
 // maxEntries is the maximum number of log entries that GetEntriesAfterIndex
-// will return at a time.
+// will return at a time. The size of the entries is not limited.
 //
 func NewInMemoryLog(maxEntries uint64) (*InMemoryLog, error) {
-	if maxEntries <= 0 {
-		return nil, fmt.Errorf(
-			"maxEntries=%v must be greater than zero", maxEntries,
-		)
+	return NewInMemoryLogWithBatchPolicy(BatchPolicy{maxEntries, 0})
+}
+
+// NewInMemoryLogWithBatchPolicy creates a new InMemoryLog whose GetEntriesAfterIndex
+// returns entries as limited by the given BatchPolicy.
+//
+func NewInMemoryLogWithBatchPolicy(batchPolicy BatchPolicy) (*InMemoryLog, error) {
+	err := batchPolicy.Validate()
+	if err != nil {
+		return nil, err
 	}
 	lock := &sync.RWMutex{}
 	iml := &InMemoryLog{
-		maxEntries,
+		batchPolicy,
 		lock,
 		logindex.NewWatchedIndexWithVerifier(nil), // FIXME: verifier
 		logindex.NewWatchedIndexWithVerifier(nil), // FIXME: verifier
+		0,
 		[]LogEntry{},
 	}
 	return iml, nil
@@ -63,23 +76,28 @@ func (iml *InMemoryLog) GetTermAtIndex(li LogIndex) (TermNo, error) {
 	if li == 0 {
 		return 0, errors.New("GetTermAtIndex(): li=0")
 	}
-	if li <= iml.lastCompacted.Get() {
+	lastCompacted := iml.lastCompacted.Get()
+	if li < lastCompacted {
 		return 0, ErrIndexCompacted
 	}
+	if li == lastCompacted {
+		return iml.lastCompactedTerm, nil
+	}
 
-	if li > iml.indexOfLastEntry.Get() {
+	if iole := iml.indexOfLastEntry.Get(); li > iole {
 		return 0, fmt.Errorf(
-			"GetTermAtIndex(): li=%v > iole=%v", li, len(iml.entries),
+			"GetTermAtIndex(): li=%v > iole=%v", li, iole,
 		)
 	}
-	return iml.entries[li-1].TermNo, nil
+	return iml.entries[li-lastCompacted-1].TermNo, nil
 }
 
 func (iml *InMemoryLog) GetEntriesAfterIndex(afterLogIndex LogIndex) ([]LogEntry, error) {
 	iml.lock.RLock()
 	defer iml.lock.RUnlock()
 
-	if afterLogIndex < iml.lastCompacted.Get() {
+	lastCompacted := iml.lastCompacted.Get()
+	if afterLogIndex < lastCompacted {
 		return nil, ErrIndexCompacted
 	}
 
@@ -100,19 +118,14 @@ func (iml *InMemoryLog) GetEntriesAfterIndex(afterLogIndex LogIndex) ([]LogEntry
 		return []LogEntry{}, nil
 	}
 
-	if numEntriesToGet > iml.maxEntries {
-		numEntriesToGet = iml.maxEntries
-	}
+	start := uint64(afterLogIndex - lastCompacted)
+	numEntriesToGet = iml.batchPolicy.BatchLength(
+		numEntriesToGet,
+		func(i uint64) uint64 { return uint64(len(iml.entries[start+i].Command)) },
+	)
 
 	logEntries := make([]LogEntry, numEntriesToGet)
-	var i uint64 = 0
-	nextIndexToGet := afterLogIndex + 1
-
-	for i < numEntriesToGet {
-		logEntries[i] = iml.entries[nextIndexToGet-1]
-		i++
-		nextIndexToGet++
-	}
+	copy(logEntries, iml.entries[start:start+numEntriesToGet])
 
 	return logEntries, nil
 }
@@ -121,7 +134,8 @@ func (iml *InMemoryLog) SetEntriesAfterIndex(li LogIndex, entries []LogEntry) er
 	iml.lock.Lock()
 	defer iml.lock.Unlock()
 
-	if li < iml.lastCompacted.Get() {
+	lastCompacted := iml.lastCompacted.Get()
+	if li < lastCompacted {
 		return ErrIndexCompacted
 	}
 	iole := iml.indexOfLastEntry.Get()
@@ -130,26 +144,52 @@ func (iml *InMemoryLog) SetEntriesAfterIndex(li LogIndex, entries []LogEntry) er
 	}
 	// delete entries after index
 	if iole > li {
-		iml.entries = iml.entries[:li]
+		iml.entries = iml.entries[:li-lastCompacted]
 	}
 	// append entries
 	iml.entries = append(iml.entries, entries...)
 
 	// update iole
-	newIole := LogIndex(len(iml.entries))
+	newIole := lastCompacted + LogIndex(len(iml.entries))
 	return iml.indexOfLastEntry.Set(newIole)
 }
 
+// DiscardEntriesBeforeIndex discards the entries before the given index.
+//
+// lastCompacted becomes li-1, and the term of that entry is kept.
+// This does nothing if li-1 is already lastCompacted.
+// The remaining entries are copied to a new slice so that the discarded
+// entries can be garbage collected.
 func (iml *InMemoryLog) DiscardEntriesBeforeIndex(li LogIndex) error {
 	iml.lock.Lock()
 	defer iml.lock.Unlock()
 
-	if li <= iml.lastCompacted.Get() {
+	lastCompacted := iml.lastCompacted.Get()
+	if li <= lastCompacted {
 		return ErrIndexCompacted
 	}
-	err := iml.lastCompacted.Set(li - 1)
-	// FIXME: actually throw away entries!
-	return err
+	iole := iml.indexOfLastEntry.Get()
+	if li-1 > iole {
+		return fmt.Errorf("InMemoryLog: discardEntriesBeforeIndex(%d) but iole=%d", li, iole)
+	}
+
+	newLastCompacted := li - 1
+	discard := newLastCompacted - lastCompacted
+	if discard == 0 {
+		// Nothing before li that is not already compacted
+		return nil
+	}
+	lastCompactedTerm := iml.entries[discard-1].TermNo
+	entries := make([]LogEntry, LogIndex(len(iml.entries))-discard)
+	copy(entries, iml.entries[discard:])
+
+	err := iml.lastCompacted.Set(newLastCompacted)
+	if err != nil {
+		return err
+	}
+	iml.lastCompactedTerm = lastCompactedTerm
+	iml.entries = entries
+	return nil
 }
 
 func (iml *InMemoryLog) AppendEntry(logEntry LogEntry) (LogIndex, error) {
@@ -161,7 +201,7 @@ func (iml *InMemoryLog) AppendEntry(logEntry LogEntry) (LogIndex, error) {
 	iml.entries = append(iml.entries, logEntry)
 
 	// update iole
-	newIole := LogIndex(len(iml.entries))
+	newIole := iml.lastCompacted.Get() + LogIndex(len(iml.entries))
 	err := iml.indexOfLastEntry.Set(newIole)
 	if err != nil {
 		return 0, err
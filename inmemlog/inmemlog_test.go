@@ -132,6 +132,90 @@ func TestInMemoryLog_GetEntriesAfterIndex(t *testing.T) {
 	}
 }
 
+// Tests for InMemoryLog's DiscardEntriesBeforeIndex implementation
+func TestInMemoryLog_DiscardEntriesBeforeIndex(t *testing.T) {
+	// Log with 10 entries with terms as shown in Figure 7, leader line
+	iml, err := TestUtil_NewInMemoryLog_WithFigure7LeaderLine(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// discarding before the first entry that is not compacted does nothing
+	err = iml.DiscardEntriesBeforeIndex(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(iml.entries) != 10 || iml.GetLastCompacted() != 0 {
+		t.Fatal(len(iml.entries), iml.GetLastCompacted())
+	}
+
+	// compacted entries are actually discarded
+	err = iml.DiscardEntriesBeforeIndex(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(iml.entries) != 6 || cap(iml.entries) != 6 {
+		t.Fatal(len(iml.entries), cap(iml.entries))
+	}
+	term, err := iml.GetTermAtIndex(4)
+	if err != nil || term != 4 {
+		t.Fatal(term, err)
+	}
+
+	// same after compaction, and the term of lastCompacted is kept
+	err = iml.DiscardEntriesBeforeIndex(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(iml.entries) != 6 || iml.GetLastCompacted() != 4 {
+		t.Fatal(len(iml.entries), iml.GetLastCompacted())
+	}
+	term, err = iml.GetTermAtIndex(4)
+	if err != nil || term != 4 {
+		t.Fatal(term, err)
+	}
+
+	// cannot discard beyond the end of the log
+	err = iml.DiscardEntriesBeforeIndex(12)
+	if err == nil || err.Error() != "InMemoryLog: discardEntriesBeforeIndex(12) but iole=10" {
+		t.Fatal(err)
+	}
+
+	// discard all entries
+	err = iml.DiscardEntriesBeforeIndex(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(iml.entries) != 0 {
+		t.Fatal(iml.entries)
+	}
+	if iole := iml.GetIndexOfLastEntry(); iole != 10 {
+		t.Fatal(iole)
+	}
+	term, err = iml.GetTermAtIndex(10)
+	if err != nil || term != 6 {
+		t.Fatal(term, err)
+	}
+	entries, err := iml.GetEntriesAfterIndex(10)
+	if err != nil || len(entries) != 0 {
+		t.Fatal(entries, err)
+	}
+
+	// the log continues after lastCompacted
+	iole, err := iml.AppendEntry(LogEntry{7, Command("c11")})
+	if err != nil || iole != 11 {
+		t.Fatal(iole, err)
+	}
+	err = iml.SetEntriesAfterIndex(10, []LogEntry{{8, Command("c11'")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := testhelpers.TestHelper_GetLogEntryAtIndex(iml, 11)
+	if !reflect.DeepEqual(le, LogEntry{8, Command("c11'")}) {
+		t.Fatal(le)
+	}
+}
+
 // Tests for InMemoryLog's maxEntries policy implementation
 func TestInMemoryLog_AlternateMaxEntries(t *testing.T) {
 	// Log with 10 entries with terms as shown in Figure 7, leader line
@@ -153,3 +237,52 @@ func TestInMemoryLog_AlternateMaxEntries(t *testing.T) {
 		t.Fatal(actualEntries)
 	}
 }
+
+// Tests for InMemoryLog's BatchPolicy implementation with a byte limit
+func TestInMemoryLog_BatchPolicyMaxBytes(t *testing.T) {
+	iml, err := NewInMemoryLogWithBatchPolicy(BatchPolicy{3, 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := []string{"aaaa", "bbbb", "cc", "dddddddddddddddd", "e", "f", "g", "h"}
+	for _, c := range commands {
+		_, err := iml.AppendEntry(LogEntry{1, Command(c)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_getEntries := func(afterLogIndex LogIndex) []string {
+		entries, err := iml.GetEntriesAfterIndex(afterLogIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var commands []string
+		for _, e := range entries {
+			commands = append(commands, string(e.Command))
+		}
+		return commands
+	}
+
+	// entries that fit in MaxBytes exactly
+	if c := _getEntries(0); !reflect.DeepEqual(c, []string{"aaaa", "bbbb", "cc"}) {
+		t.Fatal(c)
+	}
+	// batch ends before an entry that does not fit
+	if c := _getEntries(1); !reflect.DeepEqual(c, []string{"bbbb", "cc"}) {
+		t.Fatal(c)
+	}
+	// an oversized entry is returned by itself
+	if c := _getEntries(3); !reflect.DeepEqual(c, []string{"dddddddddddddddd"}) {
+		t.Fatal(c)
+	}
+	// MaxEntries still applies to small entries
+	if c := _getEntries(4); !reflect.DeepEqual(c, []string{"e", "f", "g"}) {
+		t.Fatal(c)
+	}
+
+	_, err = NewInMemoryLogWithBatchPolicy(BatchPolicy{0, 10})
+	if err == nil || err.Error() != "maxEntries=0 must be greater than zero" {
+		t.Fatal(err)
+	}
+}
@@ -16,9 +16,11 @@ package raft
 // However, note that compaction should never advance past the state machine's lastApplied index
 // (which in turn should never advance past the Consensus module's commitIndex):
 //
-// FIXME: is compaction allowed to delete last entry? may need term of last entry!
 // lastCompacted <= lastApplied <= commitIndex <= indexOfLastEntry
 //
+// Compaction may discard every entry in the log, but the Log must still remember the
+// term of the entry at lastCompacted (see GetTermAtIndex).
+//
 // If you are writing your own implementation, please understand the concurrency requirements and
 // error handling behavior:
 //
@@ -69,12 +71,15 @@ type Log interface {
 	// It is an error if the given index is beyond the end of the log.
 	// (i.e. the given index is greater than indexOfLastEntry)
 	//
-	// This method must return ErrIndexCompacted if the given index is less than or equal to
+	// The term of the entry at lastCompacted must still be returned even though the
+	// entry itself has been discarded, since it is needed to check an AppendEntries
+	// that continues from lastCompacted.
+	//
+	// This method must return ErrIndexCompacted if the given index is less than
 	// lastCompacted, and the calling ConsensusModule will handle this gracefully.
 	//
 	// An index of 0 is invalid for this call.
 	// There should be no entries for the Log of a new server.
-	// FIXME: should log remember term of lastCompacted?
 	GetTermAtIndex(LogIndex) (TermNo, error)
 
 	// Get multiple entries after the given index.
@@ -83,10 +88,13 @@ type Log interface {
 	// or used to apply log entries to the state machine.
 	//
 	// This method is expected to decide how many entries to return based on some policy.
-	// This interface itself has no specific requirements on the policy, but it is expected
-	// that such a policy will be based on various cluster behavior as well as RPC behavior.
+	// It is recommended that the Log respects a BatchPolicy, i.e. limits both the number
+	// of entries and the total size of their commands, since a batch that is too large
+	// for the RPC transport will never be delivered. (The ConsensusModule also trims
+	// the returned entries to its own BatchPolicy before sending them.)
 	//
-	// If there are entries after the given index, the call must return at least one entry.
+	// If there are entries after the given index, the call must return at least one entry,
+	// even if that entry alone is larger than the policy allows.
 	//
 	// It is an error if the given index is beyond the end of the log.
 	// (i.e. the given index is greater than indexOfLastEntry)
@@ -144,6 +152,39 @@ type Log interface {
 	AppendEntry(LogEntry) (LogIndex, error)
 }
 
+// AsyncLog is a Log whose AppendEntry may return before the appended entry is
+// durable.
+//
+// Implementing this interface is optional.
+//
+// If the Log given to the ConsensusModule implements this interface, a leader
+// sends new entries to its followers while they are still being written to its
+// own stable storage, and only counts itself towards a majority for an entry once
+// indexOfLastDurableEntry has reached the entry's index (see #10.2.1 in the Raft
+// dissertation). This takes the leader's fsync off the critical path of a commit.
+//
+// Otherwise, the ConsensusModule assumes that AppendEntry is synchronous i.e. that
+// every entry up to indexOfLastEntry is durable.
+//
+type AsyncLog interface {
+	Log
+
+	// Get the index of the last entry that has been written to stable storage as a
+	// WatchableIndex.
+	//
+	// Must be less than or equal to indexOfLastEntry.
+	//
+	// SetEntriesAfterIndex must still be synchronous i.e. every entry up to the new
+	// indexOfLastEntry must be durable when it returns, since a follower acknowledges
+	// the entries to the leader right after the call. This means that the value is
+	// equal to indexOfLastEntry after the call, and decreases if entries were deleted.
+	//
+	// Listeners may be called from any goroutine, including during calls to this Log.
+	// An error writing an appended entry should be returned by a later call to
+	// AppendEntry or SetEntriesAfterIndex.
+	GetIndexOfLastDurableEntryWatchable() WatchableIndex
+}
+
 // StateMachine is the interface that the state machine must expose to Raft.
 //
 // You must implement this interface!
@@ -208,6 +249,62 @@ type StateMachine interface {
 	ApplyCommand(logIndex LogIndex, command Command) CommandResult
 }
 
+// BatchStateMachine is a StateMachine that can apply several committed entries in one call.
+//
+// Implementing this interface is optional. If the StateMachine given to the ConsensusModule
+// also implements BatchStateMachine, committed entries are applied with ApplyEntries instead
+// of ApplyCommand. A state machine that is backed by an embedded database can then apply a
+// whole batch in one transaction, with one sync to stable storage.
+//
+// The batches are the entries returned by Log.GetEntriesAfterIndex, trimmed to commitIndex,
+// so their size is limited by the Log's batch policy.
+//
+type BatchStateMachine interface {
+	StateMachine
+
+	// ApplyEntries should apply the commands of the given entries to the state machine.
+	//
+	// The entries are at consecutive log indexes starting at firstLogIndex, and the log
+	// index of the last entry should become the new value of lastApplied.
+	//
+	// This method should return only after all changes have been applied, and should
+	// return the results in the same order as the entries. Returning a different number
+	// of results is fatal for the ConsensusModule.
+	//
+	// The given firstLogIndex should be one more than the current value of lastApplied and
+	// this method should panic if this is not the case.
+	//
+	// Since lastApplied should be as durable as the state machine, an implementation that
+	// persists its state should apply the whole batch atomically, including lastApplied.
+	ApplyEntries(firstLogIndex LogIndex, entries []LogEntry) []CommandResult
+}
+
+// FallibleStateMachine is a StateMachine that can report a failure to apply a command,
+// such as an I/O error, instead of panicking.
+//
+// Implementing this interface is optional. If the StateMachine given to the ConsensusModule
+// also implements FallibleStateMachine, committed entries are applied one at a time with
+// TryApplyCommand, even if it is also a BatchStateMachine, and failures are handled as
+// decided by the ApplyFailurePolicy of the ConsensusModule.
+//
+type FallibleStateMachine interface {
+	StateMachine
+
+	// TryApplyCommand is ApplyCommand with an error return.
+	//
+	// If an error is returned, the state machine must be unchanged - in particular
+	// lastApplied must not change - so that the command can be applied again.
+	TryApplyCommand(logIndex LogIndex, command Command) (CommandResult, error)
+
+	// SkipCommand should record that the command at the given log index failed with the
+	// given error, and make the log index the new value of lastApplied without applying
+	// the command.
+	//
+	// This is only called with ApplyFailureSkip, after TryApplyCommand failed for the
+	// same log index.
+	SkipCommand(logIndex LogIndex, err error)
+}
+
 // Raft persistent state on all servers.
 //
 // You must implement this interface!
@@ -256,6 +353,30 @@ type RaftPersistentState interface {
 	SetVotedFor(votedFor ServerId) error
 }
 
+// BufferedRaftPersistentState is a RaftPersistentState whose SetCurrentTerm and
+// SetVotedFor may return before the new values are durable.
+//
+// Implementing this interface is optional.
+//
+// This lets an implementation that keeps the state and the log in the same file
+// write a change of term or vote together with the log entries that follow it,
+// using a single sync.
+//
+// If the RaftPersistentState given to the ConsensusModule implements this
+// interface, the ConsensusModule calls SyncState before sending RequestVote RPCs
+// and before replying to an RPC, since the changed values must be durable before
+// any other server can see them.
+//
+type BufferedRaftPersistentState interface {
+	RaftPersistentState
+
+	// Make any change to currentTerm and votedFor durable.
+	//
+	// This call should be synchronous and should do nothing if there are no such
+	// changes.
+	SyncState() error
+}
+
 // RPC service.
 //
 // You must implement this interface!
@@ -0,0 +1,114 @@
+// Package binenc has the helpers for the compact binary encodings of packages
+// wire and kvsm.
+//
+// Integers are unsigned varints (see encoding/binary), and booleans are a
+// single byte with the value 0 or 1. A Decoder rejects varints that are not
+// minimally encoded, so that every value has exactly one encoding.
+//
+package binenc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// AppendUvarint appends the varint encoding of v to dst.
+func AppendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
+
+// AppendBool appends the encoding of v to dst.
+func AppendBool(dst []byte, v bool) []byte {
+	if v {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+// Decoder reads values from an encoding. After the first error, all reads
+// return zero values and the error is returned by Err.
+type Decoder struct {
+	b   []byte
+	p   int
+	err error
+
+	prefix       string // e.g. "wire", for error messages
+	errTruncated error
+}
+
+// NewDecoder creates a Decoder that reads the given bytes from offset p.
+//
+// Errors are prefixed by the given package name, except when the bytes end
+// early, where the given errTruncated is used.
+//
+func NewDecoder(b []byte, p int, prefix string, errTruncated error) *Decoder {
+	return &Decoder{b, p, nil, prefix, errTruncated}
+}
+
+// Err returns the first error, or nil.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Remaining returns the number of bytes that have not been read.
+func (d *Decoder) Remaining() int {
+	return len(d.b) - d.p
+}
+
+func (d *Decoder) Uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b[d.p:])
+	if n == 0 {
+		d.err = d.errTruncated
+		return 0
+	}
+	if n < 0 {
+		d.err = errors.New(d.prefix + ": varint overflows 64 bits")
+		return 0
+	}
+	if n > 1 && d.b[d.p+n-1] == 0 {
+		// Only the shortest encoding is valid, so that every value has
+		// exactly one encoding
+		d.err = errors.New(d.prefix + ": varint is not minimally encoded")
+		return 0
+	}
+	d.p += n
+	return v
+}
+
+func (d *Decoder) Bool() bool {
+	if d.err != nil {
+		return false
+	}
+	if d.p >= len(d.b) {
+		d.err = d.errTruncated
+		return false
+	}
+	v := d.b[d.p]
+	if v > 1 {
+		d.err = fmt.Errorf("%v: bad boolean value: %v", d.prefix, v)
+		return false
+	}
+	d.p++
+	return v == 1
+}
+
+// Bytes returns the next n bytes without copying them.
+func (d *Decoder) Bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.b)-d.p) {
+		d.err = d.errTruncated
+		return nil
+	}
+	end := d.p + int(n)
+	v := d.b[d.p:end:end]
+	d.p = end
+	return v
+}
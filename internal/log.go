@@ -30,6 +30,13 @@ type LogTail interface {
 	AppendEntry(LogEntry) (LogIndex, error)
 }
 
+// AsyncLogTail is the subset of the AsyncLog interface used by components that will only
+// access the non-compacted tail of the raft log. See LogTail.
+type AsyncLogTail interface {
+	LogTail
+	GetIndexOfLastDurableEntryWatchable() WatchableIndex
+}
+
 // LogTailRO is the read-only subset of LogTail
 type LogTailRO interface {
 	GetIndexOfLastEntry() LogIndex
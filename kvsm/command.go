@@ -0,0 +1,186 @@
+// Package kvsm is a replicated key-value store that implements raft.StateMachine.
+//
+// Clients encode commands with Get, Put, Delete and CAS and append them with
+// IConsensusModule.AppendCommand. The result of each command is a Result, and
+// the result of a command that cannot be decoded is a *CommandError.
+//
+// Results depend only on the state and the command, so every replica returns
+// the same result for the same log entry.
+//
+// Command encoding:
+//
+//  op (1 byte), key, then depending on op:
+//  Get, Delete:  nothing
+//  Put:          value
+//  CAS:          absent (1 byte), old (only if absent is 0), value
+//
+// Strings are an unsigned varint length followed by the bytes. As in package
+// wire, a command has exactly one encoding: a decoder rejects varints that are
+// not minimally encoded and bytes after the end of the command.
+//
+package kvsm
+
+import (
+	"errors"
+	"fmt"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/internal/binenc"
+)
+
+// Op is the operation of a command.
+type Op uint8
+
+const (
+	OpGet Op = iota + 1
+	OpPut
+	OpDelete
+	OpCAS
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpGet:
+		return "get"
+	case OpPut:
+		return "put"
+	case OpDelete:
+		return "delete"
+	case OpCAS:
+		return "cas"
+	default:
+		return fmt.Sprintf("Op(%d)", uint8(op))
+	}
+}
+
+// Request is a decoded command.
+type Request struct {
+	Op  Op
+	Key string
+	// The value to put, or the new value of a CAS.
+	Value string
+	// For a CAS: the expected current value, or Absent if the key is expected
+	// to not exist.
+	Old    string
+	Absent bool
+}
+
+// Result is the result of applying a command.
+type Result struct {
+	// The value of the key before the command was applied, if Found.
+	Value string
+	Found bool
+	// OK is false for a CAS whose expected value did not match, in which case
+	// the state is unchanged. It is true for all other commands.
+	OK bool
+}
+
+// CommandError is the result of a command that cannot be decoded.
+//
+// The command has no effect.
+//
+type CommandError struct {
+	LogIndex LogIndex
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("kvsm: bad command at index %v: %v", e.LogIndex, e.Err)
+}
+
+// ErrTruncated is returned when decoding a command or snapshot that ends early.
+var ErrTruncated = errors.New("kvsm: truncated")
+
+// Get returns the command to read the value of the given key.
+func Get(key string) Command {
+	return Request{Op: OpGet, Key: key}.Encode()
+}
+
+// Put returns the command to set the value of the given key.
+func Put(key, value string) Command {
+	return Request{Op: OpPut, Key: key, Value: value}.Encode()
+}
+
+// Delete returns the command to delete the given key.
+func Delete(key string) Command {
+	return Request{Op: OpDelete, Key: key}.Encode()
+}
+
+// CAS returns the command to set the value of the given key to value only if
+// its current value is old.
+//
+// To set a key only if it does not exist, use a Request with Absent set.
+//
+func CAS(key, old, value string) Command {
+	return Request{Op: OpCAS, Key: key, Value: value, Old: old}.Encode()
+}
+
+// Encode returns the encoding of the request.
+//
+// Fields that are not used by the operation are not encoded.
+//
+func (r Request) Encode() Command {
+	b := []byte{byte(r.Op)}
+	b = appendString(b, r.Key)
+	switch r.Op {
+	case OpPut:
+		b = appendString(b, r.Value)
+	case OpCAS:
+		if r.Absent {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+			b = appendString(b, r.Old)
+		}
+		b = appendString(b, r.Value)
+	}
+	return Command(b)
+}
+
+// Decode decodes the given command.
+func Decode(command Command) (Request, error) {
+	if len(command) == 0 {
+		return Request{}, ErrTruncated
+	}
+	d := newDecoder(command, 1)
+	r := Request{Op: Op(command[0])}
+	r.Key = d.string()
+	switch r.Op {
+	case OpGet, OpDelete:
+	case OpPut:
+		r.Value = d.string()
+	case OpCAS:
+		r.Absent = d.Bool()
+		if !r.Absent {
+			r.Old = d.string()
+		}
+		r.Value = d.string()
+	default:
+		return Request{}, fmt.Errorf("kvsm: unknown op: %v", command[0])
+	}
+	if d.Err() != nil {
+		return Request{}, d.Err()
+	}
+	if d.Remaining() != 0 {
+		return Request{}, fmt.Errorf("kvsm: %v unexpected bytes after command", d.Remaining())
+	}
+	return r, nil
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = binenc.AppendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// decoder reads values from a command or snapshot.
+type decoder struct {
+	*binenc.Decoder
+}
+
+func newDecoder(b []byte, p int) decoder {
+	return decoder{binenc.NewDecoder(b, p, "kvsm", ErrTruncated)}
+}
+
+func (d decoder) string() string {
+	return string(d.Bytes(d.Uvarint()))
+}
@@ -0,0 +1,71 @@
+package kvsm
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/divtxt/raft"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		command  Command
+		expected []byte
+	}{
+		{Get("k"), []byte{1, 1, 'k'}},
+		{Put("k", "ab"), []byte{2, 1, 'k', 2, 'a', 'b'}},
+		{Delete(""), []byte{3, 0}},
+		{CAS("k", "a", "b"), []byte{4, 1, 'k', 0, 1, 'a', 1, 'b'}},
+		{Request{Op: OpCAS, Key: "k", Value: "b", Absent: true}.Encode(), []byte{4, 1, 'k', 1, 1, 'b'}},
+	}
+	for _, test := range tests {
+		if !bytes.Equal(test.command, test.expected) {
+			t.Fatal(test.command, test.expected)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	requests := []Request{
+		{Op: OpGet, Key: "k"},
+		{Op: OpPut, Key: "k", Value: "v"},
+		{Op: OpPut, Key: "", Value: ""},
+		{Op: OpDelete, Key: "k"},
+		{Op: OpCAS, Key: "k", Value: "v", Old: "o"},
+		{Op: OpCAS, Key: "k", Value: "v", Absent: true},
+		{Op: OpPut, Key: "k", Value: string(make([]byte, 300))},
+	}
+	for _, r := range requests {
+		d, err := Decode(r.Encode())
+		if err != nil {
+			t.Fatal(r, err)
+		}
+		if d != r {
+			t.Fatal(d, r)
+		}
+	}
+}
+
+func TestDecode_Errors(t *testing.T) {
+	tests := []struct {
+		command  []byte
+		expected string
+	}{
+		{nil, "kvsm: truncated"},
+		{[]byte{1}, "kvsm: truncated"},
+		{[]byte{1, 2, 'k'}, "kvsm: truncated"},
+		{[]byte{2, 1, 'k'}, "kvsm: truncated"},
+		{[]byte{4, 1, 'k', 0, 0}, "kvsm: truncated"},
+		{[]byte{5, 1, 'k'}, "kvsm: unknown op: 5"},
+		{[]byte{0, 1, 'k'}, "kvsm: unknown op: 0"},
+		{[]byte{1, 1, 'k', 0}, "kvsm: 1 unexpected bytes after command"},
+		{[]byte{1, 0x81, 0x00}, "kvsm: varint is not minimally encoded"},
+		{[]byte{4, 1, 'k', 2, 0}, "kvsm: bad boolean value: 2"},
+	}
+	for _, test := range tests {
+		_, err := Decode(test.command)
+		if err == nil || err.Error() != test.expected {
+			t.Fatal(test.command, err)
+		}
+	}
+}
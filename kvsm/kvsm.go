@@ -0,0 +1,151 @@
+package kvsm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	. "github.com/divtxt/raft"
+)
+
+// KVStateMachine is an in-memory key-value store of strings.
+//
+// A KVStateMachine is safe for concurrent use: ApplyCommand is called by the
+// ConsensusModule while the local reads below can be called by other goroutines.
+//
+type KVStateMachine struct {
+	mutex       *sync.Mutex
+	lastApplied LogIndex
+	values      map[string]string
+}
+
+var _ BatchStateMachine = (*KVStateMachine)(nil)
+
+// NewKVStateMachine creates an empty KVStateMachine with lastApplied of 0.
+func NewKVStateMachine() *KVStateMachine {
+	return &KVStateMachine{&sync.Mutex{}, 0, make(map[string]string)}
+}
+
+// GetLastApplied implements StateMachine.
+func (kv *KVStateMachine) GetLastApplied() LogIndex {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	return kv.lastApplied
+}
+
+// ApplyCommand implements StateMachine.
+//
+// The result is a Result, or a *CommandError if the command cannot be decoded.
+// Panics if logIndex is not lastApplied + 1.
+//
+func (kv *KVStateMachine) ApplyCommand(logIndex LogIndex, command Command) CommandResult {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	kv.checkNextIndex(logIndex)
+	return kv.applyCommand(logIndex, command)
+}
+
+// ApplyEntries implements BatchStateMachine.
+//
+// The whole batch is applied while holding the lock once, so local reads see
+// either none or all of the batch.
+//
+func (kv *KVStateMachine) ApplyEntries(firstLogIndex LogIndex, entries []LogEntry) []CommandResult {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	kv.checkNextIndex(firstLogIndex)
+	results := make([]CommandResult, len(entries))
+	for i, entry := range entries {
+		results[i] = kv.applyCommand(firstLogIndex+LogIndex(i), entry.Command)
+	}
+	return results
+}
+
+// checkNextIndex panics if logIndex is not lastApplied + 1. The caller must hold
+// the mutex.
+func (kv *KVStateMachine) checkNextIndex(logIndex LogIndex) {
+	if logIndex != kv.lastApplied+1 {
+		panic(fmt.Sprintf(
+			"KVStateMachine: logIndex=%d is not lastApplied+1 with lastApplied=%d",
+			logIndex,
+			kv.lastApplied,
+		))
+	}
+}
+
+// applyCommand applies the command at logIndex, which must be lastApplied + 1.
+// The caller must hold the mutex.
+func (kv *KVStateMachine) applyCommand(logIndex LogIndex, command Command) CommandResult {
+	kv.lastApplied = logIndex
+	r, err := Decode(command)
+	if err != nil {
+		return &CommandError{logIndex, err}
+	}
+	return kv.apply(r)
+}
+
+func (kv *KVStateMachine) apply(r Request) Result {
+	value, found := kv.values[r.Key]
+	result := Result{value, found, true}
+	switch r.Op {
+	case OpPut:
+		kv.values[r.Key] = r.Value
+	case OpDelete:
+		delete(kv.values, r.Key)
+	case OpCAS:
+		if r.Absent {
+			result.OK = !found
+		} else {
+			result.OK = found && value == r.Old
+		}
+		if result.OK {
+			kv.values[r.Key] = r.Value
+		}
+	}
+	return result
+}
+
+// Get returns the local value of the given key.
+//
+// This is a read of the local state, which can be behind the rest of the
+// cluster. For a linearizable read, append a Get command instead.
+//
+func (kv *KVStateMachine) Get(key string) (string, bool) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	value, found := kv.values[key]
+	return value, found
+}
+
+// GetWithLastApplied is Get that also returns the value of lastApplied that the
+// value was read at.
+//
+// The value reflects exactly the entries up to the returned lastApplied, which
+// Get followed by GetLastApplied does not guarantee since entries can be applied
+// between the two calls.
+//
+func (kv *KVStateMachine) GetWithLastApplied(key string) (string, bool, LogIndex) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	value, found := kv.values[key]
+	return value, found, kv.lastApplied
+}
+
+// Len returns the number of keys.
+func (kv *KVStateMachine) Len() int {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	return len(kv.values)
+}
+
+// sortedKeys returns the keys in order. The caller must hold the mutex.
+func (kv *KVStateMachine) sortedKeys() []string {
+	keys := make([]string, 0, len(kv.values))
+	for key := range kv.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,244 @@
+package kvsm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/config"
+	"github.com/divtxt/raft/impl"
+	"github.com/divtxt/raft/inmemlog"
+	"github.com/divtxt/raft/rps"
+	"github.com/divtxt/raft/simnet"
+	"github.com/divtxt/raft/testdata"
+)
+
+func TestKVStateMachine(t *testing.T) {
+	kv := NewKVStateMachine()
+	tests := []struct {
+		command  Command
+		expected CommandResult
+	}{
+		{Get("a"), Result{"", false, true}},
+		{Put("a", "1"), Result{"", false, true}},
+		{Get("a"), Result{"1", true, true}},
+		{Put("a", "2"), Result{"1", true, true}},
+		{CAS("a", "1", "3"), Result{"2", true, false}},
+		{CAS("a", "2", "3"), Result{"2", true, true}},
+		{CAS("b", "", "1"), Result{"", false, false}},
+		{Request{Op: OpCAS, Key: "a", Value: "4", Absent: true}.Encode(), Result{"3", true, false}},
+		{Request{Op: OpCAS, Key: "b", Value: "1", Absent: true}.Encode(), Result{"", false, true}},
+		{Delete("a"), Result{"3", true, true}},
+		{Delete("a"), Result{"", false, true}},
+		{Command{9}, nil}, // a *CommandError
+		{Get("b"), Result{"1", true, true}},
+	}
+	for i, test := range tests {
+		li := LogIndex(i + 1)
+		result := kv.ApplyCommand(li, test.command)
+		if e, ok := result.(*CommandError); ok {
+			if e.Error() != "kvsm: bad command at index 12: kvsm: unknown op: 9" {
+				t.Fatal(li, e)
+			}
+		} else if result != test.expected {
+			t.Fatal(li, result, test.expected)
+		}
+		if kv.GetLastApplied() != li {
+			t.Fatal(li, kv.GetLastApplied())
+		}
+	}
+	if v, ok := kv.Get("b"); !ok || v != "1" || kv.Len() != 1 {
+		t.Fatal(v, ok, kv.Len())
+	}
+	if v, ok, li := kv.GetWithLastApplied("b"); !ok || v != "1" || li != 13 {
+		t.Fatal(v, ok, li)
+	}
+	if v, ok, li := kv.GetWithLastApplied("a"); ok || v != "" || li != 13 {
+		t.Fatal(v, ok, li)
+	}
+}
+
+func TestKVStateMachine_ApplyWrongIndex(t *testing.T) {
+	kv := NewKVStateMachine()
+	defer func() {
+		if r := recover(); r != "KVStateMachine: logIndex=2 is not lastApplied+1 with lastApplied=0" {
+			t.Fatal(r)
+		}
+	}()
+	kv.ApplyCommand(2, Get("a"))
+}
+
+func TestKVStateMachine_ApplyEntries(t *testing.T) {
+	commands := []Command{
+		Put("a", "1"), Get("a"), CAS("a", "1", "2"), Command{9}, Delete("a"), Put("b", "3"), Get("b"),
+	}
+	kv1 := NewKVStateMachine()
+	var results1 []CommandResult
+	for i, command := range commands {
+		results1 = append(results1, kv1.ApplyCommand(LogIndex(i+1), command))
+	}
+
+	kv2 := NewKVStateMachine()
+	var results2 []CommandResult
+	for i := 0; i < len(commands); i += 3 {
+		var entries []LogEntry
+		for j := i; j < i+3 && j < len(commands); j++ {
+			entries = append(entries, LogEntry{1, commands[j]})
+		}
+		results2 = append(results2, kv2.ApplyEntries(LogIndex(i+1), entries)...)
+	}
+	if !reflect.DeepEqual(results1, results2) {
+		t.Fatal(results1, results2)
+	}
+
+	var b1, b2 bytes.Buffer
+	if err := kv1.Snapshot(&b1); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv2.Snapshot(&b2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b1.Bytes(), b2.Bytes()) || kv2.GetLastApplied() != LogIndex(len(commands)) {
+		t.Fatal(kv2.GetLastApplied())
+	}
+
+	defer func() {
+		if r := recover(); r != "KVStateMachine: logIndex=9 is not lastApplied+1 with lastApplied=7" {
+			t.Fatal(r)
+		}
+	}()
+	kv2.ApplyEntries(9, []LogEntry{{1, Get("a")}})
+}
+
+var testServerIds = []ServerId{101, 102, 103}
+
+// TestKVStateMachine_Cluster runs concurrent CAS increments of a counter on a
+// cluster with message faults, and checks that the counter and the replicas
+// agree.
+func TestKVStateMachine_Cluster(t *testing.T) {
+	sms := make(map[ServerId]*KVStateMachine)
+	for _, serverId := range testServerIds {
+		sms[serverId] = NewKVStateMachine()
+	}
+	newNode := func(serverId ServerId, rpcService RpcService) (IConsensusModule, error) {
+		iml, err := inmemlog.NewInMemoryLog(testdata.MaxEntriesPerAppendEntry)
+		if err != nil {
+			return nil, err
+		}
+		ci, err := config.NewClusterInfo(testServerIds, serverId)
+		if err != nil {
+			return nil, err
+		}
+		return impl.NewConsensusModule(
+			rps.NewIMPSWithCurrentTerm(0),
+			iml,
+			sms[serverId],
+			rpcService,
+			ci,
+			config.TimeSettings{testdata.TickerDuration, testdata.ElectionTimeoutLow},
+			log.New(ioutil.Discard, "", 0),
+		)
+	}
+	c, err := simnet.NewCluster(testServerIds, 1, newNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.StopAll()
+	err = c.Network.SetFaults(simnet.Faults{Drop: 0.02, MaxDelay: 2 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// apply appends the command on the leader and waits for its result.
+	// Returns nil if the command may or may not have been applied.
+	apply := func(command Command) *Result {
+		leader, err := c.WaitForLeader(time.Second)
+		if err != nil {
+			return nil
+		}
+		cm := c.Node(leader)
+		if cm == nil {
+			return nil
+		}
+		crc, err := cm.AppendCommand(command)
+		if err != nil {
+			return nil
+		}
+		select {
+		case result, ok := <-crc:
+			if ok {
+				r := result.(Result)
+				return &r
+			}
+		case <-time.After(time.Second):
+		}
+		return nil
+	}
+
+	const clients = 3
+	const increments = 5
+	var mutex sync.Mutex
+	succeeded, unknown := 0, 0
+	wg := &sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; {
+				r := apply(Get("counter"))
+				if r == nil {
+					continue
+				}
+				v, _ := strconv.Atoi(r.Value)
+				r = apply(Request{OpCAS, "counter", strconv.Itoa(v + 1), r.Value, !r.Found}.Encode())
+				mutex.Lock()
+				if r == nil {
+					unknown++
+				} else if r.OK {
+					succeeded++
+					n++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	final := func() int {
+		r := apply(Get("counter"))
+		for r == nil {
+			r = apply(Get("counter"))
+		}
+		v, _ := strconv.Atoi(r.Value)
+		return v
+	}()
+	if final < succeeded || final > succeeded+unknown {
+		t.Fatal(final, succeeded, unknown)
+	}
+
+	// Every replica converges to the same snapshot.
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		var snapshots [][]byte
+		for _, serverId := range testServerIds {
+			var buf bytes.Buffer
+			if err := sms[serverId].Snapshot(&buf); err != nil {
+				t.Fatal(err)
+			}
+			snapshots = append(snapshots, buf.Bytes())
+		}
+		if bytes.Equal(snapshots[0], snapshots[1]) && bytes.Equal(snapshots[0], snapshots[2]) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replicas did not converge")
+		}
+		time.Sleep(testdata.SleepToLetGoroutineRun)
+	}
+}
@@ -0,0 +1,140 @@
+package kvsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/internal/binenc"
+)
+
+// Snapshot layout:
+//
+//  magic "kvsm" (4 bytes), version (1 byte), lastApplied, count,
+//  then count pairs of key and value in key order,
+//  then the CRC-32C of all the previous bytes (4 bytes, big-endian)
+//
+// lastApplied and count are unsigned varints, and keys and values are strings
+// as in commands. The pairs are in key order so that replicas with the same
+// state write the same snapshot.
+//
+const (
+	snapshotMagic   = "kvsm"
+	snapshotVersion = 1
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Snapshot writes the state, including lastApplied, to the given writer.
+func (kv *KVStateMachine) Snapshot(w io.Writer) error {
+	kv.mutex.Lock()
+	b := append([]byte(snapshotMagic), snapshotVersion)
+	b = binenc.AppendUvarint(b, uint64(kv.lastApplied))
+	b = binenc.AppendUvarint(b, uint64(len(kv.values)))
+	for _, key := range kv.sortedKeys() {
+		b = appendString(b, key)
+		b = appendString(b, kv.values[key])
+	}
+	kv.mutex.Unlock()
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(b, crc32cTable))
+	b = append(b, sum[:]...)
+	_, err := w.Write(b)
+	return err
+}
+
+// Restore replaces the state with a snapshot read from the given reader.
+//
+// The state is not changed if the snapshot cannot be read.
+//
+func (kv *KVStateMachine) Restore(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	lastApplied, values, err := decodeSnapshot(b)
+	if err != nil {
+		return err
+	}
+
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	kv.lastApplied = lastApplied
+	kv.values = values
+	return nil
+}
+
+// SnapshotInfo is the metadata of a snapshot.
+type SnapshotInfo struct {
+	Version     uint8
+	LastApplied LogIndex
+	Keys        int
+	Size        int
+	Checksum    uint32
+}
+
+// ReadSnapshotInfo reads a snapshot from the given reader, checks it and returns
+// its metadata.
+func ReadSnapshotInfo(r io.Reader) (SnapshotInfo, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	lastApplied, values, err := decodeSnapshot(b)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	return SnapshotInfo{
+		snapshotVersion,
+		lastApplied,
+		len(values),
+		len(b),
+		binary.BigEndian.Uint32(b[len(b)-4:]),
+	}, nil
+}
+
+func decodeSnapshot(b []byte) (LogIndex, map[string]string, error) {
+	if len(b) < len(snapshotMagic)+1+4 {
+		return 0, nil, ErrTruncated
+	}
+	if string(b[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, nil, errors.New("kvsm: not a snapshot")
+	}
+	if v := b[len(snapshotMagic)]; v != snapshotVersion {
+		return 0, nil, fmt.Errorf("kvsm: unsupported snapshot version: %v", v)
+	}
+	body, sum := b[:len(b)-4], b[len(b)-4:]
+	if binary.BigEndian.Uint32(sum) != crc32.Checksum(body, crc32cTable) {
+		return 0, nil, errors.New("kvsm: snapshot checksum mismatch")
+	}
+
+	d := newDecoder(body, len(snapshotMagic)+1)
+	lastApplied := LogIndex(d.Uvarint())
+	n := d.Uvarint()
+	// Each pair takes at least 2 bytes, which bounds the allocation below
+	if n > uint64(d.Remaining())/2 {
+		return 0, nil, ErrTruncated
+	}
+	values := make(map[string]string, n)
+	prev := ""
+	for i := uint64(0); i < n && d.Err() == nil; i++ {
+		key := d.string()
+		if i > 0 && key <= prev {
+			return 0, nil, fmt.Errorf("kvsm: snapshot keys out of order: %q after %q", key, prev)
+		}
+		values[key] = d.string()
+		prev = key
+	}
+	if d.Err() != nil {
+		return 0, nil, d.Err()
+	}
+	if d.Remaining() != 0 {
+		return 0, nil, fmt.Errorf("kvsm: %v unexpected bytes after snapshot", d.Remaining())
+	}
+	return lastApplied, values, nil
+}
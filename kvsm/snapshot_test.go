@@ -0,0 +1,127 @@
+package kvsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	kv := NewKVStateMachine()
+	kv.ApplyCommand(1, Put("b", "2"))
+	kv.ApplyCommand(2, Put("a", "1"))
+	kv.ApplyCommand(3, Put("c", ""))
+
+	var buf bytes.Buffer
+	if err := kv.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		'k', 'v', 's', 'm', 1, 3, 3,
+		1, 'a', 1, '1',
+		1, 'b', 1, '2',
+		1, 'c', 0,
+	}
+	if !bytes.Equal(buf.Bytes()[:len(buf.Bytes())-4], expected) {
+		t.Fatal(buf.Bytes())
+	}
+
+	// A replica that applied the same commands in another order of keys
+	// writes the same snapshot.
+	kv2 := NewKVStateMachine()
+	kv2.ApplyCommand(1, Put("c", ""))
+	kv2.ApplyCommand(2, Put("a", "1"))
+	kv2.ApplyCommand(3, Put("b", "2"))
+	var buf2 bytes.Buffer
+	if err := kv2.Snapshot(&buf2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+		t.Fatal(buf2.Bytes())
+	}
+
+	// Restore replaces the state
+	r := NewKVStateMachine()
+	r.ApplyCommand(1, Put("x", "x"))
+	if err := r.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if r.GetLastApplied() != 3 || !reflect.DeepEqual(r.values, kv.values) {
+		t.Fatal(r.lastApplied, r.values)
+	}
+	if res := r.ApplyCommand(4, Get("a")); res != (Result{"1", true, true}) {
+		t.Fatal(res)
+	}
+
+	si, err := ReadSnapshotInfo(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := binary.BigEndian.Uint32(buf.Bytes()[buf.Len()-4:])
+	if si != (SnapshotInfo{1, 3, 3, buf.Len(), checksum}) {
+		t.Fatal(si)
+	}
+	if _, err := ReadSnapshotInfo(bytes.NewReader(buf.Bytes()[1:])); err == nil {
+		t.Fatal()
+	}
+}
+
+func TestRestore_Errors(t *testing.T) {
+	kv := NewKVStateMachine()
+	kv.ApplyCommand(1, Put("a", "1"))
+	var buf bytes.Buffer
+	if err := kv.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), good...))
+	}
+	tests := []struct {
+		snapshot []byte
+		expected string
+	}{
+		{nil, "kvsm: truncated"},
+		{corrupt(func(b []byte) []byte { b[0] = 'x'; return b }), "kvsm: not a snapshot"},
+		{corrupt(func(b []byte) []byte { b[4] = 2; return b }), "kvsm: unsupported snapshot version: 2"},
+		{corrupt(func(b []byte) []byte { b[8] = 'b'; return b }), "kvsm: snapshot checksum mismatch"},
+		{corrupt(func(b []byte) []byte { return b[:len(b)-1] }), "kvsm: snapshot checksum mismatch"},
+	}
+	r := NewKVStateMachine()
+	r.ApplyCommand(1, Put("x", "x"))
+	for _, test := range tests {
+		err := r.Restore(bytes.NewReader(test.snapshot))
+		if err == nil || err.Error() != test.expected {
+			t.Fatal(test.snapshot, err)
+		}
+	}
+	// The state is unchanged after a failed restore
+	if v, ok := r.Get("x"); r.GetLastApplied() != 1 || !ok || v != "x" {
+		t.Fatal(r.lastApplied, r.values)
+	}
+
+	// Keys out of order are rejected even with a valid checksum
+	kv2 := NewKVStateMachine()
+	kv2.values = map[string]string{"a": "", "b": ""}
+	var buf2 bytes.Buffer
+	if err := kv2.Snapshot(&buf2); err != nil {
+		t.Fatal(err)
+	}
+	sorted := buf2.Bytes()
+	swapped := append([]byte(nil), sorted...)
+	copy(swapped[7:], []byte{1, 'b', 0, 1, 'a', 0})
+	_, _, err := decodeSnapshot(fixChecksum(swapped))
+	if err == nil || err.Error() != `kvsm: snapshot keys out of order: "a" after "b"` {
+		t.Fatal(err)
+	}
+}
+
+// fixChecksum replaces the checksum at the end of the given snapshot.
+func fixChecksum(b []byte) []byte {
+	body := b[:len(b)-4]
+	binary.BigEndian.PutUint32(b[len(body):], crc32.Checksum(body, crc32cTable))
+	return b
+}
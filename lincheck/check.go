@@ -0,0 +1,196 @@
+package lincheck
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Model is a sequential specification of the system being checked.
+//
+// States must be values that can be compared by their printed form with %#v,
+// which is used to avoid searching the same state twice.
+//
+type Model interface {
+	// Init returns the initial state.
+	Init() interface{}
+
+	// Step applies the given input to the given state, and returns the new
+	// state and the expected output. Step must not modify the given state.
+	Step(state interface{}, input interface{}) (interface{}, interface{})
+}
+
+// Partitioner is an optional interface for a Model whose history can be split
+// into independent parts - e.g. by key - that are checked separately.
+type Partitioner interface {
+	Partition(history []Operation) [][]Operation
+}
+
+// NotLinearizableError is returned by Check for a history that is not
+// linearizable.
+type NotLinearizableError struct {
+	// The operations of the partition that is not linearizable.
+	History []Operation
+	// The longest linearization found for a prefix of the history.
+	Longest []Operation
+	// The completed operations that could not be linearized after Longest.
+	Remaining []Operation
+}
+
+func (e *NotLinearizableError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(
+		&b, "history of %v operations is not linearizable: %v operations linearized:",
+		len(e.History), len(e.Longest),
+	)
+	for _, op := range e.Longest {
+		b.WriteString("\n  ")
+		b.WriteString(op.String())
+	}
+	b.WriteString("\nbut none of these can be next:")
+	for _, op := range e.Remaining {
+		b.WriteString("\n  ")
+		b.WriteString(op.String())
+	}
+	return b.String()
+}
+
+// Check checks that the given history is linearizable for the given model.
+//
+// Returns a *NotLinearizableError if it is not.
+//
+func Check(model Model, history []Operation) error {
+	if model == nil {
+		return errors.New("'model' cannot be nil")
+	}
+	for _, op := range history {
+		if op.Return <= op.Call {
+			return fmt.Errorf("operation returns before it is called: %v", op)
+		}
+	}
+	partitions := [][]Operation{history}
+	if p, ok := model.(Partitioner); ok {
+		partitions = p.Partition(history)
+	}
+	for _, partition := range partitions {
+		if err := checkPartition(model, partition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// search is the state of the search for a linearization of a partition.
+type search struct {
+	model Model
+	ops   []Operation // ordered by Call
+
+	linearized []bool
+	order      []int // the current linearization
+	remaining  int   // completed operations not yet linearized
+	visited    map[string]bool
+
+	longest []int
+}
+
+func checkPartition(model Model, history []Operation) error {
+	ops := append([]Operation(nil), history...)
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+
+	s := &search{
+		model:      model,
+		ops:        ops,
+		linearized: make([]bool, len(ops)),
+		visited:    make(map[string]bool),
+	}
+	for _, op := range ops {
+		if op.Return != Pending {
+			s.remaining++
+		}
+	}
+	if s.run(model.Init()) {
+		return nil
+	}
+
+	e := &NotLinearizableError{History: history}
+	done := make([]bool, len(ops))
+	for _, i := range s.longest {
+		e.Longest = append(e.Longest, ops[i])
+		done[i] = true
+	}
+	for i, op := range ops {
+		if !done[i] && op.Return != Pending {
+			e.Remaining = append(e.Remaining, op)
+		}
+	}
+	return e
+}
+
+// run searches for a linearization of the operations not yet linearized,
+// starting from the given state.
+func (s *search) run(state interface{}) bool {
+	if s.remaining == 0 {
+		return true
+	}
+	key := s.key(state)
+	if s.visited[key] {
+		return false
+	}
+	s.visited[key] = true
+
+	// An operation can be next if it was called before every operation that
+	// is not yet linearized has returned.
+	minReturn := int64(Pending)
+	for i, op := range s.ops {
+		if !s.linearized[i] && op.Return < minReturn {
+			minReturn = op.Return
+		}
+	}
+	for i, op := range s.ops {
+		if op.Call > minReturn {
+			break
+		}
+		if s.linearized[i] {
+			continue
+		}
+		newState, output := s.model.Step(state, op.Input)
+		if op.Return != Pending && !reflect.DeepEqual(output, op.Output) {
+			continue
+		}
+
+		s.linearized[i] = true
+		s.order = append(s.order, i)
+		if op.Return != Pending {
+			s.remaining--
+		}
+		if len(s.order) > len(s.longest) {
+			s.longest = append(s.longest[:0], s.order...)
+		}
+
+		if s.run(newState) {
+			return true
+		}
+
+		s.linearized[i] = false
+		s.order = s.order[:len(s.order)-1]
+		if op.Return != Pending {
+			s.remaining++
+		}
+	}
+	return false
+}
+
+func (s *search) key(state interface{}) string {
+	var b strings.Builder
+	for _, l := range s.linearized {
+		if l {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+	}
+	fmt.Fprintf(&b, "|%#v", state)
+	return b.String()
+}
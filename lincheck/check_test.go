@@ -0,0 +1,186 @@
+package lincheck
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func write(v int) RegisterInput {
+	return RegisterInput{true, v}
+}
+
+var read = RegisterInput{}
+
+func TestCheck_Register(t *testing.T) {
+	m := RegisterModel{0}
+
+	tests := []struct {
+		name         string
+		history      []Operation
+		linearizable bool
+	}{
+		{"empty", nil, true},
+		{
+			"sequential",
+			[]Operation{
+				{0, write(1), 1, nil, 2},
+				{1, read, 3, 1, 4},
+			},
+			true,
+		},
+		{
+			"stale read",
+			[]Operation{
+				{0, write(1), 1, nil, 2},
+				{1, read, 3, 0, 4},
+			},
+			false,
+		},
+		{
+			// The read can be linearized before or after the concurrent write
+			"concurrent read of old value",
+			[]Operation{
+				{0, write(1), 1, nil, 4},
+				{1, read, 2, 0, 3},
+			},
+			true,
+		},
+		{
+			"concurrent read of new value",
+			[]Operation{
+				{0, write(1), 1, nil, 4},
+				{1, read, 2, 1, 3},
+			},
+			true,
+		},
+		{
+			// Once a read sees the new value, a later read cannot see the old one
+			"new then old",
+			[]Operation{
+				{0, write(1), 1, nil, 10},
+				{1, read, 2, 1, 3},
+				{2, read, 4, 0, 5},
+			},
+			false,
+		},
+		{
+			"pending write that took effect",
+			[]Operation{
+				{0, write(1), 1, nil, Pending},
+				{1, read, 2, 1, 3},
+			},
+			true,
+		},
+		{
+			"pending write that did not take effect",
+			[]Operation{
+				{0, write(1), 1, nil, Pending},
+				{1, read, 2, 0, 3},
+			},
+			true,
+		},
+		{
+			"pending write cannot take effect before it is called",
+			[]Operation{
+				{1, read, 1, 1, 2},
+				{0, write(1), 3, nil, Pending},
+			},
+			false,
+		},
+	}
+	for _, test := range tests {
+		err := Check(m, test.history)
+		if test.linearizable && err != nil {
+			t.Fatal(test.name, err)
+		}
+		if !test.linearizable {
+			if _, ok := err.(*NotLinearizableError); !ok {
+				t.Fatal(test.name, err)
+			}
+		}
+	}
+}
+
+func TestCheck_KV(t *testing.T) {
+	m := KVModel{}
+	history := []Operation{
+		{0, KVInput{KVAppend, "x", "a"}, 1, nil, 2},
+		{1, KVInput{KVPut, "y", "1"}, 3, nil, 6},
+		{0, KVInput{KVAppend, "x", "b"}, 4, nil, 5},
+		{2, KVInput{KVGet, "y", ""}, 4, "1", 7},
+		{2, KVInput{KVGet, "x", ""}, 8, "ab", 9},
+	}
+	if err := Check(m, history); err != nil {
+		t.Fatal(err)
+	}
+
+	// A duplicated append is not linearizable
+	history[4].Output = "abb"
+	err := Check(m, history)
+	e, ok := err.(*NotLinearizableError)
+	if !ok {
+		t.Fatal(err)
+	}
+	// ... and the error has only the operations on the key
+	if len(e.History) != 3 || len(e.Longest) != 2 || !reflect.DeepEqual(e.Remaining, history[4:]) {
+		t.Fatal(e)
+	}
+	expected := `history of 3 operations is not linearizable: 2 operations linearized:
+  client 0: append("x", "a") -> <nil> [1, 2]
+  client 0: append("x", "b") -> <nil> [4, 5]
+but none of these can be next:
+  client 2: get("x") -> abb [8, 9]`
+	if err.Error() != expected {
+		t.Fatal(err)
+	}
+}
+
+func TestCheck_Errors(t *testing.T) {
+	if err := Check(nil, nil); err == nil {
+		t.Fatal()
+	}
+	err := Check(RegisterModel{}, []Operation{{0, read, 2, nil, 2}})
+	if err == nil || !strings.HasPrefix(err.Error(), "operation returns before it is called") {
+		t.Fatal(err)
+	}
+}
+
+// Concurrent writes allow many orders, which memoization keeps tractable.
+func TestCheck_Concurrent(t *testing.T) {
+	var history []Operation
+	for i := 0; i < 10; i++ {
+		history = append(history, Operation{i, write(i), 1 + int64(i), nil, 100 + int64(i)})
+	}
+	history = append(history, Operation{10, read, 200, 7, 201})
+	if err := Check(RegisterModel{0}, history); err != nil {
+		t.Fatal(err)
+	}
+	history[10].Output = 10
+	if err := Check(RegisterModel{0}, history); err == nil {
+		t.Fatal()
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+	id1 := r.Invoke(1, write(1))
+	id2 := r.Invoke(2, read)
+	id3 := r.Invoke(3, write(3))
+	r.Complete(id2, 0)
+	r.Fail(id3)
+	r.Invoke(4, read)
+	r.Complete(id1, nil)
+
+	expected := []Operation{
+		{1, write(1), 1, nil, 6},
+		{2, read, 2, 0, 4},
+		{4, read, 5, nil, Pending},
+	}
+	if h := r.History(); !reflect.DeepEqual(h, expected) {
+		t.Fatal(h)
+	}
+	if err := Check(RegisterModel{0}, r.History()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,265 @@
+package lincheck
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/config"
+	"github.com/divtxt/raft/impl"
+	"github.com/divtxt/raft/inmemlog"
+	"github.com/divtxt/raft/rps"
+	"github.com/divtxt/raft/simnet"
+	"github.com/divtxt/raft/testdata"
+)
+
+var testServerIds = []ServerId{101, 102, 103, 104, 105}
+
+var testKeys = []string{"x", "y", "z"}
+
+const (
+	testClients       = 5
+	testDuration      = 2 * time.Second
+	testResultTimeout = time.Second
+)
+
+// encodeKVInput encodes a KVInput as a command for kvStateMachine.
+func encodeKVInput(ki KVInput) Command {
+	return Command(fmt.Sprintf("%d %s %s", ki.Op, ki.Key, ki.Value))
+}
+
+// kvStateMachine is a key-value store that applies commands encoded by
+// encodeKVInput, with the outputs of KVModel.
+//
+// It keeps its state when its server is restarted.
+//
+type kvStateMachine struct {
+	mutex       *sync.Mutex
+	lastApplied LogIndex
+	values      map[string]string
+}
+
+func newKVStateMachine() *kvStateMachine {
+	return &kvStateMachine{&sync.Mutex{}, 0, make(map[string]string)}
+}
+
+func (kv *kvStateMachine) GetLastApplied() LogIndex {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	return kv.lastApplied
+}
+
+func (kv *kvStateMachine) ApplyCommand(logIndex LogIndex, command Command) CommandResult {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if logIndex != kv.lastApplied+1 {
+		panic(fmt.Sprintf("kvStateMachine: logIndex=%d but lastApplied=%d", logIndex, kv.lastApplied))
+	}
+	kv.lastApplied = logIndex
+
+	var op KVOp
+	var key, value string
+	fmt.Sscanf(string(command), "%d %s %s", &op, &key, &value)
+	switch op {
+	case KVPut:
+		kv.values[key] = value
+	case KVAppend:
+		kv.values[key] += value
+	default:
+		return kv.values[key]
+	}
+	return nil
+}
+
+// newTestCluster starts a cluster of ConsensusModules that keep their log,
+// persistent state and state machine when restarted.
+func newTestCluster(t *testing.T, seed int64) *simnet.Cluster {
+	mutex := &sync.Mutex{}
+	logs := make(map[ServerId]*inmemlog.InMemoryLog)
+	states := make(map[ServerId]*rps.InMemoryRaftPersistentState)
+	sms := make(map[ServerId]*kvStateMachine)
+
+	newNode := func(serverId ServerId, rpcService RpcService) (IConsensusModule, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if logs[serverId] == nil {
+			iml, err := inmemlog.NewInMemoryLog(testdata.MaxEntriesPerAppendEntry)
+			if err != nil {
+				return nil, err
+			}
+			logs[serverId] = iml
+			states[serverId] = rps.NewIMPSWithCurrentTerm(0)
+			sms[serverId] = newKVStateMachine()
+		}
+
+		ci, err := config.NewClusterInfo(testServerIds, serverId)
+		if err != nil {
+			return nil, err
+		}
+		return impl.NewConsensusModule(
+			states[serverId],
+			logs[serverId],
+			sms[serverId],
+			rpcService,
+			ci,
+			config.TimeSettings{testdata.TickerDuration, testdata.ElectionTimeoutLow},
+			log.New(ioutil.Discard, "", 0),
+		)
+	}
+
+	c, err := simnet.NewCluster(testServerIds, seed, newNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// runClient runs operations on random keys against the leader until stop is
+// closed, recording them with the given Recorder.
+//
+// An operation that the leader rejects had no effect. An operation whose result
+// channel is closed or times out is left pending: the entry may have been
+// discarded by this leader but still be committed by a later one.
+//
+func runClient(c *simnet.Cluster, r *Recorder, clientId int, stop <-chan struct{}) {
+	rnd := rand.New(rand.NewSource(int64(clientId)))
+	for n := 0; ; n++ {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		leaders := c.Leaders()
+		if len(leaders) == 0 {
+			time.Sleep(testdata.SleepToLetGoroutineRun)
+			continue
+		}
+		cm := c.Node(leaders[rnd.Intn(len(leaders))])
+		if cm == nil {
+			continue
+		}
+
+		key := testKeys[rnd.Intn(len(testKeys))]
+		// Values are unique so that a duplicated or lost operation is visible.
+		value := fmt.Sprintf("%d.%d,", clientId, n)
+		var input KVInput
+		switch p := rnd.Intn(10); {
+		case p < 4:
+			input = KVInput{KVGet, key, ""}
+		case p < 5:
+			input = KVInput{KVPut, key, value}
+		default:
+			input = KVInput{KVAppend, key, value}
+		}
+
+		id := r.Invoke(clientId, input)
+		crc, err := cm.AppendCommand(encodeKVInput(input))
+		if err != nil {
+			r.Fail(id)
+			continue
+		}
+		select {
+		case result, ok := <-crc:
+			if ok {
+				r.Complete(id, result)
+			}
+		case <-time.After(testResultTimeout):
+		}
+	}
+}
+
+// runNemesis injects random partitions and crashes until stop is closed.
+func runNemesis(c *simnet.Cluster, seed int64, stop <-chan struct{}) {
+	rnd := rand.New(rand.NewSource(seed))
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(100+rnd.Intn(200)) * time.Millisecond):
+		}
+
+		c.Network.Heal()
+		for _, serverId := range testServerIds {
+			if c.Node(serverId) == nil {
+				if err := c.Start(serverId); err != nil {
+					panic(err)
+				}
+			}
+		}
+
+		ids := append([]ServerId(nil), testServerIds...)
+		rnd.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+		switch rnd.Intn(4) {
+		case 0:
+			// all healed
+		case 1:
+			c.Network.Isolate(ids[0], ids[1:])
+		case 2:
+			c.Network.Partition(ids[:2], ids[2:])
+		case 3:
+			c.Stop(ids[0])
+		}
+	}
+}
+
+// TestCluster_Linearizable checks that clients of a cluster see linearizable
+// results while the network is partitioned and servers are restarted.
+func TestCluster_Linearizable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	c := newTestCluster(t, 1)
+	err := c.Network.SetFaults(simnet.Faults{
+		Drop:      0.02,
+		MaxDelay:  2 * time.Millisecond,
+		Duplicate: 0.05,
+		LateDelay: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRecorder()
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < testClients; i++ {
+		wg.Add(1)
+		go func(clientId int) {
+			defer wg.Done()
+			runClient(c, r, clientId, stop)
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runNemesis(c, 1, stop)
+	}()
+
+	time.Sleep(testDuration)
+	close(stop)
+	wg.Wait()
+	c.StopAll()
+
+	history := r.History()
+	completed := 0
+	for _, op := range history {
+		if op.Return != Pending {
+			completed++
+		}
+	}
+	t.Logf("%v operations, %v completed", len(history), completed)
+	if completed == 0 {
+		t.Fatal("no operations completed")
+	}
+
+	if err := Check(KVModel{}, history); err != nil {
+		t.Fatal(err)
+	}
+}
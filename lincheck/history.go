@@ -0,0 +1,103 @@
+// Package lincheck records client histories and checks them for linearizability.
+//
+// Clients record the invocation and completion of each operation with a
+// Recorder. Check then searches for a linearization of the history - an order
+// of the operations that is consistent with their real-time order and with a
+// sequential Model of the system - using the algorithm of Wing & Gong with the
+// memoization of Lowe, as used by Porcupine and Knossos.
+//
+// An operation that has no known result, e.g. because the client timed out, is
+// pending: it may or may not have taken effect, at any time after it was
+// invoked. An operation that is known to have had no effect, e.g. because the
+// leader rejected the command, should be removed from the history with Fail.
+//
+package lincheck
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Pending is the Return time of an operation that has no known result.
+const Pending = math.MaxInt64
+
+// Operation is an operation in a history.
+//
+// Call and Return are logical times: an operation can only have taken effect
+// after its Call and before its Return.
+//
+type Operation struct {
+	ClientId int
+	Input    interface{}
+	Call     int64
+	Output   interface{}
+	Return   int64
+}
+
+func (op Operation) String() string {
+	if op.Return == Pending {
+		return fmt.Sprintf("client %v: %v -> ? [%v, pending]", op.ClientId, op.Input, op.Call)
+	}
+	return fmt.Sprintf(
+		"client %v: %v -> %v [%v, %v]", op.ClientId, op.Input, op.Output, op.Call, op.Return,
+	)
+}
+
+// Recorder records a history of operations from concurrent clients.
+//
+// A Recorder is safe for concurrent use.
+//
+type Recorder struct {
+	mutex  *sync.Mutex
+	clock  int64
+	ops    []Operation
+	failed []bool
+}
+
+// NewRecorder creates an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{mutex: &sync.Mutex{}}
+}
+
+// Invoke records the invocation of an operation by the given client, and
+// returns an id for the operation.
+func (r *Recorder) Invoke(clientId int, input interface{}) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clock++
+	r.ops = append(r.ops, Operation{clientId, input, r.clock, nil, Pending})
+	r.failed = append(r.failed, false)
+	return len(r.ops) - 1
+}
+
+// Complete records the completion of the given operation with its output.
+func (r *Recorder) Complete(id int, output interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clock++
+	r.ops[id].Output = output
+	r.ops[id].Return = r.clock
+}
+
+// Fail removes the given operation from the history. This must only be called
+// if the operation is known to have had no effect.
+func (r *Recorder) Fail(id int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.failed[id] = true
+}
+
+// History returns the operations recorded so far. Operations that have not
+// completed are pending.
+func (r *Recorder) History() []Operation {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	history := make([]Operation, 0, len(r.ops))
+	for i, op := range r.ops {
+		if !r.failed[i] {
+			history = append(history, op)
+		}
+	}
+	return history
+}
@@ -0,0 +1,122 @@
+package lincheck
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RegisterInput is the input of an operation on a register.
+type RegisterInput struct {
+	Write bool
+	Value interface{} // the value to write
+}
+
+func (ri RegisterInput) String() string {
+	if ri.Write {
+		return fmt.Sprintf("write(%v)", ri.Value)
+	}
+	return "read()"
+}
+
+// RegisterModel is a single read/write register.
+//
+// A read outputs the value of the register and a write outputs nil.
+//
+type RegisterModel struct {
+	// The initial value of the register.
+	Initial interface{}
+}
+
+// Init implements Model.
+func (rm RegisterModel) Init() interface{} {
+	return rm.Initial
+}
+
+// Step implements Model.
+func (rm RegisterModel) Step(state interface{}, input interface{}) (interface{}, interface{}) {
+	ri := input.(RegisterInput)
+	if ri.Write {
+		return ri.Value, nil
+	}
+	return state, state
+}
+
+// KVOp is the type of an operation on a key-value store.
+type KVOp int
+
+// The KVOp values.
+const (
+	KVGet KVOp = iota
+	KVPut
+	KVAppend
+)
+
+// KVInput is the input of an operation on a key-value store.
+type KVInput struct {
+	Op    KVOp
+	Key   string
+	Value string // the value to put or append
+}
+
+func (ki KVInput) String() string {
+	switch ki.Op {
+	case KVGet:
+		return fmt.Sprintf("get(%q)", ki.Key)
+	case KVPut:
+		return fmt.Sprintf("put(%q, %q)", ki.Key, ki.Value)
+	case KVAppend:
+		return fmt.Sprintf("append(%q, %q)", ki.Key, ki.Value)
+	default:
+		return fmt.Sprintf("KVOp(%d)(%q, %q)", ki.Op, ki.Key, ki.Value)
+	}
+}
+
+// KVModel is a key-value store of strings, where a missing key has the value "".
+//
+// A get outputs the value of the key, and a put or append outputs nil.
+// Appends make duplicated operations visible to later gets.
+//
+// KVModel partitions a history by key.
+//
+type KVModel struct{}
+
+// Init implements Model.
+func (KVModel) Init() interface{} {
+	return ""
+}
+
+// Step implements Model.
+//
+// Since a history is partitioned by key, the state is the value of one key.
+//
+func (KVModel) Step(state interface{}, input interface{}) (interface{}, interface{}) {
+	value := state.(string)
+	ki := input.(KVInput)
+	switch ki.Op {
+	case KVPut:
+		return ki.Value, nil
+	case KVAppend:
+		return value + ki.Value, nil
+	default:
+		return value, value
+	}
+}
+
+// Partition implements Partitioner.
+func (KVModel) Partition(history []Operation) [][]Operation {
+	byKey := make(map[string][]Operation)
+	for _, op := range history {
+		key := op.Input.(KVInput).Key
+		byKey[key] = append(byKey[key], op)
+	}
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	partitions := make([][]Operation, len(keys))
+	for i, key := range keys {
+		partitions[i] = byKey[key]
+	}
+	return partitions
+}
@@ -14,7 +14,11 @@ type WatchedIndex struct {
 	lock      sync.Mutex
 	value     LogIndex
 	verifier  IndexChangeVerifier
-	listeners []IndexChangeListener
+	listeners []*watchedIndexListener
+}
+
+type watchedIndexListener struct {
+	f IndexChangeListener
 }
 
 // NewWatchedIndex creates a new WatchedIndex without a verifier.
@@ -46,11 +50,30 @@ func (p *WatchedIndex) Get() LogIndex {
 // the value or the list of listeners which means that it is NOT safe to call
 // from the verifier or a listener.
 //
-// Whenever the underlying value changes, the listener will be called.
-func (p *WatchedIndex) AddListener(didChangeListener IndexChangeListener) {
+// Whenever the underlying value changes, the listener will be called until
+// it is removed by calling the returned function. Like AddListener, the
+// returned function is NOT safe to call from the verifier or a listener.
+// Calling it more than once has no further effect.
+func (p *WatchedIndex) AddListener(didChangeListener IndexChangeListener) func() {
+	l := &watchedIndexListener{didChangeListener}
 	p.lock.Lock()
-	p.listeners = append(p.listeners, didChangeListener)
+	p.listeners = append(p.listeners, l)
 	p.lock.Unlock()
+	return func() {
+		p.removeListener(l)
+	}
+}
+
+func (p *WatchedIndex) removeListener(l *watchedIndexListener) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i, x := range p.listeners {
+		if x == l {
+			p.listeners = append(p.listeners[:i], p.listeners[i+1:]...)
+			return
+		}
+	}
 }
 
 // Set the LogIndex to the given value.
@@ -84,8 +107,8 @@ func (p *WatchedIndex) Set(new LogIndex) error {
 
 	atomic.StoreUint64((*uint64)(&p.value), uint64(new))
 
-	for _, f := range p.listeners {
-		f(new)
+	for _, l := range p.listeners {
+		l.f(new)
 	}
 	return nil
 }
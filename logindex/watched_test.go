@@ -55,6 +55,40 @@ func TestWatchedIndex(t *testing.T) {
 	ss.checkCalls(t, []string{"icl1:8", "icl2:8"})
 }
 
+func TestWatchedIndex_RemoveListener(t *testing.T) {
+	wi := logindex.NewWatchedIndex()
+
+	ss := &someStrings{}
+
+	remove1 := wi.AddListener(func(n LogIndex) {
+		ss.append(fmt.Sprintf("icl1:%v", n))
+	})
+	wi.AddListener(func(n LogIndex) {
+		ss.append(fmt.Sprintf("icl2:%v", n))
+	})
+	remove3 := wi.AddListener(func(n LogIndex) {
+		ss.append(fmt.Sprintf("icl3:%v", n))
+	})
+
+	// Removed listeners are not called, and the others keep their order
+	remove1()
+	err := wi.Set(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.checkCalls(t, []string{"icl2:2", "icl3:2"})
+
+	// Removing again has no effect
+	remove1()
+	remove3()
+	remove3()
+	err = wi.Set(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.checkCalls(t, []string{"icl2:3"})
+}
+
 func TestWatchedIndex_With_Verifier(t *testing.T) {
 	ss := &someStrings{}
 
@@ -0,0 +1,171 @@
+// Package recovery rewrites the state of a surviving server so that a cluster
+// that has permanently lost a majority of its servers can be brought back.
+//
+// This is an unsafe operation: raft cannot make progress without a quorum, and
+// recovery works around that by declaring a new set of members and making the
+// chosen survivor the most up-to-date server among them. Entries that were
+// committed by the old cluster but are not in the log of the survivor are lost,
+// and entries in the log of the survivor that were never committed become
+// committed. It is the equivalent of Consul's peers.json recovery.
+//
+// Procedure:
+//
+//  1. Stop every remaining server of the cluster. Recovery must never be used
+//     while any server of the old cluster is still running.
+//  2. Pick the survivor with the most up-to-date log - the highest last term,
+//     then the highest last index (see cmd/raftctl). Picking any other
+//     survivor loses more entries.
+//  3. Run UnsafeRecover on the data of that survivor with the new members.
+//     This bumps its term and appends an audit entry at the new term.
+//  4. Change the cluster configuration of every new member to the new members.
+//  5. Start the recovered server first, then start the other new members one
+//     at a time and wait for the recovered server to become leader before
+//     starting the next one. Until it is leader, a majority of the other new
+//     members could elect a leader of their own and overwrite the recovered log.
+//
+// Other survivors can keep their logs: the recovered server replaces any
+// entries that conflict with its own once it is leader.
+//
+package recovery
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/config"
+)
+
+// Acknowledgement is the guard of UnsafeRecover: the caller must pass
+// AcknowledgeDataLoss to show that it accepts the loss of committed entries.
+type Acknowledgement string
+
+// AcknowledgeDataLoss is the only Acknowledgement accepted by UnsafeRecover.
+const AcknowledgeDataLoss Acknowledgement = "I understand that unsafe recovery can lose committed entries"
+
+// ErrNotAcknowledged is returned by UnsafeRecover if the Acknowledgement is not
+// AcknowledgeDataLoss.
+var ErrNotAcknowledged = errors.New("recovery: data loss was not acknowledged")
+
+// Record is the audit record of a recovery.
+type Record struct {
+	Time     time.Time
+	ServerId ServerId
+	// The new members of the cluster, in order.
+	Members []ServerId
+	// The term of the server before and after the recovery.
+	OldTerm TermNo
+	NewTerm TermNo
+	// The last entry of the log before the recovery.
+	LastLogIndex LogIndex
+	LastLogTerm  TermNo
+	// The index of the audit entry. Its term is NewTerm.
+	AuditIndex LogIndex
+	Reason     string
+}
+
+// AuditCommandFunc returns the command of the audit entry for the given record,
+// so that the recovery is visible in the replicated state.
+//
+// The command is applied to the state machine like any other command, so it
+// must be a valid command for the state machine.
+//
+type AuditCommandFunc func(record Record) (Command, error)
+
+// UnsafeRecover makes this server of the given ClusterInfo - which lists the
+// new members of the cluster - the most up-to-date server of the new cluster.
+//
+// It sets the current term to one more than the highest of the current term
+// and the term of the last entry, and appends an audit entry at the new term.
+// The survivor then wins any election against the other new members, and the
+// audit entry - and with it every entry before it - is committed in the new
+// term once the survivor is leader.
+//
+// The server must not be running. If the log buffers writes, it must be closed
+// or synced after this returns.
+//
+// See the package documentation for the procedure and the data loss risks.
+//
+func UnsafeRecover(
+	raftPersistentState RaftPersistentState,
+	log Log,
+	clusterInfo *config.ClusterInfo,
+	auditCommand AuditCommandFunc,
+	reason string,
+	ack Acknowledgement,
+) (*Record, error) {
+	if ack != AcknowledgeDataLoss {
+		return nil, ErrNotAcknowledged
+	}
+	if raftPersistentState == nil {
+		return nil, errors.New("'raftPersistentState' cannot be nil")
+	}
+	if log == nil {
+		return nil, errors.New("'log' cannot be nil")
+	}
+	if clusterInfo == nil {
+		return nil, errors.New("'clusterInfo' cannot be nil")
+	}
+	if auditCommand == nil {
+		return nil, errors.New("'auditCommand' cannot be nil")
+	}
+	if reason == "" {
+		return nil, errors.New("reason cannot be empty")
+	}
+
+	members := []ServerId{clusterInfo.GetThisServerId()}
+	clusterInfo.ForEachPeer(func(serverId ServerId) {
+		members = append(members, serverId)
+	})
+	sort.Slice(members, func(i, j int) bool { return members[i] < members[j] })
+
+	lastLogIndex := log.GetIndexOfLastEntry()
+	var lastLogTerm TermNo
+	if lastLogIndex > 0 {
+		var err error
+		lastLogTerm, err = log.GetTermAtIndex(lastLogIndex)
+		if err != nil {
+			return nil, fmt.Errorf("recovery: cannot read the last entry: %v", err)
+		}
+	}
+	oldTerm := raftPersistentState.GetCurrentTerm()
+	newTerm := oldTerm
+	if lastLogTerm > newTerm {
+		newTerm = lastLogTerm
+	}
+	newTerm++
+
+	record := Record{
+		time.Now(),
+		clusterInfo.GetThisServerId(),
+		members,
+		oldTerm,
+		newTerm,
+		lastLogIndex,
+		lastLogTerm,
+		lastLogIndex + 1,
+		reason,
+	}
+	command, err := auditCommand(record)
+	if err != nil {
+		return nil, fmt.Errorf("recovery: audit command: %v", err)
+	}
+
+	// The term must be saved first: the log must never have an entry with a
+	// term that is higher than the current term.
+	if err := raftPersistentState.SetCurrentTerm(newTerm); err != nil {
+		return nil, err
+	}
+	auditIndex, err := log.AppendEntry(LogEntry{newTerm, command})
+	if err != nil {
+		return nil, err
+	}
+	if auditIndex != record.AuditIndex {
+		return nil, fmt.Errorf(
+			"recovery: audit entry appended at index %v instead of %v", auditIndex, record.AuditIndex,
+		)
+	}
+	return &record, nil
+}
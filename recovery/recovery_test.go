@@ -0,0 +1,272 @@
+package recovery
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/config"
+	"github.com/divtxt/raft/impl"
+	"github.com/divtxt/raft/inmemlog"
+	"github.com/divtxt/raft/kvsm"
+	"github.com/divtxt/raft/rps"
+	"github.com/divtxt/raft/simnet"
+	"github.com/divtxt/raft/testdata"
+)
+
+func auditPut(record Record) (Command, error) {
+	return kvsm.Put("recovery", record.Reason), nil
+}
+
+func newTestLog(t *testing.T, terms ...TermNo) *inmemlog.InMemoryLog {
+	iml, err := inmemlog.NewInMemoryLog(testdata.MaxEntriesPerAppendEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, termNo := range terms {
+		if _, err := iml.AppendEntry(LogEntry{termNo, Command("c")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return iml
+}
+
+func TestUnsafeRecover_Validation(t *testing.T) {
+	ci, err := config.NewClusterInfo([]ServerId{1, 2, 3}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imps := rps.NewIMPSWithCurrentTerm(2)
+	iml := newTestLog(t, 1, 2)
+
+	tests := []struct {
+		raftPersistentState RaftPersistentState
+		log                 Log
+		clusterInfo         *config.ClusterInfo
+		auditCommand        AuditCommandFunc
+		reason              string
+		ack                 Acknowledgement
+		expected            string
+	}{
+		{imps, iml, ci, auditPut, "lost 2 and 3", "yes", ErrNotAcknowledged.Error()},
+		{nil, iml, ci, auditPut, "lost 2 and 3", AcknowledgeDataLoss, "'raftPersistentState' cannot be nil"},
+		{imps, nil, ci, auditPut, "lost 2 and 3", AcknowledgeDataLoss, "'log' cannot be nil"},
+		{imps, iml, nil, auditPut, "lost 2 and 3", AcknowledgeDataLoss, "'clusterInfo' cannot be nil"},
+		{imps, iml, ci, nil, "lost 2 and 3", AcknowledgeDataLoss, "'auditCommand' cannot be nil"},
+		{imps, iml, ci, auditPut, "", AcknowledgeDataLoss, "reason cannot be empty"},
+		{
+			imps, iml, ci,
+			func(Record) (Command, error) { return nil, errors.New("boom") },
+			"lost 2 and 3", AcknowledgeDataLoss,
+			"recovery: audit command: boom",
+		},
+	}
+	for _, test := range tests {
+		_, err := UnsafeRecover(
+			test.raftPersistentState, test.log, test.clusterInfo, test.auditCommand, test.reason, test.ack,
+		)
+		if err == nil || err.Error() != test.expected {
+			t.Fatal(test.expected, err)
+		}
+	}
+
+	// Nothing was changed
+	if imps.GetCurrentTerm() != 2 || iml.GetIndexOfLastEntry() != 2 {
+		t.Fatal(imps.GetCurrentTerm(), iml.GetIndexOfLastEntry())
+	}
+}
+
+func TestUnsafeRecover(t *testing.T) {
+	ci, err := config.NewClusterInfo([]ServerId{5, 1, 3}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		currentTerm TermNo
+		terms       []TermNo
+		newTerm     TermNo
+	}{
+		{0, nil, 1},
+		{5, []TermNo{1, 1, 3}, 6},
+		{3, []TermNo{1, 1, 3}, 4},
+	}
+	for _, test := range tests {
+		imps := rps.NewIMPSWithCurrentTerm(test.currentTerm)
+		if test.currentTerm != 0 {
+			if err := imps.SetVotedFor(5); err != nil {
+				t.Fatal(err)
+			}
+		}
+		iml := newTestLog(t, test.terms...)
+
+		start := time.Now()
+		record, err := UnsafeRecover(imps, iml, ci, auditPut, "lost 2 and 4", AcknowledgeDataLoss)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastLogIndex := LogIndex(len(test.terms))
+		var lastLogTerm TermNo
+		if lastLogIndex > 0 {
+			lastLogTerm = test.terms[lastLogIndex-1]
+		}
+		if record.Time.Before(start) {
+			t.Fatal(record.Time)
+		}
+		expected := Record{
+			record.Time,
+			3,
+			[]ServerId{1, 3, 5},
+			test.currentTerm,
+			test.newTerm,
+			lastLogIndex,
+			lastLogTerm,
+			lastLogIndex + 1,
+			"lost 2 and 4",
+		}
+		if !reflect.DeepEqual(*record, expected) {
+			t.Fatal(*record, expected)
+		}
+
+		if imps.GetCurrentTerm() != test.newTerm || imps.GetVotedFor() != 0 {
+			t.Fatal(imps.GetCurrentTerm(), imps.GetVotedFor())
+		}
+		if iml.GetIndexOfLastEntry() != lastLogIndex+1 {
+			t.Fatal(iml.GetIndexOfLastEntry())
+		}
+		entries, err := iml.GetEntriesAfterIndex(lastLogIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(entries, []LogEntry{{test.newTerm, kvsm.Put("recovery", "lost 2 and 4")}}) {
+			t.Fatal(entries)
+		}
+	}
+}
+
+// A 5 server cluster loses 3 servers, and the leader is recovered into a new
+// cluster with one of the other survivors.
+func TestUnsafeRecover_Cluster(t *testing.T) {
+	var mutex sync.Mutex
+	logs := make(map[ServerId]*inmemlog.InMemoryLog)
+	states := make(map[ServerId]*rps.InMemoryRaftPersistentState)
+	sms := make(map[ServerId]*kvsm.KVStateMachine)
+	newClusterFunc := func(serverIds []ServerId) simnet.NewNodeFunc {
+		return func(serverId ServerId, rpcService RpcService) (IConsensusModule, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if logs[serverId] == nil {
+				iml, err := inmemlog.NewInMemoryLog(testdata.MaxEntriesPerAppendEntry)
+				if err != nil {
+					return nil, err
+				}
+				logs[serverId] = iml
+				states[serverId] = rps.NewIMPSWithCurrentTerm(0)
+			}
+			// The state is rebuilt from the log on restart
+			sms[serverId] = kvsm.NewKVStateMachine()
+			ci, err := config.NewClusterInfo(serverIds, serverId)
+			if err != nil {
+				return nil, err
+			}
+			return impl.NewConsensusModule(
+				states[serverId],
+				logs[serverId],
+				sms[serverId],
+				rpcService,
+				ci,
+				config.TimeSettings{testdata.TickerDuration, testdata.ElectionTimeoutLow},
+				log.New(ioutil.Discard, "", 0),
+			)
+		}
+	}
+	sm := func(serverId ServerId) *kvsm.KVStateMachine {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return sms[serverId]
+	}
+
+	// apply appends the command on the leader and waits for it to be applied.
+	apply := func(c *simnet.Cluster, leader ServerId, command Command) {
+		crc, err := c.Node(leader).AppendCommand(command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case _, ok := <-crc:
+			if !ok {
+				t.Fatal("command was overwritten")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	serverIds := []ServerId{1, 2, 3, 4, 5}
+	c, err := simnet.NewCluster(serverIds, 1, newClusterFunc(serverIds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader, err := c.WaitForLeader(time.Second)
+	if err != nil {
+		c.StopAll()
+		t.Fatal(err)
+	}
+	apply(c, leader, kvsm.Put("a", "1"))
+	apply(c, leader, kvsm.Put("b", "2"))
+	c.StopAll()
+
+	// The leader has every committed entry. The other survivor may not.
+	other := leader%5 + 1
+	ci, err := config.NewClusterInfo([]ServerId{leader, other}, leader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := UnsafeRecover(states[leader], logs[leader], ci, auditPut, "lost 3 servers", AcknowledgeDataLoss)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the recovered server can be elected in the new cluster.
+	newServerIds := []ServerId{leader, other}
+	c, err = simnet.NewCluster(newServerIds, 2, newClusterFunc(newServerIds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.StopAll()
+	newLeader, err := c.WaitForLeader(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newLeader != leader || states[leader].GetCurrentTerm() < record.NewTerm {
+		t.Fatal(newLeader, states[leader].GetCurrentTerm())
+	}
+	apply(c, leader, kvsm.Put("c", "3"))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for _, serverId := range newServerIds {
+		for {
+			kv := sm(serverId)
+			v, _ := kv.Get("c")
+			if v == "3" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal(serverId, kv.Len())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		kv := sm(serverId)
+		a, _ := kv.Get("a")
+		b, _ := kv.Get("b")
+		r, _ := kv.Get("recovery")
+		if a != "1" || b != "2" || r != "lost 3 servers" {
+			t.Fatal(serverId, a, b, r)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package rpcauth
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/wire"
+)
+
+// Transport sends signed requests to the Handlers of other servers.
+type Transport interface {
+	// Call sends the given request to the Handler of the given server and returns
+	// the reply from the Handler, or nil if the call failed for any reason.
+	//
+	// Calls should follow the notes on the RpcService interface.
+	Call(toServer ServerId, request []byte) []byte
+}
+
+// Client is an RpcService that signs RPCs and sends them with a Transport.
+//
+// A reply is only returned if it is signed by the server that the request was
+// sent to, and is the reply to that request.
+//
+type Client struct {
+	thisServerId ServerId
+	keyring      *Keyring
+	transport    Transport
+	logger       *log.Logger
+
+	mutex   *sync.Mutex
+	lastSeq uint64
+}
+
+// Check that Client implements the RpcService interface
+var _ RpcService = (*Client)(nil)
+
+// NewClient creates a Client for the given server.
+func NewClient(
+	thisServerId ServerId,
+	keyring *Keyring,
+	transport Transport,
+	logger *log.Logger,
+) (*Client, error) {
+	if thisServerId == 0 {
+		return nil, errors.New("thisServerId is 0")
+	}
+	if keyring == nil {
+		return nil, errors.New("'keyring' cannot be nil")
+	}
+	if transport == nil {
+		return nil, errors.New("'transport' cannot be nil")
+	}
+	if logger == nil {
+		return nil, errors.New("'logger' cannot be nil")
+	}
+
+	return &Client{thisServerId, keyring, transport, logger, &sync.Mutex{}, 0}, nil
+}
+
+func (c *Client) RpcAppendEntries(toServer ServerId, rpc *RpcAppendEntries) *RpcAppendEntriesReply {
+	reply, _ := c.call(toServer, rpc).(*RpcAppendEntriesReply)
+	return reply
+}
+
+func (c *Client) RpcRequestVote(toServer ServerId, rpc *RpcRequestVote) *RpcRequestVoteReply {
+	reply, _ := c.call(toServer, rpc).(*RpcRequestVoteReply)
+	return reply
+}
+
+// call signs and sends the given RPC and returns the verified reply, or nil if
+// the call failed.
+func (c *Client) call(toServer ServerId, rpc interface{}) interface{} {
+	message, err := wire.Encode(nil, rpc)
+	if err != nil {
+		c.logger.Println("[rpcauth] Failed to encode RPC:", err)
+		return nil
+	}
+	seq := c.nextSeq()
+	request := seal(c.keyring, &envelope{c.thisServerId, toServer, seq, message})
+
+	replyBytes := c.transport.Call(toServer, request)
+	if replyBytes == nil {
+		return nil
+	}
+
+	env, err := open(c.keyring, replyBytes)
+	if err != nil {
+		c.logger.Println("[rpcauth] Refused reply from", toServer, ":", err)
+		return nil
+	}
+	if env.from != toServer || env.to != c.thisServerId || env.seq != seq {
+		c.logger.Printf(
+			"[rpcauth] Refused reply from %v: reply is from %v to %v for request %v, expected request %v",
+			toServer, env.from, env.to, env.seq, seq,
+		)
+		return nil
+	}
+	reply, err := wire.Decode(env.message)
+	if err != nil {
+		c.logger.Println("[rpcauth] Bad reply from", toServer, ":", err)
+		return nil
+	}
+	return reply
+}
+
+// nextSeq returns the sequence number for the next request.
+//
+// This is the current time in nanoseconds, or one more than the last sequence
+// number if the clock has not moved on.
+func (c *Client) nextSeq() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	seq := uint64(time.Now().UnixNano())
+	if seq <= c.lastSeq {
+		seq = c.lastSeq + 1
+	}
+	c.lastSeq = seq
+	return seq
+}
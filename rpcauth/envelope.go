@@ -0,0 +1,122 @@
+// Package rpcauth authenticates raft RPCs with HMAC for networks without TLS.
+//
+// Client is an RpcService that encodes each RPC with package wire and signs it
+// with a shared cluster key. Handler is the receive path: it verifies each
+// request and rejects forgeries and replays before passing the RPC on to the
+// ConsensusModule. Replies are signed in the same way, and are bound to their
+// request.
+//
+// The signed bytes are sent by a Transport, which can be any transport that
+// can carry a request and reply of bytes.
+//
+// Each signed message (an envelope) has the following layout:
+//
+//  version (1 byte)
+//  key id, sender, receiver, sequence number (unsigned varints)
+//  message (see package wire)
+//  HMAC-SHA256 of all the above (32 bytes)
+//
+// The sequence number of a request is a wall clock time in nanoseconds that
+// increases with every request sent by a Client. A Handler rejects a request
+// whose sequence number is not greater than the last one from the same sender,
+// or is outside the allowed clock skew. The clock skew check means that old
+// requests cannot be replayed after a Handler restarts, and requires the clocks
+// of the servers to be roughly in sync. A reply has the sequence number of its
+// request.
+//
+package rpcauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	. "github.com/divtxt/raft"
+)
+
+const (
+	envelopeVersion = 1
+	macSize         = sha256.Size
+)
+
+var (
+	ErrUnknownKey   = errors.New("rpcauth: message is signed with an unknown key")
+	ErrBadSignature = errors.New("rpcauth: bad signature")
+	ErrReplayed     = errors.New("rpcauth: request is a replay")
+	ErrClockSkew    = errors.New("rpcauth: request is outside the allowed clock skew")
+
+	errMalformed = errors.New("rpcauth: malformed message")
+)
+
+// envelope is the authenticated data of a signed message.
+type envelope struct {
+	from    ServerId
+	to      ServerId
+	seq     uint64
+	message []byte
+}
+
+// seal signs the given envelope with the signing key of the keyring.
+func seal(keyring *Keyring, env *envelope) []byte {
+	key := keyring.signingKey()
+
+	b := make([]byte, 0, 1+4*binary.MaxVarintLen64+len(env.message)+macSize)
+	b = append(b, envelopeVersion)
+	b = appendUvarint(b, uint64(key.Id))
+	b = appendUvarint(b, uint64(env.from))
+	b = appendUvarint(b, uint64(env.to))
+	b = appendUvarint(b, env.seq)
+	b = append(b, env.message...)
+
+	mac := hmac.New(sha256.New, key.Secret)
+	_, _ = mac.Write(b)
+	return mac.Sum(b)
+}
+
+// open verifies the given signed message and returns its envelope.
+//
+// The message of the returned envelope refers to the given bytes.
+//
+func open(keyring *Keyring, b []byte) (*envelope, error) {
+	if len(b) < 1+macSize {
+		return nil, errMalformed
+	}
+	if b[0] != envelopeVersion {
+		return nil, fmt.Errorf("rpcauth: unsupported version: %v", b[0])
+	}
+	signed, sig := b[:len(b)-macSize], b[len(b)-macSize:]
+
+	p := 1
+	var fields [4]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(signed[p:])
+		if n <= 0 {
+			return nil, errMalformed
+		}
+		fields[i] = v
+		p += n
+	}
+	if fields[0] > 1<<32-1 {
+		return nil, errMalformed
+	}
+
+	secret, ok := keyring.lookup(uint32(fields[0]))
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return nil, ErrBadSignature
+	}
+
+	return &envelope{ServerId(fields[1]), ServerId(fields[2]), fields[3], signed[p:]}, nil
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
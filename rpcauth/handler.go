@@ -0,0 +1,136 @@
+package rpcauth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/wire"
+)
+
+// RpcProcessor is the subset of IConsensusModule that receives incoming RPCs.
+type RpcProcessor interface {
+	ProcessRpcAppendEntries(from ServerId, rpc *RpcAppendEntries) (*RpcAppendEntriesReply, error)
+	ProcessRpcRequestVote(from ServerId, rpc *RpcRequestVote) (*RpcRequestVoteReply, error)
+}
+
+// Handler verifies the signed requests sent by Clients on other servers and
+// dispatches them to the given RpcProcessor - usually a ConsensusModule.
+//
+// A request is refused if it is not signed with an accepted key, is not for
+// this server, or is a replay. The sender passed to the RpcProcessor is the
+// sender that was signed.
+//
+type Handler struct {
+	thisServerId ServerId
+	keyring      *Keyring
+	processor    RpcProcessor
+	maxClockSkew time.Duration
+	logger       *log.Logger
+
+	mutex   *sync.Mutex
+	lastSeq map[ServerId]uint64
+}
+
+// NewHandler creates a Handler for the given server.
+//
+// maxClockSkew is the allowed difference between the clocks of this server and
+// a sender, and should allow for the time to deliver a request.
+//
+func NewHandler(
+	thisServerId ServerId,
+	keyring *Keyring,
+	processor RpcProcessor,
+	maxClockSkew time.Duration,
+	logger *log.Logger,
+) (*Handler, error) {
+	if thisServerId == 0 {
+		return nil, errors.New("thisServerId is 0")
+	}
+	if keyring == nil {
+		return nil, errors.New("'keyring' cannot be nil")
+	}
+	if processor == nil {
+		return nil, errors.New("'processor' cannot be nil")
+	}
+	if maxClockSkew <= 0 {
+		return nil, fmt.Errorf("maxClockSkew=%v must be greater than zero", maxClockSkew)
+	}
+	if logger == nil {
+		return nil, errors.New("'logger' cannot be nil")
+	}
+
+	return &Handler{
+		thisServerId,
+		keyring,
+		processor,
+		maxClockSkew,
+		logger,
+		&sync.Mutex{},
+		make(map[ServerId]uint64),
+	}, nil
+}
+
+// Handle verifies and processes the given request, and returns the signed reply.
+//
+// An error means that the request was refused or that the RpcProcessor returned
+// an error, and the transport should treat it as a failed call.
+//
+func (h *Handler) Handle(request []byte) ([]byte, error) {
+	env, err := h.verify(request)
+	if err != nil {
+		h.logger.Println("[rpcauth] Refused request:", err)
+		return nil, err
+	}
+
+	msg, err := wire.Decode(env.message)
+	if err != nil {
+		return nil, err
+	}
+	var reply interface{}
+	switch rpc := msg.(type) {
+	case *RpcAppendEntries:
+		reply, err = h.processor.ProcessRpcAppendEntries(env.from, rpc)
+	case *RpcRequestVote:
+		reply, err = h.processor.ProcessRpcRequestVote(env.from, rpc)
+	default:
+		return nil, fmt.Errorf("rpcauth: unexpected request type: %T", msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := wire.Encode(nil, reply)
+	if err != nil {
+		return nil, err
+	}
+	return seal(h.keyring, &envelope{h.thisServerId, env.from, env.seq, message}), nil
+}
+
+// verify checks the signature, receiver and sequence number of the given request.
+func (h *Handler) verify(request []byte) (*envelope, error) {
+	env, err := open(h.keyring, request)
+	if err != nil {
+		return nil, err
+	}
+	if env.to != h.thisServerId {
+		return nil, fmt.Errorf("rpcauth: request from %v is for %v", env.from, env.to)
+	}
+
+	now := time.Now().UnixNano()
+	skew := int64(h.maxClockSkew)
+	if seq := int64(env.seq); seq < now-skew || seq > now+skew {
+		return nil, ErrClockSkew
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if env.seq <= h.lastSeq[env.from] {
+		return nil, ErrReplayed
+	}
+	h.lastSeq[env.from] = env.seq
+	return env, nil
+}
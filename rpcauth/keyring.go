@@ -0,0 +1,110 @@
+package rpcauth
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MinKeySize is the minimum size of the secret of a Key.
+const MinKeySize = 32
+
+// Key is a shared cluster key.
+//
+// The Id is sent with each message so that the receiver knows which key to
+// verify it with, and must be different for each key used by the cluster.
+type Key struct {
+	Id     uint32
+	Secret []byte
+}
+
+// Keyring holds the keys of a server: the key that it signs messages with,
+// and optionally a second key that it also accepts messages signed with.
+//
+// To rotate keys without interrupting the cluster, change the keys of every
+// server in three steps, finishing each step on all servers before starting
+// the next:
+//
+// 1. SetKeys(oldKey, &newKey) - every server accepts the new key.
+//
+// 2. SetKeys(newKey, &oldKey) - servers sign with the new key, and still
+// accept the old key from servers that have not switched yet.
+//
+// 3. SetKeys(newKey, nil) - the old key is no longer accepted.
+//
+// A Keyring is safe for concurrent use.
+//
+type Keyring struct {
+	mutex     *sync.RWMutex
+	signKey   Key
+	acceptKey *Key
+}
+
+// NewKeyring creates a Keyring that signs and verifies messages with the given key.
+func NewKeyring(signKey Key) (*Keyring, error) {
+	kr := &Keyring{&sync.RWMutex{}, Key{}, nil}
+	err := kr.SetKeys(signKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// SetKeys replaces the keys of the Keyring.
+//
+// Messages are signed with signKey, and messages signed with either signKey
+// or acceptKey are accepted. acceptKey can be nil.
+//
+func (kr *Keyring) SetKeys(signKey Key, acceptKey *Key) error {
+	if err := checkKey(signKey); err != nil {
+		return err
+	}
+	if acceptKey != nil {
+		if err := checkKey(*acceptKey); err != nil {
+			return err
+		}
+		if acceptKey.Id == signKey.Id {
+			return fmt.Errorf("keys have the same id: %v", signKey.Id)
+		}
+		acceptKey = copyKey(*acceptKey)
+	}
+
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	kr.signKey = *copyKey(signKey)
+	kr.acceptKey = acceptKey
+	return nil
+}
+
+// signingKey returns the key to sign messages with.
+func (kr *Keyring) signingKey() Key {
+	kr.mutex.RLock()
+	defer kr.mutex.RUnlock()
+	return kr.signKey
+}
+
+// lookup returns the secret of the accepted key with the given id.
+func (kr *Keyring) lookup(id uint32) ([]byte, bool) {
+	kr.mutex.RLock()
+	defer kr.mutex.RUnlock()
+	if kr.signKey.Id == id {
+		return kr.signKey.Secret, true
+	}
+	if kr.acceptKey != nil && kr.acceptKey.Id == id {
+		return kr.acceptKey.Secret, true
+	}
+	return nil, false
+}
+
+func checkKey(key Key) error {
+	if len(key.Secret) < MinKeySize {
+		return fmt.Errorf("secret of key %v is %v bytes, must be at least %v", key.Id, len(key.Secret), MinKeySize)
+	}
+	return nil
+}
+
+// copyKey copies the key so that the caller cannot change the secret.
+func copyKey(key Key) *Key {
+	secret := make([]byte, len(key.Secret))
+	copy(secret, key.Secret)
+	return &Key{key.Id, secret}
+}
@@ -0,0 +1,411 @@
+package rpcauth
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/wire"
+)
+
+const testMaxClockSkew = time.Minute
+
+var (
+	testKey1 = Key{1, bytes.Repeat([]byte{1}, MinKeySize)}
+	testKey2 = Key{2, bytes.Repeat([]byte{2}, MinKeySize)}
+)
+
+// mockProcessor records the RPCs it receives and replies with the current term.
+type mockProcessor struct {
+	mutex    sync.Mutex
+	received []interface{}
+	term     TermNo
+}
+
+func (mp *mockProcessor) process(from ServerId, rpc interface{}) TermNo {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.received = append(mp.received, from, rpc)
+	return mp.term
+}
+
+func (mp *mockProcessor) ProcessRpcAppendEntries(
+	from ServerId, rpc *RpcAppendEntries,
+) (*RpcAppendEntriesReply, error) {
+	return &RpcAppendEntriesReply{mp.process(from, rpc), true}, nil
+}
+
+func (mp *mockProcessor) ProcessRpcRequestVote(
+	from ServerId, rpc *RpcRequestVote,
+) (*RpcRequestVoteReply, error) {
+	return &RpcRequestVoteReply{mp.process(from, rpc), true}, nil
+}
+
+func (mp *mockProcessor) checkReceived(t *testing.T, expected ...interface{}) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	if !reflect.DeepEqual(mp.received, expected) {
+		t.Fatal(mp.received)
+	}
+	mp.received = nil
+}
+
+// mockTransport calls Handlers directly, and can change requests and replies
+// on the way.
+type mockTransport struct {
+	handlers      map[ServerId]*Handler
+	lastRequest   []byte
+	lastErr       error
+	changeRequest func([]byte) []byte
+	changeReply   func([]byte) []byte
+}
+
+func (mt *mockTransport) Call(toServer ServerId, request []byte) []byte {
+	if mt.changeRequest != nil {
+		request = mt.changeRequest(request)
+	}
+	mt.lastRequest = request
+	reply, err := mt.handlers[toServer].Handle(request)
+	mt.lastErr = err
+	if err != nil {
+		return nil
+	}
+	if mt.changeReply != nil {
+		reply = mt.changeReply(reply)
+	}
+	return reply
+}
+
+func newTestLogger() *log.Logger {
+	return log.New(os.Stderr, "rpcauth_test", log.Flags())
+}
+
+func newTestKeyring(t *testing.T, signKey Key, acceptKey *Key) *Keyring {
+	kr, err := NewKeyring(signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kr.SetKeys(signKey, acceptKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+// setup returns a client for server 101 and a handler for server 102.
+func setup(t *testing.T, mp *mockProcessor) (*Client, *Handler, *mockTransport) {
+	h, err := NewHandler(102, newTestKeyring(t, testKey1, nil), mp, testMaxClockSkew, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt := &mockTransport{handlers: map[ServerId]*Handler{102: h}}
+	c, err := NewClient(101, newTestKeyring(t, testKey1, nil), mt, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, h, mt
+}
+
+func TestClientAndHandler(t *testing.T) {
+	mp := &mockProcessor{term: 8}
+	c, _, mt := setup(t, mp)
+
+	rpcAE := &RpcAppendEntries{8, 4, 4, []LogEntry{{4, Command("c5")}}, 3}
+	aeReply := c.RpcAppendEntries(102, rpcAE)
+	if !reflect.DeepEqual(aeReply, &RpcAppendEntriesReply{8, true}) {
+		t.Fatal(aeReply)
+	}
+	mp.checkReceived(t, ServerId(101), rpcAE)
+
+	rpcRV := &RpcRequestVote{9, 10, 6}
+	rvReply := c.RpcRequestVote(102, rpcRV)
+	if !reflect.DeepEqual(rvReply, &RpcRequestVoteReply{8, true}) {
+		t.Fatal(rvReply)
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+
+	// The request is the encoded RPC with a header and signature
+	message, err := wire.Encode(nil, rpcRV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(mt.lastRequest, message) || len(mt.lastRequest) > len(message)+1+4*10+macSize {
+		t.Fatalf("%x", mt.lastRequest)
+	}
+}
+
+func TestHandler_RefusesForgeries(t *testing.T) {
+	mp := &mockProcessor{term: 8}
+	c, _, mt := setup(t, mp)
+	rpcRV := &RpcRequestVote{9, 10, 6}
+
+	// Any change to the request is detected
+	for i := 0; i < 40; i++ {
+		i := i
+		mt.changeRequest = func(b []byte) []byte {
+			if i >= len(b) {
+				return b[:len(b)-1]
+			}
+			changed := append([]byte(nil), b...)
+			changed[i] ^= 0x10
+			return changed
+		}
+		if r := c.RpcRequestVote(102, rpcRV); r != nil {
+			t.Fatal(i, r)
+		}
+		if mt.lastErr == nil {
+			t.Fatal(i)
+		}
+	}
+	mp.checkReceived(t)
+
+	// A request with the sender changed
+	mt.changeRequest = func(b []byte) []byte {
+		changed := append([]byte(nil), b...)
+		changed[2] = 103 // the sender is after the version and key id
+		return changed
+	}
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	if mt.lastErr != ErrBadSignature {
+		t.Fatal(mt.lastErr)
+	}
+
+	// A request signed with another key
+	otherKey := Key{1, bytes.Repeat([]byte{3}, MinKeySize)}
+	for _, key := range []Key{otherKey, testKey2} {
+		key := key
+		mt.changeRequest = func(b []byte) []byte {
+			env, err := open(newTestKeyring(t, testKey1, nil), b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return seal(newTestKeyring(t, key, nil), env)
+		}
+		if r := c.RpcRequestVote(102, rpcRV); r != nil {
+			t.Fatal(r)
+		}
+	}
+	if mt.lastErr != ErrUnknownKey {
+		t.Fatal(mt.lastErr)
+	}
+
+	mp.checkReceived(t)
+}
+
+func TestHandler_RefusesReplays(t *testing.T) {
+	mp := &mockProcessor{term: 8}
+	c, h, mt := setup(t, mp)
+	rpcRV := &RpcRequestVote{9, 10, 6}
+
+	if r := c.RpcRequestVote(102, rpcRV); r == nil {
+		t.Fatal()
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+	request := mt.lastRequest
+
+	// The same request again
+	_, err := h.Handle(request)
+	if err != ErrReplayed {
+		t.Fatal(err)
+	}
+
+	// An earlier request after a later one
+	early := seal(newTestKeyring(t, testKey1, nil), &envelope{101, 102, c.nextSeq(), []byte{}})
+	if r := c.RpcRequestVote(102, rpcRV); r == nil {
+		t.Fatal()
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+	_, err = h.Handle(early)
+	if err != ErrReplayed {
+		t.Fatal(err)
+	}
+
+	// An old request after the handler restarts
+	kr := newTestKeyring(t, testKey1, nil)
+	h, err = NewHandler(102, kr, mp, testMaxClockSkew, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := wire.Encode(nil, rpcRV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := uint64(time.Now().Add(-2 * testMaxClockSkew).UnixNano())
+	_, err = h.Handle(seal(kr, &envelope{101, 102, old, message}))
+	if err != ErrClockSkew {
+		t.Fatal(err)
+	}
+	future := uint64(time.Now().Add(2 * testMaxClockSkew).UnixNano())
+	_, err = h.Handle(seal(kr, &envelope{101, 102, future, message}))
+	if err != ErrClockSkew {
+		t.Fatal(err)
+	}
+
+	// A request for another server
+	_, err = h.Handle(seal(kr, &envelope{101, 103, c.nextSeq(), message}))
+	if err == nil || err.Error() != "rpcauth: request from 101 is for 103" {
+		t.Fatal(err)
+	}
+
+	mp.checkReceived(t)
+}
+
+func TestClient_RefusesBadReplies(t *testing.T) {
+	mp := &mockProcessor{term: 8}
+	c, _, mt := setup(t, mp)
+	rpcRV := &RpcRequestVote{9, 10, 6}
+	kr := newTestKeyring(t, testKey1, nil)
+
+	// Forged reply
+	mt.changeReply = func(b []byte) []byte {
+		changed := append([]byte(nil), b...)
+		changed[len(changed)-macSize-1] ^= 1
+		return changed
+	}
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+
+	// Reply from the wrong server, to the wrong server, or to another request
+	tests := []func(env *envelope){
+		func(env *envelope) { env.from = 103 },
+		func(env *envelope) { env.to = 103 },
+		func(env *envelope) { env.seq-- },
+	}
+	for _, change := range tests {
+		change := change
+		mt.changeReply = func(b []byte) []byte {
+			env, err := open(kr, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			change(env)
+			return seal(kr, env)
+		}
+		if r := c.RpcRequestVote(102, rpcRV); r != nil {
+			t.Fatal(r)
+		}
+	}
+
+	// Reply of the wrong type
+	mt.changeReply = func(b []byte) []byte {
+		env, err := open(kr, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.message, err = wire.Encode(nil, &RpcAppendEntriesReply{8, true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seal(kr, env)
+	}
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+
+	// The requests did reach the handler
+	mp.checkReceived(t,
+		ServerId(101), rpcRV, ServerId(101), rpcRV, ServerId(101), rpcRV,
+		ServerId(101), rpcRV, ServerId(101), rpcRV,
+	)
+}
+
+// Rotate keys as described in the Keyring documentation while servers send RPCs.
+func TestKeyRotation(t *testing.T) {
+	mp := &mockProcessor{term: 8}
+	krs := map[ServerId]*Keyring{
+		101: newTestKeyring(t, testKey1, nil),
+		102: newTestKeyring(t, testKey1, nil),
+	}
+	mt := &mockTransport{handlers: make(map[ServerId]*Handler)}
+	clients := make(map[ServerId]*Client)
+	for id, kr := range krs {
+		h, err := NewHandler(id, kr, mp, testMaxClockSkew, newTestLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		mt.handlers[id] = h
+		clients[id], err = NewClient(id, kr, mt, newTestLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rpcRV := &RpcRequestVote{9, 10, 6}
+	checkCalls := func(expectOk bool) {
+		t.Helper()
+		if r := clients[101].RpcRequestVote(102, rpcRV); (r != nil) != expectOk {
+			t.Fatal(r)
+		}
+		if r := clients[102].RpcRequestVote(101, rpcRV); (r != nil) != expectOk {
+			t.Fatal(r)
+		}
+	}
+	setKeys := func(id ServerId, signKey Key, acceptKey *Key) {
+		err := krs[id].SetKeys(signKey, acceptKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkCalls(true)
+
+	// Step 1, with a call between each server
+	setKeys(101, testKey1, &testKey2)
+	checkCalls(true)
+	setKeys(102, testKey1, &testKey2)
+	checkCalls(true)
+
+	// Step 2
+	setKeys(101, testKey2, &testKey1)
+	checkCalls(true)
+	setKeys(102, testKey2, &testKey1)
+	checkCalls(true)
+
+	// Step 3
+	setKeys(101, testKey2, nil)
+	checkCalls(true)
+	setKeys(102, testKey2, nil)
+	checkCalls(true)
+
+	// Skipping a step breaks calls
+	setKeys(101, testKey1, nil)
+	checkCalls(false)
+}
+
+func TestKeyring(t *testing.T) {
+	_, err := NewKeyring(Key{1, []byte("short")})
+	if err == nil || err.Error() != "secret of key 1 is 5 bytes, must be at least 32" {
+		t.Fatal(err)
+	}
+
+	kr := newTestKeyring(t, testKey1, nil)
+	err = kr.SetKeys(testKey1, &Key{1, testKey2.Secret})
+	if err == nil || err.Error() != "keys have the same id: 1" {
+		t.Fatal(err)
+	}
+	err = kr.SetKeys(testKey1, &Key{2, nil})
+	if err == nil {
+		t.Fatal()
+	}
+
+	// Keys are copied
+	secret := bytes.Repeat([]byte{4}, MinKeySize)
+	err = kr.SetKeys(Key{4, secret}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret[0] = 5
+	if s, ok := kr.lookup(4); !ok || s[0] != 4 {
+		t.Fatal(s, ok)
+	}
+	if _, ok := kr.lookup(1); ok {
+		t.Fatal()
+	}
+}
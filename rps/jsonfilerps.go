@@ -27,7 +27,8 @@ type JsonFileRaftPersistentState struct {
 // If the file does not exist, the values are initialized to default values.
 // However, the file is not actually written until a setter call.
 //
-// Every setter will synchronously write to the underlying json file.
+// Every setter will synchronously and durably write to the underlying json file
+// before returning, as required by RaftPersistentState.
 //
 // The writes are done without reading the current values and the file is never read
 // after initialization. This means that concurrent writes by another instance, method
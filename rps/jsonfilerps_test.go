@@ -75,7 +75,7 @@ func TestNewJsonFileRaftpersistentState_Whitebox(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if bytes.Compare(data, []byte("{\"currentTerm\":1,\"votedFor\":0}")) != 0 {
+	if bytes.Compare(data, []byte("{\"data\":{\"currentTerm\":1,\"votedFor\":0},\"crc32c\":3412640525}")) != 0 {
 		t.Fatal(string(data))
 	}
 
@@ -89,7 +89,7 @@ func TestNewJsonFileRaftpersistentState_Whitebox(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if bytes.Compare(data, []byte("{\"currentTerm\":1,\"votedFor\":2000}")) != 0 {
+	if bytes.Compare(data, []byte("{\"data\":{\"currentTerm\":1,\"votedFor\":2000},\"crc32c\":741933064}")) != 0 {
 		t.Fatal(string(data))
 	}
 }
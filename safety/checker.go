@@ -0,0 +1,442 @@
+// Package safety checks raft safety properties for the executions of a cluster.
+//
+// A Checker is given observations of the servers of a cluster - from a
+// simulation, or by polling a running cluster - and the commands applied to
+// their state machines. It checks these properties (#5.2, #5.3, #5.4, Figure 3):
+//
+//  - Election Safety: at most one leader can be elected in a given term
+//  - Log Matching: if two logs contain an entry with the same index and term,
+//    then the logs are identical in all entries up through the given index
+//  - Leader Completeness: if a log entry is committed in a given term, then
+//    that entry will be present in the logs of the leaders for all higher terms
+//  - State Machine Safety: if a server has applied a log entry at a given index
+//    to its state machine, no other server will ever apply a different log
+//    entry for the same index
+//  - the term of a server never decreases, and its commitIndex never decreases
+//    until it restarts
+//
+// The first failure is returned as a *Violation with a trace of the recent
+// observations that led to it.
+//
+package safety
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	. "github.com/divtxt/raft"
+)
+
+// The properties that are checked.
+const (
+	ElectionSafety       = "election safety"
+	LogMatching          = "log matching"
+	LeaderCompleteness   = "leader completeness"
+	StateMachineSafety   = "state machine safety"
+	MonotonicTerm        = "monotonic term"
+	MonotonicCommitIndex = "monotonic commitIndex"
+)
+
+// Observation is the state of a server at some point in time.
+//
+// Entries must be a copy of the log entries after LastCompacted, and can stop
+// at any index at or after CommitIndex.
+//
+type Observation struct {
+	ServerId      ServerId
+	Term          TermNo
+	State         ServerState
+	CommitIndex   LogIndex
+	LastCompacted LogIndex
+	Entries       []LogEntry
+}
+
+func (o *Observation) indexOfLastEntry() LogIndex {
+	return o.LastCompacted + LogIndex(len(o.Entries))
+}
+
+// entry returns the entry at the given index, if it is in the observation.
+func (o *Observation) entry(li LogIndex) (LogEntry, bool) {
+	if li <= o.LastCompacted || li > o.indexOfLastEntry() {
+		return LogEntry{}, false
+	}
+	return o.Entries[li-o.LastCompacted-1], true
+}
+
+// Violation is a broken safety property.
+type Violation struct {
+	Property string
+	Detail   string
+	// The most recent events before the violation, oldest first.
+	Trace []string
+}
+
+func (v *Violation) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "safety: %v violated: %v", v.Property, v.Detail)
+	if len(v.Trace) > 0 {
+		b.WriteString("\ntrace:")
+		for _, line := range v.Trace {
+			b.WriteString("\n  ")
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
+// Checker checks the safety properties for a cluster.
+//
+// A Checker is safe for concurrent use.
+//
+type Checker struct {
+	mutex *sync.Mutex
+
+	servers      map[ServerId]*serverInfo
+	leaders      map[TermNo]ServerId
+	committed    map[LogIndex]committedEntry
+	maxCommitted LogIndex // the highest index in committed
+	applied      map[LogIndex]Command
+
+	trace     []traceRecord // ring buffer
+	traceNext int
+	traceLen  int
+
+	err *Violation
+}
+
+type serverInfo struct {
+	term        TermNo
+	commitIndex LogIndex
+	lastApplied LogIndex
+	last        *Observation // the latest observation
+}
+
+type committedEntry struct {
+	entry LogEntry
+	// A term in which the entry was known to be committed.
+	term TermNo
+}
+
+// NewChecker creates a Checker that keeps the given number of recent events
+// for the trace of a Violation.
+func NewChecker(traceLen int) (*Checker, error) {
+	if traceLen < 0 {
+		return nil, fmt.Errorf("traceLen=%v must not be negative", traceLen)
+	}
+	return &Checker{
+		mutex:     &sync.Mutex{},
+		servers:   make(map[ServerId]*serverInfo),
+		leaders:   make(map[TermNo]ServerId),
+		committed: make(map[LogIndex]committedEntry),
+		applied:   make(map[LogIndex]Command),
+		trace:     make([]traceRecord, traceLen),
+	}, nil
+}
+
+// Err returns the first Violation, or nil.
+func (c *Checker) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err == nil {
+		return nil
+	}
+	return c.err
+}
+
+// Event adds a line to the trace e.g. for a partition or a crash.
+func (c *Checker) Event(format string, args ...interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.addTrace(traceRecord{format: format, args: args})
+}
+
+// Restarted records that the given server has restarted, and can have a lower
+// commitIndex and lastApplied than before.
+func (c *Checker) Restarted(serverId ServerId) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.addTrace(traceRecord{format: "%v: restarted", args: []interface{}{serverId}})
+	if s := c.servers[serverId]; s != nil {
+		s.commitIndex = 0
+		s.lastApplied = 0
+	}
+}
+
+// Observe checks the given observation against all earlier observations.
+//
+// Returns the first Violation, which may be from an earlier call.
+//
+func (c *Checker) Observe(o Observation) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if o.ServerId == 0 {
+		return errors.New("ServerId is 0")
+	}
+	c.addTrace(traceRecord{observation: &o})
+	if c.err == nil {
+		c.observe(&o)
+	}
+	if c.err == nil {
+		return nil
+	}
+	return c.err
+}
+
+// Applied checks a command applied to the state machine of the given server.
+//
+// Returns the first Violation, which may be from an earlier call.
+//
+func (c *Checker) Applied(serverId ServerId, li LogIndex, command Command) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.addTrace(traceRecord{
+		format: "%v: applied %v %q", args: []interface{}{serverId, li, string(command)},
+	})
+	if c.err == nil {
+		c.checkApplied(serverId, li, command)
+	}
+	if c.err == nil {
+		return nil
+	}
+	return c.err
+}
+
+func (c *Checker) observe(o *Observation) {
+	s := c.servers[o.ServerId]
+	if s == nil {
+		s = &serverInfo{}
+		c.servers[o.ServerId] = s
+	}
+
+	if o.Term < s.term {
+		c.fail(MonotonicTerm, "%v: term %v after term %v", o.ServerId, o.Term, s.term)
+		return
+	}
+	s.term = o.Term
+	if o.CommitIndex < s.commitIndex {
+		c.fail(
+			MonotonicCommitIndex,
+			"%v: commitIndex %v after commitIndex %v", o.ServerId, o.CommitIndex, s.commitIndex,
+		)
+		return
+	}
+	s.commitIndex = o.CommitIndex
+
+	if o.State == LEADER {
+		if leader, ok := c.leaders[o.Term]; ok && leader != o.ServerId {
+			c.fail(ElectionSafety, "%v and %v are both leaders in term %v", leader, o.ServerId, o.Term)
+			return
+		}
+		c.leaders[o.Term] = o.ServerId
+	}
+
+	// Committed entries
+	for li := o.LastCompacted + 1; li <= o.CommitIndex; li++ {
+		entry, ok := o.entry(li)
+		if !ok {
+			break
+		}
+		if ce, ok := c.committed[li]; ok {
+			if !entriesEqual(ce.entry, entry) {
+				c.fail(
+					StateMachineSafety,
+					"%v: committed %v at index %v but %v was committed",
+					o.ServerId, entryString(entry), li, entryString(ce.entry),
+				)
+				return
+			}
+			continue
+		}
+		if cmd, ok := c.applied[li]; ok && !bytes.Equal(cmd, entry.Command) {
+			c.fail(
+				StateMachineSafety,
+				"%v: committed %v at index %v but %q was applied",
+				o.ServerId, entryString(entry), li, string(cmd),
+			)
+			return
+		}
+		c.committed[li] = committedEntry{entry, o.Term}
+		if li > c.maxCommitted {
+			c.maxCommitted = li
+		}
+	}
+
+	if o.State == LEADER {
+		c.checkLeaderCompleteness(o)
+		if c.err != nil {
+			return
+		}
+	}
+
+	for _, otherId := range c.sortedServerIds() {
+		other := c.servers[otherId]
+		if otherId == o.ServerId || other.last == nil {
+			continue
+		}
+		c.checkLogMatching(o, other.last)
+		if c.err != nil {
+			return
+		}
+	}
+	s.last = o
+}
+
+// checkLeaderCompleteness checks that a leader has all entries committed in
+// earlier terms.
+func (c *Checker) checkLeaderCompleteness(o *Observation) {
+	for li := o.LastCompacted + 1; li <= c.maxCommitted; li++ {
+		ce, ok := c.committed[li]
+		if !ok || ce.term >= o.Term {
+			continue
+		}
+		entry, ok := o.entry(li)
+		if !ok || !entriesEqual(entry, ce.entry) {
+			have := "no entry"
+			if ok {
+				have = entryString(entry)
+			}
+			c.fail(
+				LeaderCompleteness,
+				"%v: leader for term %v has %v at index %v but %v was committed in term %v",
+				o.ServerId, o.Term, have, li, entryString(ce.entry), ce.term,
+			)
+			return
+		}
+	}
+}
+
+// checkLogMatching checks that two logs are identical up to the last index
+// where they have entries with the same term.
+func (c *Checker) checkLogMatching(o1, o2 *Observation) {
+	low := o1.LastCompacted
+	if o2.LastCompacted > low {
+		low = o2.LastCompacted
+	}
+	high := o1.indexOfLastEntry()
+	if iole2 := o2.indexOfLastEntry(); iole2 < high {
+		high = iole2
+	}
+	li := high
+	for ; li > low; li-- {
+		e1, _ := o1.entry(li)
+		e2, _ := o2.entry(li)
+		if e1.TermNo == e2.TermNo {
+			break
+		}
+	}
+	match := li
+	matchTerm := TermNo(0)
+	if e1, ok := o1.entry(match); ok {
+		matchTerm = e1.TermNo
+	}
+	for ; li > low; li-- {
+		e1, _ := o1.entry(li)
+		e2, _ := o2.entry(li)
+		if !entriesEqual(e1, e2) {
+			c.fail(
+				LogMatching,
+				"%v and %v both have term %v at index %v but have %v and %v at index %v",
+				o1.ServerId, o2.ServerId, matchTerm, match, entryString(e1), entryString(e2), li,
+			)
+			return
+		}
+	}
+}
+
+func (c *Checker) checkApplied(serverId ServerId, li LogIndex, command Command) {
+	s := c.servers[serverId]
+	if s == nil {
+		s = &serverInfo{}
+		c.servers[serverId] = s
+	}
+	if s.lastApplied != 0 && li != s.lastApplied+1 {
+		c.fail(StateMachineSafety, "%v: applied index %v after index %v", serverId, li, s.lastApplied)
+		return
+	}
+	s.lastApplied = li
+	if cmd, ok := c.applied[li]; ok {
+		if !bytes.Equal(cmd, command) {
+			c.fail(
+				StateMachineSafety,
+				"%v: applied %q at index %v but %q was applied",
+				serverId, string(command), li, string(cmd),
+			)
+		}
+		return
+	}
+	if ce, ok := c.committed[li]; ok && !bytes.Equal(ce.entry.Command, command) {
+		c.fail(
+			StateMachineSafety,
+			"%v: applied %q at index %v but %v was committed",
+			serverId, string(command), li, entryString(ce.entry),
+		)
+		return
+	}
+	c.applied[li] = command
+}
+
+func (c *Checker) fail(property string, format string, args ...interface{}) {
+	c.err = &Violation{property, fmt.Sprintf(format, args...), c.traceLines()}
+}
+
+func (c *Checker) sortedServerIds() []ServerId {
+	serverIds := make([]ServerId, 0, len(c.servers))
+	for serverId := range c.servers {
+		serverIds = append(serverIds, serverId)
+	}
+	sort.Slice(serverIds, func(i, j int) bool { return serverIds[i] < serverIds[j] })
+	return serverIds
+}
+
+func entriesEqual(e1, e2 LogEntry) bool {
+	return e1.TermNo == e2.TermNo && bytes.Equal(e1.Command, e2.Command)
+}
+
+func entryString(e LogEntry) string {
+	return fmt.Sprintf("{%v %q}", e.TermNo, string(e.Command))
+}
+
+// traceRecord is an event in the trace. It is only formatted if there is a
+// Violation since observations are frequent.
+type traceRecord struct {
+	observation *Observation
+	format      string
+	args        []interface{}
+}
+
+func (tr traceRecord) String() string {
+	if o := tr.observation; o != nil {
+		return fmt.Sprintf(
+			"%v: term=%v %v commitIndex=%v lastCompacted=%v iole=%v",
+			o.ServerId, o.Term, ServerStateToString(o.State), o.CommitIndex, o.LastCompacted, o.indexOfLastEntry(),
+		)
+	}
+	return fmt.Sprintf(tr.format, tr.args...)
+}
+
+func (c *Checker) addTrace(tr traceRecord) {
+	if len(c.trace) == 0 {
+		return
+	}
+	c.trace[c.traceNext] = tr
+	c.traceNext = (c.traceNext + 1) % len(c.trace)
+	if c.traceLen < len(c.trace) {
+		c.traceLen++
+	}
+}
+
+func (c *Checker) traceLines() []string {
+	lines := make([]string, 0, c.traceLen)
+	start := c.traceNext - c.traceLen
+	if start < 0 {
+		start += len(c.trace)
+	}
+	for i := 0; i < c.traceLen; i++ {
+		lines = append(lines, c.trace[(start+i)%len(c.trace)].String())
+	}
+	return lines
+}
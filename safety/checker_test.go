@@ -0,0 +1,243 @@
+package safety
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/testhelpers"
+)
+
+func newTestChecker(t *testing.T) *Checker {
+	c, err := NewChecker(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// makeEntries returns entries with the given terms and commands "c1", "c2" ...
+func makeEntries(terms ...TermNo) []LogEntry {
+	entries := make([]LogEntry, len(terms))
+	for i, term := range terms {
+		entries[i] = LogEntry{term, testhelpers.DummyCommand(i + 1)}
+	}
+	return entries
+}
+
+func observe(t *testing.T, c *Checker, o Observation) {
+	t.Helper()
+	if err := c.Observe(o); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectViolation(t *testing.T, err error, property string, detail string) *Violation {
+	t.Helper()
+	v, ok := err.(*Violation)
+	if !ok {
+		t.Fatal(err)
+	}
+	if v.Property != property || v.Detail != detail {
+		t.Fatal(v)
+	}
+	return v
+}
+
+func TestNewChecker(t *testing.T) {
+	if _, err := NewChecker(-1); err == nil {
+		t.Fatal()
+	}
+	c := newTestChecker(t)
+	if c.Err() != nil {
+		t.Fatal(c.Err())
+	}
+	if err := c.Observe(Observation{}); err == nil || err.Error() != "ServerId is 0" {
+		t.Fatal(err)
+	}
+}
+
+func TestChecker_ValidExecution(t *testing.T) {
+	c := newTestChecker(t)
+
+	observe(t, c, Observation{101, 1, LEADER, 0, 0, makeEntries(1, 1)})
+	observe(t, c, Observation{102, 1, FOLLOWER, 1, 0, makeEntries(1)})
+	observe(t, c, Observation{101, 1, LEADER, 2, 0, makeEntries(1, 1, 1)})
+	if err := c.Applied(102, 1, Command("c1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Applied(101, 1, Command("c1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Applied(101, 2, Command("c2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new leader overwrites an uncommitted entry of the old leader
+	observe(t, c, Observation{103, 2, LEADER, 0, 0, makeEntries(1, 1, 2)})
+	observe(t, c, Observation{102, 2, FOLLOWER, 3, 0, makeEntries(1, 1, 2)})
+	observe(t, c, Observation{101, 2, FOLLOWER, 2, 0, makeEntries(1, 1, 2)})
+
+	// A restarted server has a lower commitIndex and applies entries again
+	c.Restarted(102)
+	observe(t, c, Observation{102, 2, FOLLOWER, 0, 0, makeEntries(1, 1, 2)})
+	if err := c.Applied(102, 1, Command("c1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compacted entries
+	observe(t, c, Observation{103, 2, LEADER, 3, 2, makeEntries(1, 1, 2)[2:]})
+}
+
+func TestChecker_ElectionSafety(t *testing.T) {
+	c := newTestChecker(t)
+	observe(t, c, Observation{101, 3, LEADER, 0, 0, nil})
+	observe(t, c, Observation{101, 3, LEADER, 0, 0, nil})
+	observe(t, c, Observation{102, 4, LEADER, 0, 0, nil})
+	err := c.Observe(Observation{103, 3, LEADER, 0, 0, nil})
+	v := expectViolation(t, err, ElectionSafety, "101 and 103 are both leaders in term 3")
+	expectedTrace := []string{
+		"101: term=3 LEADER commitIndex=0 lastCompacted=0 iole=0",
+		"101: term=3 LEADER commitIndex=0 lastCompacted=0 iole=0",
+		"102: term=4 LEADER commitIndex=0 lastCompacted=0 iole=0",
+		"103: term=3 LEADER commitIndex=0 lastCompacted=0 iole=0",
+	}
+	if !reflect.DeepEqual(v.Trace, expectedTrace) {
+		t.Fatal(v.Trace)
+	}
+
+	// The first violation is kept
+	if c.Err() != err {
+		t.Fatal(c.Err())
+	}
+	if err2 := c.Observe(Observation{101, 5, FOLLOWER, 0, 0, nil}); err2 != err {
+		t.Fatal(err2)
+	}
+}
+
+func TestChecker_LogMatching(t *testing.T) {
+	c := newTestChecker(t)
+	observe(t, c, Observation{101, 3, FOLLOWER, 0, 0, makeEntries(1, 2, 3)})
+	// Logs that differ after the last matching term are fine
+	observe(t, c, Observation{102, 3, FOLLOWER, 0, 0, makeEntries(1, 2, 2, 2)})
+
+	entries := makeEntries(1, 1, 3)
+	err := c.Observe(Observation{103, 3, FOLLOWER, 0, 0, entries})
+	expectViolation(
+		t, err, LogMatching,
+		`103 and 101 both have term 3 at index 3 but have {1 "c2"} and {2 "c2"} at index 2`,
+	)
+
+	// Different commands for the same term
+	c = newTestChecker(t)
+	observe(t, c, Observation{101, 3, FOLLOWER, 0, 0, makeEntries(1, 2)})
+	entries = makeEntries(1, 2)
+	entries[0].Command = Command("x")
+	err = c.Observe(Observation{102, 3, FOLLOWER, 0, 0, entries})
+	expectViolation(
+		t, err, LogMatching,
+		`102 and 101 both have term 2 at index 2 but have {1 "x"} and {1 "c1"} at index 1`,
+	)
+}
+
+func TestChecker_LeaderCompleteness(t *testing.T) {
+	c := newTestChecker(t)
+	observe(t, c, Observation{101, 2, FOLLOWER, 2, 0, makeEntries(1, 2)})
+	// A leader in the same term can still be missing the entry
+	observe(t, c, Observation{102, 2, LEADER, 0, 0, makeEntries(1, 2)[:1]})
+
+	err := c.Observe(Observation{103, 3, LEADER, 0, 0, makeEntries(1)})
+	expectViolation(
+		t, err, LeaderCompleteness,
+		`103: leader for term 3 has no entry at index 2 but {2 "c2"} was committed in term 2`,
+	)
+}
+
+func TestChecker_StateMachineSafety(t *testing.T) {
+	// Committed entries
+	c := newTestChecker(t)
+	observe(t, c, Observation{101, 2, FOLLOWER, 2, 0, makeEntries(1, 2)})
+	err := c.Observe(Observation{102, 2, FOLLOWER, 2, 0, makeEntries(1, 3)})
+	expectViolation(
+		t, err, StateMachineSafety,
+		`102: committed {3 "c2"} at index 2 but {2 "c2"} was committed`,
+	)
+
+	// Applied commands
+	c = newTestChecker(t)
+	if err := c.Applied(101, 1, Command("c1")); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Applied(102, 1, Command("x"))
+	expectViolation(t, err, StateMachineSafety, `102: applied "x" at index 1 but "c1" was applied`)
+
+	// Applied vs committed
+	c = newTestChecker(t)
+	observe(t, c, Observation{101, 2, FOLLOWER, 1, 0, makeEntries(1)})
+	err = c.Applied(102, 1, Command("x"))
+	expectViolation(t, err, StateMachineSafety, `102: applied "x" at index 1 but {1 "c1"} was committed`)
+
+	c = newTestChecker(t)
+	if err := c.Applied(101, 1, Command("x")); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Observe(Observation{102, 2, FOLLOWER, 1, 0, makeEntries(1)})
+	expectViolation(t, err, StateMachineSafety, `102: committed {1 "c1"} at index 1 but "x" was applied`)
+
+	// Order
+	c = newTestChecker(t)
+	if err := c.Applied(101, 4, Command("c4")); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Applied(101, 6, Command("c6"))
+	expectViolation(t, err, StateMachineSafety, `101: applied index 6 after index 4`)
+}
+
+func TestChecker_Monotonic(t *testing.T) {
+	c := newTestChecker(t)
+	observe(t, c, Observation{101, 3, FOLLOWER, 1, 0, makeEntries(1)})
+	err := c.Observe(Observation{101, 2, FOLLOWER, 1, 0, makeEntries(1)})
+	expectViolation(t, err, MonotonicTerm, "101: term 2 after term 3")
+
+	c = newTestChecker(t)
+	observe(t, c, Observation{101, 3, FOLLOWER, 1, 0, makeEntries(1)})
+	c.Restarted(101)
+	observe(t, c, Observation{101, 3, FOLLOWER, 0, 0, makeEntries(1)})
+	observe(t, c, Observation{101, 3, FOLLOWER, 1, 0, makeEntries(1)})
+	err = c.Observe(Observation{101, 3, FOLLOWER, 0, 0, makeEntries(1)})
+	v := expectViolation(t, err, MonotonicCommitIndex, "101: commitIndex 0 after commitIndex 1")
+	if len(v.Trace) != 5 || v.Trace[1] != "101: restarted" {
+		t.Fatal(v.Trace)
+	}
+}
+
+func TestChecker_Event(t *testing.T) {
+	c := newTestChecker(t)
+	c.Event("partition %v", []ServerId{101})
+	observe(t, c, Observation{101, 1, LEADER, 0, 0, nil})
+	err := c.Observe(Observation{102, 1, LEADER, 0, 0, nil})
+	if err == nil {
+		t.Fatal()
+	}
+	expected := "safety: election safety violated: 101 and 102 are both leaders in term 1\n" +
+		"trace:\n" +
+		"  partition [101]\n" +
+		"  101: term=1 LEADER commitIndex=0 lastCompacted=0 iole=0\n" +
+		"  102: term=1 LEADER commitIndex=0 lastCompacted=0 iole=0"
+	if err.Error() != expected {
+		t.Fatal(err)
+	}
+
+	// No trace
+	c, err = NewChecker(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Event("heal")
+	observe(t, c, Observation{101, 1, LEADER, 0, 0, nil})
+	err = c.Observe(Observation{102, 1, LEADER, 0, 0, nil})
+	if err == nil || strings.Contains(err.Error(), "trace") {
+		t.Fatal(err)
+	}
+}
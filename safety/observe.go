@@ -0,0 +1,178 @@
+package safety
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/divtxt/raft"
+)
+
+// ReadLog returns a copy of the entries of the given log after lastCompacted,
+// up to the given index or the end of the log.
+//
+// The log should not change during the read: entries up to the commitIndex of
+// a server never change, and nor does the log of a leader while it is leader.
+//
+func ReadLog(log Log, upTo LogIndex) (LogIndex, []LogEntry, error) {
+	lastCompacted := log.GetLastCompacted()
+	if iole := log.GetIndexOfLastEntry(); upTo > iole {
+		upTo = iole
+	}
+	var entries []LogEntry
+	for li := lastCompacted; li < upTo; {
+		batch, err := log.GetEntriesAfterIndex(li)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(batch) == 0 {
+			return 0, nil, errors.New("GetEntriesAfterIndex returned no entries")
+		}
+		for _, entry := range batch {
+			if li == upTo {
+				break
+			}
+			entries = append(entries, LogEntry{entry.TermNo, append(Command(nil), entry.Command...)})
+			li++
+		}
+	}
+	return lastCompacted, entries, nil
+}
+
+// Server is a running server to be observed by a Monitor.
+//
+// The StateMachine should be created by NewStateMachine so that the Checker
+// sees the applied commands.
+//
+type Server struct {
+	ServerId            ServerId
+	ConsensusModule     IConsensusModule
+	RaftPersistentState RaftPersistentState
+	Log                 Log
+	StateMachine        StateMachine
+}
+
+// ObserveServer makes an Observation of a running server.
+//
+// Since the ConsensusModule is running, the observation uses the lastApplied
+// of the state machine as the commitIndex. Returns false if the server changed
+// its term or state during the observation, and should be observed again.
+//
+func ObserveServer(s Server) (Observation, bool, error) {
+	term := s.RaftPersistentState.GetCurrentTerm()
+	state := s.ConsensusModule.GetServerState()
+	commitIndex := s.StateMachine.GetLastApplied()
+	upTo := commitIndex
+	if state == LEADER {
+		upTo = s.Log.GetIndexOfLastEntry()
+	}
+	lastCompacted, entries, err := ReadLog(s.Log, upTo)
+	if err == ErrIndexCompacted {
+		return Observation{}, false, nil
+	}
+	if err != nil {
+		return Observation{}, false, err
+	}
+	if s.ConsensusModule.GetServerState() != state ||
+		s.RaftPersistentState.GetCurrentTerm() != term {
+		return Observation{}, false, nil
+	}
+	return Observation{s.ServerId, term, state, commitIndex, lastCompacted, entries}, true, nil
+}
+
+// NewStateMachine returns a StateMachine that checks the commands applied to
+// the given StateMachine of the given server.
+//
+// The returned StateMachine is safe for concurrent use.
+//
+func NewStateMachine(checker *Checker, serverId ServerId, sm StateMachine) StateMachine {
+	return &checkedStateMachine{&sync.Mutex{}, checker, serverId, sm}
+}
+
+type checkedStateMachine struct {
+	mutex    *sync.Mutex
+	checker  *Checker
+	serverId ServerId
+	sm       StateMachine
+}
+
+func (csm *checkedStateMachine) GetLastApplied() LogIndex {
+	csm.mutex.Lock()
+	defer csm.mutex.Unlock()
+	return csm.sm.GetLastApplied()
+}
+
+func (csm *checkedStateMachine) ApplyCommand(li LogIndex, command Command) CommandResult {
+	csm.mutex.Lock()
+	defer csm.mutex.Unlock()
+	// A Violation is reported by the Checker.
+	_ = csm.checker.Applied(csm.serverId, li, command)
+	return csm.sm.ApplyCommand(li, command)
+}
+
+// Monitor periodically observes a running cluster for a Checker.
+type Monitor struct {
+	checker *Checker
+	servers func() []Server
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewMonitor starts a Monitor that observes the servers returned by the given
+// function at the given interval.
+//
+// The servers function is called for each round of observations, and should
+// return the servers that are currently running.
+//
+func NewMonitor(checker *Checker, interval time.Duration, servers func() []Server) (*Monitor, error) {
+	if checker == nil {
+		return nil, errors.New("'checker' cannot be nil")
+	}
+	if interval <= 0 {
+		return nil, errors.New("interval must be greater than zero")
+	}
+	if servers == nil {
+		return nil, errors.New("'servers' cannot be nil")
+	}
+	m := &Monitor{checker, servers, make(chan struct{}), make(chan struct{})}
+	go m.run(interval)
+	return m, nil
+}
+
+func (m *Monitor) run(interval time.Duration) {
+	defer close(m.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, s := range m.servers() {
+			o, ok, err := ObserveServer(s)
+			if err != nil {
+				m.checker.Event("%v: observe error: %v", s.ServerId, err)
+				continue
+			}
+			if ok {
+				// A Violation is reported by the Checker.
+				_ = m.checker.Observe(o)
+			}
+		}
+	}
+}
+
+// Stop stops the Monitor and returns the first Violation found by the Checker.
+//
+// Stop can be called more than once, but not concurrently.
+//
+func (m *Monitor) Stop() error {
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+	<-m.done
+	return m.checker.Err()
+}
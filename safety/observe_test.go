@@ -0,0 +1,177 @@
+package safety
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/inmemlog"
+	"github.com/divtxt/raft/rps"
+	"github.com/divtxt/raft/testdata"
+	"github.com/divtxt/raft/testhelpers"
+)
+
+// mockCM is an IConsensusModule with a given server state. If flip is set, the
+// state changes on every call.
+type mockCM struct {
+	IConsensusModule
+	state ServerState
+	flip  bool
+}
+
+func (m *mockCM) GetServerState() ServerState {
+	state := m.state
+	if m.flip {
+		m.state = LEADER - m.state
+	}
+	return state
+}
+
+func TestReadLog(t *testing.T) {
+	terms := testdata.TestUtil_MakeFigure7LeaderLineTerms()
+	iml, err := inmemlog.TestUtil_NewInMemoryLog_WithFigure7LeaderLine(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastCompacted, entries, err := ReadLog(iml, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastCompacted != 0 || !reflect.DeepEqual(entries, makeEntries(terms...)) {
+		t.Fatal(lastCompacted, entries)
+	}
+
+	// The entries are a copy
+	entries[0].Command[0] = 'x'
+	if le := testhelpers.TestHelper_GetLogEntryAtIndex(iml, 1); string(le.Command) != "c1" {
+		t.Fatal(le)
+	}
+
+	_, entries, err = ReadLog(iml, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, makeEntries(terms[:4]...)) {
+		t.Fatal(entries)
+	}
+
+	if err := iml.DiscardEntriesBeforeIndex(5); err != nil {
+		t.Fatal(err)
+	}
+	lastCompacted, entries, err = ReadLog(iml, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastCompacted != iml.GetLastCompacted() ||
+		!reflect.DeepEqual(entries, makeEntries(terms[:7]...)[lastCompacted:]) {
+		t.Fatal(lastCompacted, entries)
+	}
+}
+
+func TestObserveServer(t *testing.T) {
+	terms := testdata.TestUtil_MakeFigure7LeaderLineTerms()
+	iml, err := inmemlog.TestUtil_NewInMemoryLog_WithFigure7LeaderLine(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestChecker(t)
+	cm := &mockCM{state: FOLLOWER}
+	s := Server{
+		101,
+		cm,
+		rps.NewIMPSWithCurrentTerm(8),
+		iml,
+		NewStateMachine(c, 101, testhelpers.NewDummyStateMachine(2)),
+	}
+
+	// A follower is observed up to lastApplied
+	o, ok, err := ObserveServer(s)
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	expected := Observation{101, 8, FOLLOWER, 2, 0, makeEntries(terms[:2]...)}
+	if !reflect.DeepEqual(o, expected) {
+		t.Fatal(o)
+	}
+
+	// A leader is observed to the end of its log
+	cm.state = LEADER
+	o, ok, err = ObserveServer(s)
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	expected = Observation{101, 8, LEADER, 2, 0, makeEntries(terms...)}
+	if !reflect.DeepEqual(o, expected) {
+		t.Fatal(o)
+	}
+
+	// A server that changes state during the observation is not observed
+	cm.flip = true
+	_, ok, err = ObserveServer(s)
+	if err != nil || ok {
+		t.Fatal(ok, err)
+	}
+}
+
+func TestNewStateMachine(t *testing.T) {
+	c := newTestChecker(t)
+	dsm := testhelpers.NewDummyStateMachine(0)
+	sm := NewStateMachine(c, 101, dsm)
+
+	if r := sm.ApplyCommand(1, Command("c1")); r != "rc1" {
+		t.Fatal(r)
+	}
+	if sm.GetLastApplied() != 1 || !dsm.AppliedCommandsEqual(1) {
+		t.Fatal()
+	}
+
+	NewStateMachine(c, 102, testhelpers.NewDummyStateMachine(0)).ApplyCommand(1, Command("c2"))
+	expectViolation(t, c.Err(), StateMachineSafety, `102: applied "c2" at index 1 but "c1" was applied`)
+}
+
+func TestMonitor(t *testing.T) {
+	c := newTestChecker(t)
+	servers := func() []Server { return nil }
+	if _, err := NewMonitor(nil, time.Millisecond, servers); err == nil {
+		t.Fatal()
+	}
+	if _, err := NewMonitor(c, 0, servers); err == nil {
+		t.Fatal()
+	}
+	if _, err := NewMonitor(c, time.Millisecond, nil); err == nil {
+		t.Fatal()
+	}
+
+	iml, err := inmemlog.NewInMemoryLog(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Server{
+		102,
+		&mockCM{state: LEADER},
+		rps.NewIMPSWithCurrentTerm(8),
+		iml,
+		NewStateMachine(c, 102, testhelpers.NewDummyStateMachine(0)),
+	}
+	m, err := NewMonitor(c, time.Millisecond, func() []Server { return []Server{s} })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The monitor observes the server
+	time.Sleep(testdata.SleepJustMoreThanATick)
+	observe(t, c, Observation{101, 7, LEADER, 0, 0, nil})
+	if err := c.Observe(Observation{101, 8, LEADER, 0, 0, nil}); err == nil {
+		t.Fatal()
+	}
+
+	if err := m.Stop(); err != c.Err() {
+		t.Fatal(err)
+	}
+	// Stop is idempotent
+	if err := m.Stop(); err != c.Err() {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,218 @@
+package seglog
+
+import (
+	"sync"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/logindex"
+	"github.com/divtxt/raft/util"
+)
+
+// AsyncSegmentedLog is a SegmentedLog whose AppendEntry does not wait for the
+// appended entry to be synced to disk.
+//
+// AppendEntry writes the entry and returns, and a background goroutine then
+// syncs the written segments and advances indexOfLastDurableEntry. This lets a
+// leader replicate an entry while its own write is still in progress (see
+// raft.AsyncLog).
+//
+// An error while syncing is returned by the next call to AppendEntry or
+// SetEntriesAfterIndex, and indexOfLastDurableEntry stops advancing.
+//
+// SetEntriesAfterIndex, DiscardEntriesBeforeIndex and Close first sync all
+// appended entries, so they remain synchronous.
+//
+type AsyncSegmentedLog struct {
+	*SegmentedLog
+
+	// syncLock is held while syncing and is always taken before lock.
+	// Segments are only removed or closed while holding it, so that the
+	// background sync can run without holding lock.
+	syncLock                *sync.Mutex
+	indexOfLastDurableEntry *logindex.WatchedIndex
+	syncer                  *util.TriggeredRunner
+
+	// The following fields are protected by lock.
+	unsynced []*segment // segments with written entries that have not been synced
+	syncErr  error
+}
+
+// Check that AsyncSegmentedLog implements the AsyncLog interface
+var _ AsyncLog = (*AsyncSegmentedLog)(nil)
+
+// OpenAsyncSegmentedLog opens or creates an AsyncSegmentedLog in the given directory.
+//
+// See OpenSegmentedLog for the parameters.
+//
+func OpenAsyncSegmentedLog(dir string, maxEntries uint64, maxSegmentSize int64) (*AsyncSegmentedLog, error) {
+	sl, err := OpenSegmentedLog(dir, maxEntries, maxSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	asl := &AsyncSegmentedLog{
+		sl,
+		&sync.Mutex{},
+		// No verifier: indexOfLastDurableEntry can go down when
+		// SetEntriesAfterIndex truncates the log, and the only other
+		// constraint - that it does not exceed indexOfLastEntry - is
+		// already guaranteed by setting it from indexOfLastEntry.
+		logindex.NewWatchedIndex(),
+		nil,
+		nil,
+		nil,
+	}
+
+	// Everything in the log is durable when it is opened.
+	// There are no listeners yet so this cannot fail
+	err = asl.indexOfLastDurableEntry.Set(sl.GetIndexOfLastEntry())
+	if err != nil {
+		return nil, err
+	}
+
+	asl.syncer = util.NewTriggeredRunner(asl.syncInBackground)
+
+	return asl, nil
+}
+
+func (asl *AsyncSegmentedLog) GetIndexOfLastDurableEntryWatchable() WatchableIndex {
+	return asl.indexOfLastDurableEntry
+}
+
+func (asl *AsyncSegmentedLog) AppendEntry(logEntry LogEntry) (LogIndex, error) {
+	asl.lock.Lock()
+	defer asl.lock.Unlock()
+
+	if asl.syncErr != nil {
+		return 0, asl.syncErr
+	}
+
+	newIole, err := asl.appendEntry(logEntry, false)
+	if err != nil {
+		return 0, err
+	}
+
+	s := asl.lastSegment()
+	if n := len(asl.unsynced); n == 0 || asl.unsynced[n-1] != s {
+		asl.unsynced = append(asl.unsynced, s)
+	}
+	asl.syncer.TriggerRun()
+
+	return newIole, nil
+}
+
+func (asl *AsyncSegmentedLog) SetEntriesAfterIndex(li LogIndex, entries []LogEntry) error {
+	asl.syncLock.Lock()
+	defer asl.syncLock.Unlock()
+
+	err := asl.syncUnsynced()
+	if err != nil {
+		return err
+	}
+
+	// Read the new iole in the same critical section that writes the entries:
+	// an AppendEntry that runs after the lock is released adds an entry that
+	// is not yet synced and so must not be reported as durable. Entries
+	// appended since syncUnsynced released the lock are synced here too.
+	asl.lock.Lock()
+	newIole, err := asl.setEntriesAfterIndexLocked(li, entries)
+	asl.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Holding syncLock keeps the background sync from setting
+	// indexOfLastDurableEntry before this.
+	return asl.indexOfLastDurableEntry.Set(newIole)
+}
+
+// setEntriesAfterIndexLocked syncs any segments written since syncUnsynced,
+// replaces the entries after the given index and returns the new
+// indexOfLastEntry, all of which is then durable.
+// The caller must hold syncLock and lock.
+func (asl *AsyncSegmentedLog) setEntriesAfterIndexLocked(li LogIndex, entries []LogEntry) (LogIndex, error) {
+	if asl.syncErr != nil {
+		return 0, asl.syncErr
+	}
+	for len(asl.unsynced) > 0 {
+		err := asl.unsynced[0].sync()
+		if err != nil {
+			asl.syncErr = err
+			return 0, err
+		}
+		asl.unsynced = asl.unsynced[1:]
+	}
+	asl.unsynced = nil
+
+	return asl.setEntriesAfterIndex(li, entries)
+}
+
+func (asl *AsyncSegmentedLog) DiscardEntriesBeforeIndex(li LogIndex) error {
+	asl.syncLock.Lock()
+	defer asl.syncLock.Unlock()
+
+	err := asl.syncUnsynced()
+	if err != nil {
+		return err
+	}
+	return asl.SegmentedLog.DiscardEntriesBeforeIndex(li)
+}
+
+// Close stops the background sync, syncs any appended entries and closes all
+// the segment files.
+//
+// The AsyncSegmentedLog must not be used after this call.
+func (asl *AsyncSegmentedLog) Close() error {
+	asl.syncer.StopSync()
+
+	asl.syncLock.Lock()
+	defer asl.syncLock.Unlock()
+
+	err := asl.syncUnsynced()
+	closeErr := asl.SegmentedLog.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (asl *AsyncSegmentedLog) syncInBackground() {
+	asl.syncLock.Lock()
+	defer asl.syncLock.Unlock()
+
+	// The error is kept in syncErr
+	_ = asl.syncUnsynced()
+}
+
+// syncUnsynced syncs the segments written by AppendEntry and advances
+// indexOfLastDurableEntry.
+//
+// The caller must hold syncLock but not lock. The segment files are synced
+// without holding lock so that AppendEntry is not blocked.
+func (asl *AsyncSegmentedLog) syncUnsynced() error {
+	asl.lock.Lock()
+	err := asl.syncErr
+	unsynced := asl.unsynced
+	asl.unsynced = nil
+	iole := asl.indexOfLastEntry.Get()
+	asl.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if len(unsynced) == 0 {
+		return nil
+	}
+
+	for _, s := range unsynced {
+		err = s.sync()
+		if err != nil {
+			asl.lock.Lock()
+			asl.syncErr = err
+			asl.lock.Unlock()
+			return err
+		}
+	}
+
+	return asl.indexOfLastDurableEntry.Set(iole)
+}
@@ -0,0 +1,189 @@
+package seglog
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/testdata"
+	"github.com/divtxt/raft/testhelpers"
+)
+
+// Make an AsyncSegmentedLog with entries with given terms.
+// Commands will be Command("c1"), Command("c2"), etc.
+func openTestAsyncLogWithTerms(t *testing.T, dir string, logTerms []TermNo) *AsyncSegmentedLog {
+	asl, err := OpenAsyncSegmentedLog(dir, 3, testMaxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, term := range logTerms {
+		command := Command("c" + strconv.Itoa(i+1))
+		_, err := asl.AppendEntry(LogEntry{term, command})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return asl
+}
+
+// Replace the background sync goroutine with manual runs so that the test
+// controls when appended entries become durable.
+func fakeRestartSyncer(asl *AsyncSegmentedLog) {
+	asl.syncer.StopSync()
+	asl.syncer.TestHelperFakeRestart()
+}
+
+// Test AsyncSegmentedLog using the Log Blackbox test.
+func TestAsyncSegmentedLog_BlackboxTest(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	asl := openTestAsyncLogWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	defer asl.Close()
+
+	testhelpers.BlackboxTest_Log(t, asl, false)
+}
+
+func TestAsyncSegmentedLog_IndexOfLastDurableEntry(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	asl := openTestAsyncLogWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	fakeRestartSyncer(asl)
+	durable := asl.GetIndexOfLastDurableEntryWatchable()
+
+	// Stopping the syncer runs any pending sync
+	if li := durable.Get(); li != 10 {
+		t.Fatal(li)
+	}
+
+	// Appended entries are not durable until synced
+	for i := 11; i <= 13; i++ {
+		li, err := asl.AppendEntry(LogEntry{8, Command("c" + strconv.Itoa(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if li != LogIndex(i) {
+			t.Fatal(li)
+		}
+	}
+	if li := durable.Get(); li != 10 {
+		t.Fatal(li)
+	}
+	if len(asl.unsynced) != 2 {
+		t.Fatal(asl.unsynced)
+	}
+
+	// The appended entries are readable right away
+	le := testhelpers.TestHelper_GetLogEntryAtIndex(asl, 13)
+	if !reflect.DeepEqual(le, LogEntry{8, Command("c13")}) {
+		t.Fatal(le)
+	}
+
+	// The background sync makes them durable
+	if !asl.syncer.TestHelperRunOnceIfTriggerPending() {
+		t.Fatal()
+	}
+	if li := durable.Get(); li != 13 {
+		t.Fatal(li)
+	}
+	if asl.unsynced != nil {
+		t.Fatal(asl.unsynced)
+	}
+
+	// SetEntriesAfterIndex syncs pending appends and is synchronous
+	_, err := asl.AppendEntry(LogEntry{8, Command("c14")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = asl.SetEntriesAfterIndex(14, []LogEntry{{8, Command("c15")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if li := durable.Get(); li != 15 {
+		t.Fatal(li)
+	}
+
+	// The durable index decreases when entries are deleted
+	err = asl.SetEntriesAfterIndex(12, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if li := durable.Get(); li != 12 {
+		t.Fatal(li)
+	}
+
+	// A pending trigger finds nothing more to sync
+	asl.syncer.TestHelperRunOnceIfTriggerPending()
+	if li := durable.Get(); li != 12 {
+		t.Fatal(li)
+	}
+}
+
+// An entry appended after SetEntriesAfterIndex has run syncUnsynced must be
+// synced before it is covered by the returned iole.
+func TestAsyncSegmentedLog_SetEntriesAfterIndexSyncsLateAppends(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	asl := openTestAsyncLogWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	fakeRestartSyncer(asl)
+
+	_, err := asl.AppendEntry(LogEntry{8, Command("c11")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(asl.unsynced) != 1 {
+		t.Fatal(asl.unsynced)
+	}
+
+	asl.lock.Lock()
+	iole, err := asl.setEntriesAfterIndexLocked(11, nil)
+	asl.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iole != 11 {
+		t.Fatal(iole)
+	}
+	if asl.unsynced != nil {
+		t.Fatal(asl.unsynced)
+	}
+}
+
+func TestAsyncSegmentedLog_CloseSyncsAppendedEntries(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	asl := openTestAsyncLogWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	fakeRestartSyncer(asl)
+	_, err := asl.AppendEntry(LogEntry{8, Command("c11")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if li := asl.GetIndexOfLastDurableEntryWatchable().Get(); li == 11 {
+		t.Fatal(li)
+	}
+
+	err = asl.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if li := asl.GetIndexOfLastDurableEntryWatchable().Get(); li != 11 {
+		t.Fatal(li)
+	}
+
+	asl, err = OpenAsyncSegmentedLog(dir, 3, testMaxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer asl.Close()
+	if li := asl.GetIndexOfLastDurableEntryWatchable().Get(); li != 11 {
+		t.Fatal(li)
+	}
+	le := testhelpers.TestHelper_GetLogEntryAtIndex(asl, 11)
+	if !reflect.DeepEqual(le, LogEntry{8, Command("c11")}) {
+		t.Fatal(le)
+	}
+}
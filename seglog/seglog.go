@@ -0,0 +1,487 @@
+// Package seglog provides a durable file-based implementation of the raft Log.
+package seglog
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/fileutil"
+	"github.com/divtxt/raft/logindex"
+)
+
+// SegmentedLog is a write-ahead log implementation of the raft Log.
+//
+// The entries are stored in append-only segment files in a single directory.
+// Each segment file is named after the index of its first entry, and a new
+// segment is started once the current one grows past maxSegmentSize bytes.
+//
+// AppendEntry and SetEntriesAfterIndex fsync the written data before returning.
+// See AsyncSegmentedLog for an AppendEntry that does not wait for the fsync.
+//
+// Every entry is stored with a CRC32C checksum. GetEntriesAfterIndex verifies
+// the checksum of every entry it reads and returns a CorruptionError for a
+// mismatch. The terms used by GetTermAtIndex are verified when the log is
+// opened.
+//
+// When the log is opened, an incomplete or corrupted tail of the last segment
+// - which is what a crash during a write leaves behind - is truncated, and
+// GetTailRepair reports how many entries were dropped. Any other damage makes
+// the open fail with a CorruptionError. Use VerifyDir to check a log offline.
+//
+// The offsets and terms of all entries are indexed in memory when the log is
+// opened, so GetTermAtIndex does not touch the disk and tail truncation is
+// a single file truncate plus deletion of any later segments.
+//
+// Log compaction deletes whole segments: DiscardEntriesBeforeIndex advances
+// lastCompacted and deletes every segment whose entries are all at or before
+// lastCompacted. The segment holding the last entry is never deleted. Since
+// lastCompacted is not persisted separately, it is reopened as the index just
+// before the first entry of the first remaining segment - which may be lower
+// than the value before the restart. Each segment header records the term of
+// the entry before its first entry, so the term of lastCompacted is always
+// available.
+//
+type SegmentedLog struct {
+	dir            string
+	maxEntries     uint64
+	maxSegmentSize int64
+
+	lock             *sync.RWMutex
+	indexOfLastEntry *logindex.WatchedIndex
+	lastCompacted    *logindex.WatchedIndex
+	segments         []*segment // never empty; only the last segment is written to
+
+	tailRepair *TailRepair
+}
+
+// Check that SegmentedLog implements the Log interface
+var _ Log = (*SegmentedLog)(nil)
+
+// OpenSegmentedLog opens or creates a SegmentedLog in the given directory.
+//
+// The directory must already exist. If it contains no segment files, a new
+// empty log is started.
+//
+// maxEntries is the maximum number of log entries that GetEntriesAfterIndex
+// will return at a time.
+//
+// maxSegmentSize is the size in bytes after which a new segment file is started.
+//
+// The caller is responsible for ensuring exclusive access to the directory.
+//
+func OpenSegmentedLog(dir string, maxEntries uint64, maxSegmentSize int64) (*SegmentedLog, error) {
+	if maxEntries <= 0 {
+		return nil, fmt.Errorf(
+			"maxEntries=%v must be greater than zero", maxEntries,
+		)
+	}
+	if maxSegmentSize <= 0 {
+		return nil, fmt.Errorf(
+			"maxSegmentSize=%v must be greater than zero", maxSegmentSize,
+		)
+	}
+
+	segments, tailRepair, err := openSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sl := &SegmentedLog{
+		dir,
+		maxEntries,
+		maxSegmentSize,
+		&sync.RWMutex{},
+		logindex.NewWatchedIndexWithVerifier(nil), // FIXME: verifier
+		logindex.NewWatchedIndexWithVerifier(nil), // FIXME: verifier
+		segments,
+		tailRepair,
+	}
+
+	// There are no listeners yet so these cannot fail
+	err = sl.lastCompacted.Set(segments[0].firstIndex - 1)
+	if err != nil {
+		return nil, err
+	}
+	err = sl.indexOfLastEntry.Set(sl.lastSegment().lastIndex())
+	if err != nil {
+		return nil, err
+	}
+
+	return sl, nil
+}
+
+// listSegments returns the first indexes of the segment files in the given
+// directory in index order.
+func listSegments(dir string) ([]LogIndex, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstIndexes []LogIndex
+	for _, fi := range fileInfos {
+		if fi.IsDir() {
+			continue
+		}
+		if firstIndex, ok := parseSegmentFileName(fi.Name()); ok {
+			firstIndexes = append(firstIndexes, firstIndex)
+		}
+	}
+	sort.Slice(firstIndexes, func(i, j int) bool { return firstIndexes[i] < firstIndexes[j] })
+	return firstIndexes, nil
+}
+
+// openSegments opens all segment files in the given directory in index order,
+// creating the first segment if there are none.
+func openSegments(dir string) ([]*segment, *TailRepair, error) {
+	firstIndexes, err := listSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(firstIndexes) == 0 {
+		s, err := createSegment(dir, 1, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []*segment{s}, nil, nil
+	}
+
+	segments := make([]*segment, 0, len(firstIndexes))
+	closeAll := func() {
+		for _, s := range segments {
+			_ = s.close()
+		}
+	}
+	var tailRepair *TailRepair
+	for i, firstIndex := range firstIndexes {
+		isLast := i == len(firstIndexes)-1
+		if i > 0 {
+			prev := segments[i-1]
+			if prev.lastIndex()+1 != firstIndex {
+				closeAll()
+				return nil, nil, fmt.Errorf(
+					"seglog: segment %v does not follow segment %v with lastIndex=%v",
+					firstIndex,
+					prev.firstIndex,
+					prev.lastIndex(),
+				)
+			}
+		}
+		s, tr, err := openSegment(dir, firstIndex, isLast)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		segments = append(segments, s)
+		tailRepair = tr
+	}
+	return segments, tailRepair, nil
+}
+
+// Close closes all the segment files.
+//
+// The SegmentedLog must not be used after this call.
+func (sl *SegmentedLog) Close() error {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	var firstErr error
+	for _, s := range sl.segments {
+		err := s.close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	sl.segments = nil
+	return firstErr
+}
+
+// GetTailRepair returns the details of a damaged tail that was truncated when
+// the log was opened, or nil if there was none.
+func (sl *SegmentedLog) GetTailRepair() *TailRepair {
+	return sl.tailRepair
+}
+
+func (sl *SegmentedLog) lastSegment() *segment {
+	return sl.segments[len(sl.segments)-1]
+}
+
+// findSegment returns the position of the segment that contains the given index.
+// The index must be present in the log.
+func (sl *SegmentedLog) findSegment(li LogIndex) int {
+	return sort.Search(len(sl.segments), func(i int) bool {
+		return sl.segments[i].lastIndex() >= li
+	})
+}
+
+// termAt returns the term of the entry at the given index.
+// The index must be present in the log or be lastCompacted.
+func (sl *SegmentedLog) termAt(li LogIndex) TermNo {
+	s := sl.segments[sl.findSegment(li)]
+	if li < s.firstIndex {
+		return s.prevTerm
+	}
+	return s.termAt(li)
+}
+
+func (sl *SegmentedLog) GetLastCompacted() LogIndex {
+	return sl.lastCompacted.Get()
+}
+
+func (sl *SegmentedLog) GetIndexOfLastEntry() LogIndex {
+	return sl.indexOfLastEntry.Get()
+}
+
+func (sl *SegmentedLog) GetIndexOfLastEntryWatchable() WatchableIndex {
+	return sl.indexOfLastEntry
+}
+
+func (sl *SegmentedLog) GetTermAtIndex(li LogIndex) (TermNo, error) {
+	sl.lock.RLock()
+	defer sl.lock.RUnlock()
+
+	if li == 0 {
+		return 0, errors.New("GetTermAtIndex(): li=0")
+	}
+	if li < sl.lastCompacted.Get() {
+		return 0, ErrIndexCompacted
+	}
+
+	iole := sl.indexOfLastEntry.Get()
+	if li > iole {
+		return 0, fmt.Errorf(
+			"GetTermAtIndex(): li=%v > iole=%v", li, iole,
+		)
+	}
+	return sl.termAt(li), nil
+}
+
+func (sl *SegmentedLog) GetEntriesAfterIndex(afterLogIndex LogIndex) ([]LogEntry, error) {
+	sl.lock.RLock()
+	defer sl.lock.RUnlock()
+
+	if afterLogIndex < sl.lastCompacted.Get() {
+		return nil, ErrIndexCompacted
+	}
+
+	iole := sl.indexOfLastEntry.Get()
+
+	if afterLogIndex > iole {
+		return nil, fmt.Errorf(
+			"afterLogIndex=%v is > iole=%v",
+			afterLogIndex,
+			iole,
+		)
+	}
+
+	var numEntriesToGet = uint64(iole - afterLogIndex)
+
+	// Short-circuit allocation for no entries to return
+	if numEntriesToGet == 0 {
+		return []LogEntry{}, nil
+	}
+
+	if numEntriesToGet > sl.maxEntries {
+		numEntriesToGet = sl.maxEntries
+	}
+
+	logEntries := make([]LogEntry, 0, numEntriesToGet)
+	nextIndexToGet := afterLogIndex + 1
+
+	for i := sl.findSegment(nextIndexToGet); uint64(len(logEntries)) < numEntriesToGet; i++ {
+		s := sl.segments[i]
+		n := int(s.lastIndex() - nextIndexToGet + 1)
+		if remaining := int(numEntriesToGet) - len(logEntries); n > remaining {
+			n = remaining
+		}
+		entries, err := s.readEntries(nextIndexToGet, n)
+		if err != nil {
+			return nil, err
+		}
+		logEntries = append(logEntries, entries...)
+		nextIndexToGet += LogIndex(n)
+	}
+
+	return logEntries, nil
+}
+
+func (sl *SegmentedLog) SetEntriesAfterIndex(li LogIndex, entries []LogEntry) error {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	_, err := sl.setEntriesAfterIndex(li, entries)
+	return err
+}
+
+// setEntriesAfterIndex replaces the entries after the given index and returns
+// the new indexOfLastEntry.
+// The caller must hold the lock.
+func (sl *SegmentedLog) setEntriesAfterIndex(li LogIndex, entries []LogEntry) (LogIndex, error) {
+	if li < sl.lastCompacted.Get() {
+		return 0, ErrIndexCompacted
+	}
+	iole := sl.indexOfLastEntry.Get()
+	if iole < li {
+		return 0, fmt.Errorf("SegmentedLog: setEntriesAfterIndex(%d, ...) but iole=%d", li, iole)
+	}
+
+	// Skip the given entries that are already in the log so that they are not
+	// rewritten. By the Log Matching Property, an existing entry with the same
+	// term is the same entry.
+	for len(entries) > 0 && li < iole {
+		if sl.termAt(li+1) != entries[0].TermNo {
+			break
+		}
+		li++
+		entries = entries[1:]
+	}
+
+	// delete entries after index
+	if iole > li {
+		err := sl.truncateAfter(li)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// append entries
+	if len(entries) > 0 {
+		err := sl.appendEntries(entries, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// update iole
+	newIole := sl.lastSegment().lastIndex()
+	return newIole, sl.indexOfLastEntry.Set(newIole)
+}
+
+// truncateAfter deletes all entries after the given index.
+func (sl *SegmentedLog) truncateAfter(li LogIndex) error {
+	removedSegments := false
+	for len(sl.segments) > 1 && sl.lastSegment().firstIndex > li+1 {
+		err := sl.lastSegment().remove()
+		if err != nil {
+			return err
+		}
+		sl.segments = sl.segments[:len(sl.segments)-1]
+		removedSegments = true
+	}
+	if removedSegments {
+		err := fileutil.SyncDir(sl.dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	s := sl.lastSegment()
+	err := s.truncate(int(li + 1 - s.firstIndex))
+	if err != nil {
+		return err
+	}
+	return s.sync()
+}
+
+// appendEntries writes the given entries after the last entry, starting new
+// segments as needed, and syncs the written segments if sync is true.
+func (sl *SegmentedLog) appendEntries(entries []LogEntry, sync bool) error {
+	for len(entries) > 0 {
+		s := sl.lastSegment()
+		if s.size >= sl.maxSegmentSize && s.count() > 0 {
+			var err error
+			s, err = createSegment(sl.dir, s.lastIndex()+1, s.termAt(s.lastIndex()))
+			if err != nil {
+				return err
+			}
+			sl.segments = append(sl.segments, s)
+		}
+
+		// Fill the segment up to maxSegmentSize, but with at least one entry
+		n := 0
+		size := s.size
+		for n < len(entries) && (n == 0 || size < sl.maxSegmentSize) {
+			size += recordHeaderSize + int64(len(entries[n].Command))
+			n++
+		}
+
+		err := s.appendEntries(entries[:n])
+		if err != nil {
+			return err
+		}
+		if sync {
+			err = s.sync()
+			if err != nil {
+				return err
+			}
+		}
+		entries = entries[n:]
+	}
+	return nil
+}
+
+// DiscardEntriesBeforeIndex discards the entries before the given index.
+//
+// lastCompacted becomes li-1, and segments that only contain entries at or
+// before the new lastCompacted are deleted. The term of lastCompacted remains
+// available from the header of the next segment.
+func (sl *SegmentedLog) DiscardEntriesBeforeIndex(li LogIndex) error {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	if li <= sl.lastCompacted.Get() {
+		return ErrIndexCompacted
+	}
+	iole := sl.indexOfLastEntry.Get()
+	if li-1 > iole {
+		return fmt.Errorf("SegmentedLog: discardEntriesBeforeIndex(%d) but iole=%d", li, iole)
+	}
+	err := sl.lastCompacted.Set(li - 1)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for n < len(sl.segments)-1 && sl.segments[n].lastIndex() < li {
+		err = sl.segments[n].remove()
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	if n > 0 {
+		sl.segments = append([]*segment(nil), sl.segments[n:]...)
+		return fileutil.SyncDir(sl.dir)
+	}
+	return nil
+}
+
+func (sl *SegmentedLog) AppendEntry(logEntry LogEntry) (LogIndex, error) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	return sl.appendEntry(logEntry, true)
+}
+
+// appendEntry appends the given entry and updates indexOfLastEntry.
+// The caller must hold the lock.
+func (sl *SegmentedLog) appendEntry(logEntry LogEntry, sync bool) (LogIndex, error) {
+	err := sl.appendEntries([]LogEntry{logEntry}, sync)
+	if err != nil {
+		return 0, err
+	}
+
+	// update iole
+	newIole := sl.lastSegment().lastIndex()
+	err = sl.indexOfLastEntry.Set(newIole)
+	if err != nil {
+		return 0, err
+	}
+
+	return newIole, nil
+}
@@ -0,0 +1,276 @@
+package seglog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/testdata"
+	"github.com/divtxt/raft/testhelpers"
+)
+
+// Small enough that the Figure 7 entries span several segments.
+const testMaxSegmentSize = 40
+
+func makeTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "seglog_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Make a SegmentedLog with entries with given terms.
+// Commands will be Command("c1"), Command("c2"), etc.
+func openTestLogWithTerms(t *testing.T, dir string, logTerms []TermNo) *SegmentedLog {
+	sl, err := OpenSegmentedLog(dir, 3, testMaxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, term := range logTerms {
+		command := Command("c" + strconv.Itoa(i+1))
+		_, err := sl.AppendEntry(LogEntry{term, command})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sl
+}
+
+func removeTestDir(t *testing.T, dir string) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func closeTestLog(t *testing.T, sl *SegmentedLog) {
+	err := sl.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentFileNameSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		names[i] = filepath.Base(name)
+	}
+	return names
+}
+
+// Test SegmentedLog using the Log Blackbox test.
+func TestSegmentedLog_BlackboxTest(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	sl := openTestLogWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	defer closeTestLog(t, sl)
+
+	testhelpers.BlackboxTest_Log(t, sl, false)
+}
+
+// Test SegmentedLog compacted log using the Log Blackbox test.
+func TestSegmentedLog_BlackboxTestWithCompaction(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	sl := openTestLogWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	defer closeTestLog(t, sl)
+
+	err := sl.DiscardEntriesBeforeIndex(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testhelpers.BlackboxTest_Log(t, sl, true)
+}
+
+func TestSegmentedLog_Reopen(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	sl := openTestLogWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+
+	// The 16 byte header and 2 entries of 18 bytes fill a segment
+	expectedFiles := []string{
+		"00000000000000000001.seg",
+		"00000000000000000003.seg",
+		"00000000000000000005.seg",
+		"00000000000000000007.seg",
+		"00000000000000000009.seg",
+	}
+	if files := segmentFiles(t, dir); !reflect.DeepEqual(files, expectedFiles) {
+		t.Fatal(files)
+	}
+
+	// Compaction deletes the segments before the given index
+	err := sl.DiscardEntriesBeforeIndex(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lc := sl.GetLastCompacted(); lc != 5 {
+		t.Fatal(lc)
+	}
+	expectedFiles = expectedFiles[2:]
+	if files := segmentFiles(t, dir); !reflect.DeepEqual(files, expectedFiles) {
+		t.Fatal(files)
+	}
+
+	// Truncation deletes the later segments
+	err = sl.SetEntriesAfterIndex(7, []LogEntry{{7, Command("c8'")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFiles = expectedFiles[:2]
+	if files := segmentFiles(t, dir); !reflect.DeepEqual(files, expectedFiles) {
+		t.Fatal(files)
+	}
+
+	err = sl.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lastCompacted is reopened at the start of the first segment
+	sl, err = OpenSegmentedLog(dir, 3, testMaxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestLog(t, sl)
+	if tr := sl.GetTailRepair(); tr != nil {
+		t.Fatal(tr)
+	}
+	if lc := sl.GetLastCompacted(); lc != 4 {
+		t.Fatal(lc)
+	}
+	// The term of lastCompacted is kept in the segment header
+	if term, err := sl.GetTermAtIndex(4); err != nil || term != 4 {
+		t.Fatal(term, err)
+	}
+	if iole := sl.GetIndexOfLastEntry(); iole != 8 {
+		t.Fatal(iole)
+	}
+	entries, err := sl.GetEntriesAfterIndex(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedEntries := []LogEntry{
+		{5, Command("c6")},
+		{5, Command("c7")},
+		{7, Command("c8'")},
+	}
+	if !reflect.DeepEqual(entries, expectedEntries) {
+		t.Fatal(entries)
+	}
+}
+
+func TestSegmentedLog_SetEntriesAfterIndexSkipsExistingEntries(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	sl := openTestLogWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	defer closeTestLog(t, sl)
+
+	lastFile := filepath.Join(dir, "00000000000000000009.seg")
+	fi, err := os.Stat(lastFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries with the same terms are not rewritten
+	err = sl.SetEntriesAfterIndex(8, []LogEntry{{6, Command("xx")}, {6, Command("xx")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := testhelpers.TestHelper_GetLogEntryAtIndex(sl, 10)
+	if !reflect.DeepEqual(le, LogEntry{6, Command("c10")}) {
+		t.Fatal(le)
+	}
+	fi2, err := os.Stat(lastFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi2.Size() != fi.Size() {
+		t.Fatal(fi2.Size())
+	}
+}
+
+func TestSegmentedLog_TornTail(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	sl := openTestLogWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	err := sl.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash during a write of the 11th entry
+	lastFile := filepath.Join(dir, "00000000000000000009.seg")
+	f, err := os.OpenFile(lastFile, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 7, 0, 0, 0, 3, 'c'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sl, err = OpenSegmentedLog(dir, 3, testMaxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestLog(t, sl)
+
+	if iole := sl.GetIndexOfLastEntry(); iole != 10 {
+		t.Fatal(iole)
+	}
+	expectedTailRepair := &TailRepair{lastFile, 53, 1}
+	if tr := sl.GetTailRepair(); !reflect.DeepEqual(tr, expectedTailRepair) {
+		t.Fatal(tr)
+	}
+	ioleAE, err := sl.AppendEntry(LogEntry{7, Command("c11")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ioleAE != 11 {
+		t.Fatal(ioleAE)
+	}
+	le := testhelpers.TestHelper_GetLogEntryAtIndex(sl, 11)
+	if !reflect.DeepEqual(le, LogEntry{7, Command("c11")}) {
+		t.Fatal(le)
+	}
+}
+
+func TestSegmentedLog_MissingSegment(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	sl := openTestLogWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	err := sl.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Remove(filepath.Join(dir, "00000000000000000005.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenSegmentedLog(dir, 3, testMaxSegmentSize)
+	if err == nil || err.Error() != "seglog: segment 7 does not follow segment 3 with lastIndex=4" {
+		t.Fatal(err)
+	}
+}
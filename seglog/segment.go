@@ -0,0 +1,250 @@
+package seglog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/fileutil"
+)
+
+// Segment file layout:
+//
+//  header: magic "RSEG" (4 bytes) + format version (uint32) + previous term (uint64)
+//  records: CRC32C (uint32) + term (uint64) + command length (uint32) + command bytes
+//
+// The CRC32C (Castagnoli) checksum of a record covers everything in the
+// record after the checksum itself.
+//
+// The previous term in the header is the term of the entry just before the
+// first entry of the segment (or 0 if there is none), so that the term of
+// lastCompacted is still known after the earlier segments are deleted.
+//
+// All integers are big-endian.
+const (
+	segmentMagic          = "RSEG"
+	segmentVersion        = 1
+	segmentHeaderSize     = 16
+	recordHeaderSize      = 16
+	segmentFileNameSuffix = ".seg"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// segment is a single append-only segment file of a SegmentedLog.
+//
+// The offsets and terms of the entries in the segment are kept in memory
+// so that lookups and tail truncation do not need to scan the file.
+type segment struct {
+	firstIndex LogIndex
+	prevTerm   TermNo // term of the entry at firstIndex-1
+	file       *os.File
+	offsets    []int64 // offset of the record for each entry
+	terms      []TermNo
+	size       int64 // offset just past the last record
+}
+
+func segmentFileName(firstIndex LogIndex) string {
+	return fmt.Sprintf("%020d%s", firstIndex, segmentFileNameSuffix)
+}
+
+// parseSegmentFileName returns the first index for a segment file name.
+func parseSegmentFileName(name string) (LogIndex, bool) {
+	if !strings.HasSuffix(name, segmentFileNameSuffix) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(strings.TrimSuffix(name, segmentFileNameSuffix), 10, 64)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+	return LogIndex(n), true
+}
+
+// createSegment creates a new empty segment file.
+func createSegment(dir string, firstIndex LogIndex, prevTerm TermNo) (*segment, error) {
+	filename := filepath.Join(dir, segmentFileName(firstIndex))
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, segmentHeaderSize)
+	copy(header, segmentMagic)
+	binary.BigEndian.PutUint32(header[4:], segmentVersion)
+	binary.BigEndian.PutUint64(header[8:], uint64(prevTerm))
+	_, err = f.Write(header)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = fileutil.SyncDir(dir)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &segment{firstIndex, prevTerm, f, nil, nil, segmentHeaderSize}, nil
+}
+
+// openSegment opens an existing segment file and builds its offset index.
+//
+// If allowTornTail is true, an incomplete or corrupted tail - e.g. from a write
+// that was interrupted by a crash - is truncated away and described by the
+// returned TailRepair.
+// Otherwise such a tail is a CorruptionError.
+func openSegment(
+	dir string, firstIndex LogIndex, allowTornTail bool,
+) (*segment, *TailRepair, error) {
+	filename := filepath.Join(dir, segmentFileName(firstIndex))
+	f, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	sr, err := scanSegment(f, firstIndex)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+
+	var tr *TailRepair
+	if sr.droppedEntries > 0 {
+		if !allowTornTail {
+			_ = f.Close()
+			return nil, nil, sr.tailCorruptionError(filename, firstIndex)
+		}
+		err = f.Truncate(sr.size)
+		if err == nil {
+			err = f.Sync()
+		}
+		if err != nil {
+			_ = f.Close()
+			return nil, nil, err
+		}
+		tr = &TailRepair{filename, sr.size, sr.droppedEntries}
+	}
+
+	return &segment{firstIndex, sr.prevTerm, f, sr.offsets, sr.terms, sr.size}, tr, nil
+}
+
+// Number of entries in this segment.
+func (s *segment) count() int {
+	return len(s.offsets)
+}
+
+// Index of the last entry in this segment.
+// If the segment is empty this is firstIndex-1.
+func (s *segment) lastIndex() LogIndex {
+	return s.firstIndex + LogIndex(len(s.offsets)) - 1
+}
+
+// The term of the entry at the given index.
+// This was verified against the entry's checksum when it was indexed.
+func (s *segment) termAt(li LogIndex) TermNo {
+	return s.terms[li-s.firstIndex]
+}
+
+// readEntries reads the entries from index li up to the given number of entries.
+//
+// The checksum of every entry is verified, and a mismatch is returned
+// as a CorruptionError.
+func (s *segment) readEntries(li LogIndex, n int) ([]LogEntry, error) {
+	i := int(li - s.firstIndex)
+	start := s.offsets[i]
+	end := s.size
+	if i+n < len(s.offsets) {
+		end = s.offsets[i+n]
+	}
+	buf := make([]byte, end-start)
+	_, err := s.file.ReadAt(buf, start)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LogEntry, n)
+	for j := range entries {
+		cmdLen := int(binary.BigEndian.Uint32(buf[12:]))
+		recordLen := recordHeaderSize + cmdLen
+		term := TermNo(binary.BigEndian.Uint64(buf[4:]))
+		if recordLen > len(buf) ||
+			binary.BigEndian.Uint32(buf) != crc32.Checksum(buf[4:recordLen], crc32cTable) ||
+			term != s.terms[i+j] {
+			return nil, &CorruptionError{
+				s.file.Name(), s.offsets[i+j], li + LogIndex(j), "checksum mismatch",
+			}
+		}
+		command := buf[recordHeaderSize:recordLen:recordLen]
+		entries[j] = LogEntry{term, Command(command)}
+		buf = buf[recordLen:]
+	}
+	return entries, nil
+}
+
+// appendEntries writes the given entries at the end of the segment.
+// The caller is responsible for calling sync().
+func (s *segment) appendEntries(entries []LogEntry) error {
+	var bufSize int
+	for _, e := range entries {
+		bufSize += recordHeaderSize + len(e.Command)
+	}
+	buf := make([]byte, bufSize)
+	offsets := make([]int64, len(entries))
+	terms := make([]TermNo, len(entries))
+	p := 0
+	for i, e := range entries {
+		offsets[i] = s.size + int64(p)
+		terms[i] = e.TermNo
+		recordLen := recordHeaderSize + len(e.Command)
+		record := buf[p : p+recordLen]
+		binary.BigEndian.PutUint64(record[4:], uint64(e.TermNo))
+		binary.BigEndian.PutUint32(record[12:], uint32(len(e.Command)))
+		copy(record[recordHeaderSize:], e.Command)
+		binary.BigEndian.PutUint32(record, crc32.Checksum(record[4:], crc32cTable))
+		p += recordLen
+	}
+	_, err := s.file.WriteAt(buf, s.size)
+	if err != nil {
+		return err
+	}
+	s.offsets = append(s.offsets, offsets...)
+	s.terms = append(s.terms, terms...)
+	s.size += int64(bufSize)
+	return nil
+}
+
+// truncate discards all entries after the first n entries.
+func (s *segment) truncate(n int) error {
+	if n >= len(s.offsets) {
+		return nil
+	}
+	newSize := s.offsets[n]
+	err := s.file.Truncate(newSize)
+	if err != nil {
+		return err
+	}
+	s.offsets = s.offsets[:n]
+	s.terms = s.terms[:n]
+	s.size = newSize
+	return nil
+}
+
+func (s *segment) sync() error {
+	return s.file.Sync()
+}
+
+func (s *segment) close() error {
+	return s.file.Close()
+}
+
+// remove closes and deletes the segment file.
+// The caller is responsible for syncing the directory.
+func (s *segment) remove() error {
+	name := s.file.Name()
+	err := s.file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
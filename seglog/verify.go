@@ -0,0 +1,382 @@
+package seglog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/divtxt/raft"
+)
+
+// CorruptionError is returned when a segment file contains data that is not valid.
+//
+// This indicates that the log was damaged after it was written, and the log
+// cannot be trusted until the damage is repaired.
+type CorruptionError struct {
+	Filename string
+	Offset   int64
+	Index    LogIndex // index of the affected entry, or 0 if not known
+	Reason   string
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Index == 0 {
+		return fmt.Sprintf("seglog: corruption in %v at offset %v: %v", e.Filename, e.Offset, e.Reason)
+	}
+	return fmt.Sprintf(
+		"seglog: corruption in %v at offset %v (index %v): %v",
+		e.Filename,
+		e.Offset,
+		e.Index,
+		e.Reason,
+	)
+}
+
+// TailRepair describes an incomplete or corrupted tail of the last segment.
+//
+// Such a tail is expected if a write was interrupted by a crash, and since the
+// interrupted write was never acknowledged it is safe to discard it.
+type TailRepair struct {
+	Filename string
+	// Offset is the size of the segment file after the tail is truncated.
+	Offset int64
+	// DroppedEntries is the number of entries - as best as can be determined
+	// from the damaged data - that were discarded.
+	DroppedEntries int
+}
+
+var errRecordIncomplete = errors.New("incomplete record")
+var errRecordChecksum = errors.New("checksum mismatch")
+
+// scanResult is the result of scanning a segment file.
+type scanResult struct {
+	prevTerm TermNo
+	offsets  []int64
+	terms    []TermNo
+	// size is the offset just past the last valid record.
+	size int64
+	// droppedEntries is the number of records after size that are incomplete or
+	// fail their checksum.
+	droppedEntries int
+}
+
+func (sr *scanResult) tailCorruptionError(filename string, firstIndex LogIndex) error {
+	return &CorruptionError{
+		filename,
+		sr.size,
+		firstIndex + LogIndex(len(sr.offsets)),
+		fmt.Sprintf("%v bad record(s) at end of segment", sr.droppedEntries),
+	}
+}
+
+// recordReader reads and checks consecutive records of a segment file.
+type recordReader struct {
+	r         *bufio.Reader
+	remaining int64
+	buf       []byte
+	checksum  uint32 // checksum of the last valid record
+}
+
+func newRecordReader(f *os.File, offset int64, fileSize int64) *recordReader {
+	sr := io.NewSectionReader(f, offset, fileSize-offset)
+	return &recordReader{bufio.NewReader(sr), fileSize - offset, nil, 0}
+}
+
+// next reads the next record and returns its term and length.
+//
+// Returns io.EOF if there are no more records, errRecordIncomplete if the file
+// ends before the end of the record and errRecordChecksum if the record does
+// not match its checksum. In the last case the returned length is the length
+// claimed by the (possibly damaged) record.
+func (rr *recordReader) next() (TermNo, int64, error) {
+	if rr.remaining == 0 {
+		return 0, 0, io.EOF
+	}
+	if rr.remaining < recordHeaderSize {
+		return 0, 0, errRecordIncomplete
+	}
+	var header [recordHeaderSize]byte
+	_, err := io.ReadFull(rr.r, header[:])
+	if err != nil {
+		return 0, 0, err
+	}
+	cmdLen := int64(binary.BigEndian.Uint32(header[12:]))
+	recordLen := recordHeaderSize + cmdLen
+	if recordLen > rr.remaining {
+		return 0, 0, errRecordIncomplete
+	}
+	if int64(cap(rr.buf)) < cmdLen {
+		rr.buf = make([]byte, cmdLen)
+	}
+	command := rr.buf[:cmdLen]
+	_, err = io.ReadFull(rr.r, command)
+	if err != nil {
+		return 0, 0, err
+	}
+	rr.remaining -= recordLen
+
+	crc := crc32.Update(crc32.Checksum(header[4:], crc32cTable), crc32cTable, command)
+	if binary.BigEndian.Uint32(header[:]) != crc {
+		return 0, recordLen, errRecordChecksum
+	}
+	rr.checksum = crc
+	return TermNo(binary.BigEndian.Uint64(header[4:])), recordLen, nil
+}
+
+// scanSegment reads the given segment file and indexes the valid records.
+//
+// Scanning stops at the first record that is incomplete or fails its checksum.
+// If a valid record can be found after such a record, the damage is not just a
+// torn tail and a CorruptionError is returned. Otherwise the bad records are
+// counted in scanResult.droppedEntries.
+func scanSegment(f *os.File, firstIndex LogIndex) (*scanResult, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fileSize := fi.Size()
+
+	header := make([]byte, segmentHeaderSize)
+	_, err = f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err == io.EOF || string(header[:4]) != segmentMagic {
+		return nil, &CorruptionError{f.Name(), 0, 0, "bad segment header"}
+	}
+	if v := binary.BigEndian.Uint32(header[4:]); v != segmentVersion {
+		return nil, fmt.Errorf("seglog: %v: unsupported segment version: %v", f.Name(), v)
+	}
+
+	sr := &scanResult{
+		prevTerm: TermNo(binary.BigEndian.Uint64(header[8:])),
+		size:     segmentHeaderSize,
+	}
+	rr := newRecordReader(f, sr.size, fileSize)
+	for {
+		term, recordLen, err := rr.next()
+		if err == io.EOF {
+			return sr, nil
+		}
+		if err == errRecordIncomplete {
+			sr.droppedEntries = 1
+			return sr, nil
+		}
+		if err == errRecordChecksum {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		sr.offsets = append(sr.offsets, sr.size)
+		sr.terms = append(sr.terms, term)
+		sr.size += recordLen
+	}
+
+	// Found a record that fails its checksum - check the rest of the segment.
+	badIndex := firstIndex + LogIndex(len(sr.offsets))
+	sr.droppedEntries = 1
+	for {
+		_, _, err := rr.next()
+		if err == io.EOF {
+			return sr, nil
+		}
+		if err == errRecordIncomplete {
+			sr.droppedEntries++
+			return sr, nil
+		}
+		if err == errRecordChecksum {
+			sr.droppedEntries++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, &CorruptionError{f.Name(), sr.size, badIndex, "checksum mismatch"}
+	}
+}
+
+// SegmentInfo describes a segment file found by VerifyDir.
+type SegmentInfo struct {
+	Filename   string
+	FirstIndex LogIndex
+	Entries    int
+	Size       int64
+}
+
+// VerifyResult is the result of VerifyDir.
+type VerifyResult struct {
+	Segments []SegmentInfo
+
+	// The index of the first entry and the index of the last entry.
+	// If the log has no entries, LastIndex is FirstIndex-1.
+	FirstIndex LogIndex
+	LastIndex  LogIndex
+
+	// If not nil, the last segment has a damaged tail that will be truncated
+	// when the log is opened.
+	TailRepair *TailRepair
+}
+
+// VerifyDir scans the SegmentedLog in the given directory and checks every
+// record against its checksum, without modifying any files.
+//
+// It also checks that the segments are contiguous, that the previous term in
+// each segment header matches the last entry of the previous segment, and that
+// the terms of the entries never decrease.
+//
+// Any damage that OpenSegmentedLog would refuse to repair is returned as
+// a CorruptionError.
+//
+// This is meant to be used offline - i.e. while the log is not open.
+func VerifyDir(dir string) (*VerifyResult, error) {
+	firstIndexes, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(firstIndexes) == 0 {
+		return nil, fmt.Errorf("seglog: no segment files in %v", dir)
+	}
+
+	vr := &VerifyResult{
+		FirstIndex: firstIndexes[0],
+		LastIndex:  firstIndexes[0] - 1,
+	}
+	var prevTerm TermNo
+	for i, firstIndex := range firstIndexes {
+		filename := filepath.Join(dir, segmentFileName(firstIndex))
+		if firstIndex != vr.LastIndex+1 {
+			return nil, &CorruptionError{
+				filename,
+				0,
+				firstIndex,
+				fmt.Sprintf("segment does not follow previous lastIndex=%v", vr.LastIndex),
+			}
+		}
+
+		sr, err := verifySegment(filename, firstIndex)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			prevTerm = sr.prevTerm
+		} else if sr.prevTerm != prevTerm {
+			return nil, &CorruptionError{
+				filename,
+				0,
+				firstIndex,
+				fmt.Sprintf("header has previous term %v but previous entry has term %v", sr.prevTerm, prevTerm),
+			}
+		}
+		if sr.droppedEntries > 0 {
+			if i != len(firstIndexes)-1 {
+				return nil, sr.tailCorruptionError(filename, firstIndex)
+			}
+			vr.TailRepair = &TailRepair{filename, sr.size, sr.droppedEntries}
+		}
+		for j, term := range sr.terms {
+			if term < prevTerm {
+				return nil, &CorruptionError{
+					filename,
+					sr.offsets[j],
+					firstIndex + LogIndex(j),
+					fmt.Sprintf("term %v is less than previous term %v", term, prevTerm),
+				}
+			}
+			prevTerm = term
+		}
+
+		vr.Segments = append(vr.Segments, SegmentInfo{
+			filename,
+			firstIndex,
+			len(sr.offsets),
+			sr.size,
+		})
+		vr.LastIndex = firstIndex + LogIndex(len(sr.offsets)) - 1
+	}
+	return vr, nil
+}
+
+func verifySegment(filename string, firstIndex LogIndex) (*scanResult, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	sr, err := scanSegment(f, firstIndex)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return sr, f.Close()
+}
+
+// EntryInfo describes an entry found by ScanDir.
+type EntryInfo struct {
+	Index       LogIndex
+	Term        TermNo
+	Filename    string
+	Offset      int64
+	CommandSize int
+	// Checksum is the CRC32C of the record, which covers the term and the command.
+	// Two entries with the same checksum almost certainly have the same term and
+	// command.
+	Checksum uint32
+}
+
+// ScanDir verifies the SegmentedLog in the given directory like VerifyDir, and
+// then calls fn for each entry in order of index.
+//
+// The entries of a damaged tail are not included. ScanDir stops and returns the
+// error if fn returns an error.
+//
+// Like VerifyDir, this is meant to be used offline and does not modify any files.
+//
+func ScanDir(dir string, fn func(EntryInfo) error) (*VerifyResult, error) {
+	vr, err := VerifyDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, si := range vr.Segments {
+		if err := scanSegmentEntries(si, fn); err != nil {
+			return nil, err
+		}
+	}
+	return vr, nil
+}
+
+func scanSegmentEntries(si SegmentInfo, fn func(EntryInfo) error) error {
+	f, err := os.Open(si.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Only read up to the verified size, which excludes a damaged tail.
+	rr := newRecordReader(f, segmentHeaderSize, si.Size)
+	offset := int64(segmentHeaderSize)
+	for i := 0; i < si.Entries; i++ {
+		term, recordLen, err := rr.next()
+		if err != nil {
+			// The file changed since it was verified
+			return fmt.Errorf("seglog: %v: %v at offset %v", si.Filename, err, offset)
+		}
+		ei := EntryInfo{
+			si.FirstIndex + LogIndex(i),
+			term,
+			si.Filename,
+			offset,
+			int(recordLen - recordHeaderSize),
+			rr.checksum,
+		}
+		if err := fn(ei); err != nil {
+			return err
+		}
+		offset += recordLen
+	}
+	return nil
+}
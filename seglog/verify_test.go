@@ -0,0 +1,307 @@
+package seglog
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/testdata"
+)
+
+// Offsets of the records in the last segment of the Figure 7 test log
+const (
+	testOffsetC9  = segmentHeaderSize
+	testOffsetC10 = testOffsetC9 + recordHeaderSize + 2
+	testSizeSeg9  = testOffsetC10 + recordHeaderSize + 3
+)
+
+// Make a closed SegmentedLog with the Figure 7 entries.
+func makeClosedFigure7TestLog(t *testing.T) string {
+	dir := makeTestDir(t)
+	sl := openTestLogWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	closeTestLog(t, sl)
+	return dir
+}
+
+// Flip the bits of the command byte of the record at the given offset.
+func corruptRecord(t *testing.T, filename string, offset int64) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, offset+recordHeaderSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[0] = ^b[0]
+	_, err = f.WriteAt(b, offset+recordHeaderSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentedLog_CorruptedTailIsTruncated(t *testing.T) {
+	dir := makeClosedFigure7TestLog(t)
+	defer removeTestDir(t, dir)
+
+	lastFile := filepath.Join(dir, "00000000000000000009.seg")
+	corruptRecord(t, lastFile, testOffsetC10)
+
+	sl, err := OpenSegmentedLog(dir, 3, testMaxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestLog(t, sl)
+
+	expectedTailRepair := &TailRepair{lastFile, testOffsetC10, 1}
+	if tr := sl.GetTailRepair(); !reflect.DeepEqual(tr, expectedTailRepair) {
+		t.Fatal(tr)
+	}
+	if iole := sl.GetIndexOfLastEntry(); iole != 9 {
+		t.Fatal(iole)
+	}
+	fi, err := os.Stat(lastFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != testOffsetC10 {
+		t.Fatal(fi.Size())
+	}
+}
+
+func TestSegmentedLog_CorruptionInMiddleOfLastSegment(t *testing.T) {
+	dir := makeClosedFigure7TestLog(t)
+	defer removeTestDir(t, dir)
+
+	lastFile := filepath.Join(dir, "00000000000000000009.seg")
+	corruptRecord(t, lastFile, testOffsetC9)
+
+	_, err := OpenSegmentedLog(dir, 3, testMaxSegmentSize)
+	expectedErr := &CorruptionError{lastFile, testOffsetC9, 9, "checksum mismatch"}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentedLog_CorruptionInEarlierSegment(t *testing.T) {
+	dir := makeClosedFigure7TestLog(t)
+	defer removeTestDir(t, dir)
+
+	// Corrupt the last entry of an earlier segment
+	file := filepath.Join(dir, "00000000000000000005.seg")
+	corruptRecord(t, file, testOffsetC10)
+
+	_, err := OpenSegmentedLog(dir, 3, testMaxSegmentSize)
+	expectedErr := &CorruptionError{file, testOffsetC10, 6, "1 bad record(s) at end of segment"}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Fatal(err)
+	}
+
+	_, err = VerifyDir(dir)
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentedLog_CorruptionAfterOpen(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	sl := openTestLogWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	defer closeTestLog(t, sl)
+
+	file := filepath.Join(dir, "00000000000000000005.seg")
+	corruptRecord(t, file, testOffsetC10)
+
+	// Term is still available from the index
+	term, err := sl.GetTermAtIndex(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if term != 5 {
+		t.Fatal(term)
+	}
+
+	// Reading the entry detects the corruption
+	_, err = sl.GetEntriesAfterIndex(4)
+	expectedErr := &CorruptionError{file, testOffsetC10, 6, "checksum mismatch"}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Fatal(err)
+	}
+	_, err = sl.GetEntriesAfterIndex(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyDir(t *testing.T) {
+	dir := makeClosedFigure7TestLog(t)
+	defer removeTestDir(t, dir)
+
+	vr, err := VerifyDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vr.FirstIndex != 1 || vr.LastIndex != 10 || vr.TailRepair != nil {
+		t.Fatal(vr)
+	}
+	if len(vr.Segments) != 5 {
+		t.Fatal(vr.Segments)
+	}
+	expectedLastSegment := SegmentInfo{
+		filepath.Join(dir, "00000000000000000009.seg"), 9, 2, testSizeSeg9,
+	}
+	if vr.Segments[4] != expectedLastSegment {
+		t.Fatal(vr.Segments[4])
+	}
+
+	// A damaged tail is reported but not repaired
+	lastFile := filepath.Join(dir, "00000000000000000009.seg")
+	corruptRecord(t, lastFile, testOffsetC10)
+
+	vr, err = VerifyDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vr.LastIndex != 9 {
+		t.Fatal(vr.LastIndex)
+	}
+	expectedTailRepair := &TailRepair{lastFile, testOffsetC10, 1}
+	if !reflect.DeepEqual(vr.TailRepair, expectedTailRepair) {
+		t.Fatal(vr.TailRepair)
+	}
+	fi, err := os.Stat(lastFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != testSizeSeg9 {
+		t.Fatal(fi.Size())
+	}
+}
+
+func TestVerifyDir_TermDecreases(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	sl := openTestLogWithTerms(t, dir, []TermNo{1, 3, 2})
+	closeTestLog(t, sl)
+
+	_, err := VerifyDir(dir)
+	expectedErr := &CorruptionError{
+		filepath.Join(dir, "00000000000000000003.seg"),
+		segmentHeaderSize,
+		3,
+		"term 2 is less than previous term 3",
+	}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyDir_PrevTermMismatch(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	sl := openTestLogWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	closeTestLog(t, sl)
+
+	// Change the previous term in the header of the segment starting at 5
+	file := filepath.Join(dir, "00000000000000000005.seg")
+	f, err := os.OpenFile(file, os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0, 0, 0, 0, 0, 0, 0, 3}, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = VerifyDir(dir)
+	expectedErr := &CorruptionError{
+		file,
+		0,
+		5,
+		"header has previous term 3 but previous entry has term 4",
+	}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Fatal(err)
+	}
+}
+
+func TestScanDir(t *testing.T) {
+	dir := makeClosedFigure7TestLog(t)
+	defer removeTestDir(t, dir)
+
+	var entries []EntryInfo
+	scan := func() *VerifyResult {
+		entries = nil
+		vr, err := ScanDir(dir, func(ei EntryInfo) error {
+			entries = append(entries, ei)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return vr
+	}
+
+	vr := scan()
+	if vr.LastIndex != 10 || len(entries) != 10 {
+		t.Fatal(vr, entries)
+	}
+	terms := testdata.TestUtil_MakeFigure7LeaderLineTerms()
+	for i, ei := range entries {
+		if ei.Index != LogIndex(i+1) || ei.Term != terms[i] || ei.CommandSize != len("c"+strconv.Itoa(i+1)) {
+			t.Fatal(ei)
+		}
+	}
+	lastFile := filepath.Join(dir, "00000000000000000009.seg")
+	if entries[9].Filename != lastFile || entries[9].Offset != testOffsetC10 {
+		t.Fatal(entries[9])
+	}
+	checksumC10 := entries[9].Checksum
+
+	// The entries of a damaged tail are not included
+	corruptRecord(t, lastFile, testOffsetC10)
+	vr = scan()
+	if vr.TailRepair == nil || len(entries) != 9 {
+		t.Fatal(vr, entries)
+	}
+
+	// A record with a different command has a different checksum
+	sl, err := OpenSegmentedLog(dir, 3, testMaxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sl.AppendEntry(LogEntry{6, Command("c10!")}); err != nil {
+		t.Fatal(err)
+	}
+	closeTestLog(t, sl)
+	scan()
+	if len(entries) != 10 || entries[9].Checksum == checksumC10 || entries[9].CommandSize != 4 {
+		t.Fatal(entries[9])
+	}
+
+	// An error from fn stops the scan
+	n := 0
+	_, err = ScanDir(dir, func(ei EntryInfo) error {
+		n++
+		return errors.New("stop")
+	})
+	if err == nil || err.Error() != "stop" || n != 1 {
+		t.Fatal(err, n)
+	}
+}
@@ -0,0 +1,243 @@
+package sim
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/aesender"
+	"github.com/divtxt/raft/config"
+	"github.com/divtxt/raft/consensus"
+	"github.com/divtxt/raft/inmemlog"
+	"github.com/divtxt/raft/rps"
+)
+
+// Node is a simulated server.
+//
+// The log and persistent state of a Node survive a crash, but its state machine
+// does not: a restarted Node applies the committed entries again from the start.
+//
+type Node struct {
+	sim *Simulation
+	id  ServerId
+
+	log   *inmemlog.InMemoryLog
+	state *rps.InMemoryRaftPersistentState
+
+	// The following are reset by a restart
+	pcm          *consensus.PassiveConsensusModule // nil if crashed
+	incarnation  uint64                            // events for older incarnations are ignored
+	lastApplied  LogIndex
+	applied      []Command
+	applyPending bool
+}
+
+func newNode(s *Simulation, serverId ServerId) (*Node, error) {
+	iml, err := inmemlog.NewInMemoryLogWithBatchPolicy(s.config.BatchPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{
+		sim:   s,
+		id:    serverId,
+		log:   iml,
+		state: rps.NewIMPSWithCurrentTerm(0),
+	}, nil
+}
+
+// Id returns the ServerId of the Node.
+func (n *Node) Id() ServerId {
+	return n.id
+}
+
+// Running returns true if the Node is running i.e. has not crashed.
+func (n *Node) Running() bool {
+	return n.pcm != nil
+}
+
+// ServerState returns the state of the running Node.
+func (n *Node) ServerState() ServerState {
+	return n.pcm.GetServerState()
+}
+
+// CurrentTerm returns the current term of the Node.
+func (n *Node) CurrentTerm() TermNo {
+	return n.state.GetCurrentTerm()
+}
+
+// CommitIndex returns the commit index of the running Node.
+func (n *Node) CommitIndex() LogIndex {
+	return n.pcm.GetCommitIndex()
+}
+
+// Log returns the log of the Node.
+func (n *Node) Log() Log {
+	return n.log
+}
+
+// Applied returns the commands applied by the Node since it last started.
+func (n *Node) Applied() []Command {
+	return append([]Command(nil), n.applied...)
+}
+
+// start starts a new incarnation of a crashed Node.
+func (n *Node) start() error {
+	if n.Running() {
+		return fmt.Errorf("%v is already running", n.id)
+	}
+	s := n.sim
+
+	ci, err := config.NewClusterInfo(s.config.ServerIds, n.id)
+	if err != nil {
+		return err
+	}
+	n.incarnation++
+	incarnation := n.incarnation
+	pcm, err := consensus.NewPassiveConsensusModuleWithRand(
+		n.state,
+		n.log,
+		n.sendRequestVote(incarnation),
+		aesender.NewLogOnlyAESenderWithBatchPolicy(n.log, s.config.BatchPolicy, n.sendAppendEntries(incarnation)),
+		ci,
+		s.config.ElectionTimeoutLow,
+		s.Now,
+		rand.New(rand.NewSource(s.rand.Int63())),
+		s.logger,
+	)
+	if err != nil {
+		return err
+	}
+	n.pcm = pcm
+	n.lastApplied = 0
+	n.applied = nil
+	n.applyPending = false
+
+	// Start ticking at a random phase so that servers do not tick together
+	phase := time.Duration(s.rand.Int63n(int64(s.config.TickInterval)))
+	n.scheduleTick(incarnation, s.now.Add(phase))
+	return nil
+}
+
+// stop crashes the Node.
+func (n *Node) stop() {
+	n.pcm = nil
+}
+
+// isCurrent returns true if the Node is running the given incarnation.
+func (n *Node) isCurrent(incarnation uint64) bool {
+	return n.Running() && n.incarnation == incarnation
+}
+
+func (n *Node) scheduleTick(incarnation uint64, at time.Time) {
+	s := n.sim
+	s.schedule(at, n.eventName("tick"), func() {
+		if !n.isCurrent(incarnation) {
+			return
+		}
+		if err := n.pcm.Tick(); err != nil {
+			s.fail(fmt.Errorf("%v: Tick: %v", n.id, err))
+			return
+		}
+		n.afterEvent()
+		n.scheduleTick(incarnation, s.now.Add(s.config.TickInterval))
+	})
+}
+
+// afterEvent checks safety and schedules an apply if needed.
+func (n *Node) afterEvent() {
+	if !n.Running() {
+		return
+	}
+	n.sim.observe(n)
+	if !n.applyPending && n.pcm.GetCommitIndex() > n.lastApplied {
+		n.applyPending = true
+		incarnation := n.incarnation
+		n.sim.schedule(n.sim.now, n.eventName("apply"), func() {
+			if n.isCurrent(incarnation) {
+				n.applyPending = false
+				n.apply()
+			}
+		})
+	}
+}
+
+// apply applies the committed entries to the state machine.
+func (n *Node) apply() {
+	commitIndex := n.pcm.GetCommitIndex()
+	for n.lastApplied < commitIndex {
+		entries, err := n.log.GetEntriesAfterIndex(n.lastApplied)
+		if err != nil {
+			n.sim.fail(fmt.Errorf("%v: apply: %v", n.id, err))
+			return
+		}
+		for _, entry := range entries {
+			if n.lastApplied == commitIndex {
+				break
+			}
+			n.lastApplied++
+			n.applied = append(n.applied, entry.Command)
+			n.sim.applied(n, n.lastApplied, entry.Command)
+		}
+	}
+}
+
+func (n *Node) sendRequestVote(incarnation uint64) func(ServerId, *RpcRequestVote) {
+	return func(to ServerId, rpc *RpcRequestVote) {
+		s := n.sim
+		from := n.id
+		s.send(from, to, "RequestVote", func(target *Node) {
+			reply, err := target.pcm.Rpc_RpcRequestVote(from, rpc)
+			if err != nil {
+				s.fail(fmt.Errorf("%v: RequestVote from %v: %v", to, from, err))
+				return
+			}
+			s.send(to, from, "RequestVoteReply", func(sender *Node) {
+				if sender.incarnation != incarnation {
+					return
+				}
+				err := sender.pcm.RpcReply_RpcRequestVoteReply(to, rpc, reply)
+				if err != nil {
+					s.fail(fmt.Errorf("%v: RequestVoteReply from %v: %v", from, to, err))
+				}
+			})
+		})
+	}
+}
+
+func (n *Node) sendAppendEntries(incarnation uint64) func(ServerId, *RpcAppendEntries) {
+	return func(to ServerId, rpc *RpcAppendEntries) {
+		// Copy the entries as a real transport would, since the log can change
+		// before the message is delivered
+		entries := make([]LogEntry, len(rpc.Entries))
+		copy(entries, rpc.Entries)
+		rpcCopy := *rpc
+		rpcCopy.Entries = entries
+
+		s := n.sim
+		from := n.id
+		s.send(from, to, "AppendEntries", func(target *Node) {
+			reply, err := target.pcm.Rpc_RpcAppendEntries(from, &rpcCopy)
+			if err != nil {
+				s.fail(fmt.Errorf("%v: AppendEntries from %v: %v", to, from, err))
+				return
+			}
+			s.send(to, from, "AppendEntriesReply", func(sender *Node) {
+				if sender.incarnation != incarnation {
+					return
+				}
+				err := sender.pcm.RpcReply_RpcAppendEntriesReply(to, &rpcCopy, reply)
+				if err != nil {
+					s.fail(fmt.Errorf("%v: AppendEntriesReply from %v: %v", from, to, err))
+				}
+			})
+		})
+	}
+}
+
+func (n *Node) eventName(name string) string {
+	if n.sim.config.Trace == nil {
+		return name
+	}
+	return fmt.Sprint(name, " ", n.id)
+}
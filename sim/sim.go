@@ -0,0 +1,442 @@
+// Package sim is a deterministic discrete-event simulation of a raft cluster.
+//
+// A Simulation drives a PassiveConsensusModule for each server from a single
+// event queue with a virtual clock. Ticks, RPC deliveries, RPC replies and
+// applies to the state machine are all events, so a simulation uses no
+// goroutines and no sleeps, and runs much faster than real time.
+//
+// All randomness - election timeouts, message latency and message loss - comes
+// from one generator seeded with Config.Seed. Running with the same Config and
+// the same calls to the Simulation always gives exactly the same result, so a
+// failing seed can be replayed, e.g. with Config.Trace set to see every event.
+//
+// After every event, the Simulation checks the raft safety properties with a
+// safety.Checker.
+//
+package sim
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/safety"
+)
+
+// Config is the configuration of a Simulation.
+type Config struct {
+	ServerIds []ServerId
+	Seed      int64
+
+	TickInterval       time.Duration
+	ElectionTimeoutLow time.Duration
+	BatchPolicy        BatchPolicy
+
+	// Each message is delayed by a random latency from MinLatency to MaxLatency.
+	MinLatency time.Duration
+	MaxLatency time.Duration
+
+	// DropRate is the probability that a message is lost.
+	DropRate float64
+
+	// Logger for the ConsensusModules. If nil, their output is discarded.
+	Logger *log.Logger
+
+	// Trace, if not nil, gets a line for every event.
+	Trace io.Writer
+}
+
+// DefaultConfig returns a Config for a cluster of the given servers with timing
+// similar to a real cluster on a local network.
+func DefaultConfig(serverIds []ServerId, seed int64) Config {
+	return Config{
+		ServerIds:          serverIds,
+		Seed:               seed,
+		TickInterval:       30 * time.Millisecond,
+		ElectionTimeoutLow: 150 * time.Millisecond,
+		BatchPolicy:        BatchPolicy{MaxEntries: 3},
+		MinLatency:         1 * time.Millisecond,
+		MaxLatency:         5 * time.Millisecond,
+	}
+}
+
+func (c *Config) validate() error {
+	if len(c.ServerIds) == 0 {
+		return errors.New("ServerIds is empty")
+	}
+	if c.TickInterval <= 0 {
+		return fmt.Errorf("TickInterval=%v must be greater than zero", c.TickInterval)
+	}
+	if c.ElectionTimeoutLow <= 0 {
+		return fmt.Errorf("ElectionTimeoutLow=%v must be greater than zero", c.ElectionTimeoutLow)
+	}
+	if err := c.BatchPolicy.Validate(); err != nil {
+		return err
+	}
+	if c.MinLatency < 0 || c.MaxLatency < c.MinLatency {
+		return fmt.Errorf("bad latency range: %v to %v", c.MinLatency, c.MaxLatency)
+	}
+	if c.DropRate < 0 || c.DropRate > 1 {
+		return fmt.Errorf("DropRate=%v must be from 0 to 1", c.DropRate)
+	}
+	return nil
+}
+
+// checkerTraceLen is the number of events in the trace of a safety violation.
+const checkerTraceLen = 50
+
+// epoch is the virtual time at the start of every simulation.
+var epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Simulation is a simulated raft cluster.
+//
+// A Simulation is not safe for concurrent use.
+//
+type Simulation struct {
+	config Config
+	rand   *rand.Rand
+	logger *log.Logger
+
+	now     time.Time
+	events  eventQueue
+	nextSeq uint64
+	count   uint64 // events run
+
+	nodes map[ServerId]*Node
+	cut   map[link]bool
+
+	checker *safety.Checker
+
+	err error // the first failure
+}
+
+type link struct {
+	from ServerId
+	to   ServerId
+}
+
+// New creates a Simulation with all servers running.
+func New(config Config) (*Simulation, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	checker, err := safety.NewChecker(checkerTraceLen)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Simulation{
+		config:  config,
+		rand:    rand.New(rand.NewSource(config.Seed)),
+		logger:  logger,
+		now:     epoch,
+		nodes:   make(map[ServerId]*Node),
+		cut:     make(map[link]bool),
+		checker: checker,
+	}
+	for _, serverId := range config.ServerIds {
+		n, err := newNode(s, serverId)
+		if err != nil {
+			return nil, err
+		}
+		s.nodes[serverId] = n
+	}
+	for _, serverId := range config.ServerIds {
+		if err := s.nodes[serverId].start(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Now returns the current virtual time.
+func (s *Simulation) Now() time.Time {
+	return s.now
+}
+
+// Elapsed returns the virtual time since the start of the simulation.
+func (s *Simulation) Elapsed() time.Duration {
+	return s.now.Sub(epoch)
+}
+
+// EventCount returns the number of events run so far.
+func (s *Simulation) EventCount() uint64 {
+	return s.count
+}
+
+// Err returns the first failure of the simulation, or nil.
+//
+// A failure is a broken safety property, or an error from a ConsensusModule.
+func (s *Simulation) Err() error {
+	return s.err
+}
+
+// Node returns the given server, or nil if it is not in the cluster.
+func (s *Simulation) Node(serverId ServerId) *Node {
+	return s.nodes[serverId]
+}
+
+// Leaders returns the running servers that are in the LEADER state, in order.
+func (s *Simulation) Leaders() []ServerId {
+	var leaders []ServerId
+	for _, serverId := range s.config.ServerIds {
+		n := s.nodes[serverId]
+		if n.Running() && n.ServerState() == LEADER {
+			leaders = append(leaders, serverId)
+		}
+	}
+	return leaders
+}
+
+// Leader returns the leader with the highest term, or 0 if there is no leader.
+func (s *Simulation) Leader() ServerId {
+	var leader ServerId
+	var leaderTerm TermNo
+	for _, serverId := range s.Leaders() {
+		if term := s.nodes[serverId].CurrentTerm(); leader == 0 || term > leaderTerm {
+			leader, leaderTerm = serverId, term
+		}
+	}
+	return leader
+}
+
+// Rand returns the random number generator of the simulation.
+//
+// Tests should use this for any random choices so that runs are repeatable.
+func (s *Simulation) Rand() *rand.Rand {
+	return s.rand
+}
+
+// At schedules the given function to run at the given virtual time after the
+// start of the simulation.
+func (s *Simulation) At(elapsed time.Duration, f func()) {
+	s.schedule(epoch.Add(elapsed), "at", f)
+}
+
+// RunFor runs events for the given duration of virtual time.
+//
+// Returns the first failure, which stops the simulation.
+func (s *Simulation) RunFor(d time.Duration) error {
+	end := s.now.Add(d)
+	for s.err == nil && len(s.events) > 0 && !s.events[0].at.After(end) {
+		s.step()
+	}
+	if s.err == nil {
+		s.now = end
+	}
+	return s.err
+}
+
+// RunUntil runs events until the given condition is true, for up to the given
+// duration of virtual time.
+//
+// The condition is checked after every event. Returns true if the condition
+// became true, and the first failure, which stops the simulation.
+//
+func (s *Simulation) RunUntil(cond func() bool, max time.Duration) (bool, error) {
+	end := s.now.Add(max)
+	for s.err == nil {
+		if cond() {
+			return true, nil
+		}
+		if len(s.events) == 0 || s.events[0].at.After(end) {
+			s.now = end
+			return cond(), nil
+		}
+		s.step()
+	}
+	return false, s.err
+}
+
+// Propose appends the given command on the given server, which must be the
+// leader, and returns its log index.
+func (s *Simulation) Propose(serverId ServerId, command Command) (LogIndex, error) {
+	n := s.nodes[serverId]
+	if n == nil || !n.Running() {
+		return 0, ErrStopped
+	}
+	li, err := n.pcm.AppendCommand(command)
+	s.trace("propose", serverId, command, "->", li, err)
+	n.afterEvent()
+	return li, err
+}
+
+// Crash stops the given server. Its log and persistent state are kept, but its
+// state machine is lost, and messages to or from it are lost.
+func (s *Simulation) Crash(serverId ServerId) {
+	s.trace("crash", serverId)
+	s.checker.Event("%v: crashed", serverId)
+	if n := s.nodes[serverId]; n != nil {
+		n.stop()
+	}
+}
+
+// Restart restarts the given crashed server.
+func (s *Simulation) Restart(serverId ServerId) error {
+	s.trace("restart", serverId)
+	n := s.nodes[serverId]
+	if n == nil {
+		return fmt.Errorf("%v is not in the cluster", serverId)
+	}
+	if err := n.start(); err != nil {
+		return err
+	}
+	s.checker.Restarted(serverId)
+	return nil
+}
+
+// Cut cuts the link from one server to another, so that messages in that
+// direction are lost.
+func (s *Simulation) Cut(from, to ServerId) {
+	s.trace("cut", from, to)
+	s.checker.Event("cut %v -> %v", from, to)
+	s.cut[link{from, to}] = true
+}
+
+// Partition cuts the links in both directions between servers in different groups.
+func (s *Simulation) Partition(groups ...[]ServerId) {
+	s.trace("partition", groups)
+	s.checker.Event("partition %v", groups)
+	for i, g1 := range groups {
+		for j, g2 := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range g1 {
+				for _, to := range g2 {
+					s.cut[link{from, to}] = true
+				}
+			}
+		}
+	}
+}
+
+// Heal restores all links.
+func (s *Simulation) Heal() {
+	s.trace("heal")
+	s.checker.Event("heal")
+	s.cut = make(map[link]bool)
+}
+
+// SetDropRate changes the probability that a message is lost.
+func (s *Simulation) SetDropRate(dropRate float64) {
+	s.trace("droprate", dropRate)
+	s.config.DropRate = dropRate
+}
+
+// step runs the next event.
+func (s *Simulation) step() {
+	e := heap.Pop(&s.events).(*event)
+	s.now = e.at
+	s.count++
+	s.trace(e.name)
+	e.run()
+}
+
+func (s *Simulation) schedule(at time.Time, name string, run func()) {
+	s.nextSeq++
+	heap.Push(&s.events, &event{at, s.nextSeq, name, run})
+}
+
+// send schedules the delivery of a message from one server to another, unless
+// the message is lost.
+//
+// deliver is called with the receiving Node, which is running.
+func (s *Simulation) send(from, to ServerId, name string, deliver func(n *Node)) {
+	if s.cut[link{from, to}] || (s.config.DropRate > 0 && s.rand.Float64() < s.config.DropRate) {
+		s.trace("drop", name, from, "->", to)
+		return
+	}
+	latency := s.config.MinLatency
+	if d := s.config.MaxLatency - s.config.MinLatency; d > 0 {
+		latency += time.Duration(s.rand.Int63n(int64(d) + 1))
+	}
+	if s.config.Trace != nil {
+		name = fmt.Sprint(name, " ", from, "->", to)
+	}
+	s.schedule(s.now.Add(latency), name, func() {
+		if n := s.nodes[to]; n.Running() {
+			deliver(n)
+			n.afterEvent()
+		}
+	})
+}
+
+// fail records the first failure.
+func (s *Simulation) fail(err error) {
+	if s.err == nil {
+		s.err = fmt.Errorf("seed %v: t=%v: %v", s.config.Seed, s.Elapsed(), err)
+		s.trace("FAIL", s.err)
+	}
+}
+
+// observe checks the safety properties for the given running server.
+func (s *Simulation) observe(n *Node) {
+	lastCompacted, entries, err := safety.ReadLog(n.log, n.log.GetIndexOfLastEntry())
+	if err != nil {
+		s.fail(fmt.Errorf("%v: %v", n.id, err))
+		return
+	}
+	err = s.checker.Observe(safety.Observation{
+		n.id, n.CurrentTerm(), n.ServerState(), n.CommitIndex(), lastCompacted, entries,
+	})
+	if err != nil {
+		s.fail(err)
+	}
+}
+
+// applied checks a command applied by the given server.
+func (s *Simulation) applied(n *Node, li LogIndex, command Command) {
+	if err := s.checker.Applied(n.id, li, command); err != nil {
+		s.fail(err)
+	}
+}
+
+func (s *Simulation) trace(args ...interface{}) {
+	if s.config.Trace != nil {
+		_, _ = fmt.Fprintln(s.config.Trace, append([]interface{}{s.Elapsed()}, args...)...)
+	}
+}
+
+// event is an entry in the event queue.
+type event struct {
+	at   time.Time
+	seq  uint64 // events at the same time run in the order they were scheduled
+	name string
+	run  func()
+}
+
+// eventQueue is a heap of events, ordered by time and then seq.
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return e
+}
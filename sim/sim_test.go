@@ -0,0 +1,409 @@
+package sim
+
+import (
+	"bytes"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/testhelpers"
+)
+
+var (
+	seeds = flag.Int("sim.seeds", 100, "number of random schedules to simulate")
+	seed  = flag.Int64("sim.seed", -1, "simulate only the random schedule with this seed")
+)
+
+var testServerIds = []ServerId{101, 102, 103}
+
+func newTestSimulation(t *testing.T, config Config) *Simulation {
+	t.Helper()
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func runUntil(t *testing.T, s *Simulation, cond func() bool, max time.Duration) {
+	t.Helper()
+	ok, err := s.RunUntil(cond, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("seed %v: condition not met after %v", s.config.Seed, max)
+	}
+}
+
+func waitForLeader(t *testing.T, s *Simulation) ServerId {
+	t.Helper()
+	runUntil(t, s, func() bool { return len(s.Leaders()) == 1 }, 10*time.Second)
+	return s.Leaders()[0]
+}
+
+func TestNew_Validation(t *testing.T) {
+	bad := []func(c *Config){
+		func(c *Config) { c.ServerIds = nil },
+		func(c *Config) { c.TickInterval = 0 },
+		func(c *Config) { c.ElectionTimeoutLow = 0 },
+		func(c *Config) { c.BatchPolicy = BatchPolicy{} },
+		func(c *Config) { c.MaxLatency = 0 },
+		func(c *Config) { c.DropRate = 1.5 },
+	}
+	for i, f := range bad {
+		c := DefaultConfig(testServerIds, 1)
+		f(&c)
+		if _, err := New(c); err == nil {
+			t.Fatal(i)
+		}
+	}
+}
+
+// The same seed always gives the same events.
+func TestSimulation_SameSeedSameRun(t *testing.T) {
+	run := func(seed int64) []byte {
+		var trace bytes.Buffer
+		c := DefaultConfig(testServerIds, seed)
+		c.DropRate = 0.1
+		c.Trace = &trace
+		s := newTestSimulation(t, c)
+		s.At(time.Second, func() {
+			if leader := s.Leader(); leader != 0 {
+				s.Crash(leader)
+			}
+		})
+		if err := s.RunFor(3 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		return trace.Bytes()
+	}
+
+	trace1 := run(1)
+	if len(trace1) == 0 {
+		t.Fatal()
+	}
+	if !bytes.Equal(run(1), trace1) {
+		t.Fatal("different traces for the same seed")
+	}
+	if bytes.Equal(run(2), trace1) {
+		t.Fatal("same trace for different seeds")
+	}
+}
+
+func TestSimulation_ElectsLeader(t *testing.T) {
+	c := DefaultConfig(testServerIds, 1)
+	s := newTestSimulation(t, c)
+
+	// -- All nodes start as followers
+	// ... and stay followers until the election timeout
+	err := s.RunFor(c.ElectionTimeoutLow - time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, serverId := range testServerIds {
+		if st := s.Node(serverId).ServerState(); st != FOLLOWER {
+			t.Fatal(serverId, st)
+		}
+	}
+
+	// -- Election timeout results in a leader being elected
+	leader := waitForLeader(t, s)
+	if s.Leader() != leader {
+		t.Fatal(s.Leader())
+	}
+	if s.Elapsed() > 2*c.ElectionTimeoutLow+c.TickInterval+c.MaxLatency*2 {
+		t.Fatal(s.Elapsed())
+	}
+
+	// -- The leader stays leader
+	if err := s.RunFor(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if l := s.Leaders(); !reflect.DeepEqual(l, []ServerId{leader}) {
+		t.Fatal(l)
+	}
+}
+
+func TestSimulation_CommandIsReplicatedVsMissingNode(t *testing.T) {
+	c := DefaultConfig(testServerIds, 1)
+	s := newTestSimulation(t, c)
+	leader := waitForLeader(t, s)
+	term := s.Node(leader).CurrentTerm()
+
+	// Simulate a follower crash
+	var follower, crashed ServerId
+	for _, serverId := range testServerIds {
+		if serverId != leader {
+			follower, crashed = crashed, serverId
+		}
+	}
+	s.Crash(crashed)
+	if s.Node(crashed).Running() {
+		t.Fatal()
+	}
+
+	// Apply a command on the leader
+	li, err := s.Propose(leader, testhelpers.DummyCommand(101))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if li != 1 {
+		t.Fatal(li)
+	}
+	expectedLe := LogEntry{term, Command("c101")}
+
+	// Command is in the leader's log
+	le := testhelpers.TestHelper_GetLogEntryAtIndex(s.Node(leader).Log(), 1)
+	if !reflect.DeepEqual(le, expectedLe) {
+		t.Fatal(le)
+	}
+	// but not yet in the follower's
+	if iole := s.Node(follower).Log().GetIndexOfLastEntry(); iole != 0 {
+		t.Fatal(iole)
+	}
+
+	// A proposal on a follower fails
+	if _, err := s.Propose(follower, Command("c102")); err != ErrNotLeader {
+		t.Fatal(err)
+	}
+	// ... as does a proposal on the crashed node
+	if _, err := s.Propose(crashed, Command("c102")); err != ErrStopped {
+		t.Fatal(err)
+	}
+
+	// The command is replicated, committed and applied on the running nodes
+	applied := func(serverIds ...ServerId) func() bool {
+		return func() bool {
+			for _, serverId := range serverIds {
+				if len(s.Node(serverId).Applied()) < 1 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	runUntil(t, s, applied(leader, follower), time.Second)
+	for _, serverId := range []ServerId{leader, follower} {
+		le := testhelpers.TestHelper_GetLogEntryAtIndex(s.Node(serverId).Log(), 1)
+		if !reflect.DeepEqual(le, expectedLe) {
+			t.Fatal(serverId, le)
+		}
+		if a := s.Node(serverId).Applied(); !reflect.DeepEqual(a, []Command{Command("c101")}) {
+			t.Fatal(serverId, a)
+		}
+	}
+
+	// Crashed follower restarts and gets the command and the commit
+	if err := s.Restart(crashed); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Restart(crashed); err == nil {
+		t.Fatal()
+	}
+	if a := s.Node(crashed).Applied(); len(a) != 0 {
+		t.Fatal(a)
+	}
+	runUntil(t, s, applied(crashed), time.Second)
+	le = testhelpers.TestHelper_GetLogEntryAtIndex(s.Node(crashed).Log(), 1)
+	if !reflect.DeepEqual(le, expectedLe) {
+		t.Fatal(le)
+	}
+	if a := s.Node(crashed).Applied(); !reflect.DeepEqual(a, []Command{Command("c101")}) {
+		t.Fatal(a)
+	}
+	if s.Leader() != leader {
+		t.Fatal(s.Leader())
+	}
+}
+
+func TestSimulation_SOLO_Command_And_CommitIndexAdvance(t *testing.T) {
+	s := newTestSimulation(t, DefaultConfig([]ServerId{101}, 1))
+
+	// -- Election timeout results in the node electing itself leader
+	if leader := waitForLeader(t, s); leader != 101 {
+		t.Fatal(leader)
+	}
+	n := s.Node(101)
+
+	// Apply a command on the leader
+	li, err := s.Propose(101, testhelpers.DummyCommand(101))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if li != 1 {
+		t.Fatal(li)
+	}
+
+	// Command is in the leader's log but not yet committed
+	le := testhelpers.TestHelper_GetLogEntryAtIndex(n.Log(), 1)
+	if !reflect.DeepEqual(le, LogEntry{1, Command("c101")}) {
+		t.Fatal(le)
+	}
+	if n.CommitIndex() != 0 {
+		t.Fatal(n.CommitIndex())
+	}
+
+	// A tick allows command to be committed and applied
+	runUntil(t, s, func() bool { return len(n.Applied()) == 1 }, s.config.TickInterval)
+	if n.CommitIndex() != 1 {
+		t.Fatal(n.CommitIndex())
+	}
+	if a := n.Applied(); !reflect.DeepEqual(a, []Command{Command("c101")}) {
+		t.Fatal(a)
+	}
+}
+
+// A broken safety property fails the simulation.
+func TestSimulation_SafetyChecks(t *testing.T) {
+	s := newTestSimulation(t, DefaultConfig(testServerIds, 1))
+	leader := waitForLeader(t, s)
+	var other ServerId = 101
+	if leader == 101 {
+		other = 102
+	}
+	// Another server claims to be the leader in the same term
+	fake := *s.Node(leader)
+	fake.id = other
+	s.observe(&fake)
+	err := s.RunFor(time.Second)
+	if err == nil || !strings.Contains(err.Error(), "election safety violated") {
+		t.Fatal(err)
+	}
+
+	s = newTestSimulation(t, DefaultConfig(testServerIds, 1))
+	s.applied(s.Node(101), 1, Command("c1"))
+	s.applied(s.Node(102), 1, Command("c1"))
+	if s.Err() != nil {
+		t.Fatal(s.Err())
+	}
+	s.applied(s.Node(103), 1, Command("c2"))
+	if err := s.Err(); err == nil || !strings.Contains(err.Error(), "state machine safety violated") {
+		t.Fatal(err)
+	}
+	// ... which stops the simulation
+	if err := s.RunFor(time.Second); err != s.Err() {
+		t.Fatal(err)
+	}
+	if s.EventCount() != 0 {
+		t.Fatal(s.EventCount())
+	}
+}
+
+// Random schedules of crashes, restarts, partitions, lost messages and
+// proposals never break safety, and the cluster recovers once the faults stop.
+//
+// Use -sim.seeds to run more schedules, and -sim.seed to replay a failing one.
+//
+func TestSimulation_RandomSchedules(t *testing.T) {
+	if *seed >= 0 {
+		simulateRandomSchedule(t, *seed)
+		return
+	}
+	n := *seeds
+	if testing.Short() {
+		n = 10
+	}
+	for i := 0; i < n; i++ {
+		simulateRandomSchedule(t, int64(i))
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+func simulateRandomSchedule(t *testing.T, seed int64) {
+	t.Helper()
+	serverIds := []ServerId{101, 102, 103}
+	if seed%2 == 1 {
+		serverIds = append(serverIds, 104, 105)
+	}
+	c := DefaultConfig(serverIds, seed)
+	c.MaxLatency = 20 * time.Millisecond
+	s := newTestSimulation(t, c)
+	r := s.Rand()
+
+	randomServer := func() ServerId {
+		return serverIds[r.Intn(len(serverIds))]
+	}
+
+	// Chaos
+	proposals := 0
+	for step := 0; step < 100; step++ {
+		switch x := r.Intn(100); {
+		case x < 40:
+			if leader := s.Leader(); leader != 0 {
+				proposals++
+				_, err := s.Propose(leader, testhelpers.DummyCommand(proposals))
+				if err != nil {
+					t.Fatalf("seed %v: %v", seed, err)
+				}
+			}
+		case x < 50:
+			s.Crash(randomServer())
+		case x < 65:
+			serverId := randomServer()
+			if !s.Node(serverId).Running() {
+				if err := s.Restart(serverId); err != nil {
+					t.Fatalf("seed %v: %v", seed, err)
+				}
+			}
+		case x < 75:
+			var g1, g2 []ServerId
+			for _, serverId := range serverIds {
+				if r.Intn(2) == 0 {
+					g1 = append(g1, serverId)
+				} else {
+					g2 = append(g2, serverId)
+				}
+			}
+			s.Partition(g1, g2)
+		case x < 80:
+			s.Cut(randomServer(), randomServer())
+		case x < 90:
+			s.Heal()
+		default:
+			s.SetDropRate(r.Float64() * 0.2)
+		}
+		d := time.Duration(r.Int63n(int64(500 * time.Millisecond)))
+		if err := s.RunFor(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Recovery - a command proposed after the faults stop is applied everywhere
+	s.Heal()
+	s.SetDropRate(0)
+	for _, serverId := range serverIds {
+		if !s.Node(serverId).Running() {
+			if err := s.Restart(serverId); err != nil {
+				t.Fatalf("seed %v: %v", seed, err)
+			}
+		}
+	}
+	final := Command("final")
+	appliedEverywhere := func() bool {
+		for _, serverId := range serverIds {
+			a := s.Node(serverId).Applied()
+			if len(a) == 0 || !bytes.Equal(a[len(a)-1], final) {
+				return false
+			}
+		}
+		return true
+	}
+	for attempt := 0; attempt < 5 && !appliedEverywhere(); attempt++ {
+		leader := waitForLeader(t, s)
+		if _, err := s.Propose(leader, final); err != nil {
+			t.Fatalf("seed %v: %v", seed, err)
+		}
+		if _, err := s.RunUntil(appliedEverywhere, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !appliedEverywhere() {
+		t.Fatalf("seed %v: final command not applied everywhere", seed)
+	}
+}
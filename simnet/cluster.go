@@ -0,0 +1,172 @@
+package simnet
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/divtxt/raft"
+)
+
+// NewNodeFunc creates and starts the ConsensusModule of the given server.
+//
+// The ConsensusModule must use the given RpcService. This is called again to
+// restart a server, and can reuse the Log and other state of the server's
+// previous ConsensusModule to simulate a restart after a crash.
+//
+type NewNodeFunc func(serverId ServerId, rpcService RpcService) (IConsensusModule, error)
+
+// Cluster is a set of ConsensusModules connected by a Network.
+//
+// A Cluster is safe for concurrent use.
+//
+type Cluster struct {
+	Network *Network
+
+	serverIds []ServerId
+	newNode   NewNodeFunc
+
+	mutex *sync.Mutex
+	nodes map[ServerId]IConsensusModule
+}
+
+// NewCluster creates a Network with the given seed and starts a ConsensusModule
+// for each of the given servers.
+func NewCluster(serverIds []ServerId, seed int64, newNode NewNodeFunc) (*Cluster, error) {
+	if len(serverIds) == 0 {
+		return nil, errors.New("serverIds is empty")
+	}
+	if newNode == nil {
+		return nil, errors.New("'newNode' cannot be nil")
+	}
+
+	c := &Cluster{
+		NewNetwork(seed),
+		append([]ServerId(nil), serverIds...),
+		newNode,
+		&sync.Mutex{},
+		make(map[ServerId]IConsensusModule),
+	}
+	for _, serverId := range serverIds {
+		if err := c.Start(serverId); err != nil {
+			c.StopAll()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// ServerIds returns the servers of the Cluster.
+func (c *Cluster) ServerIds() []ServerId {
+	return append([]ServerId(nil), c.serverIds...)
+}
+
+// Node returns the ConsensusModule of the given server, or nil if it is stopped.
+func (c *Cluster) Node(serverId ServerId) IConsensusModule {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.nodes[serverId]
+}
+
+// Start starts a new ConsensusModule for the given stopped server.
+func (c *Cluster) Start(serverId ServerId) error {
+	if !c.isMember(serverId) {
+		return fmt.Errorf("%v is not in the cluster", serverId)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.nodes[serverId] != nil {
+		return fmt.Errorf("%v is already running", serverId)
+	}
+	cm, err := c.newNode(serverId, c.Network.RpcService(serverId))
+	if err != nil {
+		return err
+	}
+	c.nodes[serverId] = cm
+	c.Network.Attach(serverId, cm)
+	return nil
+}
+
+// Stop stops the ConsensusModule of the given server and detaches it from the Network.
+//
+// This does nothing if the server is already stopped.
+func (c *Cluster) Stop(serverId ServerId) {
+	c.mutex.Lock()
+	cm := c.nodes[serverId]
+	delete(c.nodes, serverId)
+	c.mutex.Unlock()
+
+	if cm != nil {
+		c.Network.Detach(serverId)
+		cm.Stop()
+	}
+}
+
+// StopAll stops all the ConsensusModules and closes the Network.
+func (c *Cluster) StopAll() {
+	c.Network.Close()
+	for _, serverId := range c.serverIds {
+		c.Stop(serverId)
+	}
+}
+
+// Leaders returns the running servers that are in the LEADER state, in order.
+//
+// There can be more than one leader e.g. when an old leader is cut off from the
+// rest of the cluster, and has not yet found out about the new leader.
+//
+func (c *Cluster) Leaders() []ServerId {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var leaders []ServerId
+	for serverId, cm := range c.nodes {
+		if cm.GetServerState() == LEADER {
+			leaders = append(leaders, serverId)
+		}
+	}
+	sort.Slice(leaders, func(i, j int) bool { return leaders[i] < leaders[j] })
+	return leaders
+}
+
+// WaitForLeader waits until exactly one of the given servers is the leader and
+// returns it. If no servers are given, all servers are checked.
+//
+// Returns an error if there is no single leader before the timeout.
+//
+func (c *Cluster) WaitForLeader(timeout time.Duration, among ...ServerId) (ServerId, error) {
+	if len(among) == 0 {
+		among = c.serverIds
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		var leaders []ServerId
+		for _, serverId := range c.Leaders() {
+			for _, s := range among {
+				if serverId == s {
+					leaders = append(leaders, serverId)
+				}
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0], nil
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("no single leader among %v after %v: leaders=%v", among, timeout, leaders)
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
+
+const waitPollInterval = 5 * time.Millisecond
+
+func (c *Cluster) isMember(serverId ServerId) bool {
+	for _, s := range c.serverIds {
+		if s == serverId {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+package simnet
+
+import (
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/config"
+	"github.com/divtxt/raft/impl"
+	"github.com/divtxt/raft/inmemlog"
+	"github.com/divtxt/raft/rps"
+	"github.com/divtxt/raft/safety"
+	"github.com/divtxt/raft/testdata"
+	"github.com/divtxt/raft/testhelpers"
+)
+
+const testWaitTimeout = 3 * time.Second
+
+var testServerIds = []ServerId{101, 102, 103}
+
+// newTestCluster starts a cluster of ConsensusModules that keep their log and
+// persistent state when restarted.
+//
+// The cluster is checked by the returned safety.Monitor.
+//
+func newTestCluster(t *testing.T, seed int64) (*Cluster, *safety.Monitor) {
+	mutex := &sync.Mutex{}
+	logs := make(map[ServerId]*inmemlog.InMemoryLog)
+	states := make(map[ServerId]*rps.InMemoryRaftPersistentState)
+	sms := make(map[ServerId]StateMachine)
+	checker, err := safety.NewChecker(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newNode := func(serverId ServerId, rpcService RpcService) (IConsensusModule, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if logs[serverId] == nil {
+			iml, err := inmemlog.NewInMemoryLog(testdata.MaxEntriesPerAppendEntry)
+			if err != nil {
+				return nil, err
+			}
+			logs[serverId] = iml
+			states[serverId] = rps.NewIMPSWithCurrentTerm(0)
+		} else {
+			checker.Restarted(serverId)
+		}
+		sms[serverId] = safety.NewStateMachine(checker, serverId, testhelpers.NewDummyStateMachine(0))
+
+		ci, err := config.NewClusterInfo(testServerIds, serverId)
+		if err != nil {
+			return nil, err
+		}
+		return impl.NewConsensusModule(
+			states[serverId],
+			logs[serverId],
+			sms[serverId],
+			rpcService,
+			ci,
+			config.TimeSettings{testdata.TickerDuration, testdata.ElectionTimeoutLow},
+			log.New(os.Stderr, "simnet_test", log.Flags()),
+		)
+	}
+
+	c, err := NewCluster(testServerIds, seed, newNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers := func() []safety.Server {
+		var servers []safety.Server
+		for _, serverId := range testServerIds {
+			if cm := c.Node(serverId); cm != nil {
+				mutex.Lock()
+				servers = append(servers, safety.Server{
+					serverId, cm, states[serverId], logs[serverId], sms[serverId],
+				})
+				mutex.Unlock()
+			}
+		}
+		return servers
+	}
+	monitor, err := safety.NewMonitor(checker, time.Millisecond, servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, monitor
+}
+
+// stopTestCluster stops the cluster and fails the test if the monitor found a
+// safety violation.
+func stopTestCluster(t *testing.T, c *Cluster, monitor *safety.Monitor) {
+	c.StopAll()
+	if err := monitor.Stop(); err != nil {
+		t.Error(err)
+	}
+}
+
+func waitForLeader(t *testing.T, c *Cluster, among ...ServerId) ServerId {
+	t.Helper()
+	leader, err := c.WaitForLeader(testWaitTimeout, among...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leader
+}
+
+// commit appends the given command on the leader among the given servers and
+// waits for it to be applied, trying again if leadership changes or the command
+// is lost.
+func commit(t *testing.T, c *Cluster, command Command, among ...ServerId) {
+	t.Helper()
+	deadline := time.Now().Add(testWaitTimeout)
+	for time.Now().Before(deadline) {
+		leader, err := c.WaitForLeader(time.Until(deadline), among...)
+		if err != nil {
+			break
+		}
+		cm := c.Node(leader)
+		if cm == nil {
+			continue
+		}
+		crc, err := cm.AppendCommand(command)
+		if err != nil {
+			continue
+		}
+		select {
+		case result, ok := <-crc:
+			if ok {
+				if result != "r"+string(command) {
+					t.Fatal(result)
+				}
+				return
+			}
+		case <-time.After(time.Until(deadline)):
+		}
+	}
+	t.Fatalf("command %q was not committed", command)
+}
+
+func others(serverId ServerId) []ServerId {
+	var others []ServerId
+	for _, s := range testServerIds {
+		if s != serverId {
+			others = append(others, s)
+		}
+	}
+	return others
+}
+
+func TestCluster_Failover(t *testing.T) {
+	c, monitor := newTestCluster(t, 1)
+	defer stopTestCluster(t, c, monitor)
+
+	leader := waitForLeader(t, c)
+	commit(t, c, Command("c1"))
+
+	// The majority elects a new leader when the leader is partitioned away
+	c.Network.Isolate(leader, others(leader))
+	newLeader := waitForLeader(t, c, others(leader)...)
+	if newLeader == leader {
+		t.Fatal(newLeader)
+	}
+	commit(t, c, Command("c2"), others(leader)...)
+
+	// The old leader steps down when the partition heals
+	c.Network.Heal()
+	if l := waitForLeader(t, c); l != newLeader {
+		t.Fatal(l)
+	}
+	commit(t, c, Command("c3"))
+
+	// The cluster continues without a stopped server, and the server can restart
+	c.Stop(newLeader)
+	if c.Node(newLeader) != nil {
+		t.Fatal()
+	}
+	waitForLeader(t, c)
+	commit(t, c, Command("c4"))
+	if err := c.Start(newLeader); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(newLeader); err == nil {
+		t.Fatal()
+	}
+	if err := c.Start(104); err == nil {
+		t.Fatal()
+	}
+	commit(t, c, Command("c5"))
+}
+
+// A leader that can receive but not send is replaced.
+func TestCluster_AsymmetricPartition(t *testing.T) {
+	c, monitor := newTestCluster(t, 2)
+	defer stopTestCluster(t, c, monitor)
+
+	leader := waitForLeader(t, c)
+	for _, s := range others(leader) {
+		c.Network.Cut(leader, s)
+	}
+	newLeader := waitForLeader(t, c, others(leader)...)
+	if newLeader == leader {
+		t.Fatal(newLeader)
+	}
+	commit(t, c, Command("c1"), others(leader)...)
+}
+
+func TestCluster_CommitsWithFaults(t *testing.T) {
+	c, monitor := newTestCluster(t, 3)
+	defer stopTestCluster(t, c, monitor)
+
+	err := c.Network.SetFaults(Faults{
+		Drop:      0.05,
+		MaxDelay:  2 * time.Millisecond,
+		Duplicate: 0.1,
+		Reorder:   0.05,
+		LateDelay: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForLeader(t, c)
+	for i := 1; i <= 10; i++ {
+		commit(t, c, testhelpers.DummyCommand(i))
+	}
+
+	s := c.Network.Stats()
+	if s.Dropped == 0 || s.Duplicated == 0 || s.Reordered == 0 {
+		t.Fatal(s)
+	}
+}
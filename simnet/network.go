@@ -0,0 +1,390 @@
+// Package simnet provides a simulated network for testing a cluster of
+// ConsensusModules in a single process.
+//
+// A Network connects servers with an RpcService for each server, and can cut
+// links between servers (partitions, including asymmetric ones) and inject
+// faults: message loss, delay, duplication and reordering. Cluster runs a set
+// of ConsensusModules on a Network, and can stop and restart them.
+//
+// Faults are random, using a seeded random number generator. Since timing also
+// affects a cluster, a run with the same seed is not exactly repeatable.
+//
+package simnet
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	. "github.com/divtxt/raft"
+)
+
+// RpcProcessor is the subset of IConsensusModule that receives incoming RPCs.
+type RpcProcessor interface {
+	ProcessRpcAppendEntries(from ServerId, rpc *RpcAppendEntries) (*RpcAppendEntriesReply, error)
+	ProcessRpcRequestVote(from ServerId, rpc *RpcRequestVote) (*RpcRequestVoteReply, error)
+}
+
+// Faults are the faults injected into messages sent over a link.
+//
+// The zero value is a perfect link.
+//
+type Faults struct {
+	// Drop is the probability that a message is lost. This applies separately
+	// to a request and its reply.
+	Drop float64
+
+	// Each message is delayed by a random duration from MinDelay to MaxDelay.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	// Duplicate is the probability that a request is delivered a second time
+	// after a random extra delay of up to LateDelay. The reply to the duplicate
+	// is discarded.
+	Duplicate float64
+
+	// Reorder is the probability that a request is held back and delivered after
+	// a random extra delay of up to LateDelay, so that later requests can overtake
+	// it. The call fails immediately as if it had timed out.
+	Reorder float64
+
+	LateDelay time.Duration
+}
+
+// Stats counts what happened to the requests sent over a Network.
+type Stats struct {
+	Sent       uint64 // requests sent
+	Delivered  uint64 // requests delivered to a server, including late ones
+	Dropped    uint64 // requests or replies lost to a cut link or Faults.Drop
+	Duplicated uint64 // requests delivered a second time
+	Reordered  uint64 // requests held back for late delivery
+}
+
+type link struct {
+	from ServerId
+	to   ServerId
+}
+
+// Network is a simulated network between servers.
+//
+// A Network is safe for concurrent use.
+//
+type Network struct {
+	mutex      *sync.Mutex
+	rand       *rand.Rand
+	servers    map[ServerId]RpcProcessor
+	cut        map[link]bool
+	faults     Faults
+	linkFaults map[link]Faults
+	stats      Stats
+	closed     bool
+}
+
+// NewNetwork creates a Network with no servers, and no faults.
+//
+// seed is the seed for the random faults.
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		&sync.Mutex{},
+		rand.New(rand.NewSource(seed)),
+		make(map[ServerId]RpcProcessor),
+		make(map[link]bool),
+		Faults{},
+		make(map[link]Faults),
+		Stats{},
+		false,
+	}
+}
+
+// Attach connects the given RpcProcessor to the network as the given server,
+// replacing any previous RpcProcessor for that server.
+func (n *Network) Attach(serverId ServerId, processor RpcProcessor) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.servers[serverId] = processor
+}
+
+// Detach disconnects the given server, e.g. to simulate a crash.
+//
+// Calls to a detached server fail.
+func (n *Network) Detach(serverId ServerId) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.servers, serverId)
+}
+
+// RpcService returns the RpcService for the given server to send RPCs with.
+func (n *Network) RpcService(from ServerId) RpcService {
+	return &rpcService{n, from}
+}
+
+// SetFaults sets the faults for every link that does not have its own faults.
+func (n *Network) SetFaults(faults Faults) error {
+	if err := faults.validate(); err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.faults = faults
+	return nil
+}
+
+// SetLinkFaults sets the faults for messages sent from one server to another.
+//
+// This only affects one direction: a reply uses the faults of the reverse link.
+// Use nil to go back to the faults set by SetFaults.
+//
+func (n *Network) SetLinkFaults(from, to ServerId, faults *Faults) error {
+	if faults != nil {
+		if err := faults.validate(); err != nil {
+			return err
+		}
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if faults == nil {
+		delete(n.linkFaults, link{from, to})
+	} else {
+		n.linkFaults[link{from, to}] = *faults
+	}
+	return nil
+}
+
+// Cut cuts the link from one server to another, so that messages in that
+// direction are lost. The link in the other direction is not affected.
+func (n *Network) Cut(from, to ServerId) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.cut[link{from, to}] = true
+}
+
+// Restore restores the link from one server to another.
+func (n *Network) Restore(from, to ServerId) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.cut, link{from, to})
+}
+
+// Partition cuts the links in both directions between servers in different groups.
+//
+// Links between servers in the same group, and links of servers that are not in
+// any group, are not changed.
+//
+func (n *Network) Partition(groups ...[]ServerId) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for i, g1 := range groups {
+		for j, g2 := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range g1 {
+				for _, to := range g2 {
+					n.cut[link{from, to}] = true
+				}
+			}
+		}
+	}
+}
+
+// Isolate cuts the links in both directions between the given server and all
+// other servers.
+func (n *Network) Isolate(serverId ServerId, others []ServerId) {
+	n.Partition([]ServerId{serverId}, others)
+}
+
+// Heal restores all links. Faults are not changed.
+func (n *Network) Heal() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.cut = make(map[link]bool)
+}
+
+// Stats returns the counts of what happened to requests so far.
+func (n *Network) Stats() Stats {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.stats
+}
+
+// Close stops all deliveries, including any pending late deliveries.
+//
+// Calls after Close fail.
+func (n *Network) Close() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.closed = true
+}
+
+// fate is what happens to a call, decided when it is made.
+type fate struct {
+	dropRequest bool
+	dropReply   bool
+	delay       time.Duration // delay of the request
+	replyDelay  time.Duration
+	late        bool          // the request is delivered late instead of now
+	duplicate   bool          // the request is delivered again later
+	lateDelay   time.Duration // extra delay of a late delivery
+}
+
+func (n *Network) decideFate(from, to ServerId) fate {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	requestFaults := n.faultsFor(from, to)
+	replyFaults := n.faultsFor(to, from)
+
+	var f fate
+	f.dropRequest = n.closed || n.cut[link{from, to}] || n.chance(requestFaults.Drop)
+	f.dropReply = n.cut[link{to, from}] || n.chance(replyFaults.Drop)
+	f.delay = n.randomDelay(requestFaults.MinDelay, requestFaults.MaxDelay)
+	f.replyDelay = n.randomDelay(replyFaults.MinDelay, replyFaults.MaxDelay)
+	if !f.dropRequest {
+		f.late = n.chance(requestFaults.Reorder)
+		f.duplicate = !f.late && n.chance(requestFaults.Duplicate)
+		f.lateDelay = n.randomDelay(0, requestFaults.LateDelay)
+	}
+
+	n.stats.Sent++
+	if f.dropRequest {
+		n.stats.Dropped++
+	} else if f.late {
+		n.stats.Reordered++
+	} else if f.duplicate {
+		n.stats.Duplicated++
+	}
+	return f
+}
+
+// faultsFor returns the faults of the given link. The mutex must be held.
+func (n *Network) faultsFor(from, to ServerId) Faults {
+	if f, ok := n.linkFaults[link{from, to}]; ok {
+		return f
+	}
+	return n.faults
+}
+
+// chance returns true with the given probability. The mutex must be held.
+func (n *Network) chance(p float64) bool {
+	return p > 0 && n.rand.Float64() < p
+}
+
+// randomDelay returns a random duration in the given range. The mutex must be held.
+func (n *Network) randomDelay(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(n.rand.Int63n(int64(max-min)+1))
+}
+
+// processor returns the RpcProcessor of the given server, or nil if the server
+// is not attached or the Network is closed.
+func (n *Network) processor(serverId ServerId, countDelivery bool) RpcProcessor {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		return nil
+	}
+	p := n.servers[serverId]
+	if p != nil && countDelivery {
+		n.stats.Delivered++
+	}
+	return p
+}
+
+func (n *Network) countDroppedReply() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.stats.Dropped++
+}
+
+// call sends a request with the given delivery function and returns the reply,
+// or nil if the call failed.
+func (n *Network) call(
+	from, to ServerId,
+	deliver func(p RpcProcessor) (interface{}, error),
+) interface{} {
+	f := n.decideFate(from, to)
+	if f.dropRequest {
+		time.Sleep(f.delay)
+		return nil
+	}
+
+	deliverLate := func() {
+		time.AfterFunc(f.delay+f.lateDelay, func() {
+			if p := n.processor(to, true); p != nil {
+				_, _ = deliver(p)
+			}
+		})
+	}
+	if f.late {
+		deliverLate()
+		return nil
+	}
+	if f.duplicate {
+		deliverLate()
+	}
+
+	time.Sleep(f.delay)
+	p := n.processor(to, true)
+	if p == nil {
+		return nil
+	}
+	reply, err := deliver(p)
+	if err != nil {
+		return nil
+	}
+	time.Sleep(f.replyDelay)
+	if f.dropReply {
+		n.countDroppedReply()
+		return nil
+	}
+	return reply
+}
+
+func (f *Faults) validate() error {
+	for _, p := range []float64{f.Drop, f.Duplicate, f.Reorder} {
+		if p < 0 || p > 1 {
+			return errors.New("probabilities must be from 0 to 1")
+		}
+	}
+	if f.MinDelay < 0 || f.MaxDelay < 0 || f.LateDelay < 0 {
+		return errors.New("delays cannot be negative")
+	}
+	return nil
+}
+
+// rpcService is the RpcService of a server on a Network.
+type rpcService struct {
+	network *Network
+	from    ServerId
+}
+
+func (rs *rpcService) RpcAppendEntries(toServer ServerId, rpc *RpcAppendEntries) *RpcAppendEntriesReply {
+	// Copy the entries, since a late delivery can happen after the caller has
+	// reused them
+	entries := make([]LogEntry, len(rpc.Entries))
+	copy(entries, rpc.Entries)
+	rpcCopy := *rpc
+	rpcCopy.Entries = entries
+
+	reply := rs.network.call(rs.from, toServer, func(p RpcProcessor) (interface{}, error) {
+		return p.ProcessRpcAppendEntries(rs.from, &rpcCopy)
+	})
+	if reply == nil {
+		return nil
+	}
+	return reply.(*RpcAppendEntriesReply)
+}
+
+func (rs *rpcService) RpcRequestVote(toServer ServerId, rpc *RpcRequestVote) *RpcRequestVoteReply {
+	rpcCopy := *rpc
+	reply := rs.network.call(rs.from, toServer, func(p RpcProcessor) (interface{}, error) {
+		return p.ProcessRpcRequestVote(rs.from, &rpcCopy)
+	})
+	if reply == nil {
+		return nil
+	}
+	return reply.(*RpcRequestVoteReply)
+}
@@ -0,0 +1,265 @@
+package simnet
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/divtxt/raft"
+)
+
+// mockProcessor records the RPCs it receives and replies with the current term.
+type mockProcessor struct {
+	mutex    sync.Mutex
+	received []interface{}
+	term     TermNo
+}
+
+func (mp *mockProcessor) process(from ServerId, rpc interface{}) TermNo {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.received = append(mp.received, from, rpc)
+	return mp.term
+}
+
+func (mp *mockProcessor) ProcessRpcAppendEntries(
+	from ServerId, rpc *RpcAppendEntries,
+) (*RpcAppendEntriesReply, error) {
+	return &RpcAppendEntriesReply{mp.process(from, rpc), true}, nil
+}
+
+func (mp *mockProcessor) ProcessRpcRequestVote(
+	from ServerId, rpc *RpcRequestVote,
+) (*RpcRequestVoteReply, error) {
+	if rpc.Term == 0 {
+		return nil, ErrStopped
+	}
+	return &RpcRequestVoteReply{mp.process(from, rpc), true}, nil
+}
+
+func (mp *mockProcessor) checkReceived(t *testing.T, expected ...interface{}) {
+	t.Helper()
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	if !reflect.DeepEqual(mp.received, expected) {
+		t.Fatal(mp.received)
+	}
+	mp.received = nil
+}
+
+func setupNetwork(t *testing.T) (*Network, RpcService, *mockProcessor) {
+	n := NewNetwork(1)
+	mp := &mockProcessor{term: 8}
+	n.Attach(102, mp)
+	n.Attach(103, &mockProcessor{term: 8})
+	return n, n.RpcService(101), mp
+}
+
+func TestNetwork(t *testing.T) {
+	n, rs, mp := setupNetwork(t)
+	defer n.Close()
+
+	rpcAE := &RpcAppendEntries{8, 4, 4, []LogEntry{{4, Command("c5")}}, 3}
+	if r := rs.RpcAppendEntries(102, rpcAE); !reflect.DeepEqual(r, &RpcAppendEntriesReply{8, true}) {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t, ServerId(101), rpcAE)
+
+	rpcRV := &RpcRequestVote{9, 10, 6}
+	if r := rs.RpcRequestVote(102, rpcRV); !reflect.DeepEqual(r, &RpcRequestVoteReply{8, true}) {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+
+	// An error from the processor is a failed call
+	if r := rs.RpcRequestVote(102, &RpcRequestVote{0, 0, 0}); r != nil {
+		t.Fatal(r)
+	}
+
+	// Calls to an unknown or detached server fail
+	if r := rs.RpcRequestVote(104, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	n.Detach(102)
+	if r := rs.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	n.Attach(102, mp)
+	if r := rs.RpcRequestVote(102, rpcRV); r == nil {
+		t.Fatal()
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+
+	if s := n.Stats(); s != (Stats{Sent: 6, Delivered: 4}) {
+		t.Fatal(s)
+	}
+
+	// Calls after Close fail
+	n.Close()
+	if r := rs.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t)
+}
+
+func TestNetwork_CutAndPartition(t *testing.T) {
+	n, rs, mp := setupNetwork(t)
+	defer n.Close()
+	rpcRV := &RpcRequestVote{9, 10, 6}
+
+	// A cut request link means the request is lost
+	n.Cut(101, 102)
+	if r := rs.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t)
+	// ... other links are not affected
+	if r := rs.RpcRequestVote(103, rpcRV); r == nil {
+		t.Fatal()
+	}
+
+	// A cut reply link means that the request is delivered but the reply is lost
+	n.Restore(101, 102)
+	n.Cut(102, 101)
+	if r := rs.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+	// ... and the other direction works
+	if r := n.RpcService(102).RpcRequestVote(103, rpcRV); r == nil {
+		t.Fatal()
+	}
+
+	n.Heal()
+	if r := rs.RpcRequestVote(102, rpcRV); r == nil {
+		t.Fatal()
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+
+	// Partition
+	n.Partition([]ServerId{101}, []ServerId{102, 103})
+	if r := rs.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	if r := n.RpcService(102).RpcRequestVote(101, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	if r := n.RpcService(103).RpcRequestVote(102, rpcRV); r == nil {
+		t.Fatal()
+	}
+	mp.checkReceived(t, ServerId(103), rpcRV)
+
+	if s := n.Stats(); s != (Stats{Sent: 8, Delivered: 5, Dropped: 4}) {
+		t.Fatal(s)
+	}
+}
+
+func TestNetwork_Faults(t *testing.T) {
+	n, rs, mp := setupNetwork(t)
+	defer n.Close()
+	rpcRV := &RpcRequestVote{9, 10, 6}
+
+	// Delay
+	err := n.SetFaults(Faults{MinDelay: 20 * time.Millisecond, MaxDelay: 30 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if r := rs.RpcRequestVote(102, rpcRV); r == nil {
+		t.Fatal()
+	}
+	if d := time.Since(start); d < 40*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatal(d)
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+
+	// Link faults override the network faults
+	err = n.SetLinkFaults(101, 102, &Faults{Drop: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rs.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t)
+	err = n.SetLinkFaults(101, 102, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Duplicate
+	err = n.SetFaults(Faults{Duplicate: 1, LateDelay: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rs.RpcRequestVote(102, rpcRV); r == nil {
+		t.Fatal()
+	}
+	time.Sleep(40 * time.Millisecond)
+	mp.checkReceived(t, ServerId(101), rpcRV, ServerId(101), rpcRV)
+
+	// Reorder - the first request arrives after the second
+	err = n.SetFaults(Faults{Reorder: 1, LateDelay: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rs.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	err = n.SetFaults(Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcRV2 := &RpcRequestVote{10, 10, 6}
+	if r := rs.RpcRequestVote(102, rpcRV2); r == nil {
+		t.Fatal()
+	}
+	time.Sleep(40 * time.Millisecond)
+	mp.checkReceived(t, ServerId(101), rpcRV2, ServerId(101), rpcRV)
+
+	// A late delivery does not see later changes to the entries by the caller
+	err = n.SetFaults(Faults{Reorder: 1, LateDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []LogEntry{{4, Command("c5")}}
+	if r := rs.RpcAppendEntries(102, &RpcAppendEntries{8, 4, 4, entries, 3}); r != nil {
+		t.Fatal(r)
+	}
+	entries[0] = LogEntry{5, Command("c6")}
+	time.Sleep(30 * time.Millisecond)
+	mp.checkReceived(t, ServerId(101), &RpcAppendEntries{8, 4, 4, []LogEntry{{4, Command("c5")}}, 3})
+
+	if s := n.Stats(); s != (Stats{Sent: 6, Delivered: 6, Dropped: 1, Duplicated: 1, Reordered: 2}) {
+		t.Fatal(s)
+	}
+
+	// Invalid faults
+	if err := n.SetFaults(Faults{Drop: 1.5}); err == nil {
+		t.Fatal()
+	}
+	if err := n.SetLinkFaults(101, 102, &Faults{MinDelay: -1}); err == nil {
+		t.Fatal()
+	}
+}
+
+// Random faults happen at roughly the given rates.
+func TestNetwork_FaultRates(t *testing.T) {
+	n, rs, _ := setupNetwork(t)
+	defer n.Close()
+	err := n.SetFaults(Faults{Drop: 0.2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		if rs.RpcRequestVote(103, &RpcRequestVote{9, 10, 6}) == nil {
+			failed++
+		}
+	}
+	// A call fails if its request or its reply is lost: 1 - 0.8*0.8 = 0.36
+	if failed < 300 || failed > 420 {
+		t.Fatal(failed)
+	}
+}
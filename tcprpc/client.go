@@ -0,0 +1,311 @@
+package tcprpc
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/wire"
+)
+
+// Client is an RpcService that sends RPCs over TCP to the Servers of the other
+// servers in the cluster.
+//
+// It follows the notes on the RpcService interface:
+//
+// - Each peer has a single connection that is opened on first use, and is
+// reopened by the next call after it fails.
+//
+// - There is at most one call in flight to a given peer. A call to a peer
+// that already has a call in flight returns nil immediately.
+//
+// - Every call is limited by callTimeout, and nil is returned for any failure
+// i.e. a connection error, a timeout or an error returned by the Server.
+// A connection whose call timed out is closed, since a late reply is no use.
+//
+// A Client created with NewTLSClient connects with TLS and only sends RPCs to
+// a peer whose certificate identifies it as the expected ServerId.
+//
+type Client struct {
+	thisServerId ServerId
+	dialTimeout  time.Duration
+	callTimeout  time.Duration
+	tlsConfig    *tls.Config // nil if not using TLS
+	identify     IdentifyFunc
+	logger       *log.Logger
+
+	peers map[ServerId]*peer // immutable after construction
+}
+
+// Check that Client implements the RpcService interface
+var _ RpcService = (*Client)(nil)
+
+type peer struct {
+	serverId ServerId
+	address  string
+
+	mutex    *sync.Mutex
+	inFlight bool
+	client   *rpc.Client // nil if not connected
+	closed   bool
+}
+
+// NewClient creates a Client for the given server.
+//
+// addresses maps the ServerId of each peer to the TCP address of its Server.
+// It may include thisServerId, which is ignored.
+//
+// dialTimeout limits the time to connect to a peer, and callTimeout limits the
+// time for a complete call including any connect. dialTimeout should be less than
+// callTimeout, and callTimeout should be well under the election timeout.
+//
+func NewClient(
+	thisServerId ServerId,
+	addresses map[ServerId]string,
+	dialTimeout time.Duration,
+	callTimeout time.Duration,
+	logger *log.Logger,
+) (*Client, error) {
+	return newClient(thisServerId, addresses, dialTimeout, callTimeout, nil, nil, logger)
+}
+
+// NewTLSClient creates a Client for the given server that uses mutual TLS.
+//
+// config should have the certificate of this server and the certificate
+// authorities of the cluster, e.g. a config from MutualTLSConfig. The certificate
+// of each peer must also be valid for its address. identify maps the certificate
+// of a peer to its ServerId.
+//
+// The other arguments are the same as for NewClient.
+//
+func NewTLSClient(
+	thisServerId ServerId,
+	addresses map[ServerId]string,
+	config *tls.Config,
+	identify IdentifyFunc,
+	dialTimeout time.Duration,
+	callTimeout time.Duration,
+	logger *log.Logger,
+) (*Client, error) {
+	if err := checkTLS(config, identify); err != nil {
+		return nil, err
+	}
+	return newClient(thisServerId, addresses, dialTimeout, callTimeout, config, identify, logger)
+}
+
+func newClient(
+	thisServerId ServerId,
+	addresses map[ServerId]string,
+	dialTimeout time.Duration,
+	callTimeout time.Duration,
+	tlsConfig *tls.Config,
+	identify IdentifyFunc,
+	logger *log.Logger,
+) (*Client, error) {
+	if thisServerId == 0 {
+		return nil, errors.New("thisServerId is 0")
+	}
+	if dialTimeout <= 0 {
+		return nil, fmt.Errorf("dialTimeout=%v must be greater than zero", dialTimeout)
+	}
+	if callTimeout <= 0 {
+		return nil, fmt.Errorf("callTimeout=%v must be greater than zero", callTimeout)
+	}
+	if logger == nil {
+		return nil, errors.New("'logger' cannot be nil")
+	}
+
+	peers := make(map[ServerId]*peer)
+	for serverId, address := range addresses {
+		if serverId == 0 {
+			return nil, errors.New("addresses contains ServerId 0")
+		}
+		if serverId == thisServerId {
+			continue
+		}
+		peers[serverId] = &peer{serverId, address, &sync.Mutex{}, false, nil, false}
+	}
+
+	return &Client{
+		thisServerId,
+		dialTimeout,
+		callTimeout,
+		tlsConfig,
+		identify,
+		logger,
+		peers,
+	}, nil
+}
+
+// Close closes all the connections.
+//
+// Calls made after Close return nil.
+func (c *Client) Close() {
+	for _, p := range c.peers {
+		p.mutex.Lock()
+		p.closed = true
+		p.disconnect()
+		p.mutex.Unlock()
+	}
+}
+
+func (c *Client) RpcAppendEntries(toServer ServerId, rpc *RpcAppendEntries) *RpcAppendEntriesReply {
+	reply, _ := c.callMessage(toServer, methodRpcAppendEntries, rpc).(*RpcAppendEntriesReply)
+	return reply
+}
+
+func (c *Client) RpcRequestVote(toServer ServerId, rpc *RpcRequestVote) *RpcRequestVoteReply {
+	reply, _ := c.callMessage(toServer, methodRpcRequestVote, rpc).(*RpcRequestVoteReply)
+	return reply
+}
+
+// callMessage sends the given message to the given peer and returns the reply,
+// or nil if the call failed. The messages are encoded with package wire.
+func (c *Client) callMessage(toServer ServerId, method string, msg interface{}) interface{} {
+	b, err := wire.Encode(nil, msg)
+	if err != nil {
+		c.logger.Println("[tcprpc] Failed to encode", method, ":", err)
+		return nil
+	}
+	reply := &Reply{}
+	if !c.call(toServer, method, &Args{c.thisServerId, b}, reply) {
+		return nil
+	}
+	replyMsg, err := wire.Decode(reply.Message)
+	if err != nil {
+		c.logger.Println("[tcprpc] Bad reply from", toServer, "to", method, ":", err)
+		return nil
+	}
+	return replyMsg
+}
+
+// call makes the given call to the given peer and returns true if it succeeded.
+func (c *Client) call(toServer ServerId, method string, args interface{}, reply interface{}) bool {
+	p, ok := c.peers[toServer]
+	if !ok {
+		panic(fmt.Sprintf("tcprpc: unknown peer: %v", toServer))
+	}
+
+	client, ok := p.startCall()
+	if !ok {
+		return false
+	}
+	defer p.endCall()
+
+	deadline := time.NewTimer(c.callTimeout)
+	defer deadline.Stop()
+
+	if client == nil {
+		var err error
+		client, err = c.dial(p)
+		if err != nil {
+			return false
+		}
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			if _, ok := call.Error.(rpc.ServerError); !ok {
+				// The connection is broken
+				p.dropConnection(client)
+			}
+			return false
+		}
+		return true
+	case <-deadline.C:
+		c.logger.Println("[tcprpc] Call to", toServer, "timed out:", method)
+		p.dropConnection(client)
+		return false
+	}
+}
+
+// dial connects to the given peer, which must have a call in flight.
+func (c *Client) dial(p *peer) (*rpc.Client, error) {
+	var conn net.Conn
+	var err error
+	if c.tlsConfig == nil {
+		conn, err = net.DialTimeout("tcp", p.address, c.dialTimeout)
+	} else {
+		conn, err = c.dialTLS(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client := rpc.NewClient(conn)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		_ = client.Close()
+		return nil, ErrStopped
+	}
+	p.client = client
+	return client, nil
+}
+
+// dialTLS connects to the given peer with TLS and checks that the peer is
+// the expected server.
+func (c *Client) dialTLS(p *peer) (net.Conn, error) {
+	// The dialer timeout also limits the handshake
+	dialer := &net.Dialer{Timeout: c.dialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", p.address, c.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	peerId, err := identifyPeer(conn, c.identify)
+	if err == nil && peerId != p.serverId {
+		err = fmt.Errorf("tcprpc: peer at %v is %v, expected %v", p.address, peerId, p.serverId)
+	}
+	if err != nil {
+		_ = conn.Close()
+		c.logger.Println("[tcprpc] Refused connection to", p.serverId, ":", err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// startCall marks a call in flight and returns the current connection,
+// which is nil if not connected.
+//
+// Returns false if the Client is closed or a call is already in flight.
+func (p *peer) startCall() (*rpc.Client, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed || p.inFlight {
+		return nil, false
+	}
+	p.inFlight = true
+	return p.client, true
+}
+
+func (p *peer) endCall() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.inFlight = false
+}
+
+// dropConnection closes the given connection if it is still the current one.
+func (p *peer) dropConnection(client *rpc.Client) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.client == client {
+		p.disconnect()
+	}
+}
+
+// disconnect closes the current connection. The mutex must be held.
+func (p *peer) disconnect() {
+	if p.client != nil {
+		_ = p.client.Close()
+		p.client = nil
+	}
+}
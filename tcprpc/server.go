@@ -0,0 +1,303 @@
+package tcprpc
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/wire"
+)
+
+// RpcProcessor is the subset of IConsensusModule that receives incoming RPCs.
+type RpcProcessor interface {
+	ProcessRpcAppendEntries(from ServerId, rpc *RpcAppendEntries) (*RpcAppendEntriesReply, error)
+	ProcessRpcRequestVote(from ServerId, rpc *RpcRequestVote) (*RpcRequestVoteReply, error)
+}
+
+// Server accepts TCP connections from Clients on other servers and dispatches
+// the RPCs they send to the given RpcProcessor - usually a ConsensusModule.
+//
+// An error from the RpcProcessor, e.g. ErrStopped, is sent back to the calling
+// Client, which treats it as a failed call.
+//
+// A Server started with ListenTLS only accepts connections from clients with a
+// verified certificate, and refuses any RPC whose sender is not the ServerId of
+// that certificate. Otherwise, anyone that can connect could send RPCs as any
+// server in the cluster.
+//
+type Server struct {
+	listener  net.Listener
+	processor RpcProcessor
+	rpcServer *rpc.Server // nil for TLS, where each connection has its own
+	tlsConfig *tls.Config // nil if not using TLS
+	identify  IdentifyFunc
+	logger    *log.Logger
+
+	mutex  *sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	done   chan struct{}
+}
+
+// handshakeTimeout limits the time for a TLS handshake on an accepted connection.
+const handshakeTimeout = 10 * time.Second
+
+// Listen starts a Server that listens on the given TCP address.
+//
+// The address is in the form "host:port" (see net.Listen).
+// The Server runs until Close is called.
+//
+func Listen(address string, processor RpcProcessor, logger *log.Logger) (*Server, error) {
+	if processor == nil {
+		return nil, errors.New("'processor' cannot be nil")
+	}
+	if logger == nil {
+		return nil, errors.New("'logger' cannot be nil")
+	}
+
+	rpcServer, err := newRpcServer(processor, 0, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return listen(address, processor, rpcServer, nil, nil, logger)
+}
+
+// ListenTLS starts a Server that listens on the given TCP address and uses
+// mutual TLS.
+//
+// config must require and verify client certificates, e.g. a config from
+// MutualTLSConfig. identify maps the certificate of a client to its ServerId.
+//
+func ListenTLS(
+	address string,
+	config *tls.Config,
+	identify IdentifyFunc,
+	processor RpcProcessor,
+	logger *log.Logger,
+) (*Server, error) {
+	if err := checkTLS(config, identify); err != nil {
+		return nil, err
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		return nil, errors.New("config must have ClientAuth set to RequireAndVerifyClientCert")
+	}
+	if processor == nil {
+		return nil, errors.New("'processor' cannot be nil")
+	}
+	if logger == nil {
+		return nil, errors.New("'logger' cannot be nil")
+	}
+
+	return listen(address, processor, nil, config, identify, logger)
+}
+
+func listen(
+	address string,
+	processor RpcProcessor,
+	rpcServer *rpc.Server,
+	tlsConfig *tls.Config,
+	identify IdentifyFunc,
+	logger *log.Logger,
+) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener,
+		processor,
+		rpcServer,
+		tlsConfig,
+		identify,
+		logger,
+		&sync.Mutex{},
+		make(map[net.Conn]bool),
+		false,
+		make(chan struct{}),
+	}
+
+	go s.acceptLoop()
+
+	return s, nil
+}
+
+// Addr returns the address that the Server is listening on.
+//
+// This is useful when listening on port 0.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops listening and closes all the accepted connections.
+//
+// This is safe to call multiple times.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.listener.Close()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mutex.Unlock()
+
+	<-s.done
+	return err
+}
+
+func (s *Server) acceptLoop() {
+	defer close(s.done)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if !closed {
+				s.logger.Println("[tcprpc] Accept failed, stopping server:", err)
+			}
+			return
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.mutex.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+	}()
+
+	if s.tlsConfig == nil {
+		// ServeConn closes the connection when the client hangs up
+		s.rpcServer.ServeConn(conn)
+		return
+	}
+
+	tlsConn, peerId, err := s.handshake(conn)
+	if err != nil {
+		_ = conn.Close()
+		s.logger.Println("[tcprpc] Refused connection from", conn.RemoteAddr(), ":", err)
+		return
+	}
+	rpcServer, err := newRpcServer(s.processor, peerId, s.logger)
+	if err != nil {
+		_ = conn.Close()
+		s.logger.Println("[tcprpc] Failed to serve connection:", err)
+		return
+	}
+	rpcServer.ServeConn(tlsConn)
+}
+
+// handshake runs the TLS handshake on the given connection and returns the
+// ServerId of the client.
+func (s *Server) handshake(conn net.Conn) (*tls.Conn, ServerId, error) {
+	tlsConn := tls.Server(conn, s.tlsConfig)
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return nil, 0, err
+	}
+	err = tlsConn.Handshake()
+	if err != nil {
+		return nil, 0, err
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, 0, err
+	}
+	peerId, err := identifyPeer(tlsConn, s.identify)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tlsConn, peerId, nil
+}
+
+func newRpcServer(processor RpcProcessor, peerId ServerId, logger *log.Logger) (*rpc.Server, error) {
+	rpcServer := rpc.NewServer()
+	err := rpcServer.RegisterName(serviceName, &raftService{processor, peerId, logger})
+	if err != nil {
+		return nil, err
+	}
+	return rpcServer, nil
+}
+
+// raftService has the net/rpc methods of the Server.
+type raftService struct {
+	processor RpcProcessor
+	peerId    ServerId // the authenticated client, or 0 if not using TLS
+	logger    *log.Logger
+}
+
+// checkFrom refuses an RPC whose sender is not the authenticated client.
+func (rs *raftService) checkFrom(from ServerId) error {
+	if rs.peerId != 0 && from != rs.peerId {
+		err := fmt.Errorf("tcprpc: RPC from %v on a connection authenticated as %v", from, rs.peerId)
+		rs.logger.Println("[tcprpc] Refused RPC:", err)
+		return err
+	}
+	return nil
+}
+
+// decode checks the sender of the given call and decodes its message.
+func (rs *raftService) decode(args *Args) (interface{}, error) {
+	if err := rs.checkFrom(args.From); err != nil {
+		return nil, err
+	}
+	return wire.Decode(args.Message)
+}
+
+func (rs *raftService) AppendEntries(args *Args, reply *Reply) error {
+	msg, err := rs.decode(args)
+	if err != nil {
+		return err
+	}
+	rpc, ok := msg.(*RpcAppendEntries)
+	if !ok {
+		return fmt.Errorf("tcprpc: %T sent to %v", msg, methodRpcAppendEntries)
+	}
+	rpcReply, err := rs.processor.ProcessRpcAppendEntries(args.From, rpc)
+	if err != nil {
+		return err
+	}
+	reply.Message, err = wire.Encode(nil, rpcReply)
+	return err
+}
+
+func (rs *raftService) RequestVote(args *Args, reply *Reply) error {
+	msg, err := rs.decode(args)
+	if err != nil {
+		return err
+	}
+	rpc, ok := msg.(*RpcRequestVote)
+	if !ok {
+		return fmt.Errorf("tcprpc: %T sent to %v", msg, methodRpcRequestVote)
+	}
+	rpcReply, err := rs.processor.ProcessRpcRequestVote(args.From, rpc)
+	if err != nil {
+		return err
+	}
+	reply.Message, err = wire.Encode(nil, rpcReply)
+	return err
+}
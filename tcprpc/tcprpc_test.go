@@ -0,0 +1,264 @@
+package tcprpc
+
+import (
+	"log"
+	"net/rpc"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/wire"
+)
+
+const (
+	testDialTimeout = 100 * time.Millisecond
+	testCallTimeout = 200 * time.Millisecond
+)
+
+// mockProcessor records the RPCs it receives and replies with the current term.
+type mockProcessor struct {
+	mutex    sync.Mutex
+	received []interface{}
+	term     TermNo
+	block    chan struct{} // if not nil, calls wait for this to be closed
+	err      error
+}
+
+func (mp *mockProcessor) process(from ServerId, rpc interface{}) (TermNo, chan struct{}, error) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.received = append(mp.received, from, rpc)
+	return mp.term, mp.block, mp.err
+}
+
+func (mp *mockProcessor) setErr(err error) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.err = err
+}
+
+func (mp *mockProcessor) ProcessRpcAppendEntries(
+	from ServerId, rpc *RpcAppendEntries,
+) (*RpcAppendEntriesReply, error) {
+	term, block, err := mp.process(from, rpc)
+	if block != nil {
+		<-block
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &RpcAppendEntriesReply{term, true}, nil
+}
+
+func (mp *mockProcessor) ProcessRpcRequestVote(
+	from ServerId, rpc *RpcRequestVote,
+) (*RpcRequestVoteReply, error) {
+	term, block, err := mp.process(from, rpc)
+	if block != nil {
+		<-block
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &RpcRequestVoteReply{term, false}, nil
+}
+
+func (mp *mockProcessor) checkReceived(t *testing.T, expected ...interface{}) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	if !reflect.DeepEqual(mp.received, expected) {
+		t.Fatal(mp.received)
+	}
+	mp.received = nil
+}
+
+func newTestLogger() *log.Logger {
+	return log.New(os.Stderr, "tcprpc_test", log.Flags())
+}
+
+func setupServerAndClient(t *testing.T, mp *mockProcessor) (*Server, *Client) {
+	s, err := Listen("127.0.0.1:0", mp, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := map[ServerId]string{
+		101: "127.0.0.1:1", // this server - ignored
+		102: s.Addr().String(),
+	}
+	c, err := NewClient(101, addresses, testDialTimeout, testCallTimeout, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+func TestClientAndServer(t *testing.T) {
+	mp := &mockProcessor{term: 8}
+	s, c := setupServerAndClient(t, mp)
+	defer s.Close()
+	defer c.Close()
+
+	rpcAE := &RpcAppendEntries{8, 4, 4, []LogEntry{{4, Command("c5")}, {5, Command("c6")}}, 3}
+	aeReply := c.RpcAppendEntries(102, rpcAE)
+	if !reflect.DeepEqual(aeReply, &RpcAppendEntriesReply{8, true}) {
+		t.Fatal(aeReply)
+	}
+	mp.checkReceived(t, ServerId(101), rpcAE)
+
+	rpcRV := &RpcRequestVote{9, 10, 6}
+	rvReply := c.RpcRequestVote(102, rpcRV)
+	if !reflect.DeepEqual(rvReply, &RpcRequestVoteReply{8, false}) {
+		t.Fatal(rvReply)
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+
+	// An error from the processor is a failed call
+	mp.setErr(ErrStopped)
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+
+	// ... but the connection is still usable
+	mp.setErr(nil)
+	if r := c.RpcRequestVote(102, rpcRV); r == nil {
+		t.Fatal()
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+}
+
+func TestServer_WireMessages(t *testing.T) {
+	mp := &mockProcessor{term: 8}
+	s, err := Listen("127.0.0.1:0", mp, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	client, err := rpc.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The messages and replies are encoded with package wire
+	rpcRV := &RpcRequestVote{9, 10, 6}
+	message, err := wire.Encode(nil, rpcRV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := &Reply{}
+	err = client.Call(methodRpcRequestVote, &Args{101, message}, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+	replyMsg, err := wire.Decode(reply.Message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replyMsg, &RpcRequestVoteReply{8, false}) {
+		t.Fatal(replyMsg)
+	}
+
+	// A message for another method is refused
+	err = client.Call(methodRpcAppendEntries, &Args{101, message}, &Reply{})
+	if err == nil || err.Error() != "tcprpc: *raft.RpcRequestVote sent to Raft.AppendEntries" {
+		t.Fatal(err)
+	}
+	mp.checkReceived(t)
+
+	// ... as is a message that cannot be decoded
+	err = client.Call(methodRpcRequestVote, &Args{101, message[:len(message)-1]}, &Reply{})
+	if err == nil || err.Error() != wire.ErrTruncated.Error() {
+		t.Fatal(err)
+	}
+	mp.checkReceived(t)
+}
+
+func TestClient_UnknownPeerPanics(t *testing.T) {
+	c, err := NewClient(101, map[ServerId]string{102: "127.0.0.1:1"}, testDialTimeout, testCallTimeout, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if r := recover(); r != "tcprpc: unknown peer: 101" {
+			t.Fatal(r)
+		}
+	}()
+	c.RpcRequestVote(101, &RpcRequestVote{1, 0, 0})
+}
+
+func TestClient_OneCallInFlightPerPeerAndTimeout(t *testing.T) {
+	block := make(chan struct{})
+	mp := &mockProcessor{term: 8, block: block}
+	s, c := setupServerAndClient(t, mp)
+	defer s.Close()
+	defer c.Close()
+	defer close(block)
+
+	rpcRV := &RpcRequestVote{9, 10, 6}
+	replies := make(chan *RpcRequestVoteReply)
+	go func() {
+		replies <- c.RpcRequestVote(102, rpcRV)
+	}()
+	time.Sleep(testCallTimeout / 4)
+
+	// A concurrent call returns nil without calling the peer
+	start := time.Now()
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	if d := time.Since(start); d > testCallTimeout/4 {
+		t.Fatal(d)
+	}
+
+	// The blocked call times out
+	if r := <-replies; r != nil {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	mp := &mockProcessor{term: 8}
+	s, c := setupServerAndClient(t, mp)
+	defer c.Close()
+	address := s.Addr().String()
+
+	rpcRV := &RpcRequestVote{9, 10, 6}
+	if r := c.RpcRequestVote(102, rpcRV); r == nil {
+		t.Fatal()
+	}
+
+	// Calls fail while the peer is down
+	err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+
+	// The next call after the peer is back reconnects
+	s, err = Listen(address, mp, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if r := c.RpcRequestVote(102, rpcRV); !reflect.DeepEqual(r, &RpcRequestVoteReply{8, false}) {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV, ServerId(101), rpcRV)
+
+	// Calls after Close return nil
+	c.Close()
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+}
@@ -0,0 +1,76 @@
+package tcprpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strconv"
+
+	. "github.com/divtxt/raft"
+)
+
+// IdentifyFunc returns the ServerId of the server that owns the given verified
+// certificate.
+//
+// It should return an error if the certificate does not identify a server.
+// A ServerId of 0 is treated as such an error.
+type IdentifyFunc func(cert *x509.Certificate) (ServerId, error)
+
+// CommonNameIdentity is an IdentifyFunc for certificates whose subject common
+// name is the ServerId in decimal e.g. "101".
+func CommonNameIdentity(cert *x509.Certificate) (ServerId, error) {
+	cn := cert.Subject.CommonName
+	id, err := strconv.ParseUint(cn, 10, 64)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("tcprpc: certificate common name is not a ServerId: %q", cn)
+	}
+	return ServerId(id), nil
+}
+
+// MutualTLSConfig returns a tls.Config for both the Server and Client of a
+// cluster that uses mutual TLS.
+//
+// cert is the certificate of this server, and roots are the certificate
+// authorities that sign the certificates of the servers in the cluster.
+//
+func MutualTLSConfig(cert tls.Certificate, roots *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// checkTLS checks the TLS arguments of ListenTLS and NewTLSClient.
+func checkTLS(config *tls.Config, identify IdentifyFunc) error {
+	if config == nil {
+		return errors.New("'config' cannot be nil")
+	}
+	if identify == nil {
+		return errors.New("'identify' cannot be nil")
+	}
+	return nil
+}
+
+// identifyPeer returns the ServerId of the peer of the given connection,
+// which must have completed its handshake.
+//
+// The ServerId is never 0, since the Server treats a peerId of 0 as a
+// connection without TLS that is not checked.
+func identifyPeer(conn *tls.Conn, identify IdentifyFunc) (ServerId, error) {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return 0, errors.New("tcprpc: peer did not send a certificate")
+	}
+	peerId, err := identify(certs[0])
+	if err != nil {
+		return 0, err
+	}
+	if peerId == 0 {
+		return 0, errors.New("tcprpc: certificate identifies ServerId 0")
+	}
+	return peerId, nil
+}
@@ -0,0 +1,290 @@
+package tcprpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/wire"
+)
+
+// testCA is a certificate authority that issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert, key, pool}
+}
+
+// issue returns a certificate for 127.0.0.1 with the given common name.
+func (ca *testCA) issue(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) config(t *testing.T, commonName string) *tls.Config {
+	return MutualTLSConfig(ca.issue(t, commonName), ca.pool)
+}
+
+func listenTLS(t *testing.T, config *tls.Config, mp *mockProcessor) *Server {
+	s, err := ListenTLS("127.0.0.1:0", config, CommonNameIdentity, mp, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTLSClient(t *testing.T, thisServerId ServerId, address string, config *tls.Config) *Client {
+	c, err := NewTLSClient(
+		thisServerId,
+		map[ServerId]string{102: address},
+		config,
+		CommonNameIdentity,
+		testDialTimeout,
+		testCallTimeout,
+		newTestLogger(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTLSClientAndServer(t *testing.T) {
+	ca := newTestCA(t)
+	mp := &mockProcessor{term: 8}
+	s := listenTLS(t, ca.config(t, "102"), mp)
+	defer s.Close()
+	c := newTLSClient(t, 101, s.Addr().String(), ca.config(t, "101"))
+	defer c.Close()
+
+	rpcAE := &RpcAppendEntries{8, 4, 4, []LogEntry{{4, Command("c5")}}, 3}
+	aeReply := c.RpcAppendEntries(102, rpcAE)
+	if !reflect.DeepEqual(aeReply, &RpcAppendEntriesReply{8, true}) {
+		t.Fatal(aeReply)
+	}
+	mp.checkReceived(t, ServerId(101), rpcAE)
+
+	rpcRV := &RpcRequestVote{9, 10, 6}
+	rvReply := c.RpcRequestVote(102, rpcRV)
+	if !reflect.DeepEqual(rvReply, &RpcRequestVoteReply{8, false}) {
+		t.Fatal(rvReply)
+	}
+	mp.checkReceived(t, ServerId(101), rpcRV)
+}
+
+// A client cannot send RPCs as a server other than the one in its certificate.
+func TestTLSServer_RefusesForgedFrom(t *testing.T) {
+	ca := newTestCA(t)
+	mp := &mockProcessor{term: 8}
+	s := listenTLS(t, ca.config(t, "102"), mp)
+	defer s.Close()
+
+	// A Client does not check its own certificate, so it can claim to be anyone
+	c := newTLSClient(t, 101, s.Addr().String(), ca.config(t, "103"))
+	defer c.Close()
+	if r := c.RpcAppendEntries(102, &RpcAppendEntries{8, 4, 4, []LogEntry{}, 3}); r != nil {
+		t.Fatal(r)
+	}
+	if r := c.RpcRequestVote(102, &RpcRequestVote{9, 10, 6}); r != nil {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t)
+
+	// Check the error with a raw connection
+	conn, err := tls.Dial("tcp", s.Addr().String(), ca.config(t, "103"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	rpcRequestVote := &RpcRequestVote{9, 10, 6}
+	message, err := wire.Encode(nil, rpcRequestVote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Call(methodRpcRequestVote, &Args{101, message}, &Reply{})
+	if err == nil || err.Error() != "tcprpc: RPC from 101 on a connection authenticated as 103" {
+		t.Fatal(err)
+	}
+	mp.checkReceived(t)
+
+	// ... and the same connection can send RPCs as itself
+	err = client.Call(methodRpcRequestVote, &Args{103, message}, &Reply{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.checkReceived(t, ServerId(103), rpcRequestVote)
+}
+
+func TestTLSServer_RefusesUnauthenticatedClients(t *testing.T) {
+	ca := newTestCA(t)
+	mp := &mockProcessor{term: 8}
+	s := listenTLS(t, ca.config(t, "102"), mp)
+	defer s.Close()
+	address := s.Addr().String()
+	rpcRV := &RpcRequestVote{9, 10, 6}
+
+	// No client certificate
+	config := ca.config(t, "101")
+	config.Certificates = nil
+	c := newTLSClient(t, 101, address, config)
+	defer c.Close()
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+
+	// Certificate from another CA
+	otherCA := newTestCA(t)
+	config = otherCA.config(t, "101")
+	config.RootCAs = ca.pool
+	c = newTLSClient(t, 101, address, config)
+	defer c.Close()
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+
+	// Certificate that does not identify a server
+	c = newTLSClient(t, 101, address, ca.config(t, "server1"))
+	defer c.Close()
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+
+	// No TLS
+	c, err := NewClient(101, map[ServerId]string{102: address}, testDialTimeout, testCallTimeout, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if r := c.RpcRequestVote(102, rpcRV); r != nil {
+		t.Fatal(r)
+	}
+
+	mp.checkReceived(t)
+}
+
+// An IdentifyFunc that returns ServerId 0 does not turn off the check of the sender.
+func TestTLSServer_RefusesServerIdZero(t *testing.T) {
+	ca := newTestCA(t)
+	mp := &mockProcessor{term: 8}
+	identifyZero := func(cert *x509.Certificate) (ServerId, error) {
+		return 0, nil
+	}
+	s, err := ListenTLS("127.0.0.1:0", ca.config(t, "102"), identifyZero, mp, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c := newTLSClient(t, 101, s.Addr().String(), ca.config(t, "103"))
+	defer c.Close()
+	if r := c.RpcRequestVote(102, &RpcRequestVote{9, 10, 6}); r != nil {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t)
+}
+
+// A client does not send RPCs to a server with the wrong identity.
+func TestTLSClient_RefusesWrongPeer(t *testing.T) {
+	ca := newTestCA(t)
+	mp := &mockProcessor{term: 8}
+	s := listenTLS(t, ca.config(t, "103"), mp)
+	defer s.Close()
+
+	c := newTLSClient(t, 101, s.Addr().String(), ca.config(t, "101"))
+	defer c.Close()
+	if r := c.RpcRequestVote(102, &RpcRequestVote{9, 10, 6}); r != nil {
+		t.Fatal(r)
+	}
+	mp.checkReceived(t)
+}
+
+func TestListenTLS_RequiresClientCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	config := ca.config(t, "102")
+	config.ClientAuth = tls.RequestClientCert
+	_, err := ListenTLS("127.0.0.1:0", config, CommonNameIdentity, &mockProcessor{}, newTestLogger())
+	if err == nil || !strings.Contains(err.Error(), "RequireAndVerifyClientCert") {
+		t.Fatal(err)
+	}
+}
+
+func TestCommonNameIdentity(t *testing.T) {
+	tests := []struct {
+		commonName    string
+		expectedId    ServerId
+		expectedError bool
+	}{
+		{"101", 101, false},
+		{"18446744073709551615", 1<<64 - 1, false},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"", 0, true},
+		{"server1", 0, true},
+	}
+	for _, test := range tests {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: test.commonName}}
+		id, err := CommonNameIdentity(cert)
+		if id != test.expectedId || (err != nil) != test.expectedError {
+			t.Fatal(test, id, err)
+		}
+	}
+}
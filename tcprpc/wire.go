@@ -0,0 +1,41 @@
+// Package tcprpc provides a TCP implementation of the raft RpcService using net/rpc.
+//
+// Client implements RpcService for sending RPCs to the other servers of the cluster,
+// and Server receives those RPCs and dispatches them to a ConsensusModule.
+//
+// The raft RPCs and their replies are encoded with package wire, and sent as
+// the payload of net/rpc calls. Both ends must use this package.
+//
+// Use ListenTLS and NewTLSClient for mutual TLS, where the certificate of each
+// server identifies its ServerId. Without TLS, a Server trusts the ServerId that
+// a client sends with each RPC.
+package tcprpc
+
+import (
+	. "github.com/divtxt/raft"
+)
+
+// The net/rpc service name and methods.
+const (
+	serviceName            = "Raft"
+	methodRpcAppendEntries = serviceName + ".AppendEntries"
+	methodRpcRequestVote   = serviceName + ".RequestVote"
+)
+
+// Args is the net/rpc request for a raft RPC.
+//
+// Message is the RPC encoded with package wire.
+//
+// net/rpc does not tell the server who is calling, so the sender's ServerId
+// is sent along with the RPC.
+type Args struct {
+	From    ServerId
+	Message []byte
+}
+
+// Reply is the net/rpc reply for a raft RPC.
+//
+// Message is the reply encoded with package wire.
+type Reply struct {
+	Message []byte
+}
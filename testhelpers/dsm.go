@@ -2,9 +2,11 @@ package testhelpers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"reflect"
 	"strconv"
+	"sync"
 
 	. "github.com/divtxt/raft"
 )
@@ -60,3 +62,82 @@ func DummyCommandEquals(c Command, n int) bool {
 	cn := Command("c" + strconv.Itoa(n))
 	return bytes.Equal(c, cn)
 }
+
+// Dummy state machine that implements BatchStateMachine.
+// Records the size of each batch. Meant only for tests.
+type DummyBatchStateMachine struct {
+	*DummyStateMachine
+	BatchSizes []int
+}
+
+func NewDummyBatchStateMachine(lastApplied LogIndex) *DummyBatchStateMachine {
+	return &DummyBatchStateMachine{NewDummyStateMachine(lastApplied), nil}
+}
+
+func (dbsm *DummyBatchStateMachine) ApplyEntries(firstLogIndex LogIndex, entries []LogEntry) []CommandResult {
+	if firstLogIndex != dbsm.lastApplied+1 {
+		panic(fmt.Sprintf(
+			"DummyBatchStateMachine: firstLogIndex=%d is not lastApplied+1 with lastApplied=%d",
+			firstLogIndex,
+			dbsm.lastApplied,
+		))
+	}
+
+	dbsm.BatchSizes = append(dbsm.BatchSizes, len(entries))
+	results := make([]CommandResult, len(entries))
+	for i, entry := range entries {
+		results[i] = dbsm.ApplyCommand(firstLogIndex+LogIndex(i), entry.Command)
+	}
+	return results
+}
+
+// ErrDummyApply is the error of DummyFallibleStateMachine.TryApplyCommand.
+var ErrDummyApply = errors.New("dummy apply failure")
+
+// Dummy state machine that implements FallibleStateMachine.
+// TryApplyCommand fails for the log indexes in the failures map, as many times as the
+// value or forever if the value is negative. Meant only for tests.
+type DummyFallibleStateMachine struct {
+	*DummyStateMachine
+	mutex    *sync.Mutex
+	failures map[LogIndex]int
+	skipped  []LogIndex
+}
+
+func NewDummyFallibleStateMachine(lastApplied LogIndex, failures map[LogIndex]int) *DummyFallibleStateMachine {
+	return &DummyFallibleStateMachine{NewDummyStateMachine(lastApplied), &sync.Mutex{}, failures, nil}
+}
+
+func (dfsm *DummyFallibleStateMachine) TryApplyCommand(logIndex LogIndex, command Command) (CommandResult, error) {
+	dfsm.mutex.Lock()
+	defer dfsm.mutex.Unlock()
+
+	if n := dfsm.failures[logIndex]; n != 0 {
+		if n > 0 {
+			dfsm.failures[logIndex] = n - 1
+		}
+		return nil, ErrDummyApply
+	}
+	return dfsm.DummyStateMachine.ApplyCommand(logIndex, command), nil
+}
+
+func (dfsm *DummyFallibleStateMachine) SkipCommand(logIndex LogIndex, err error) {
+	dfsm.mutex.Lock()
+	defer dfsm.mutex.Unlock()
+
+	dfsm.skipped = append(dfsm.skipped, logIndex)
+	dfsm.lastApplied = logIndex
+}
+
+func (dfsm *DummyFallibleStateMachine) GetLastApplied() LogIndex {
+	dfsm.mutex.Lock()
+	defer dfsm.mutex.Unlock()
+	return dfsm.lastApplied
+}
+
+// Skipped returns the log indexes given to SkipCommand.
+func (dfsm *DummyFallibleStateMachine) Skipped() []LogIndex {
+	dfsm.mutex.Lock()
+	defer dfsm.mutex.Unlock()
+	return append([]LogIndex(nil), dfsm.skipped...)
+}
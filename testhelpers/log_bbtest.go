@@ -62,10 +62,18 @@ func BlackboxTest_Log(t *testing.T, log Log, lastCompactedIsFour bool) {
 		if err != ErrIndexCompacted {
 			t.Fatal(entries, err)
 		}
-		_, err = log.GetTermAtIndex(4)
+		_, err = log.GetTermAtIndex(3)
 		if err != ErrIndexCompacted {
 			t.Fatal(err)
 		}
+		// the term of lastCompacted is still available
+		term, err := log.GetTermAtIndex(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if term != 4 {
+			t.Fatal(term)
+		}
 	}
 
 	// get multiple entries
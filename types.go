@@ -58,7 +58,10 @@ type WatchableIndex interface {
 
 	// Add the given callback as a listener for changes.
 	// This is NOT safe to call from a listener.
-	AddListener(didChangeListener IndexChangeListener)
+	//
+	// The returned function removes the listener. It is also NOT safe to call
+	// from a listener.
+	AddListener(didChangeListener IndexChangeListener) (remove func())
 }
 
 // An integer that uniquely identifies a server in a Raft cluster.
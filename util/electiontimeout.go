@@ -5,20 +5,31 @@ import (
 	"time"
 )
 
-var r *rand.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
-
 type ElectionTimeoutChooser struct {
 	electionTimeoutLow time.Duration
+	rand               *rand.Rand
 }
 
+// NewElectionTimeoutChooser creates a chooser with its own random number generator
+// seeded from the current time.
 func NewElectionTimeoutChooser(electionTimeoutLow time.Duration) *ElectionTimeoutChooser {
-	return &ElectionTimeoutChooser{electionTimeoutLow}
+	return NewElectionTimeoutChooserWithRand(
+		electionTimeoutLow, rand.New(rand.NewSource(time.Now().UnixNano())),
+	)
+}
+
+// NewElectionTimeoutChooserWithRand creates a chooser that uses the given random number
+// generator, which must not be shared since it is not safe for concurrent use.
+//
+// Use a generator with a fixed seed to get the same election timeouts every time.
+func NewElectionTimeoutChooserWithRand(electionTimeoutLow time.Duration, rand *rand.Rand) *ElectionTimeoutChooser {
+	return &ElectionTimeoutChooser{electionTimeoutLow, rand}
 }
 
 func (etc *ElectionTimeoutChooser) ChooseRandomElectionTimeout() time.Duration {
 	// #5.2-p6s2: ..., election timeouts are chosen randomly from a fixed
 	// interval (e.g., 150-300ms)
 	// Currently, we choose a time between electionTimeoutLow and 2*electionTimeoutLow
-	timeout := etc.electionTimeoutLow + time.Duration(r.Int63n(int64(etc.electionTimeoutLow)+1))
+	timeout := etc.electionTimeoutLow + time.Duration(etc.rand.Int63n(int64(etc.electionTimeoutLow)+1))
 	return timeout
 }
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"math/rand"
 	"testing"
 	"time"
 )
@@ -26,3 +27,16 @@ func TestElectionTimeoutChooser(t *testing.T) {
 		t.Fatal(timeout1)
 	}
 }
+
+func TestElectionTimeoutChooser_SameSeedSameTimeouts(t *testing.T) {
+	etc1 := NewElectionTimeoutChooserWithRand(150*time.Millisecond, rand.New(rand.NewSource(42)))
+	etc2 := NewElectionTimeoutChooserWithRand(150*time.Millisecond, rand.New(rand.NewSource(42)))
+
+	for i := 0; i < 10; i++ {
+		timeout1 := etc1.ChooseRandomElectionTimeout()
+		timeout2 := etc2.ChooseRandomElectionTimeout()
+		if timeout1 != timeout2 {
+			t.Fatal(i, timeout1, timeout2)
+		}
+	}
+}
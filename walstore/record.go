@@ -0,0 +1,172 @@
+package walstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	. "github.com/divtxt/raft"
+)
+
+// Record layout:
+//
+//  CRC32C (uint32) + type (uint8) + index (uint64) + term (uint64)
+//  + data length (uint32) + data bytes
+//
+// The CRC32C (Castagnoli) checksum of a record covers everything in the
+// record after the checksum itself. All integers are big-endian.
+//
+// The meaning of the fields depends on the record type:
+//
+//  recordEntry:     the log entry at index with the given term and command as data
+//  recordTruncate:  delete all entries after index
+//  recordState:     currentTerm as term and votedFor (uint64) as data
+//  recordCompacted: lastCompacted as index and its term
+//
+// Entries are never overwritten in place: recordTruncate followed by recordEntry
+// records replaces entries, and the later records win when the WAL is replayed.
+const recordHeaderSize = 25
+
+type recordType uint8
+
+const (
+	recordEntry recordType = iota + 1
+	recordTruncate
+	recordState
+	recordCompacted
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+type record struct {
+	typ   recordType
+	index LogIndex
+	term  TermNo
+	data  []byte
+}
+
+func entryRecord(li LogIndex, entry LogEntry) record {
+	return record{recordEntry, li, entry.TermNo, entry.Command}
+}
+
+func stateRecord(currentTerm TermNo, votedFor ServerId) record {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(votedFor))
+	return record{recordState, 0, currentTerm, data}
+}
+
+func (r *record) size() int64 {
+	return recordHeaderSize + int64(len(r.data))
+}
+
+// votedFor returns the votedFor value of a recordState.
+func (r *record) votedFor() ServerId {
+	return ServerId(binary.BigEndian.Uint64(r.data))
+}
+
+// encodeRecords returns the encoded records and the offset of each record
+// relative to the start of the returned bytes.
+func encodeRecords(records []record) ([]byte, []int64) {
+	var bufSize int64
+	for i := range records {
+		bufSize += records[i].size()
+	}
+	buf := make([]byte, bufSize)
+	offsets := make([]int64, len(records))
+	var p int64
+	for i := range records {
+		r := &records[i]
+		offsets[i] = p
+		b := buf[p : p+r.size()]
+		b[4] = byte(r.typ)
+		binary.BigEndian.PutUint64(b[5:], uint64(r.index))
+		binary.BigEndian.PutUint64(b[13:], uint64(r.term))
+		binary.BigEndian.PutUint32(b[21:], uint32(len(r.data)))
+		copy(b[recordHeaderSize:], r.data)
+		binary.BigEndian.PutUint32(b, crc32.Checksum(b[4:], crc32cTable))
+		p += r.size()
+	}
+	return buf, offsets
+}
+
+// decodeRecord decodes a single record that fills the given bytes.
+//
+// Returns errRecordChecksum if the record does not match its checksum or
+// if the record length does not match.
+func decodeRecord(b []byte) (record, error) {
+	if len(b) < recordHeaderSize {
+		return record{}, errRecordIncomplete
+	}
+	dataLen := int(binary.BigEndian.Uint32(b[21:]))
+	if recordHeaderSize+dataLen != len(b) {
+		return record{}, errRecordChecksum
+	}
+	if binary.BigEndian.Uint32(b) != crc32.Checksum(b[4:], crc32cTable) {
+		return record{}, errRecordChecksum
+	}
+	r := record{
+		recordType(b[4]),
+		LogIndex(binary.BigEndian.Uint64(b[5:])),
+		TermNo(binary.BigEndian.Uint64(b[13:])),
+		b[recordHeaderSize:len(b):len(b)],
+	}
+	if r.typ < recordEntry || r.typ > recordCompacted {
+		return record{}, fmt.Errorf("walstore: unknown record type: %v", r.typ)
+	}
+	if r.typ == recordState && len(r.data) != 8 {
+		return record{}, fmt.Errorf("walstore: bad state record length: %v", len(r.data))
+	}
+	return r, nil
+}
+
+var errRecordIncomplete = errors.New("incomplete record")
+var errRecordChecksum = errors.New("checksum mismatch")
+
+// recordReader reads and checks consecutive records of a segment file.
+type recordReader struct {
+	r         *bufio.Reader
+	remaining int64
+}
+
+func newRecordReader(f *os.File, offset int64, fileSize int64) *recordReader {
+	sr := io.NewSectionReader(f, offset, fileSize-offset)
+	return &recordReader{bufio.NewReader(sr), fileSize - offset}
+}
+
+// next reads the next record.
+//
+// Returns io.EOF if there are no more records, errRecordIncomplete if the file
+// ends before the end of the record and errRecordChecksum if the record does
+// not match its checksum. In the last case the returned length is the length
+// claimed by the (possibly damaged) record.
+func (rr *recordReader) next() (record, int64, error) {
+	if rr.remaining == 0 {
+		return record{}, 0, io.EOF
+	}
+	if rr.remaining < recordHeaderSize {
+		return record{}, 0, errRecordIncomplete
+	}
+	header, err := rr.r.Peek(recordHeaderSize)
+	if err != nil {
+		return record{}, 0, err
+	}
+	recordLen := recordHeaderSize + int64(binary.BigEndian.Uint32(header[21:]))
+	if recordLen > rr.remaining {
+		return record{}, 0, errRecordIncomplete
+	}
+	b := make([]byte, recordLen)
+	_, err = io.ReadFull(rr.r, b)
+	if err != nil {
+		return record{}, 0, err
+	}
+	rr.remaining -= recordLen
+	r, err := decodeRecord(b)
+	if err != nil {
+		return record{}, recordLen, err
+	}
+	return r, recordLen, nil
+}
@@ -0,0 +1,260 @@
+package walstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/fileutil"
+)
+
+// Segment file layout:
+//
+//  header: magic "RWAL" (4 bytes) + format version (uint32) + CRC32C (uint32)
+//          + baseIndex (uint64) + baseTerm (uint64)
+//          + currentTerm (uint64) + votedFor (uint64)
+//  records: see record.go
+//
+// The header is a snapshot of the state when the segment was started:
+// baseIndex is the index of the last entry and baseTerm is its term, and
+// currentTerm and votedFor are the persistent state. The records in the
+// segment are changes after that snapshot, so once the earlier segments
+// are deleted the log can still be replayed from the first segment.
+//
+// Segment files are named after a sequence number that starts at 1.
+const (
+	segmentMagic          = "RWAL"
+	segmentVersion        = 1
+	segmentHeaderSize     = 44
+	segmentFileNameSuffix = ".wal"
+)
+
+type segmentHeader struct {
+	baseIndex   LogIndex
+	baseTerm    TermNo
+	currentTerm TermNo
+	votedFor    ServerId
+}
+
+// segment is a single append-only segment file of a WALStore.
+type segment struct {
+	seq    uint64
+	header segmentHeader
+	file   *os.File
+	size   int64 // offset just past the last record
+}
+
+func segmentFileName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, segmentFileNameSuffix)
+}
+
+// parseSegmentFileName returns the sequence number for a segment file name.
+func parseSegmentFileName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, segmentFileNameSuffix) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(strings.TrimSuffix(name, segmentFileNameSuffix), 10, 64)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+func encodeSegmentHeader(h segmentHeader) []byte {
+	b := make([]byte, segmentHeaderSize)
+	copy(b, segmentMagic)
+	binary.BigEndian.PutUint32(b[4:], segmentVersion)
+	binary.BigEndian.PutUint64(b[12:], uint64(h.baseIndex))
+	binary.BigEndian.PutUint64(b[20:], uint64(h.baseTerm))
+	binary.BigEndian.PutUint64(b[28:], uint64(h.currentTerm))
+	binary.BigEndian.PutUint64(b[36:], uint64(h.votedFor))
+	binary.BigEndian.PutUint32(b[8:], crc32.Checksum(b[12:], crc32cTable))
+	return b
+}
+
+func decodeSegmentHeader(filename string, b []byte) (segmentHeader, error) {
+	if string(b[:4]) != segmentMagic ||
+		binary.BigEndian.Uint32(b[8:]) != crc32.Checksum(b[12:], crc32cTable) {
+		return segmentHeader{}, &CorruptionError{filename, 0, "bad segment header"}
+	}
+	if v := binary.BigEndian.Uint32(b[4:]); v != segmentVersion {
+		return segmentHeader{}, fmt.Errorf("walstore: %v: unsupported segment version: %v", filename, v)
+	}
+	return segmentHeader{
+		LogIndex(binary.BigEndian.Uint64(b[12:])),
+		TermNo(binary.BigEndian.Uint64(b[20:])),
+		TermNo(binary.BigEndian.Uint64(b[28:])),
+		ServerId(binary.BigEndian.Uint64(b[36:])),
+	}, nil
+}
+
+// createSegment creates a new segment file with the given header.
+func createSegment(dir string, seq uint64, header segmentHeader) (*segment, error) {
+	filename := filepath.Join(dir, segmentFileName(seq))
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(encodeSegmentHeader(header))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = fileutil.SyncDir(dir)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &segment{seq, header, f, segmentHeaderSize}, nil
+}
+
+// openSegment opens an existing segment file and reads its header.
+func openSegment(dir string, seq uint64) (*segment, error) {
+	filename := filepath.Join(dir, segmentFileName(seq))
+	f, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	headerBytes := make([]byte, segmentHeaderSize)
+	_, err = f.ReadAt(headerBytes, 0)
+	if err == io.EOF {
+		err = &CorruptionError{filename, 0, "bad segment header"}
+	}
+	var header segmentHeader
+	if err == nil {
+		header, err = decodeSegmentHeader(filename, headerBytes)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &segment{seq, header, f, segmentHeaderSize}, nil
+}
+
+// replay reads the records of the segment and passes them to the given
+// function in order.
+//
+// If allowTornTail is true, an incomplete or corrupted tail - e.g. from a write
+// that was interrupted by a crash - is truncated away and described by the
+// returned TailRepair.
+// Otherwise such a tail is a CorruptionError.
+//
+// If a valid record can be found after a bad record, the damage is not just a
+// torn tail and a CorruptionError is returned.
+func (s *segment) replay(
+	allowTornTail bool,
+	apply func(r *record, offset int64, recordLen int64) error,
+) (*TailRepair, error) {
+	fi, err := s.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	filename := s.file.Name()
+
+	rr := newRecordReader(s.file, s.size, fi.Size())
+	var r record
+	var recordLen int64
+	for {
+		r, recordLen, err = rr.next()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err == errRecordIncomplete || err == errRecordChecksum {
+			break
+		}
+		if err != nil {
+			return nil, &CorruptionError{filename, s.size, err.Error()}
+		}
+		err = apply(&r, s.size, recordLen)
+		if err != nil {
+			return nil, &CorruptionError{filename, s.size, err.Error()}
+		}
+		s.size += recordLen
+	}
+
+	// Found a bad record - check the rest of the segment.
+	droppedRecords := 1
+	for err == errRecordChecksum {
+		_, _, err = rr.next()
+		if err == nil {
+			return nil, &CorruptionError{filename, s.size, "checksum mismatch"}
+		}
+		if err == errRecordIncomplete || err == errRecordChecksum {
+			droppedRecords++
+		}
+	}
+	if err != io.EOF && err != errRecordIncomplete {
+		return nil, &CorruptionError{filename, s.size, err.Error()}
+	}
+
+	if !allowTornTail {
+		return nil, &CorruptionError{
+			filename, s.size, fmt.Sprintf("%v bad record(s) at end of segment", droppedRecords),
+		}
+	}
+	err = s.file.Truncate(s.size)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &TailRepair{filename, s.size, droppedRecords}, nil
+}
+
+// readRecord reads and checks the record at the given offset.
+func (s *segment) readRecord(offset int64, recordLen int64) (record, error) {
+	b := make([]byte, recordLen)
+	_, err := s.file.ReadAt(b, offset)
+	if err != nil {
+		return record{}, err
+	}
+	r, err := decodeRecord(b)
+	if err != nil {
+		return record{}, &CorruptionError{s.file.Name(), offset, err.Error()}
+	}
+	return r, nil
+}
+
+// appendRecords writes the given records at the end of the segment and syncs
+// the segment file.
+//
+// Returns the offset of each record.
+func (s *segment) appendRecords(records []record) ([]int64, error) {
+	buf, offsets := encodeRecords(records)
+	_, err := s.file.WriteAt(buf, s.size)
+	if err != nil {
+		return nil, err
+	}
+	err = s.file.Sync()
+	if err != nil {
+		return nil, err
+	}
+	for i := range offsets {
+		offsets[i] += s.size
+	}
+	s.size += int64(len(buf))
+	return offsets, nil
+}
+
+func (s *segment) close() error {
+	return s.file.Close()
+}
+
+// remove closes and deletes the segment file.
+// The caller is responsible for syncing the directory.
+func (s *segment) remove() error {
+	name := s.file.Name()
+	err := s.file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
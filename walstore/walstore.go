@@ -0,0 +1,715 @@
+// Package walstore provides a durable implementation of both the raft Log and
+// RaftPersistentState on a single write-ahead log.
+package walstore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/fileutil"
+	"github.com/divtxt/raft/logindex"
+)
+
+// CorruptionError is returned when a segment file contains data that is not valid.
+//
+// This indicates that the WAL was damaged after it was written, and the WAL
+// cannot be trusted until the damage is repaired.
+type CorruptionError struct {
+	Filename string
+	Offset   int64
+	Reason   string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("walstore: corruption in %v at offset %v: %v", e.Filename, e.Offset, e.Reason)
+}
+
+// TailRepair describes an incomplete or corrupted tail of the last segment.
+//
+// Such a tail is expected if a write was interrupted by a crash, and since the
+// interrupted write was never acknowledged it is safe to discard it.
+type TailRepair struct {
+	Filename string
+	// Offset is the size of the segment file after the tail is truncated.
+	Offset int64
+	// DroppedRecords is the number of records - as best as can be determined
+	// from the damaged data - that were discarded.
+	DroppedRecords int
+}
+
+// WALStore implements both the raft Log and RaftPersistentState on a single
+// write-ahead log, so the same instance should be given as both to the
+// ConsensusModule.
+//
+// The WAL is a sequence of append-only segment files in a single directory.
+// Log entries, truncations, log compaction and changes to currentTerm and
+// votedFor are all appended to the WAL as checksummed records, and every
+// Log method that changes anything returns only after a single fsync of the
+// current segment. Since a term or vote change and the entries that follow it
+// are ordered in the same file, the persistent state and the log can never
+// be inconsistent with each other after a crash, and recovery only needs to
+// replay a single directory.
+//
+// WALStore is a BufferedRaftPersistentState: SetCurrentTerm and SetVotedFor
+// only change the values in memory, and the change is written by the next
+// write to the WAL - sharing its fsync - or by SyncState. So a follower that
+// learns of a new term from an AppendEntries RPC writes the new term and the
+// new entries with one fsync, and a candidate writes its new term and its vote
+// for itself with one fsync.
+//
+// Entries are never overwritten in place. SetEntriesAfterIndex appends
+// a truncate record followed by the new entries, and the later records win
+// when the WAL is replayed.
+//
+// A new segment is started once the current one grows past maxSegmentSize
+// bytes. Its header holds a snapshot of the last entry's index and term and of
+// currentTerm and votedFor, so that DiscardEntriesBeforeIndex can delete the
+// earlier segments once lastCompacted has reached that snapshot. lastCompacted
+// itself is also recorded in the WAL and survives a restart.
+//
+// When the WAL is opened, an incomplete or corrupted tail of the last segment
+// - which is what a crash during a write leaves behind - is truncated, and
+// GetTailRepair reports how many records were dropped. Any other damage makes
+// the open fail with a CorruptionError.
+//
+// The location and term of every entry after lastCompacted are indexed in
+// memory, so GetTermAtIndex does not touch the disk.
+//
+type WALStore struct {
+	dir            string
+	maxEntries     uint64
+	maxSegmentSize int64
+
+	lock              *sync.RWMutex
+	indexOfLastEntry  *logindex.WatchedIndex
+	lastCompacted     *logindex.WatchedIndex
+	lastCompactedTerm TermNo
+	entries           []entryLocation // the entries after lastCompacted
+	currentTerm       TermNo
+	votedFor          ServerId
+	statePending      bool       // currentTerm and votedFor have not been written yet
+	segments          []*segment // never empty; only the last segment is written to
+
+	tailRepair *TailRepair
+}
+
+// entryLocation is the location of the record for a log entry.
+type entryLocation struct {
+	seg       *segment
+	offset    int64
+	recordLen int64
+	term      TermNo
+}
+
+// Check that WALStore implements the Log and RaftPersistentState interfaces
+var _ Log = (*WALStore)(nil)
+var _ BufferedRaftPersistentState = (*WALStore)(nil)
+
+// OpenWALStore opens or creates a WALStore in the given directory.
+//
+// The directory must already exist. If it contains no segment files, a new
+// empty WAL is started.
+//
+// maxEntries is the maximum number of log entries that GetEntriesAfterIndex
+// will return at a time.
+//
+// maxSegmentSize is the size in bytes after which a new segment file is started.
+//
+// The caller is responsible for ensuring exclusive access to the directory.
+//
+func OpenWALStore(dir string, maxEntries uint64, maxSegmentSize int64) (*WALStore, error) {
+	if maxEntries <= 0 {
+		return nil, fmt.Errorf(
+			"maxEntries=%v must be greater than zero", maxEntries,
+		)
+	}
+	if maxSegmentSize <= 0 {
+		return nil, fmt.Errorf(
+			"maxSegmentSize=%v must be greater than zero", maxSegmentSize,
+		)
+	}
+
+	ws := &WALStore{
+		dir,
+		maxEntries,
+		maxSegmentSize,
+		&sync.RWMutex{},
+		logindex.NewWatchedIndexWithVerifier(nil), // FIXME: verifier
+		logindex.NewWatchedIndexWithVerifier(nil), // FIXME: verifier
+		0,
+		nil,
+		0,
+		0,
+		false,
+		nil,
+		nil,
+	}
+
+	err := ws.openSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+// listSegments returns the sequence numbers of the segment files in the given
+// directory in order.
+func listSegments(dir string) ([]uint64, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+	for _, fi := range fileInfos {
+		if fi.IsDir() {
+			continue
+		}
+		if seq, ok := parseSegmentFileName(fi.Name()); ok {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// openSegments opens and replays all segment files in the given directory in
+// order, creating the first segment if there are none.
+func (ws *WALStore) openSegments() error {
+	seqs, err := listSegments(ws.dir)
+	if err != nil {
+		return err
+	}
+
+	if len(seqs) == 0 {
+		s, err := createSegment(ws.dir, 1, segmentHeader{})
+		if err != nil {
+			return err
+		}
+		ws.segments = []*segment{s}
+		return nil
+	}
+
+	closeAll := func() {
+		for _, s := range ws.segments {
+			_ = s.close()
+		}
+		ws.segments = nil
+	}
+	rp := &replayer{ws: ws}
+	for i, seq := range seqs {
+		isLast := i == len(seqs)-1
+		if i > 0 && seq != seqs[i-1]+1 {
+			closeAll()
+			return fmt.Errorf("walstore: segment %v does not follow segment %v", seq, seqs[i-1])
+		}
+		s, err := openSegment(ws.dir, seq)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		ws.segments = append(ws.segments, s)
+		err = rp.beginSegment(s)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		tr, err := s.replay(isLast, rp.apply)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		ws.tailRepair = tr
+	}
+	err = rp.finish()
+	if err != nil {
+		closeAll()
+		return err
+	}
+
+	// There are no listeners yet so these cannot fail
+	err = ws.lastCompacted.Set(rp.lastCompacted)
+	if err != nil {
+		return err
+	}
+	return ws.indexOfLastEntry.Set(rp.lastCompacted + LogIndex(len(ws.entries)))
+}
+
+// replayer rebuilds the state of a WALStore from the records in its segments.
+type replayer struct {
+	ws            *WALStore
+	seg           *segment
+	lastCompacted LogIndex
+	// A truncation to before lastCompacted means the term of lastCompacted is
+	// not known until a later compacted record.
+	lastCompactedTermUnknown bool
+}
+
+func (rp *replayer) iole() LogIndex {
+	return rp.lastCompacted + LogIndex(len(rp.ws.entries))
+}
+
+func (rp *replayer) termAt(li LogIndex) TermNo {
+	if li == rp.lastCompacted {
+		return rp.ws.lastCompactedTerm
+	}
+	return rp.ws.entries[li-rp.lastCompacted-1].term
+}
+
+// beginSegment starts the replay of a segment.
+//
+// The first segment initializes the state from its header, and the header of
+// every later segment must match the state replayed so far.
+func (rp *replayer) beginSegment(s *segment) error {
+	ws := rp.ws
+	h := s.header
+	if rp.seg == nil {
+		rp.lastCompacted = h.baseIndex
+		ws.lastCompactedTerm = h.baseTerm
+		ws.currentTerm = h.currentTerm
+		ws.votedFor = h.votedFor
+		rp.seg = s
+		return nil
+	}
+	if rp.lastCompactedTermUnknown && h.baseIndex == rp.lastCompacted {
+		ws.lastCompactedTerm = h.baseTerm
+		rp.lastCompactedTermUnknown = false
+	}
+	if h.baseIndex != rp.iole() ||
+		h.baseTerm != rp.termAt(h.baseIndex) ||
+		h.currentTerm != ws.currentTerm ||
+		h.votedFor != ws.votedFor {
+		return &CorruptionError{s.file.Name(), 0, "segment header does not match previous segments"}
+	}
+	rp.seg = s
+	return nil
+}
+
+func (rp *replayer) apply(r *record, offset int64, recordLen int64) error {
+	ws := rp.ws
+	iole := rp.iole()
+	switch r.typ {
+	case recordEntry:
+		if r.index != iole+1 {
+			return fmt.Errorf("entry index %v does not follow iole=%v", r.index, iole)
+		}
+		ws.entries = append(ws.entries, entryLocation{rp.seg, offset, recordLen, r.term})
+	case recordTruncate:
+		if r.index > iole {
+			return fmt.Errorf("truncate index %v is after iole=%v", r.index, iole)
+		}
+		if r.index >= rp.lastCompacted {
+			ws.entries = ws.entries[:r.index-rp.lastCompacted]
+		} else {
+			rp.lastCompacted = r.index
+			rp.lastCompactedTermUnknown = true
+			ws.entries = nil
+		}
+	case recordCompacted:
+		if r.index > iole {
+			return fmt.Errorf("compacted index %v is after iole=%v", r.index, iole)
+		}
+		if r.index > rp.lastCompacted {
+			if term := rp.termAt(r.index); term != r.term {
+				return fmt.Errorf("compacted term %v does not match entry term %v", r.term, term)
+			}
+			ws.entries = append([]entryLocation(nil), ws.entries[r.index-rp.lastCompacted:]...)
+			rp.lastCompacted = r.index
+			ws.lastCompactedTerm = r.term
+			rp.lastCompactedTermUnknown = false
+		} else if r.index == rp.lastCompacted && rp.lastCompactedTermUnknown {
+			ws.lastCompactedTerm = r.term
+			rp.lastCompactedTermUnknown = false
+		}
+	case recordState:
+		ws.currentTerm = r.term
+		ws.votedFor = r.votedFor()
+	}
+	return nil
+}
+
+func (rp *replayer) finish() error {
+	if rp.lastCompactedTermUnknown {
+		return fmt.Errorf(
+			"walstore: term of lastCompacted=%v is not known - segments are missing",
+			rp.lastCompacted,
+		)
+	}
+	return nil
+}
+
+// Close writes any change to currentTerm and votedFor that has not been
+// written yet, and closes all the segment files.
+//
+// The WALStore must not be used after this call.
+func (ws *WALStore) Close() error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	firstErr := ws.writePendingState()
+	for _, s := range ws.segments {
+		err := s.close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	ws.segments = nil
+	return firstErr
+}
+
+// GetTailRepair returns the details of a damaged tail that was truncated when
+// the WAL was opened, or nil if there was none.
+func (ws *WALStore) GetTailRepair() *TailRepair {
+	return ws.tailRepair
+}
+
+func (ws *WALStore) lastSegment() *segment {
+	return ws.segments[len(ws.segments)-1]
+}
+
+// termAt returns the term of the entry at the given index.
+// The index must be present in the log or be lastCompacted.
+func (ws *WALStore) termAt(li LogIndex) TermNo {
+	lastCompacted := ws.lastCompacted.Get()
+	if li == lastCompacted {
+		return ws.lastCompactedTerm
+	}
+	return ws.entries[li-lastCompacted-1].term
+}
+
+// writeRecords appends the given records to the WAL with a single fsync, first
+// starting a new segment if the current one is full.
+//
+// A pending change to currentTerm and votedFor is written before the given
+// records with the same fsync.
+//
+// Returns the segment and the offset of each of the given records.
+func (ws *WALStore) writeRecords(records []record) (*segment, []int64, error) {
+	s := ws.lastSegment()
+	if s.size >= ws.maxSegmentSize {
+		// The header of the new segment must match the state at the end of
+		// the current segment, so a pending state is written there first.
+		err := ws.writePendingState()
+		if err != nil {
+			return nil, nil, err
+		}
+		iole := ws.indexOfLastEntry.Get()
+		header := segmentHeader{iole, ws.termAt(iole), ws.currentTerm, ws.votedFor}
+		s, err = createSegment(ws.dir, s.seq+1, header)
+		if err != nil {
+			return nil, nil, err
+		}
+		ws.segments = append(ws.segments, s)
+	}
+	statePending := ws.statePending
+	if statePending {
+		records = append([]record{stateRecord(ws.currentTerm, ws.votedFor)}, records...)
+	}
+	offsets, err := s.appendRecords(records)
+	if err != nil {
+		return nil, nil, err
+	}
+	if statePending {
+		ws.statePending = false
+		offsets = offsets[1:]
+	}
+	return s, offsets, nil
+}
+
+// writePendingState writes a pending change to currentTerm and votedFor to the
+// last segment.
+func (ws *WALStore) writePendingState() error {
+	if !ws.statePending {
+		return nil
+	}
+	_, err := ws.lastSegment().appendRecords(
+		[]record{stateRecord(ws.currentTerm, ws.votedFor)},
+	)
+	if err != nil {
+		return err
+	}
+	ws.statePending = false
+	return nil
+}
+
+// -- Log
+
+func (ws *WALStore) GetLastCompacted() LogIndex {
+	return ws.lastCompacted.Get()
+}
+
+func (ws *WALStore) GetIndexOfLastEntry() LogIndex {
+	return ws.indexOfLastEntry.Get()
+}
+
+func (ws *WALStore) GetIndexOfLastEntryWatchable() WatchableIndex {
+	return ws.indexOfLastEntry
+}
+
+func (ws *WALStore) GetTermAtIndex(li LogIndex) (TermNo, error) {
+	ws.lock.RLock()
+	defer ws.lock.RUnlock()
+
+	if li == 0 {
+		return 0, errors.New("GetTermAtIndex(): li=0")
+	}
+	if li < ws.lastCompacted.Get() {
+		return 0, ErrIndexCompacted
+	}
+
+	iole := ws.indexOfLastEntry.Get()
+	if li > iole {
+		return 0, fmt.Errorf(
+			"GetTermAtIndex(): li=%v > iole=%v", li, iole,
+		)
+	}
+	return ws.termAt(li), nil
+}
+
+func (ws *WALStore) GetEntriesAfterIndex(afterLogIndex LogIndex) ([]LogEntry, error) {
+	ws.lock.RLock()
+	defer ws.lock.RUnlock()
+
+	lastCompacted := ws.lastCompacted.Get()
+	if afterLogIndex < lastCompacted {
+		return nil, ErrIndexCompacted
+	}
+
+	iole := ws.indexOfLastEntry.Get()
+
+	if afterLogIndex > iole {
+		return nil, fmt.Errorf(
+			"afterLogIndex=%v is > iole=%v",
+			afterLogIndex,
+			iole,
+		)
+	}
+
+	var numEntriesToGet = uint64(iole - afterLogIndex)
+
+	// Short-circuit allocation for no entries to return
+	if numEntriesToGet == 0 {
+		return []LogEntry{}, nil
+	}
+
+	if numEntriesToGet > ws.maxEntries {
+		numEntriesToGet = ws.maxEntries
+	}
+
+	logEntries := make([]LogEntry, numEntriesToGet)
+	nextIndexToGet := afterLogIndex + 1
+
+	for i := range logEntries {
+		el := ws.entries[nextIndexToGet-lastCompacted-1]
+		r, err := el.seg.readRecord(el.offset, el.recordLen)
+		if err != nil {
+			return nil, err
+		}
+		if r.typ != recordEntry || r.index != nextIndexToGet || r.term != el.term {
+			return nil, &CorruptionError{
+				el.seg.file.Name(), el.offset, fmt.Sprintf("not the entry at index %v", nextIndexToGet),
+			}
+		}
+		logEntries[i] = LogEntry{r.term, Command(r.data)}
+		nextIndexToGet++
+	}
+
+	return logEntries, nil
+}
+
+func (ws *WALStore) SetEntriesAfterIndex(li LogIndex, entries []LogEntry) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	lastCompacted := ws.lastCompacted.Get()
+	if li < lastCompacted {
+		return ErrIndexCompacted
+	}
+	iole := ws.indexOfLastEntry.Get()
+	if iole < li {
+		return fmt.Errorf("WALStore: setEntriesAfterIndex(%d, ...) but iole=%d", li, iole)
+	}
+
+	// Skip the given entries that are already in the log so that they are not
+	// rewritten. By the Log Matching Property, an existing entry with the same
+	// term is the same entry.
+	for len(entries) > 0 && li < iole {
+		if ws.termAt(li+1) != entries[0].TermNo {
+			break
+		}
+		li++
+		entries = entries[1:]
+	}
+
+	records := make([]record, 0, len(entries)+1)
+	if iole > li {
+		records = append(records, record{recordTruncate, li, 0, nil})
+	}
+	firstEntryRecord := len(records)
+	for i, entry := range entries {
+		records = append(records, entryRecord(li+1+LogIndex(i), entry))
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	s, offsets, err := ws.writeRecords(records)
+	if err != nil {
+		return err
+	}
+
+	// delete entries after index
+	ws.entries = ws.entries[:li-lastCompacted]
+	// append entries
+	for i := firstEntryRecord; i < len(records); i++ {
+		ws.entries = append(ws.entries, entryLocation{s, offsets[i], records[i].size(), records[i].term})
+	}
+
+	// update iole
+	return ws.indexOfLastEntry.Set(lastCompacted + LogIndex(len(ws.entries)))
+}
+
+// DiscardEntriesBeforeIndex discards the entries before the given index.
+//
+// lastCompacted becomes li-1, and the segments that are no longer needed to
+// replay the WAL are deleted.
+func (ws *WALStore) DiscardEntriesBeforeIndex(li LogIndex) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	lastCompacted := ws.lastCompacted.Get()
+	if li <= lastCompacted {
+		return ErrIndexCompacted
+	}
+	iole := ws.indexOfLastEntry.Get()
+	if li-1 > iole {
+		return fmt.Errorf("WALStore: discardEntriesBeforeIndex(%d) but iole=%d", li, iole)
+	}
+
+	newLastCompacted := li - 1
+	newLastCompactedTerm := ws.termAt(newLastCompacted)
+	_, _, err := ws.writeRecords(
+		[]record{{recordCompacted, newLastCompacted, newLastCompactedTerm, nil}},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = ws.lastCompacted.Set(newLastCompacted)
+	if err != nil {
+		return err
+	}
+	ws.lastCompactedTerm = newLastCompactedTerm
+	ws.entries = append([]entryLocation(nil), ws.entries[newLastCompacted-lastCompacted:]...)
+
+	// A segment is not needed once the header of the next segment is at or
+	// before lastCompacted.
+	n := 0
+	for n < len(ws.segments)-1 && ws.segments[n+1].header.baseIndex <= newLastCompacted {
+		err = ws.segments[n].remove()
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	if n > 0 {
+		ws.segments = append([]*segment(nil), ws.segments[n:]...)
+		return fileutil.SyncDir(ws.dir)
+	}
+	return nil
+}
+
+func (ws *WALStore) AppendEntry(logEntry LogEntry) (LogIndex, error) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	newIole := ws.indexOfLastEntry.Get() + 1
+	r := entryRecord(newIole, logEntry)
+	s, offsets, err := ws.writeRecords([]record{r})
+	if err != nil {
+		return 0, err
+	}
+	ws.entries = append(ws.entries, entryLocation{s, offsets[0], r.size(), r.term})
+
+	// update iole
+	err = ws.indexOfLastEntry.Set(newIole)
+	if err != nil {
+		return 0, err
+	}
+
+	return newIole, nil
+}
+
+// -- RaftPersistentState
+
+func (ws *WALStore) GetCurrentTerm() TermNo {
+	ws.lock.RLock()
+	defer ws.lock.RUnlock()
+	return ws.currentTerm
+}
+
+func (ws *WALStore) GetVotedFor() ServerId {
+	ws.lock.RLock()
+	defer ws.lock.RUnlock()
+	return ws.votedFor
+}
+
+func (ws *WALStore) SetCurrentTerm(currentTerm TermNo) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if currentTerm == 0 {
+		return errors.New("FATAL: attempt to set currentTerm to 0")
+	}
+	if currentTerm < ws.currentTerm {
+		return fmt.Errorf(
+			"FATAL: attempt to decrease currentTerm: %v to %v", ws.currentTerm, currentTerm,
+		)
+	}
+	votedFor := ws.votedFor
+	if currentTerm > ws.currentTerm {
+		votedFor = 0
+	}
+	return ws.setState(currentTerm, votedFor)
+}
+
+func (ws *WALStore) SetVotedFor(votedFor ServerId) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if ws.currentTerm == 0 {
+		return errors.New("FATAL: attempt to set votedFor while currentTerm is 0")
+	}
+	if votedFor == 0 {
+		return errors.New("FATAL: attempt to set votedFor to 0")
+	}
+	if ws.votedFor != 0 {
+		return fmt.Errorf(
+			"FATAL: attempt to change non-zero votedFor: %v to %v", ws.votedFor, votedFor,
+		)
+	}
+	return ws.setState(ws.currentTerm, votedFor)
+}
+
+// SyncState writes any change to currentTerm and votedFor that has not already
+// been written along with a change to the log.
+func (ws *WALStore) SyncState() error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	return ws.writePendingState()
+}
+
+// setState changes currentTerm and votedFor in memory, leaving the change to
+// be written by the next write to the WAL.
+func (ws *WALStore) setState(currentTerm TermNo, votedFor ServerId) error {
+	if currentTerm == ws.currentTerm && votedFor == ws.votedFor {
+		return nil
+	}
+	ws.currentTerm = currentTerm
+	ws.votedFor = votedFor
+	ws.statePending = true
+	return nil
+}
@@ -0,0 +1,475 @@
+package walstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/testdata"
+	"github.com/divtxt/raft/testhelpers"
+)
+
+// Small enough that the Figure 7 entries span several segments.
+const testMaxSegmentSize = 100
+
+func makeTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "walstore_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func openTestStore(t *testing.T, dir string) *WALStore {
+	ws, err := OpenWALStore(dir, 3, testMaxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+// Make a WALStore with entries with given terms.
+// Commands will be Command("c1"), Command("c2"), etc.
+func openTestStoreWithTerms(t *testing.T, dir string, logTerms []TermNo) *WALStore {
+	ws := openTestStore(t, dir)
+	for i, term := range logTerms {
+		command := Command("c" + strconv.Itoa(i+1))
+		_, err := ws.AppendEntry(LogEntry{term, command})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ws
+}
+
+func removeTestDir(t *testing.T, dir string) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func closeTestStore(t *testing.T, ws *WALStore) {
+	err := ws.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentFileNameSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		names[i] = filepath.Base(name)
+	}
+	return names
+}
+
+func checkTestStoreEntries(t *testing.T, ws *WALStore, afterLogIndex LogIndex, expected []LogEntry) {
+	entries, err := ws.GetEntriesAfterIndex(afterLogIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatal(entries)
+	}
+}
+
+// Test WALStore using the Log Blackbox test.
+func TestWALStore_BlackboxTest(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	ws := openTestStoreWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	defer closeTestStore(t, ws)
+
+	testhelpers.BlackboxTest_Log(t, ws, false)
+}
+
+// Test WALStore compacted log using the Log Blackbox test.
+func TestWALStore_BlackboxTestWithCompaction(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	ws := openTestStoreWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	defer closeTestStore(t, ws)
+
+	err := ws.DiscardEntriesBeforeIndex(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testhelpers.BlackboxTest_Log(t, ws, true)
+}
+
+// Test WALStore using the RaftPersistentState Blackbox test.
+func TestWALStore_RaftPersistentStateBlackboxTest(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	ws := openTestStore(t, dir)
+	testhelpers.BlackboxTest_RaftPersistentState(t, ws)
+	closeTestStore(t, ws)
+
+	ws = openTestStore(t, dir)
+	defer closeTestStore(t, ws)
+	if ct := ws.GetCurrentTerm(); ct != 4 {
+		t.Fatal(ct)
+	}
+	if vf := ws.GetVotedFor(); vf != 2 {
+		t.Fatal(vf)
+	}
+}
+
+func TestWALStore_Reopen(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	ws := openTestStoreWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+
+	// The 44 byte header and 3 entries of 27 bytes fill a segment
+	expectedFiles := []string{
+		"00000000000000000001.wal",
+		"00000000000000000002.wal",
+		"00000000000000000003.wal",
+		"00000000000000000004.wal",
+	}
+	if files := segmentFiles(t, dir); !reflect.DeepEqual(files, expectedFiles) {
+		t.Fatal(files)
+	}
+
+	err := ws.SetCurrentTerm(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ws.SetVotedFor(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ws.SyncState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncation does not lose the state written after the truncated entries
+	err = ws.SetEntriesAfterIndex(7, []LogEntry{{7, Command("c8'")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFiles = append(expectedFiles, "00000000000000000005.wal")
+	if files := segmentFiles(t, dir); !reflect.DeepEqual(files, expectedFiles) {
+		t.Fatal(files)
+	}
+
+	// Compaction deletes the segments that are no longer needed
+	err = ws.DiscardEntriesBeforeIndex(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFiles = expectedFiles[2:]
+	if files := segmentFiles(t, dir); !reflect.DeepEqual(files, expectedFiles) {
+		t.Fatal(files)
+	}
+
+	closeTestStore(t, ws)
+
+	ws = openTestStore(t, dir)
+	defer closeTestStore(t, ws)
+	if tr := ws.GetTailRepair(); tr != nil {
+		t.Fatal(tr)
+	}
+	if lc := ws.GetLastCompacted(); lc != 7 {
+		t.Fatal(lc)
+	}
+	if iole := ws.GetIndexOfLastEntry(); iole != 8 {
+		t.Fatal(iole)
+	}
+	if term, err := ws.GetTermAtIndex(7); err != nil || term != 5 {
+		t.Fatal(term, err)
+	}
+	checkTestStoreEntries(t, ws, 7, []LogEntry{{7, Command("c8'")}})
+	if ct := ws.GetCurrentTerm(); ct != 7 {
+		t.Fatal(ct)
+	}
+	if vf := ws.GetVotedFor(); vf != 3 {
+		t.Fatal(vf)
+	}
+}
+
+func TestWALStore_ReopenAfterTruncateBeforeSegment(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	ws := openTestStoreWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+
+	// Replace entries that are in earlier segments
+	err := ws.SetEntriesAfterIndex(1, []LogEntry{
+		{2, Command("c2'")},
+		{2, Command("c3'")},
+		{2, Command("c4'")},
+		{2, Command("c5'")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compaction deletes the first segment, so the WAL is replayed from the
+	// header of the second segment even though its entries were replaced
+	err = ws.DiscardEntriesBeforeIndex(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFiles := []string{
+		"00000000000000000002.wal",
+		"00000000000000000003.wal",
+		"00000000000000000004.wal",
+		"00000000000000000005.wal",
+	}
+	if files := segmentFiles(t, dir); !reflect.DeepEqual(files, expectedFiles) {
+		t.Fatal(files)
+	}
+
+	closeTestStore(t, ws)
+
+	ws = openTestStore(t, dir)
+	defer closeTestStore(t, ws)
+	if lc := ws.GetLastCompacted(); lc != 3 {
+		t.Fatal(lc)
+	}
+	if term, err := ws.GetTermAtIndex(3); err != nil || term != 2 {
+		t.Fatal(term, err)
+	}
+	checkTestStoreEntries(t, ws, 3, []LogEntry{{2, Command("c4'")}, {2, Command("c5'")}})
+}
+
+func TestWALStore_SetEntriesAfterIndexSkipsExistingEntries(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	ws := openTestStoreWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	defer closeTestStore(t, ws)
+
+	size := ws.lastSegment().size
+
+	// Entries with the same terms are not rewritten
+	err := ws.SetEntriesAfterIndex(8, []LogEntry{{6, Command("xx")}, {6, Command("xx")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := testhelpers.TestHelper_GetLogEntryAtIndex(ws, 10)
+	if !reflect.DeepEqual(le, LogEntry{6, Command("c10")}) {
+		t.Fatal(le)
+	}
+	if ws.lastSegment().size != size {
+		t.Fatal(ws.lastSegment().size)
+	}
+}
+
+// A change to currentTerm and votedFor is written along with the next change
+// to the log, or by SyncState.
+func TestWALStore_StateIsWrittenWithLogChanges(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	ws := openTestStoreWithTerms(t, dir, []TermNo{1, 1})
+	const stateRecordSize = recordHeaderSize + 8
+	const entryRecordSize = recordHeaderSize + 2
+
+	// Nothing is written until the log changes
+	size := ws.lastSegment().size
+	err := ws.SetCurrentTerm(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ws.SetVotedFor(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.lastSegment().size != size {
+		t.Fatal(ws.lastSegment().size)
+	}
+	if ct, vf := ws.GetCurrentTerm(), ws.GetVotedFor(); ct != 2 || vf != 3 {
+		t.Fatal(ct, vf)
+	}
+
+	// One state record with the latest values is written with the entry
+	_, err = ws.AppendEntry(LogEntry{2, Command("c3")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.lastSegment().size != size+stateRecordSize+entryRecordSize {
+		t.Fatal(ws.lastSegment().size)
+	}
+	checkTestStoreEntries(t, ws, 2, []LogEntry{{2, Command("c3")}})
+
+	// SyncState writes a pending change by itself, and only once
+	err = ws.SetCurrentTerm(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size = ws.lastSegment().size
+	err = ws.SyncState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.lastSegment().size != size+stateRecordSize {
+		t.Fatal(ws.lastSegment().size)
+	}
+	err = ws.SyncState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.lastSegment().size != size+stateRecordSize {
+		t.Fatal(ws.lastSegment().size)
+	}
+
+	// A pending change is written to the full segment before a new segment
+	// is started, so that the header of the new segment matches it
+	err = ws.SetVotedFor(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ws.AppendEntry(LogEntry{4, Command("c4")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFiles := []string{"00000000000000000001.wal", "00000000000000000002.wal"}
+	if files := segmentFiles(t, dir); !reflect.DeepEqual(files, expectedFiles) {
+		t.Fatal(files)
+	}
+	if h := ws.lastSegment().header; h.currentTerm != 4 || h.votedFor != 5 {
+		t.Fatal(h)
+	}
+	closeTestStore(t, ws)
+
+	ws = openTestStore(t, dir)
+	defer closeTestStore(t, ws)
+	if ct, vf := ws.GetCurrentTerm(), ws.GetVotedFor(); ct != 4 || vf != 5 {
+		t.Fatal(ct, vf)
+	}
+	checkTestStoreEntries(t, ws, 2, []LogEntry{{2, Command("c3")}, {4, Command("c4")}})
+}
+
+// Simulate a crash at every point during the write of a record by truncating
+// the last segment, and check that the WAL always reopens with either the old
+// or the new state.
+func TestWALStore_TornTail(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	ws := openTestStoreWithTerms(t, dir, []TermNo{1, 1})
+	err := ws.SetCurrentTerm(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ws.SyncState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ws.SetVotedFor(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ws.SyncState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastFile := ws.lastSegment().file.Name()
+	newSize := ws.lastSegment().size
+	oldSize := newSize - (recordHeaderSize + 8)
+	closeTestStore(t, ws)
+
+	for size := oldSize; size <= newSize; size++ {
+		err = os.Truncate(lastFile, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ws = openTestStore(t, dir)
+		var expectedTailRepair *TailRepair
+		var expectedVotedFor ServerId = 5
+		if size < newSize {
+			expectedVotedFor = 0
+			if size > oldSize {
+				expectedTailRepair = &TailRepair{lastFile, oldSize, 1}
+			}
+		}
+		if tr := ws.GetTailRepair(); !reflect.DeepEqual(tr, expectedTailRepair) {
+			t.Fatal(size, tr)
+		}
+		if ct := ws.GetCurrentTerm(); ct != 2 {
+			t.Fatal(size, ct)
+		}
+		if vf := ws.GetVotedFor(); vf != expectedVotedFor {
+			t.Fatal(size, vf)
+		}
+		if iole := ws.GetIndexOfLastEntry(); iole != 2 {
+			t.Fatal(size, iole)
+		}
+		closeTestStore(t, ws)
+
+		// Restore the record for the next iteration
+		if size < newSize {
+			ws = openTestStore(t, dir)
+			err = ws.SetVotedFor(5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			closeTestStore(t, ws)
+		}
+	}
+}
+
+func TestWALStore_CorruptionInEarlierSegment(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	ws := openTestStoreWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	closeTestStore(t, ws)
+
+	// Flip a bit in the command of the last record of the first segment
+	file := filepath.Join(dir, "00000000000000000001.wal")
+	offset := int64(segmentHeaderSize + 2*(recordHeaderSize+2))
+	f, err := os.OpenFile(file, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{'x'}, offset+recordHeaderSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenWALStore(dir, 3, testMaxSegmentSize)
+	expectedErr := &CorruptionError{file, offset, "1 bad record(s) at end of segment"}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Fatal(err)
+	}
+}
+
+func TestWALStore_MissingSegment(t *testing.T) {
+	dir := makeTestDir(t)
+	defer removeTestDir(t, dir)
+
+	ws := openTestStoreWithTerms(t, dir, testdata.TestUtil_MakeFigure7LeaderLineTerms())
+	closeTestStore(t, ws)
+
+	err := os.Remove(filepath.Join(dir, "00000000000000000002.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenWALStore(dir, 3, testMaxSegmentSize)
+	if err == nil || err.Error() != "walstore: segment 3 does not follow segment 1" {
+		t.Fatal(err)
+	}
+}
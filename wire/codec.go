@@ -0,0 +1,169 @@
+// Package wire provides a compact versioned binary encoding of the raft RPC messages.
+//
+// This is the canonical wire format for the Rpc* types, so that transports can
+// interoperate and so that servers running different versions can talk to each
+// other during a rolling upgrade.
+//
+// Message layout:
+//
+//  header:  version (1 byte) + message type (1 byte)
+//  body:    depends on the message type
+//
+// All indices and terms are unsigned varints (see encoding/binary), and booleans
+// are a single byte with the value 0 or 1.
+//
+//  RpcAppendEntries:       term, prevLogIndex, prevLogTerm, leaderCommit,
+//                          entry count, then for each entry:
+//                          term, command length, command bytes
+//  RpcAppendEntriesReply:  term, success
+//  RpcRequestVote:         term, lastLogIndex, lastLogTerm
+//  RpcRequestVoteReply:    term, voteGranted
+//
+// A decoder rejects a message with a version it does not know, an unknown message
+// type, a varint that is not minimally encoded, or bytes after the end of the
+// message. This means that every message has exactly one encoding.
+//
+// The format of a version never changes: a change to the format must use a new
+// version, and the golden files in testdata check that existing versions still
+// encode and decode the same way.
+//
+package wire
+
+import (
+	"errors"
+	"fmt"
+
+	. "github.com/divtxt/raft"
+	"github.com/divtxt/raft/internal/binenc"
+)
+
+// Version is the format version written by Encode.
+const Version = 1
+
+const headerSize = 2
+
+// MessageType identifies the type of an encoded message.
+type MessageType uint8
+
+const (
+	TypeAppendEntries MessageType = iota + 1
+	TypeAppendEntriesReply
+	TypeRequestVote
+	TypeRequestVoteReply
+)
+
+var ErrTruncated = errors.New("wire: message is truncated")
+
+// UnsupportedVersionError is returned when decoding a message with an unknown version.
+type UnsupportedVersionError struct {
+	Version uint8
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("wire: unsupported version: %v", e.Version)
+}
+
+// Encode appends the encoding of the given message to dst and returns the
+// extended buffer.
+//
+// The message must be one of *RpcAppendEntries, *RpcAppendEntriesReply,
+// *RpcRequestVote or *RpcRequestVoteReply.
+//
+func Encode(dst []byte, msg interface{}) ([]byte, error) {
+	switch m := msg.(type) {
+	case *RpcAppendEntries:
+		dst = append(dst, Version, byte(TypeAppendEntries))
+		dst = binenc.AppendUvarint(dst, uint64(m.Term))
+		dst = binenc.AppendUvarint(dst, uint64(m.PrevLogIndex))
+		dst = binenc.AppendUvarint(dst, uint64(m.PrevLogTerm))
+		dst = binenc.AppendUvarint(dst, uint64(m.LeaderCommit))
+		dst = binenc.AppendUvarint(dst, uint64(len(m.Entries)))
+		for _, e := range m.Entries {
+			dst = binenc.AppendUvarint(dst, uint64(e.TermNo))
+			dst = binenc.AppendUvarint(dst, uint64(len(e.Command)))
+			dst = append(dst, e.Command...)
+		}
+	case *RpcAppendEntriesReply:
+		dst = append(dst, Version, byte(TypeAppendEntriesReply))
+		dst = binenc.AppendUvarint(dst, uint64(m.Term))
+		dst = binenc.AppendBool(dst, m.Success)
+	case *RpcRequestVote:
+		dst = append(dst, Version, byte(TypeRequestVote))
+		dst = binenc.AppendUvarint(dst, uint64(m.Term))
+		dst = binenc.AppendUvarint(dst, uint64(m.LastLogIndex))
+		dst = binenc.AppendUvarint(dst, uint64(m.LastLogTerm))
+	case *RpcRequestVoteReply:
+		dst = append(dst, Version, byte(TypeRequestVoteReply))
+		dst = binenc.AppendUvarint(dst, uint64(m.Term))
+		dst = binenc.AppendBool(dst, m.VoteGranted)
+	default:
+		return nil, fmt.Errorf("wire: cannot encode message of type %T", msg)
+	}
+	return dst, nil
+}
+
+// Decode decodes the message in the given bytes.
+//
+// The returned message is one of *RpcAppendEntries, *RpcAppendEntriesReply,
+// *RpcRequestVote or *RpcRequestVoteReply.
+//
+// The commands of a decoded RpcAppendEntries are not copied but refer to the
+// given bytes, so the bytes must not be modified while the message is in use.
+// The Entries of a decoded RpcAppendEntries are never nil.
+//
+func Decode(b []byte) (interface{}, error) {
+	if len(b) < headerSize {
+		return nil, ErrTruncated
+	}
+	if b[0] != Version {
+		return nil, &UnsupportedVersionError{b[0]}
+	}
+	d := binenc.NewDecoder(b, headerSize, "wire", ErrTruncated)
+
+	var msg interface{}
+	switch MessageType(b[1]) {
+	case TypeAppendEntries:
+		m := &RpcAppendEntries{}
+		m.Term = TermNo(d.Uvarint())
+		m.PrevLogIndex = LogIndex(d.Uvarint())
+		m.PrevLogTerm = TermNo(d.Uvarint())
+		m.LeaderCommit = LogIndex(d.Uvarint())
+		n := d.Uvarint()
+		// Each entry takes at least 2 bytes, which bounds the allocation below
+		if n > uint64(d.Remaining())/2 {
+			return nil, ErrTruncated
+		}
+		m.Entries = make([]LogEntry, n)
+		for i := range m.Entries {
+			m.Entries[i].TermNo = TermNo(d.Uvarint())
+			m.Entries[i].Command = Command(d.Bytes(d.Uvarint()))
+		}
+		msg = m
+	case TypeAppendEntriesReply:
+		m := &RpcAppendEntriesReply{}
+		m.Term = TermNo(d.Uvarint())
+		m.Success = d.Bool()
+		msg = m
+	case TypeRequestVote:
+		m := &RpcRequestVote{}
+		m.Term = TermNo(d.Uvarint())
+		m.LastLogIndex = LogIndex(d.Uvarint())
+		m.LastLogTerm = TermNo(d.Uvarint())
+		msg = m
+	case TypeRequestVoteReply:
+		m := &RpcRequestVoteReply{}
+		m.Term = TermNo(d.Uvarint())
+		m.VoteGranted = d.Bool()
+		msg = m
+	default:
+		return nil, fmt.Errorf("wire: unknown message type: %v", b[1])
+	}
+
+	if d.Err() != nil {
+		return nil, d.Err()
+	}
+	if d.Remaining() != 0 {
+		return nil, fmt.Errorf("wire: %v unexpected bytes after message", d.Remaining())
+	}
+	return msg, nil
+}
@@ -0,0 +1,200 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/divtxt/raft"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// goldenMessages are the messages in the golden files in testdata.
+//
+// Never change an existing entry: the golden files check that the format of
+// a version does not change.
+//
+var goldenMessages = []struct {
+	name string
+	msg  interface{}
+}{
+	{
+		"v1_appendentries",
+		&RpcAppendEntries{
+			8,
+			300,
+			7,
+			[]LogEntry{{7, Command("c301")}, {8, Command{0, 255}}, {8, Command{}}},
+			128,
+		},
+	},
+	{"v1_appendentries_heartbeat", &RpcAppendEntries{1 << 40, 0, 0, []LogEntry{}, 0}},
+	{"v1_appendentriesreply", &RpcAppendEntriesReply{8, true}},
+	{"v1_requestvote", &RpcRequestVote{9, 1<<64 - 1, 8}},
+	{"v1_requestvotereply", &RpcRequestVoteReply{9, false}},
+}
+
+func goldenPath(name string) string {
+	return filepath.Join("testdata", name+".hex")
+}
+
+// readGolden reads a golden file, which contains the encoding as hex.
+func readGolden(t testing.TB, name string) []byte {
+	h, err := ioutil.ReadFile(goldenPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(string(h)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestGolden(t *testing.T) {
+	for _, g := range goldenMessages {
+		b, err := Encode(nil, g.msg)
+		if err != nil {
+			t.Fatal(g.name, err)
+		}
+		if *update {
+			err = ioutil.WriteFile(goldenPath(g.name), []byte(hex.EncodeToString(b)+"\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		golden := readGolden(t, g.name)
+		if !bytes.Equal(b, golden) {
+			t.Fatalf("%v: encoded %x, golden %x", g.name, b, golden)
+		}
+		msg, err := Decode(golden)
+		if err != nil {
+			t.Fatal(g.name, err)
+		}
+		if !reflect.DeepEqual(msg, g.msg) {
+			t.Fatalf("%v: %#v", g.name, msg)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	b, err := Encode(nil, &RpcRequestVoteReply{300, true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte{1, 4, 0xac, 0x02, 1}) {
+		t.Fatalf("%x", b)
+	}
+
+	// Appends to dst
+	b, err = Encode([]byte{42}, &RpcAppendEntriesReply{5, false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte{42, 1, 2, 5, 0}) {
+		t.Fatalf("%x", b)
+	}
+
+	// Nil entries are encoded like empty entries
+	b, err = Encode(nil, &RpcAppendEntries{1, 2, 1, nil, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte{1, 1, 1, 2, 1, 0, 0}) {
+		t.Fatalf("%x", b)
+	}
+
+	// Unknown types and non-pointer types are errors
+	_, err = Encode(nil, "foo")
+	if err == nil || err.Error() != "wire: cannot encode message of type string" {
+		t.Fatal(err)
+	}
+	_, err = Encode(nil, RpcRequestVote{1, 0, 0})
+	if err == nil || err.Error() != "wire: cannot encode message of type raft.RpcRequestVote" {
+		t.Fatal(err)
+	}
+}
+
+func TestDecode_DoesNotCopyCommands(t *testing.T) {
+	b, err := Encode(nil, &RpcAppendEntries{8, 4, 4, []LogEntry{{8, Command("c5")}}, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := msg.(*RpcAppendEntries).Entries[0].Command
+	if string(command) != "c5" {
+		t.Fatal(command)
+	}
+
+	// The command refers to the input bytes
+	b[len(b)-1] = '6'
+	if string(command) != "c6" {
+		t.Fatal(command)
+	}
+
+	// The command cannot be appended to over the rest of the input
+	if cap(command) != len(command) {
+		t.Fatal(cap(command))
+	}
+}
+
+func TestDecode_Errors(t *testing.T) {
+	tests := []struct {
+		b             []byte
+		expectedError string
+	}{
+		{[]byte{}, "wire: message is truncated"},
+		{[]byte{1}, "wire: message is truncated"},
+		{[]byte{2, 4, 1, 0}, "wire: unsupported version: 2"},
+		{[]byte{0, 4, 1, 0}, "wire: unsupported version: 0"},
+		{[]byte{1, 0, 1, 0}, "wire: unknown message type: 0"},
+		{[]byte{1, 5, 1, 0}, "wire: unknown message type: 5"},
+		// Truncated fields
+		{[]byte{1, 3, 9, 10}, "wire: message is truncated"},
+		{[]byte{1, 4, 9}, "wire: message is truncated"},
+		{[]byte{1, 4, 0x80}, "wire: message is truncated"},
+		{[]byte{1, 1, 8, 4, 4, 3, 1, 8, 3, 'c', '5'}, "wire: message is truncated"},
+		// More entries than could fit in the message
+		{[]byte{1, 1, 8, 4, 4, 3, 2, 8, 0}, "wire: message is truncated"},
+		{
+			[]byte{1, 1, 8, 4, 4, 3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+			"wire: message is truncated",
+		},
+		// Bad values
+		{[]byte{1, 4, 9, 2}, "wire: bad boolean value: 2"},
+		{
+			[]byte{1, 4, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 1},
+			"wire: varint overflows 64 bits",
+		},
+		{[]byte{1, 4, 0x89, 0x00, 1}, "wire: varint is not minimally encoded"},
+		{[]byte{1, 4, 9, 1, 0}, "wire: 1 unexpected bytes after message"},
+	}
+	for _, test := range tests {
+		msg, err := Decode(test.b)
+		if msg != nil {
+			t.Fatalf("%x: %#v", test.b, msg)
+		}
+		if err == nil || err.Error() != test.expectedError {
+			t.Fatalf("%x: %v", test.b, err)
+		}
+	}
+
+	_, err := Decode([]byte{7, 1})
+	if e, ok := err.(*UnsupportedVersionError); !ok || e.Version != 7 {
+		t.Fatal(err)
+	}
+	_, err = Decode([]byte{1, 3, 9})
+	if err != ErrTruncated {
+		t.Fatal(err)
+	}
+}
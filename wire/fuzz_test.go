@@ -0,0 +1,83 @@
+//go:build go1.18
+// +build go1.18
+
+package wire
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	. "github.com/divtxt/raft"
+)
+
+// FuzzDecode checks that Decode does not panic, and that every message it
+// accepts has exactly one encoding.
+func FuzzDecode(f *testing.F) {
+	for _, g := range goldenMessages {
+		f.Add(readGolden(f, g.name))
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, err := Decode(b)
+		if err != nil {
+			if msg != nil {
+				t.Fatalf("%#v", msg)
+			}
+			return
+		}
+		b2, err := Encode(nil, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, b2) {
+			t.Fatalf("decoded %x, encoded %x", b, b2)
+		}
+	})
+}
+
+// FuzzAppendEntries checks that an RpcAppendEntries survives a round trip.
+func FuzzAppendEntries(f *testing.F) {
+	f.Add(uint64(8), uint64(4), uint64(4), uint64(3), uint64(8), []byte("c5"), uint8(2))
+	f.Add(uint64(0), uint64(0), uint64(0), uint64(0), uint64(0), []byte{}, uint8(0))
+	f.Add(uint64(1<<64-1), uint64(1<<63), uint64(1), uint64(127), uint64(128), []byte{0}, uint8(1))
+
+	f.Fuzz(func(
+		t *testing.T,
+		term, prevLogIndex, prevLogTerm, leaderCommit, entryTerm uint64,
+		command []byte,
+		numEntries uint8,
+	) {
+		entries := make([]LogEntry, numEntries)
+		for i := range entries {
+			entries[i] = LogEntry{TermNo(entryTerm + uint64(i)), Command(command)}
+		}
+		rpc := &RpcAppendEntries{
+			TermNo(term),
+			LogIndex(prevLogIndex),
+			TermNo(prevLogTerm),
+			entries,
+			LogIndex(leaderCommit),
+		}
+
+		b, err := Encode(nil, rpc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := Decode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := msg.(*RpcAppendEntries)
+		// Decode never returns a nil command, so compare commands separately
+		for i := range decoded.Entries {
+			if !bytes.Equal(decoded.Entries[i].Command, entries[i].Command) {
+				t.Fatal(i, decoded.Entries[i].Command)
+			}
+			decoded.Entries[i].Command = entries[i].Command
+		}
+		if !reflect.DeepEqual(decoded, rpc) {
+			t.Fatalf("%#v", decoded)
+		}
+	})
+}